@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+var (
+	adminToken string
+	// adminInsecure (ADMIN_INSECURE=1) opens the admin API when no ADMIN_TOKEN is
+	// set, for local development only
+	adminInsecure bool
+)
+
+// adminOnly requires "Authorization: Bearer $ADMIN_TOKEN". Without ADMIN_TOKEN the
+// admin API is closed unless ADMIN_INSECURE=1.
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authorizeAdmin(w, r) {
+			next(w, r)
+		}
+	}
+}
+
+// authorizeAdmin applies adminOnly's check to one request, writing the error
+// response if it fails.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		if !adminInsecure {
+			http.Error(w, "Admin API is disabled: ADMIN_TOKEN is not set", http.StatusServiceUnavailable)
+			return false
+		}
+		return true
+	}
+	if !isAdmin(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// isAdmin reports whether r carries the admin token as a Bearer credential.
+func isAdmin(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
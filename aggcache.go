@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// aggCacheEntry is a materialized aggregation result together with the cities,
+// countries and day range it was computed from, so new readings only invalidate
+// the entries they can affect.
+type aggCacheEntry struct {
+	Key        string    `bson:"_id"`
+	Cities     []string  `bson:"cities,omitempty"`
+	Countries  []string  `bson:"countries,omitempty"`
+	AllRegions bool      `bson:"all_regions,omitempty"`
+	From       string    `bson:"from"`
+	To         string    `bson:"to"`
+	Result     []byte    `bson:"result"`
+	ComputedAt time.Time `bson:"computed_at"`
+	// Pending marks an entry still being computed, holding the token of the
+	// request computing it. Invalidation deletes it like any other entry, which
+	// tells that request its result is already stale.
+	Pending string `bson:"pending,omitempty"`
+}
+
+// aggDeps describes what an aggregation reads.
+type aggDeps struct {
+	Cities     []string
+	Countries  []string
+	AllRegions bool
+	From       string
+	To         string
+}
+
+const (
+	minDay = "0000-01-01"
+	maxDay = "9999-12-31"
+)
+
+var aggCacheCollection *mongo.Collection
+
+// aggCacheTTL bounds how long an entry nothing invalidated is kept.
+const aggCacheTTL = 24 * time.Hour
+
+// aggCacheKey identifies an aggregation by what it reads, so parameters it
+// ignores do not create new entries. Cities keep their order, which is the
+// order of the results.
+func aggCacheKey(kind string, deps aggDeps) string {
+	return strings.Join([]string{
+		kind,
+		"cities=" + strings.Join(deps.Cities, ","),
+		"countries=" + strings.Join(deps.Countries, ","),
+		fmt.Sprintf("all=%t", deps.AllRegions),
+		"from=" + deps.From,
+		"to=" + deps.To,
+	}, "|")
+}
+
+// serveCachedAggregation writes the cached result for kind and deps, computing
+// and storing it first when it is missing. The X-Cache header reports HIT, MISS,
+// or BYPASS when the result could not be stored, e.g. because a write invalidated
+// it while it was being computed.
+func serveCachedAggregation(w http.ResponseWriter, ctx context.Context, kind string, deps aggDeps, compute func(ctx context.Context) (any, error)) {
+	key := aggCacheKey(kind, deps)
+	var entry aggCacheEntry
+	err := aggCacheCollection.FindOne(ctx, bson.M{"_id": key, "pending": bson.M{"$exists": false}}).Decode(&entry)
+	if err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Cache", "HIT")
+		w.Header().Set("X-Cache-Computed-At", entry.ComputedAt.UTC().Format(time.RFC3339))
+		w.Write(entry.Result)
+		return
+	}
+
+	entry = aggCacheEntry{
+		Key:        key,
+		Cities:     deps.Cities,
+		Countries:  deps.Countries,
+		AllRegions: deps.AllRegions,
+		From:       deps.From,
+		To:         deps.To,
+		ComputedAt: time.Now(),
+		Pending:    primitive.NewObjectID().Hex(),
+	}
+	if entry.From == "" {
+		entry.From = minDay
+	}
+	if entry.To == "" {
+		entry.To = maxDay
+	}
+	// Claim the key before computing, so an invalidation that lands meanwhile
+	// deletes the claim and the stale result below is not stored. Read-only mode
+	// serves the result without caching it.
+	claimErr := errReadOnly
+	if !readOnly.Load() {
+		_, claimErr = aggCacheCollection.ReplaceOne(ctx, bson.M{"_id": key}, entry, options.Replace().SetUpsert(true))
+	}
+
+	result, err := compute(ctx)
+	if err != nil {
+		http.Error(w, "Failed to compute aggregation", http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Failed to encode aggregation", http.StatusInternalServerError)
+		return
+	}
+
+	cache := "BYPASS"
+	if claimErr == nil {
+		token := entry.Pending
+		entry.Result, entry.Pending = body, ""
+		stored, err := aggCacheCollection.ReplaceOne(ctx, bson.M{"_id": key, "pending": token}, entry)
+		if err == nil && stored.MatchedCount == 1 {
+			cache = "MISS"
+		}
+	}
+	w.Header().Set("X-Cache", cache)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// applyAggCache drops cached aggregations that depend on the event's city and day,
+// or on its country for region summaries.
+func applyAggCache(ctx context.Context, c *mongo.Collection, ev Event) error {
+	var filter bson.M
+	switch ev.Type {
+	case EventFetch, EventImport:
+		day := ev.Data.LastUpdated.UTC().Format(dayLayout)
+		filter = bson.M{"$or": bson.A{
+			bson.M{"cities": ev.City, "from": bson.M{"$lte": day}, "to": bson.M{"$gte": day}},
+			bson.M{"countries": ev.Data.Country},
+			bson.M{"all_regions": true},
+		}}
+	case EventDelete:
+		// We no longer know the deleted city's country, so drop every region summary too
+		filter = bson.M{"$or": bson.A{
+			bson.M{"cities": ev.City},
+			bson.M{"countries": bson.M{"$exists": true}},
+			bson.M{"all_regions": true},
+		}}
+	default:
+		return nil
+	}
+	_, err := c.DeleteMany(ctx, filter)
+	return err
+}
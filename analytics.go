@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// BusinessSeries is a daily series uploaded by a team, e.g. sales at one store,
+// tied to the city whose weather it should be compared with. Only the holder of
+// the token returned when it was created can replace it.
+type BusinessSeries struct {
+	Name       string        `bson:"_id" json:"name"`
+	City       string        `bson:"city" json:"city"`
+	Points     []SeriesPoint `bson:"points" json:"points"`
+	UploadedAt time.Time     `bson:"uploaded_at" json:"uploaded_at"`
+	TokenHash  string        `bson:"token_hash" json:"-"`
+}
+
+type SeriesPoint struct {
+	Date  string  `bson:"date" json:"date"`
+	Value float64 `bson:"value" json:"value"`
+}
+
+type Correlation struct {
+	Variable       string  `json:"variable"`
+	Lag            int     `json:"lag_days"`
+	N              int     `json:"n"`
+	R              float64 `json:"r"`
+	PValue         float64 `json:"p_value"`
+	PValueAdjusted float64 `json:"p_value_bonferroni"`
+	ConfidenceLow  float64 `json:"ci95_low"`
+	ConfidenceHigh float64 `json:"ci95_high"`
+	Significant    bool    `json:"significant"`
+}
+
+const (
+	maxSeriesPoints    = 20000
+	defaultMaxLag      = 7
+	maxLag             = 60
+	minCorrelationDays = 10
+	significanceLevel  = 0.05
+)
+
+// conditionCategories maps OpenWeather description keywords to broad categories,
+// checked in order so "thunderstorm with rain" is a thunderstorm.
+var conditionCategories = []struct {
+	Category string
+	Keywords []string
+}{
+	{"thunderstorm", []string{"thunderstorm"}},
+	{"snow", []string{"snow", "sleet"}},
+	{"rain", []string{"rain", "drizzle", "shower"}},
+	{"fog", []string{"fog", "mist", "haze", "smoke", "dust", "sand"}},
+	{"clouds", []string{"cloud", "overcast"}},
+	{"clear", []string{"clear"}},
+}
+
+var seriesCollection *mongo.Collection
+
+func conditionCategory(description string) string {
+	description = strings.ToLower(description)
+	for _, c := range conditionCategories {
+		for _, keyword := range c.Keywords {
+			if strings.Contains(description, keyword) {
+				return c.Category
+			}
+		}
+	}
+	return "other"
+}
+
+// seriesHandler creates (POST), replaces (PUT) or returns (GET) a business series.
+// Uploads are JSON, or CSV with date,value rows when sent as text/csv with
+// ?name=&city=. Creating a series returns a token; replacing it needs that token
+// in X-Series-Token.
+func seriesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		var series BusinessSeries
+		if err := seriesCollection.FindOne(ctx, bson.M{"_id": r.URL.Query().Get("name")}).Decode(&series); err != nil {
+			http.Error(w, "Series not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(series)
+	case http.MethodPost, http.MethodPut:
+		series, err := parseSeriesUpload(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		series.UploadedAt = time.Now()
+		status, token := http.StatusOK, ""
+		if r.Method == http.MethodPost {
+			tokenBytes := make([]byte, 24)
+			if _, err := rand.Read(tokenBytes); err != nil {
+				http.Error(w, "Failed to store series", http.StatusInternalServerError)
+				return
+			}
+			token = hex.EncodeToString(tokenBytes)
+			series.TokenHash = sha256Hex([]byte(token))
+			if _, err := seriesCollection.InsertOne(ctx, series); mongo.IsDuplicateKeyError(err) {
+				http.Error(w, "Series already exists", http.StatusConflict)
+				return
+			} else if err != nil {
+				http.Error(w, "Failed to store series", http.StatusInternalServerError)
+				return
+			}
+			status = http.StatusCreated
+		} else {
+			// Series of other creators, and those stored before tokens, are reported as not found
+			series.TokenHash = sha256Hex([]byte(r.Header.Get("X-Series-Token")))
+			result, err := seriesCollection.ReplaceOne(ctx, bson.M{"_id": series.Name, "token_hash": series.TokenHash}, series)
+			if err != nil {
+				http.Error(w, "Failed to store series", http.StatusInternalServerError)
+				return
+			}
+			if result.MatchedCount == 0 {
+				http.Error(w, "Series not found", http.StatusNotFound)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Name   string `json:"name"`
+			City   string `json:"city"`
+			Points int    `json:"points"`
+			Token  string `json:"token,omitempty"`
+		}{series.Name, series.City, len(series.Points), token})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func parseSeriesUpload(r *http.Request) (BusinessSeries, error) {
+	var series BusinessSeries
+	body := io.LimitReader(r.Body, 8<<20)
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		series.Name = r.URL.Query().Get("name")
+		series.City = r.URL.Query().Get("city")
+		rows, err := csv.NewReader(body).ReadAll()
+		if err != nil {
+			return series, fmt.Errorf("invalid CSV: %w", err)
+		}
+		for i, row := range rows {
+			if len(row) < 2 {
+				return series, fmt.Errorf("row %d: expected date,value", i+1)
+			}
+			value, err := strconv.ParseFloat(strings.TrimSpace(row[1]), 64)
+			if err != nil {
+				if i == 0 {
+					continue // header
+				}
+				return series, fmt.Errorf("row %d: bad value", i+1)
+			}
+			series.Points = append(series.Points, SeriesPoint{Date: strings.TrimSpace(row[0]), Value: value})
+		}
+	} else if err := json.NewDecoder(body).Decode(&series); err != nil {
+		return series, fmt.Errorf("invalid request body")
+	}
+
+	if series.Name == "" || series.City == "" {
+		return series, fmt.Errorf("name and city are required")
+	}
+	if len(series.Points) == 0 || len(series.Points) > maxSeriesPoints {
+		return series, fmt.Errorf("series needs between 1 and %d points", maxSeriesPoints)
+	}
+	seen := map[string]bool{}
+	for _, p := range series.Points {
+		if _, err := time.Parse(dayLayout, p.Date); err != nil {
+			return series, fmt.Errorf("date %q must be YYYY-MM-DD", p.Date)
+		}
+		if seen[p.Date] {
+			return series, fmt.Errorf("date %s appears twice", p.Date)
+		}
+		seen[p.Date] = true
+	}
+	sort.Slice(series.Points, func(i, j int) bool { return series.Points[i].Date < series.Points[j].Date })
+	return series, nil
+}
+
+// dailyWeatherVariables returns, per day, the weather variables the series is
+// correlated with: temperatures and precipitation from the daily aggregates and
+// a 0/1 indicator for the day's most common condition category.
+func dailyWeatherVariables(ctx context.Context, city, from, to string) (map[string]map[string]float64, error) {
+	cursor, err := dailyCollection.Find(ctx, bson.M{"city": city, "day": bson.M{"$gte": from, "$lte": to}})
+	if err != nil {
+		return nil, err
+	}
+	var days []DailyAggregate
+	if err := cursor.All(ctx, &days); err != nil {
+		return nil, err
+	}
+
+	variables := map[string]map[string]float64{}
+	for _, d := range days {
+		variables[d.Day] = map[string]float64{
+			"avg_temp": d.AvgTemp(),
+			"max_temp": d.MaxTemp,
+			"min_temp": d.MinTemp,
+			"precip":   d.Precip,
+		}
+	}
+
+	start, _ := time.Parse(dayLayout, from)
+	end, _ := time.Parse(dayLayout, to)
+	history, err := loadHistory(ctx, city, start, end.Add(24*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]map[string]int{}
+	for _, reading := range history {
+		day := reading.LastUpdated.UTC().Format(dayLayout)
+		if counts[day] == nil {
+			counts[day] = map[string]int{}
+		}
+		counts[day][conditionCategory(reading.Description)]++
+	}
+	for day, byCategory := range counts {
+		if variables[day] == nil {
+			continue
+		}
+		dominant, best := "", 0
+		for category, n := range byCategory {
+			if n > best || (n == best && category < dominant) {
+				dominant, best = category, n
+			}
+		}
+		for _, c := range conditionCategories {
+			value := 0.0
+			if c.Category == dominant {
+				value = 1
+			}
+			variables[day]["condition_"+c.Category] = value
+		}
+	}
+	return variables, nil
+}
+
+// correlationHandler correlates a series with its city's weather for lags of 0 to
+// max_lag days, where lag k pairs each value with the weather k days earlier.
+func correlationHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("series")
+	if name == "" {
+		http.Error(w, "series parameter is required", http.StatusBadRequest)
+		return
+	}
+	lags := defaultMaxLag
+	if raw := r.URL.Query().Get("max_lag"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 || parsed > maxLag {
+			http.Error(w, fmt.Sprintf("max_lag must be between 0 and %d", maxLag), http.StatusBadRequest)
+			return
+		}
+		lags = parsed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var series BusinessSeries
+	if err := seriesCollection.FindOne(ctx, bson.M{"_id": name}).Decode(&series); err != nil {
+		http.Error(w, "Series not found", http.StatusNotFound)
+		return
+	}
+
+	first, _ := time.Parse(dayLayout, series.Points[0].Date)
+	from := first.AddDate(0, 0, -lags).Format(dayLayout)
+	to := series.Points[len(series.Points)-1].Date
+	weather, err := dailyWeatherVariables(ctx, series.City, from, to)
+	if err != nil {
+		http.Error(w, "Failed to load weather history", http.StatusInternalServerError)
+		return
+	}
+
+	variableNames := map[string]bool{}
+	for _, vars := range weather {
+		for v := range vars {
+			variableNames[v] = true
+		}
+	}
+	names := make([]string, 0, len(variableNames))
+	for v := range variableNames {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+
+	results := []Correlation{}
+	for _, variable := range names {
+		for lag := 0; lag <= lags; lag++ {
+			var xs, ys []float64
+			for _, p := range series.Points {
+				day, _ := time.Parse(dayLayout, p.Date)
+				vars, ok := weather[day.AddDate(0, 0, -lag).Format(dayLayout)]
+				if !ok {
+					continue
+				}
+				value, ok := vars[variable]
+				if !ok {
+					continue
+				}
+				xs = append(xs, value)
+				ys = append(ys, p.Value)
+			}
+			if len(xs) < minCorrelationDays {
+				continue
+			}
+			rho := pearson(xs, ys)
+			if math.IsNaN(rho) {
+				continue
+			}
+			low, high := fisherInterval(rho, len(xs))
+			results = append(results, Correlation{
+				Variable:       variable,
+				Lag:            lag,
+				N:              len(xs),
+				R:              rho,
+				PValue:         correlationPValue(rho, len(xs)),
+				ConfidenceLow:  low,
+				ConfidenceHigh: high,
+			})
+		}
+	}
+	// Many variables and lags are tested at once, so judge significance on the
+	// Bonferroni-adjusted p-value
+	for i := range results {
+		results[i].PValueAdjusted = bonferroni(results[i].PValue, len(results))
+		results[i].Significant = results[i].PValueAdjusted < significanceLevel
+	}
+	sort.SliceStable(results, func(i, j int) bool { return math.Abs(results[i].R) > math.Abs(results[j].R) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Series       string        `json:"series"`
+		City         string        `json:"city"`
+		Correlations []Correlation `json:"correlations"`
+	}{series.Name, series.City, results})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditEntry records who changed what, for operations that touch many cities.
+type AuditEntry struct {
+	Time   time.Time `bson:"time" json:"time"`
+	Actor  string    `bson:"actor" json:"actor"`
+	Note   string    `bson:"note,omitempty" json:"note,omitempty"`
+	Action string    `bson:"action" json:"action"`
+	City   string    `bson:"city,omitempty" json:"city,omitempty"`
+	Job    string    `bson:"job,omitempty" json:"job,omitempty"`
+	Detail string    `bson:"detail,omitempty" json:"detail,omitempty"`
+	Error  string    `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+const maxActorNote = 200
+
+var auditCollection *mongo.Collection
+
+// requestActor names the caller for audit entries from what was authenticated:
+// "admin" for the admin token, else the client address.
+func requestActor(r *http.Request) string {
+	if isAdmin(r) {
+		return "admin"
+	}
+	return r.RemoteAddr
+}
+
+// requestNote returns the caller's X-Actor header. Anyone can set it, so it is
+// kept next to the actor as a note and never used instead of it.
+func requestNote(r *http.Request) string {
+	note := strings.TrimSpace(r.Header.Get("X-Actor"))
+	if len(note) > maxActorNote {
+		note = strings.ToValidUTF8(note[:maxActorNote], "")
+	}
+	return note
+}
+
+func writeAudit(ctx context.Context, entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if _, err := auditCollection.InsertOne(ctx, entry); err != nil {
+		log.Println("Failed to write audit entry:", err)
+	}
+}
+
+// auditHandler lists audit entries, newest first, optionally for one ?job= or ?city=.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	if job := r.URL.Query().Get("job"); job != "" {
+		filter["job"] = job
+	}
+	if city := r.URL.Query().Get("city"); city != "" {
+		filter["city"] = city
+	}
+	limit := int64(100)
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || parsed <= 0 || parsed > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cursor, err := auditCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"time": -1}).SetLimit(limit))
+	if err != nil {
+		http.Error(w, "Failed to load audit log", http.StatusInternalServerError)
+		return
+	}
+	entries := []AuditEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		http.Error(w, "Failed to load audit log", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
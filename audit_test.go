@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestActorIgnoresXActor(t *testing.T) {
+	adminToken = "secret"
+	defer func() { adminToken = "" }()
+
+	r := httptest.NewRequest("POST", "/weather/bulk", nil)
+	r.RemoteAddr = "192.0.2.7:4711"
+	r.Header.Set("X-Actor", "admin")
+	if got := requestActor(r); got != "192.0.2.7:4711" {
+		t.Errorf("unauthenticated actor = %q", got)
+	}
+	if got := requestNote(r); got != "admin" {
+		t.Errorf("note = %q", got)
+	}
+
+	r.Header.Set("Authorization", "Bearer secret")
+	if got := requestActor(r); got != "admin" {
+		t.Errorf("authenticated actor = %q", got)
+	}
+	r.Header.Set("Authorization", "secret")
+	if got := requestActor(r); got != "192.0.2.7:4711" {
+		t.Errorf("token without the Bearer scheme gave actor %q", got)
+	}
+}
+
+func TestAuthorizeAdmin(t *testing.T) {
+	defer func() { adminToken, adminInsecure = "", false }()
+	tests := []struct {
+		token    string
+		insecure bool
+		header   string
+		want     int
+	}{
+		{"", false, "", 503},
+		{"", true, "", 200},
+		{"secret", true, "", 401},
+		{"secret", false, "Bearer wrong", 401},
+		{"secret", false, "Bearer secret", 200},
+	}
+	for _, tt := range tests {
+		adminToken, adminInsecure = tt.token, tt.insecure
+		r := httptest.NewRequest("POST", "/weather/bulk", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		if authorizeAdmin(w, r) {
+			w.WriteHeader(200)
+		}
+		if w.Code != tt.want {
+			t.Errorf("token %q insecure %v header %q: got %d, want %d", tt.token, tt.insecure, tt.header, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BulkJob applies one action to every city matching Filter, a WHERE expression
+// over the current dataset of the query API (e.g. "country = 'GB' AND temp > 25").
+type BulkJob struct {
+	ID         primitive.ObjectID `bson:"_id" json:"id"`
+	Action     string             `bson:"action" json:"action"`
+	Filter     string             `bson:"filter" json:"filter"`
+	Tags       []string           `bson:"tags,omitempty" json:"tags,omitempty"`
+	Interval   string             `bson:"interval,omitempty" json:"interval,omitempty"`
+	Actor      string             `bson:"actor" json:"actor"`
+	Note       string             `bson:"note,omitempty" json:"note,omitempty"`
+	Instance   string             `bson:"instance,omitempty" json:"instance,omitempty"`
+	Status     string             `bson:"status" json:"status"`
+	Total      int                `bson:"total" json:"total"`
+	Done       int                `bson:"done" json:"done"`
+	Failed     int                `bson:"failed" json:"failed"`
+	Errors     []BulkError        `bson:"errors" json:"errors"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time          `bson:"updated_at" json:"updated_at"`
+	FinishedAt time.Time          `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+}
+
+type BulkError struct {
+	City  string `bson:"city" json:"city"`
+	Error string `bson:"error" json:"error"`
+}
+
+const (
+	bulkRunning            = "running"
+	bulkSucceeded          = "succeeded"
+	bulkCompletedWithError = "completed_with_errors"
+	bulkFailed             = "failed"
+
+	maxBulkTargets      = 10000
+	maxBulkErrors       = 20
+	bulkWorkers         = 4
+	bulkProgressEvery   = time.Second
+	bulkPreviewSample   = 10
+	bulkActionTimeout   = 15 * time.Second
+	bulkMatchingTimeout = 30 * time.Second
+	// A running job saves progress at least every bulkActionTimeout, so one
+	// untouched for this long lost its process
+	bulkStaleAfter = 10 * time.Minute
+)
+
+var bulkActions = map[string]bool{"refresh": true, "delete": true, "tag": true, "untag": true, "set_refresh_interval": true}
+
+var bulkJobsCollection *mongo.Collection
+
+// matchCities returns the cities whose current reading satisfies the filter.
+func matchCities(ctx context.Context, where queryExpr) ([]string, error) {
+	var cities []string
+	err := queryDatasets["current"].scan(ctx, where, func(row queryRow) error {
+		match, err := evalExpr(where, row, nil)
+		if err != nil {
+			return queryError{err}
+		}
+		if truthy(match) {
+			if len(cities) == maxBulkTargets {
+				return badQuery("filter matches more than %d cities", maxBulkTargets)
+			}
+			cities = append(cities, row["city"].(string))
+		}
+		return nil
+	})
+	return cities, err
+}
+
+// bulkHandler previews or starts a bulk job (POST) and lists recent jobs (GET).
+func bulkHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listBulkJobsHandler(w, r)
+	case http.MethodPost:
+		createBulkJobHandler(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createBulkJobHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Filter   string   `json:"filter"`
+		Action   string   `json:"action"`
+		Tags     []string `json:"tags"`
+		Interval string   `json:"interval"`
+		Preview  bool     `json:"preview"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	// An empty filter is not "everything"; that has to be asked for with TRUE
+	if strings.TrimSpace(body.Filter) == "" {
+		http.Error(w, "filter is required (use TRUE to match every city)", http.StatusBadRequest)
+		return
+	}
+	where, err := parseCondition(body.Filter)
+	if err == nil {
+		err = checkColumns(where, queryDatasets["current"].columns)
+	}
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !bulkActions[body.Action] {
+		http.Error(w, "action must be refresh, delete, tag, untag or set_refresh_interval", http.StatusBadRequest)
+		return
+	}
+
+	var tags []string
+	for _, tag := range body.Tags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if (body.Action == "tag" || body.Action == "untag") && len(tags) == 0 {
+		http.Error(w, "tags are required for tag and untag", http.StatusBadRequest)
+		return
+	}
+	var interval time.Duration
+	if body.Action == "set_refresh_interval" {
+		if interval, err = time.ParseDuration(body.Interval); err != nil || (interval != 0 && interval < minRefreshInterval) {
+			http.Error(w, fmt.Sprintf("interval must be a duration of at least %v, or 0 to stop refreshing", minRefreshInterval), http.StatusBadRequest)
+			return
+		}
+	}
+	// Previews only read; running a job is an admin operation
+	if !body.Preview && !authorizeAdmin(w, r) {
+		return
+	}
+	if !body.Preview && readOnly.Load() {
+		refuseWrite(w)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bulkMatchingTimeout)
+	defer cancel()
+	cities, err := matchCities(ctx, where)
+	if err != nil {
+		if _, ok := err.(queryError); ok {
+			http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, "Failed to evaluate filter", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if body.Preview {
+		sample := cities
+		if len(sample) > bulkPreviewSample {
+			sample = sample[:bulkPreviewSample]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Action  string   `json:"action"`
+			Matched int      `json:"matched"`
+			Sample  []string `json:"sample"`
+		}{body.Action, len(cities), append([]string{}, sample...)})
+		return
+	}
+
+	now := time.Now()
+	self, _ := clusterPeers()
+	job := BulkJob{
+		ID:        primitive.NewObjectID(),
+		Action:    body.Action,
+		Filter:    body.Filter,
+		Tags:      tags,
+		Interval:  body.Interval,
+		Actor:     requestActor(r),
+		Note:      requestNote(r),
+		Instance:  self.ID,
+		Status:    bulkRunning,
+		Total:     len(cities),
+		Errors:    []BulkError{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if _, err := bulkJobsCollection.InsertOne(ctx, job); err != nil {
+		http.Error(w, "Failed to create bulk job", http.StatusInternalServerError)
+		return
+	}
+	writeAudit(ctx, AuditEntry{
+		Actor:  job.Actor,
+		Note:   job.Note,
+		Action: "bulk." + job.Action + ".start",
+		Job:    job.ID.Hex(),
+		Detail: fmt.Sprintf("filter %q matched %d cities", job.Filter, job.Total),
+	})
+	go runBulkJob(job, cities, interval)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/weather/bulk/"+job.ID.Hex())
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// runBulkJob works through the cities with a few workers, saving progress to the
+// job document at most every bulkProgressEvery and writing one audit entry per city.
+// Read-only mode stops the job before the next city: it fails once the mode ends
+// and its document can be written again, and the cities left can be run as a new job.
+func runBulkJob(job BulkJob, cities []string, interval time.Duration) {
+	var mu sync.Mutex
+	lastSaved := time.Now()
+	save := func(force bool) {
+		if !force && (time.Since(lastSaved) < bulkProgressEvery || readOnly.Load()) {
+			return
+		}
+		lastSaved = time.Now()
+		job.UpdatedAt = lastSaved
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := bulkJobsCollection.ReplaceOne(ctx, bson.M{"_id": job.ID}, job); err != nil {
+			log.Printf("Failed to save bulk job %s: %v", job.ID.Hex(), err)
+		}
+	}
+
+	// Workers read the job's settings from a copy; job itself changes under mu
+	spec := job
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < bulkWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for city := range work {
+				if readOnly.Load() {
+					continue
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), bulkActionTimeout)
+				detail, err := applyBulkAction(ctx, spec, city, interval)
+				entry := AuditEntry{Actor: spec.Actor, Note: spec.Note, Action: "bulk." + spec.Action, City: city, Job: spec.ID.Hex(), Detail: detail}
+				if err != nil {
+					entry.Error = err.Error()
+				}
+				writeAudit(ctx, entry)
+				cancel()
+
+				mu.Lock()
+				job.Done++
+				if err != nil {
+					job.Failed++
+					if len(job.Errors) < maxBulkErrors {
+						job.Errors = append(job.Errors, BulkError{City: city, Error: err.Error()})
+					}
+				}
+				save(false)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, city := range cities {
+		if readOnly.Load() {
+			break
+		}
+		work <- city
+	}
+	close(work)
+	wg.Wait()
+
+	job.Status = bulkSucceeded
+	if job.Failed > 0 {
+		job.Status = bulkCompletedWithError
+	}
+	if job.Done < job.Total {
+		job.Status = bulkFailed
+		job.Errors = append(job.Errors, BulkError{Error: fmt.Sprintf("stopped by read-only mode after %d of %d cities", job.Done, job.Total)})
+		for readOnly.Load() {
+			time.Sleep(maintenanceSyncInterval)
+		}
+	}
+	job.FinishedAt = time.Now()
+	save(true)
+}
+
+// failInterruptedBulkJobs marks jobs this replica was running before a restart,
+// and jobs no replica has saved for bulkStaleAfter, as failed. Their goroutines
+// are gone, so they would otherwise stay running forever.
+func failInterruptedBulkJobs(ctx context.Context) (int64, error) {
+	now := time.Now()
+	self, _ := clusterPeers()
+	filter := interruptedBulkJobsFilter(self.ID, now)
+	update := bson.M{
+		"$set":  bson.M{"status": bulkFailed, "updated_at": now, "finished_at": now},
+		"$push": bson.M{"errors": BulkError{Error: "interrupted by a restart"}},
+	}
+	result, err := bulkJobsCollection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func interruptedBulkJobsFilter(instance string, now time.Time) bson.M {
+	return bson.M{"status": bulkRunning, "$or": bson.A{
+		bson.M{"instance": instance},
+		bson.M{"updated_at": bson.M{"$lt": now.Add(-bulkStaleAfter)}},
+	}}
+}
+
+func applyBulkAction(ctx context.Context, job BulkJob, city string, interval time.Duration) (string, error) {
+	switch job.Action {
+	case "refresh":
+		weather, err := refreshLocation(ctx, Location{City: city})
+		if err != nil {
+			return "", err
+		}
+		return "fetched from " + weather.Provider, nil
+	case "delete":
+		if _, err := recordEvent(ctx, Event{Type: EventDelete, City: city}); err != nil {
+			return "", err
+		}
+		return "deleted", setRefreshInterval(ctx, city, 0)
+	case "tag", "untag":
+		var stored WeatherData
+		if err := weatherCollection.FindOne(ctx, bson.M{"city": city}).Decode(&stored); err != nil {
+			return "", err
+		}
+		tags := retag(stored.Tags, job.Tags, job.Action == "tag")
+		if len(tags) == len(stored.Tags) {
+			return "unchanged", nil
+		}
+		if _, err := recordEvent(ctx, Event{Type: EventRetag, City: city, Tags: tags}); err != nil {
+			return "", err
+		}
+		return "tags now " + strings.Join(tags, ","), nil
+	case "set_refresh_interval":
+		if readOnly.Load() {
+			return "", errReadOnly
+		}
+		if err := setRefreshInterval(ctx, city, interval); err != nil {
+			return "", err
+		}
+		if interval == 0 {
+			return "no longer refreshed", nil
+		}
+		return "refreshed every " + interval.String(), nil
+	}
+	return "", fmt.Errorf("unknown action %q", job.Action)
+}
+
+// retag adds or removes tags, comparing case-insensitively like routing rules do.
+func retag(current, changes []string, add bool) []string {
+	tags := []string{}
+	for _, tag := range current {
+		if add || !containsFold(changes, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if add {
+		for _, tag := range changes {
+			if !containsFold(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+func listBulkJobsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cursor, err := bulkJobsCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(50))
+	if err != nil {
+		http.Error(w, "Failed to load bulk jobs", http.StatusInternalServerError)
+		return
+	}
+	jobs := []BulkJob{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		http.Error(w, "Failed to load bulk jobs", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// bulkJobHandler reports a job's progress at /weather/bulk/{id}.
+func bulkJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(strings.TrimPrefix(r.URL.Path, "/weather/bulk/"))
+	if err != nil {
+		http.Error(w, "Bulk job not found", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var job BulkJob
+	if err := bulkJobsCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&job); err != nil {
+		http.Error(w, "Bulk job not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestRetag(t *testing.T) {
+	tests := []struct {
+		current, changes []string
+		add              bool
+		want             []string
+	}{
+		{nil, []string{"coast"}, true, []string{"coast"}},
+		{[]string{"Coast"}, []string{"coast", "north"}, true, []string{"Coast", "north"}},
+		{[]string{"coast", "north"}, []string{"NORTH"}, false, []string{"coast"}},
+		{[]string{"coast"}, []string{"south"}, false, []string{"coast"}},
+		{[]string{"coast"}, []string{"coast"}, false, []string{}},
+	}
+	for _, tt := range tests {
+		if got := retag(tt.current, tt.changes, tt.add); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("retag(%v, %v, %v) = %v, want %v", tt.current, tt.changes, tt.add, got, tt.want)
+		}
+	}
+}
+
+// withCurrentRows replaces the current dataset with n cities, the first half in GB.
+func withCurrentRows(t *testing.T, n int) {
+	saved := queryDatasets["current"]
+	queryDatasets["current"] = queryDataset{columns: weatherColumns, scan: func(ctx context.Context, where queryExpr, fn func(queryRow) error) error {
+		for i := 0; i < n; i++ {
+			country := "GB"
+			if i >= n/2 {
+				country = "FR"
+			}
+			if err := fn(queryRow{"city": fmt.Sprintf("city%d", i), "country": country}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+	t.Cleanup(func() { queryDatasets["current"] = saved })
+}
+
+func TestMatchCities(t *testing.T) {
+	withCurrentRows(t, 10)
+	where, err := parseCondition("country = 'GB'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cities, err := matchCities(context.Background(), where)
+	if err != nil || len(cities) != 5 {
+		t.Errorf("matchCities = %v, %v; want 5 cities", cities, err)
+	}
+}
+
+func TestMatchCitiesLimit(t *testing.T) {
+	where, err := parseCondition("TRUE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withCurrentRows(t, maxBulkTargets)
+	if cities, err := matchCities(context.Background(), where); err != nil || len(cities) != maxBulkTargets {
+		t.Errorf("exactly %d cities: got %d, %v", maxBulkTargets, len(cities), err)
+	}
+
+	withCurrentRows(t, maxBulkTargets+1)
+	_, err = matchCities(context.Background(), where)
+	if _, ok := err.(queryError); !ok || !strings.Contains(err.Error(), "more than") {
+		t.Errorf("%d cities: err = %v, want a query error", maxBulkTargets+1, err)
+	}
+}
+
+func TestInterruptedBulkJobsFilter(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	filter := interruptedBulkJobsFilter("replica-a", now)
+	if filter["status"] != bulkRunning {
+		t.Errorf("status = %v, want only running jobs", filter["status"])
+	}
+	or, ok := filter["$or"].(bson.A)
+	if !ok || len(or) != 2 {
+		t.Fatalf("$or = %#v", filter["$or"])
+	}
+	if !reflect.DeepEqual(or[0], bson.M{"instance": "replica-a"}) {
+		t.Errorf("own jobs clause = %v", or[0])
+	}
+	want := bson.M{"updated_at": bson.M{"$lt": now.Add(-bulkStaleAfter)}}
+	if !reflect.DeepEqual(or[1], want) {
+		t.Errorf("stale jobs clause = %v, want %v", or[1], want)
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Peer is one replica of the service.
+type Peer struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"` // host:port other replicas reach it on
+}
+
+// discoveryConfig comes from DISCOVERY ("consul", "dns" or empty for a single
+// replica) and the settings of the chosen mechanism.
+type discoveryConfig struct {
+	Mode        string
+	ConsulAddr  string
+	ConsulToken string
+	Service     string
+	SRVName     string
+	Advertise   string
+}
+
+const (
+	discoveryInterval   = 15 * time.Second
+	defaultConsulAddr   = "http://127.0.0.1:8500"
+	defaultServiceName  = "weather-app"
+	peerNotifyTimeout   = 2 * time.Second
+	consulCheckInterval = "10s"
+	consulDeregister    = "1m"
+)
+
+var discovery discoveryConfig
+
+// cluster holds the replicas seen by the last discovery round, always including
+// this one, ordered by ID.
+var cluster = struct {
+	sync.RWMutex
+	self    Peer
+	peers   []Peer
+	updated time.Time
+	err     string
+}{}
+
+var peerClient = &http.Client{Timeout: peerNotifyTimeout}
+
+func loadDiscoveryConfig() error {
+	discovery = discoveryConfig{
+		Mode:        os.Getenv("DISCOVERY"),
+		ConsulAddr:  os.Getenv("CONSUL_ADDR"),
+		ConsulToken: os.Getenv("CONSUL_TOKEN"),
+		Service:     os.Getenv("SERVICE_NAME"),
+		SRVName:     os.Getenv("DISCOVERY_SRV"),
+		Advertise:   os.Getenv("ADVERTISE_ADDR"),
+	}
+	if discovery.ConsulAddr == "" {
+		discovery.ConsulAddr = defaultConsulAddr
+	}
+	if discovery.Service == "" {
+		discovery.Service = defaultServiceName
+	}
+	if discovery.Advertise == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to determine ADVERTISE_ADDR: %w", err)
+		}
+		discovery.Advertise = host + listenAddr
+	}
+	if _, _, err := net.SplitHostPort(discovery.Advertise); err != nil {
+		return fmt.Errorf("ADVERTISE_ADDR must be host:port: %w", err)
+	}
+
+	switch discovery.Mode {
+	case "", "consul":
+	case "dns":
+		if discovery.SRVName == "" {
+			return fmt.Errorf("DISCOVERY=dns needs DISCOVERY_SRV")
+		}
+	default:
+		return fmt.Errorf("DISCOVERY must be consul or dns")
+	}
+	// Peers call each other's admin API, which is closed without a token
+	if discovery.Mode != "" && os.Getenv("ADMIN_TOKEN") == "" && os.Getenv("ADMIN_INSECURE") != "1" {
+		return fmt.Errorf("DISCOVERY needs ADMIN_TOKEN, shared by every replica")
+	}
+
+	self := Peer{ID: discovery.Advertise, Addr: discovery.Advertise}
+	if discovery.Mode == "consul" {
+		self.ID = discovery.Service + "-" + strings.NewReplacer(":", "-", ".", "-").Replace(discovery.Advertise)
+	}
+	cluster.Lock()
+	cluster.self, cluster.peers = self, []Peer{self}
+	cluster.Unlock()
+	return nil
+}
+
+// runDiscovery registers this replica (Consul) and keeps the peer list current.
+func runDiscovery() {
+	if discovery.Mode == "" {
+		return
+	}
+	registered := false
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), discoveryInterval)
+		var peers []Peer
+		var err error
+		switch discovery.Mode {
+		case "consul":
+			registered, err = consulEnsureRegistered(ctx, registered)
+			if err == nil {
+				peers, err = consulPeers(ctx)
+			}
+		case "dns":
+			peers, err = srvPeers(ctx)
+		}
+		cancel()
+		setPeers(peers, err)
+		time.Sleep(discoveryInterval)
+	}
+}
+
+func setPeers(peers []Peer, err error) {
+	cluster.Lock()
+	defer cluster.Unlock()
+	if err != nil {
+		log.Println("Service discovery failed:", err)
+		cluster.err = err.Error()
+		return
+	}
+	found := false
+	for _, p := range peers {
+		if p.ID == cluster.self.ID || p.Addr == cluster.self.Addr {
+			found = true
+		}
+	}
+	if !found {
+		peers = append(peers, cluster.self)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	cluster.peers, cluster.updated, cluster.err = peers, time.Now(), ""
+}
+
+func consulRequest(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(discovery.ConsulAddr, "/")+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if discovery.ConsulToken != "" {
+		req.Header.Set("X-Consul-Token", discovery.ConsulToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &consulStatusError{Method: method, Path: path, StatusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+type consulStatusError struct {
+	Method, Path string
+	StatusCode   int
+}
+
+func (e *consulStatusError) Error() string {
+	return fmt.Sprintf("consul %s %s: status %d", e.Method, e.Path, e.StatusCode)
+}
+
+// consulEnsureRegistered registers this replica unless the local agent still
+// has it. An agent restarted without its data directory forgets every service,
+// so a replica registered earlier is checked again on every round.
+func consulEnsureRegistered(ctx context.Context, registered bool) (bool, error) {
+	if registered {
+		cluster.RLock()
+		id := cluster.self.ID
+		cluster.RUnlock()
+		resp, err := consulRequest(ctx, http.MethodGet, "/v1/agent/service/"+url.PathEscape(id), nil)
+		if err == nil {
+			resp.Body.Close()
+			return true, nil
+		}
+		var status *consulStatusError
+		if !errors.As(err, &status) || status.StatusCode != http.StatusNotFound {
+			return false, err
+		}
+		log.Println("Consul agent lost this replica's registration; registering again")
+	}
+	if err := consulRegister(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// consulRegister registers with the local agent. Consul drops the registration
+// once /readyz has failed for consulDeregister, so a crashed replica leaves the
+// catalog on its own.
+func consulRegister(ctx context.Context) error {
+	host, portText, _ := net.SplitHostPort(discovery.Advertise)
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return fmt.Errorf("ADVERTISE_ADDR port: %w", err)
+	}
+	cluster.RLock()
+	id := cluster.self.ID
+	cluster.RUnlock()
+	registration := map[string]any{
+		"ID":      id,
+		"Name":    discovery.Service,
+		"Address": host,
+		"Port":    port,
+		"Check": map[string]any{
+			"HTTP":                           "http://" + discovery.Advertise + "/readyz",
+			"Interval":                       consulCheckInterval,
+			"DeregisterCriticalServiceAfter": consulDeregister,
+		},
+	}
+	resp, err := consulRequest(ctx, http.MethodPut, "/v1/agent/service/register", registration)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func consulPeers(ctx context.Context) ([]Peer, error) {
+	resp, err := consulRequest(ctx, http.MethodGet, "/v1/health/service/"+url.PathEscape(discovery.Service)+"?passing=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var entries []struct {
+		Node struct {
+			Address string `json:"Address"`
+		} `json:"Node"`
+		Service struct {
+			ID      string `json:"ID"`
+			Address string `json:"Address"`
+			Port    int    `json:"Port"`
+		} `json:"Service"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("failed to parse consul health: %w", err)
+	}
+	peers := make([]Peer, 0, len(entries))
+	for _, e := range entries {
+		// An empty service address means the node's address
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		peers = append(peers, Peer{ID: e.Service.ID, Addr: net.JoinHostPort(host, strconv.Itoa(e.Service.Port))})
+	}
+	return peers, nil
+}
+
+func srvPeers(ctx context.Context) ([]Peer, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", discovery.SRVName)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]Peer, 0, len(records))
+	for _, srv := range records {
+		addr := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+		peers = append(peers, Peer{ID: addr, Addr: addr})
+	}
+	return peers, nil
+}
+
+func clusterPeers() (Peer, []Peer) {
+	cluster.RLock()
+	defer cluster.RUnlock()
+	return cluster.self, append([]Peer(nil), cluster.peers...)
+}
+
+// ownsKey reports whether this replica is responsible for key, by rendezvous
+// hashing over the current peers. Peers agree on the owner as long as they see
+// the same list; when membership changes only the keys of the replicas that came
+// or went move.
+func ownsKey(key string) bool {
+	self, peers := clusterPeers()
+	if len(peers) <= 1 {
+		return true
+	}
+	var owner string
+	var best uint64
+	for _, p := range peers {
+		h := fnv.New64a()
+		h.Write([]byte(p.ID))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := mix64(h.Sum64()); owner == "" || score > best {
+			owner, best = p.ID, score
+		}
+	}
+	return owner == self.ID
+}
+
+// mix64 is MurmurHash3's finalizer. FNV alone barely changes the high bits
+// between similar peer IDs, which skews the rendezvous split badly.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// notifyPeers tells the other replicas to refresh their in-memory response cache
+// for cities written here. Failures, including a peer refusing the admin token,
+// only leave a peer's cache stale until its next read of the city, so they are
+// logged and not retried.
+func notifyPeers(ev Event) {
+	switch ev.Type {
+	case EventFetch, EventImport, EventRetag, EventDelete:
+	default:
+		return
+	}
+	self, peers := clusterPeers()
+	if len(peers) <= 1 {
+		return
+	}
+	body, err := json.Marshal(struct {
+		Type string `json:"type"`
+		City string `json:"city"`
+	}{ev.Type, ev.City})
+	if err != nil {
+		return
+	}
+	postToPeers(self, peers, "/admin/cluster/invalidate", body)
+}
+
+// notifyPeersOfMaintenance tells the other replicas to load the cluster-wide
+// maintenance mode now; a peer that misses it catches up at its next poll.
+func notifyPeersOfMaintenance() {
+	self, peers := clusterPeers()
+	postToPeers(self, peers, "/admin/cluster/maintenance", nil)
+}
+
+// postToPeers sends body to path on every peer but self, in the background,
+// authenticated with the admin token the replicas share.
+func postToPeers(self Peer, peers []Peer, path string, body []byte) {
+	for _, p := range peers {
+		if p.ID == self.ID {
+			continue
+		}
+		go func(p Peer) {
+			req, err := http.NewRequest(http.MethodPost, "http://"+p.Addr+path, bytes.NewReader(body))
+			if err != nil {
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if adminToken != "" {
+				req.Header.Set("Authorization", "Bearer "+adminToken)
+			}
+			resp, err := peerClient.Do(req)
+			if err != nil {
+				log.Printf("Failed to notify peer %s: %v", p.ID, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Printf("Failed to notify peer %s: status %d", p.ID, resp.StatusCode)
+			}
+		}(p)
+	}
+}
+
+// invalidateHandler applies a write made on another replica to this replica's
+// response cache. It does not publish, so the event goes no further.
+func invalidateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var ev Event
+	if err := json.NewDecoder(r.Body).Decode(&ev); err != nil || ev.City == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	refreshResponseCache(ev)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// clusterMaintenanceHandler loads the cluster-wide maintenance mode after
+// another replica switched it.
+func clusterMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := syncMaintenance(ctx); err != nil {
+		http.Error(w, "Failed to load maintenance mode", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// clusterHandler shows the replicas this one knows about.
+func clusterHandler(w http.ResponseWriter, r *http.Request) {
+	cluster.RLock()
+	status := struct {
+		Discovery string    `json:"discovery"`
+		Self      Peer      `json:"self"`
+		Peers     []Peer    `json:"peers"`
+		Updated   time.Time `json:"updated,omitempty"`
+		Error     string    `json:"error,omitempty"`
+	}{discovery.Mode, cluster.self, cluster.peers, cluster.updated, cluster.err}
+	cluster.RUnlock()
+	if status.Discovery == "" {
+		status.Discovery = "none"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func writeClusterMetrics(w io.Writer) {
+	_, peers := clusterPeers()
+	writeMetricHeader(w, "weather_cluster_peers", "gauge", "Replicas known to this one, itself included.")
+	fmt.Fprintf(w, "weather_cluster_peers %d\n", len(peers))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// consulStub is a minimal Consul agent: it keeps registrations in memory and
+// serves them back as passing health entries.
+type consulStub struct {
+	mu            sync.Mutex
+	services      map[string]map[string]any
+	registrations int
+	tokens        []string
+	extra         []map[string]any
+}
+
+func (c *consulStub) forget() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.services = map[string]map[string]any{}
+}
+
+func (c *consulStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens = append(c.tokens, r.Header.Get("X-Consul-Token"))
+	switch {
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/agent/service/register":
+		var registration map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.services[registration["ID"].(string)] = registration
+		c.registrations++
+	case r.Method == http.MethodGet && len(r.URL.Path) > len("/v1/agent/service/") && r.URL.Path[:len("/v1/agent/service/")] == "/v1/agent/service/":
+		service, ok := c.services[r.URL.Path[len("/v1/agent/service/"):]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(service)
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/health/service/weather-app":
+		if r.URL.Query().Get("passing") != "true" {
+			http.Error(w, "expected ?passing=true", http.StatusBadRequest)
+			return
+		}
+		entries := append([]map[string]any{}, c.extra...)
+		for _, s := range c.services {
+			entries = append(entries, map[string]any{
+				"Node":    map[string]any{"Address": "10.0.0.1"},
+				"Service": map[string]any{"ID": s["ID"], "Address": s["Address"], "Port": s["Port"]},
+			})
+		}
+		json.NewEncoder(w).Encode(entries)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func withConsulStub(t *testing.T) *consulStub {
+	stub := &consulStub{services: map[string]map[string]any{}}
+	server := httptest.NewServer(stub)
+	savedDiscovery := discovery
+	cluster.Lock()
+	savedSelf, savedPeers := cluster.self, cluster.peers
+	cluster.Unlock()
+	t.Cleanup(func() {
+		server.Close()
+		discovery = savedDiscovery
+		cluster.Lock()
+		cluster.self, cluster.peers = savedSelf, savedPeers
+		cluster.Unlock()
+	})
+
+	discovery = discoveryConfig{Mode: "consul", ConsulAddr: server.URL + "/", ConsulToken: "consul-secret", Service: "weather-app", Advertise: "10.0.0.5:8080"}
+	self := Peer{ID: "weather-app-10-0-0-5-8080", Addr: "10.0.0.5:8080"}
+	cluster.Lock()
+	cluster.self, cluster.peers = self, []Peer{self}
+	cluster.Unlock()
+	return stub
+}
+
+func TestConsulRegister(t *testing.T) {
+	stub := withConsulStub(t)
+	if err := consulRegister(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	registration := stub.services["weather-app-10-0-0-5-8080"]
+	if registration == nil {
+		t.Fatalf("not registered: %v", stub.services)
+	}
+	if registration["Name"] != "weather-app" || registration["Address"] != "10.0.0.5" || registration["Port"] != float64(8080) {
+		t.Errorf("unexpected registration %v", registration)
+	}
+	check, _ := registration["Check"].(map[string]any)
+	if check["HTTP"] != "http://10.0.0.5:8080/readyz" || check["DeregisterCriticalServiceAfter"] != consulDeregister {
+		t.Errorf("unexpected check %v", check)
+	}
+	if stub.tokens[0] != "consul-secret" {
+		t.Errorf("sent token %q", stub.tokens[0])
+	}
+}
+
+func TestConsulPeers(t *testing.T) {
+	stub := withConsulStub(t)
+	stub.extra = []map[string]any{
+		{"Node": map[string]any{"Address": "10.0.0.7"}, "Service": map[string]any{"ID": "weather-app-b", "Address": "", "Port": 8080}},
+		{"Node": map[string]any{"Address": "10.0.0.8"}, "Service": map[string]any{"ID": "weather-app-c", "Address": "fd00::8", "Port": 9090}},
+	}
+	peers, err := consulPeers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Peer{
+		{ID: "weather-app-b", Addr: "10.0.0.7:8080"},
+		{ID: "weather-app-c", Addr: "[fd00::8]:9090"},
+	}
+	if !reflect.DeepEqual(peers, want) {
+		t.Errorf("got %v, want %v", peers, want)
+	}
+}
+
+func TestConsulReregistersAfterAgentRestart(t *testing.T) {
+	stub := withConsulStub(t)
+	ctx := context.Background()
+
+	registered, err := consulEnsureRegistered(ctx, false)
+	if err != nil || !registered {
+		t.Fatalf("first round: %v, %v", registered, err)
+	}
+	if registered, err = consulEnsureRegistered(ctx, registered); err != nil || !registered || stub.registrations != 1 {
+		t.Fatalf("second round re-registered needlessly: %d registrations, %v", stub.registrations, err)
+	}
+
+	stub.forget()
+	if registered, err = consulEnsureRegistered(ctx, registered); err != nil || !registered {
+		t.Fatalf("after agent restart: %v, %v", registered, err)
+	}
+	if stub.registrations != 2 || stub.services["weather-app-10-0-0-5-8080"] == nil {
+		t.Errorf("registration not restored: %d registrations", stub.registrations)
+	}
+	peers, err := consulPeers(ctx)
+	if err != nil || len(peers) != 1 || peers[0].Addr != "10.0.0.5:8080" {
+		t.Errorf("peers after re-registering: %v, %v", peers, err)
+	}
+}
+
+func TestSetPeersAddsSelf(t *testing.T) {
+	withConsulStub(t)
+	self, _ := clusterPeers()
+
+	setPeers([]Peer{{ID: "z", Addr: "10.0.0.9:8080"}, {ID: "a", Addr: "10.0.0.2:8080"}}, nil)
+	_, peers := clusterPeers()
+	want := []Peer{{ID: "a", Addr: "10.0.0.2:8080"}, self, {ID: "z", Addr: "10.0.0.9:8080"}}
+	if !reflect.DeepEqual(peers, want) {
+		t.Errorf("got %v, want %v", peers, want)
+	}
+
+	// Self listed under its address only is not added twice
+	setPeers([]Peer{{ID: "10.0.0.5:8080", Addr: self.Addr}}, nil)
+	if _, peers = clusterPeers(); len(peers) != 1 {
+		t.Errorf("got %v, want only self", peers)
+	}
+
+	// A failed round keeps the last known peers
+	setPeers(nil, fmt.Errorf("consul down"))
+	if _, peers = clusterPeers(); len(peers) != 1 || cluster.err != "consul down" {
+		t.Errorf("after a failure: %v, %q", peers, cluster.err)
+	}
+}
+
+func TestOwnsKeySplitsKeys(t *testing.T) {
+	withConsulStub(t)
+	peers := []Peer{{ID: "weather-app-10-0-0-5-8080", Addr: "10.0.0.5:8080"}, {ID: "weather-app-10-0-0-6-8080", Addr: "10.0.0.6:8080"}, {ID: "weather-app-10-0-0-7-8080", Addr: "10.0.0.7:8080"}}
+	owners := func(peers []Peer) map[string]string {
+		owner := map[string]string{}
+		for _, self := range peers {
+			cluster.Lock()
+			cluster.self, cluster.peers = self, peers
+			cluster.Unlock()
+			for i := 0; i < 3000; i++ {
+				key := fmt.Sprintf("city-%d", i)
+				if ownsKey(key) {
+					if owner[key] != "" {
+						t.Fatalf("%s owned by both %s and %s", key, owner[key], self.ID)
+					}
+					owner[key] = self.ID
+				}
+			}
+		}
+		return owner
+	}
+
+	before := owners(peers)
+	counts := map[string]int{}
+	for _, id := range before {
+		counts[id]++
+	}
+	if len(before) != 3000 {
+		t.Fatalf("%d of 3000 keys have an owner", len(before))
+	}
+	for _, p := range peers {
+		if counts[p.ID] < 800 {
+			t.Errorf("%s owns only %d of 3000 keys", p.ID, counts[p.ID])
+		}
+	}
+
+	// When the second replica leaves, only its keys move
+	after := owners([]Peer{peers[0], peers[2]})
+	for key, owner := range before {
+		if owner != peers[1].ID && after[key] != owner {
+			t.Errorf("%s moved from %s to %s", key, owner, after[key])
+		}
+	}
+
+	// A lone replica owns everything
+	cluster.Lock()
+	cluster.self, cluster.peers = peers[0], peers[:1]
+	cluster.Unlock()
+	if !ownsKey("anything") {
+		t.Error("single replica does not own a key")
+	}
+}
+
+func TestLoadDiscoveryConfigNeedsAdminToken(t *testing.T) {
+	withConsulStub(t)
+	t.Setenv("ADVERTISE_ADDR", "10.0.0.5:8080")
+	t.Setenv("DISCOVERY", "consul")
+	t.Setenv("ADMIN_TOKEN", "")
+	t.Setenv("ADMIN_INSECURE", "")
+	if err := loadDiscoveryConfig(); err == nil || !strings.Contains(err.Error(), "ADMIN_TOKEN") {
+		t.Errorf("consul discovery without ADMIN_TOKEN: %v", err)
+	}
+
+	t.Setenv("ADMIN_TOKEN", "secret")
+	if err := loadDiscoveryConfig(); err != nil {
+		t.Errorf("consul discovery with ADMIN_TOKEN: %v", err)
+	}
+	t.Setenv("ADMIN_TOKEN", "")
+	t.Setenv("DISCOVERY", "")
+	if err := loadDiscoveryConfig(); err != nil {
+		t.Errorf("single replica without ADMIN_TOKEN: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// offlineCommands run without loading configuration or connecting to the store.
+// They return the process exit code.
+var offlineCommands = map[string]func(args []string) int{
+	"doctor": runDoctor,
+}
+
+// runCommand runs one of the `weather <command>` maintenance commands.
+func runCommand(name string, args []string) error {
+	switch name {
+	case "rebuild-projections":
+		ctx := context.Background()
+		count, err := rebuildProjections(ctx)
+		if err != nil {
+			return fmt.Errorf("rebuild failed after %d events: %w", count, err)
+		}
+		if err := ensureIndexes(ctx); err != nil {
+			return err
+		}
+		log.Printf("Rebuilt projections from %d events", count)
+		return nil
+	case "ingest-storms":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: weather ingest-storms <file-or-url>...")
+		}
+		ctx := context.Background()
+		for _, source := range args {
+			storms, positions, err := ingestStorms(ctx, source)
+			if err != nil {
+				return err
+			}
+			log.Printf("Ingested %d storms and %d positions from %s", storms, positions, source)
+		}
+		return nil
+	case "publish-static":
+		return runPublishStatic(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
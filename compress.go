@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// Column codecs for history blocks. Timestamps use delta-of-delta encoding and
+// floats use XOR encoding, both as described in Facebook's Gorilla paper.
+
+var errShortColumn = errors.New("column is truncated")
+
+type bitWriter struct {
+	buf   []byte
+	nbits uint8 // bits used in the last byte
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.nbits == 0 || w.nbits == 8 {
+		w.buf = append(w.buf, 0)
+		w.nbits = 0
+	}
+	if bit {
+		w.buf[len(w.buf)-1] |= 1 << (7 - w.nbits)
+	}
+	w.nbits++
+}
+
+func (w *bitWriter) writeBits(value uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(value>>uint(i)&1 == 1)
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos int // in bits
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.buf)*8 {
+		return false, errShortColumn
+	}
+	bit := r.buf[r.pos/8]>>(7-uint(r.pos%8))&1 == 1
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	var value uint64
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		value <<= 1
+		if bit {
+			value |= 1
+		}
+	}
+	return value, nil
+}
+
+// encodeTimes encodes millisecond timestamps with delta-of-delta buckets.
+func encodeTimes(times []int64) []byte {
+	w := &bitWriter{}
+	var prev, prevDelta int64
+	for i, t := range times {
+		switch i {
+		case 0:
+			w.writeBits(uint64(t), 64)
+		case 1:
+			prevDelta = t - prev
+			w.writeBits(zigzag(prevDelta), 64)
+		default:
+			delta := t - prev
+			dod := delta - prevDelta
+			switch {
+			case dod == 0:
+				w.writeBit(false)
+			case dod >= -63 && dod <= 64:
+				w.writeBits(0b10, 2)
+				w.writeBits(uint64(dod+63), 7)
+			case dod >= -255 && dod <= 256:
+				w.writeBits(0b110, 3)
+				w.writeBits(uint64(dod+255), 9)
+			case dod >= -2047 && dod <= 2048:
+				w.writeBits(0b1110, 4)
+				w.writeBits(uint64(dod+2047), 12)
+			default:
+				w.writeBits(0b1111, 4)
+				w.writeBits(zigzag(dod), 64)
+			}
+			prevDelta = delta
+		}
+		prev = t
+	}
+	return w.buf
+}
+
+func decodeTimes(buf []byte, n int) ([]int64, error) {
+	r := &bitReader{buf: buf}
+	times := make([]int64, 0, n)
+	var prev, delta int64
+	for i := 0; i < n; i++ {
+		switch i {
+		case 0:
+			v, err := r.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			prev = int64(v)
+		case 1:
+			v, err := r.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			delta = unzigzag(v)
+			prev += delta
+		default:
+			prefix := 0
+			for prefix < 4 {
+				bit, err := r.readBit()
+				if err != nil {
+					return nil, err
+				}
+				if !bit {
+					break
+				}
+				prefix++
+			}
+			var dod int64
+			switch prefix {
+			case 1:
+				v, err := r.readBits(7)
+				if err != nil {
+					return nil, err
+				}
+				dod = int64(v) - 63
+			case 2:
+				v, err := r.readBits(9)
+				if err != nil {
+					return nil, err
+				}
+				dod = int64(v) - 255
+			case 3:
+				v, err := r.readBits(12)
+				if err != nil {
+					return nil, err
+				}
+				dod = int64(v) - 2047
+			case 4:
+				v, err := r.readBits(64)
+				if err != nil {
+					return nil, err
+				}
+				dod = unzigzag(v)
+			}
+			delta += dod
+			prev += delta
+		}
+		times = append(times, prev)
+	}
+	return times, nil
+}
+
+// encodeFloats XOR-encodes each value against the previous one, storing only the
+// meaningful bits when they differ.
+func encodeFloats(values []float64) []byte {
+	w := &bitWriter{}
+	var prev uint64
+	leading, trailing := -1, 0
+	for i, f := range values {
+		v := math.Float64bits(f)
+		if i == 0 {
+			w.writeBits(v, 64)
+			prev = v
+			continue
+		}
+		xor := v ^ prev
+		prev = v
+		if xor == 0 {
+			w.writeBit(false)
+			continue
+		}
+		w.writeBit(true)
+		lz := bits.LeadingZeros64(xor)
+		tz := bits.TrailingZeros64(xor)
+		if lz > 31 {
+			lz = 31
+		}
+		if leading >= 0 && lz >= leading && tz >= trailing {
+			w.writeBit(false)
+			w.writeBits(xor>>uint(trailing), 64-leading-trailing)
+			continue
+		}
+		leading, trailing = lz, tz
+		meaningful := 64 - leading - trailing
+		w.writeBit(true)
+		w.writeBits(uint64(leading), 5)
+		// 64 meaningful bits is stored as 0 since it does not fit in 6 bits
+		w.writeBits(uint64(meaningful&63), 6)
+		w.writeBits(xor>>uint(trailing), meaningful)
+	}
+	return w.buf
+}
+
+func decodeFloats(buf []byte, n int) ([]float64, error) {
+	r := &bitReader{buf: buf}
+	values := make([]float64, 0, n)
+	var prev uint64
+	leading, trailing := 0, 0
+	for i := 0; i < n; i++ {
+		if i == 0 {
+			v, err := r.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			prev = v
+			values = append(values, math.Float64frombits(v))
+			continue
+		}
+		changed, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			newWindow, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if newWindow {
+				lz, err := r.readBits(5)
+				if err != nil {
+					return nil, err
+				}
+				meaningful, err := r.readBits(6)
+				if err != nil {
+					return nil, err
+				}
+				if meaningful == 0 {
+					meaningful = 64
+				}
+				leading = int(lz)
+				trailing = 64 - leading - int(meaningful)
+			}
+			xor, err := r.readBits(64 - leading - trailing)
+			if err != nil {
+				return nil, err
+			}
+			prev ^= xor << uint(trailing)
+		}
+		values = append(values, math.Float64frombits(prev))
+	}
+	return values, nil
+}
+
+// encodeDict stores each string as a uvarint index into dict, adding new entries.
+func encodeDict(values []string, dict *[]string) []byte {
+	index := make(map[string]int, len(*dict))
+	for i, s := range *dict {
+		index[s] = i
+	}
+	var buf []byte
+	for _, s := range values {
+		i, ok := index[s]
+		if !ok {
+			i = len(*dict)
+			*dict = append(*dict, s)
+			index[s] = i
+		}
+		buf = binary.AppendUvarint(buf, uint64(i))
+	}
+	return buf
+}
+
+func decodeDict(buf []byte, dict []string, n int) ([]string, error) {
+	values := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		idx, size := binary.Uvarint(buf)
+		if size <= 0 || idx >= uint64(len(dict)) {
+			return nil, errShortColumn
+		}
+		buf = buf[size:]
+		values = append(values, dict[idx])
+	}
+	return values, nil
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTimesRoundTrip(t *testing.T) {
+	tests := map[string][]int64{
+		"empty":           {},
+		"single":          {1704067200123},
+		"two":             {1704067200123, 1704070800456},
+		"identical":       {1704067200000, 1704067200000, 1704067200000, 1704067200000},
+		"regular":         {0, 3600000, 7200000, 10800000, 14400000},
+		"jitter":          {1704067200000, 1704070801234, 1704074399002, 1704078000999, 1704081600000},
+		"negative deltas": {1704081600000, 1704078000000, 1704078000001, 1704067200000, 1704067199999},
+		"every bucket":    {0, 1000, 2064, 3000, 4256, 5000, 7048, 9000, 9000 + 1<<40, 0},
+		"before 1970":     {-86400000, -3600000, 0, 3600000},
+	}
+	for name, times := range tests {
+		t.Run(name, func(t *testing.T) {
+			decoded, err := decodeTimes(encodeTimes(times), len(times))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(decoded) != len(times) {
+				t.Fatalf("decoded %d timestamps, want %d", len(decoded), len(times))
+			}
+			for i := range times {
+				if decoded[i] != times[i] {
+					t.Fatalf("timestamp %d: got %d, want %d", i, decoded[i], times[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFloatsRoundTrip(t *testing.T) {
+	tests := map[string][]float64{
+		"empty":      {},
+		"single":     {12.34},
+		"identical":  {5.5, 5.5, 5.5, 5.5},
+		"zeros":      {0, 0, math.Copysign(0, -1), 0},
+		"negative":   {-3.2, -3.25, 1.1, -40.0, -0.01},
+		"nan":        {1.5, math.NaN(), math.NaN(), 2.5, math.NaN()},
+		"infinities": {math.Inf(1), math.Inf(-1), 0, math.Inf(1)},
+		"extremes":   {math.MaxFloat64, math.SmallestNonzeroFloat64, -math.MaxFloat64, 1},
+		"temperatures": {
+			9.850000000000023, 10.120000000000005, 10.460000000000036, 10.009999999999991,
+			9.560000000000002, 9.560000000000002, 8.980000000000018,
+		},
+	}
+	for name, values := range tests {
+		t.Run(name, func(t *testing.T) {
+			decoded, err := decodeFloats(encodeFloats(values), len(values))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(decoded) != len(values) {
+				t.Fatalf("decoded %d values, want %d", len(decoded), len(values))
+			}
+			// Compare bits so NaN and -0 must survive exactly
+			for i := range values {
+				if math.Float64bits(decoded[i]) != math.Float64bits(values[i]) {
+					t.Fatalf("value %d: got %v, want %v", i, decoded[i], values[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	times := encodeTimes([]int64{0, 1000, 2500, 2600})
+	if _, err := decodeTimes(times[:len(times)-2], 4); err == nil {
+		t.Error("decodeTimes accepted a truncated column")
+	}
+	floats := encodeFloats([]float64{1, 2, 3.5, -7})
+	if _, err := decodeFloats(floats[:10], 4); err == nil {
+		t.Error("decodeFloats accepted a truncated column")
+	}
+}
+
+func TestDictRoundTrip(t *testing.T) {
+	var dict []string
+	first := encodeDict([]string{"clear sky", "light rain", "clear sky", ""}, &dict)
+	second := encodeDict([]string{"", "snow", "light rain"}, &dict)
+	if len(dict) != 4 {
+		t.Fatalf("dictionary has %d entries, want 4: %q", len(dict), dict)
+	}
+	for _, c := range []struct {
+		buf  []byte
+		want []string
+	}{
+		{first, []string{"clear sky", "light rain", "clear sky", ""}},
+		{second, []string{"", "snow", "light rain"}},
+	} {
+		got, err := decodeDict(c.buf, dict, len(c.want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range c.want {
+			if got[i] != c.want[i] {
+				t.Fatalf("got %q, want %q", got, c.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, 2, 28, 22, 17, 30, 0, time.UTC) // a Wednesday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 2, 28, 22, 18, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 2, 28, 23, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2024, 2, 28, 22, 20, 0, 0, time.UTC)},
+		{"5,50 8-10 * * *", time.Date(2024, 2, 29, 8, 5, 0, 0, time.UTC)},
+		{"15 3 * * 1-5", time.Date(2024, 2, 29, 3, 15, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 12 30 * *", time.Date(2024, 3, 30, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"30 6 10/5 * *", time.Date(2024, 3, 10, 6, 30, 0, 0, time.UTC)},
+		// With both day fields restricted either one matches: the 1st or a Friday
+		{"0 9 1 * 5", time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)},
+		{"0 9 15 * 4", time.Date(2024, 2, 29, 9, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: Next = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestCronNextIsStrictlyAfter(t *testing.T) {
+	s, _ := parseCron("0 * * * *")
+	at := time.Date(2024, 1, 1, 5, 0, 0, 0, time.UTC)
+	if got := s.Next(at); !got.Equal(at.Add(time.Hour)) {
+		t.Errorf("Next(%s) = %s", at, got)
+	}
+	// Times in other zones are evaluated in UTC
+	local := at.In(time.FixedZone("UTC+2", 2*3600)).Add(-time.Minute)
+	if got := s.Next(local); !got.Equal(at) {
+		t.Errorf("Next(%s) = %s, want %s", local, got, at)
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"@yearly",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) was accepted", expr)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type doctorStatus string
+
+const (
+	doctorOK   doctorStatus = "OK"
+	doctorWarn doctorStatus = "WARN"
+	doctorFail doctorStatus = "FAIL"
+	doctorSkip doctorStatus = "SKIP"
+)
+
+const (
+	maxClockSkewWarn = 2 * time.Second
+	maxClockSkewFail = 30 * time.Second
+	// A known city used to probe providers; coordinate-only providers need its position
+	doctorProbeCity = "London"
+	doctorProbeLat  = 51.5085
+	doctorProbeLon  = -0.1257
+)
+
+type doctor struct {
+	failures int
+	warnings int
+}
+
+func (d *doctor) report(status doctorStatus, check, detail, fix string) {
+	switch status {
+	case doctorFail:
+		d.failures++
+	case doctorWarn:
+		d.warnings++
+	}
+	fmt.Printf("[%-4s] %s: %s\n", status, check, detail)
+	if fix != "" && status != doctorOK {
+		fmt.Printf("       fix: %s\n", fix)
+	}
+}
+
+// runDoctor checks configuration, the store, providers, the clock and the listen
+// port, printing a fix for each problem. It returns the process exit code.
+func runDoctor(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	skipProviders := flags.Bool("skip-providers", false, "do not call providers (saves API quota)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	d := &doctor{}
+	d.checkConfig()
+
+	router, routerErr := loadRouter(os.Getenv("ROUTING_CONFIG"), newOpenWeatherProvider("openweather", os.Getenv("BASE_URL"), os.Getenv("API_KEY")))
+	if routerErr != nil {
+		d.report(doctorFail, "routing config", routerErr.Error(), "fix or unset ROUTING_CONFIG")
+	} else {
+		d.report(doctorOK, "routing config", fmt.Sprintf("%d provider(s) configured", len(router.Providers())), "")
+	}
+
+	client := d.checkStore()
+	if client != nil {
+		defer client.Disconnect(context.Background())
+		initStore(client.Database(databaseName))
+		d.checkIndexes()
+		d.checkMigrations()
+		d.checkClockSkew(client)
+	}
+
+	switch {
+	case *skipProviders:
+		d.report(doctorSkip, "providers", "skipped by --skip-providers", "")
+	case routerErr != nil:
+		d.report(doctorSkip, "providers", "routing config is invalid", "")
+	default:
+		d.checkProviders(router)
+	}
+
+	d.checkPort()
+
+	fmt.Printf("\n%d failure(s), %d warning(s)\n", d.failures, d.warnings)
+	if d.failures > 0 {
+		return 1
+	}
+	return 0
+}
+
+func (d *doctor) checkConfig() {
+	if err := godotenv.Load(); err != nil {
+		d.report(doctorWarn, ".env", "no readable .env file in "+mustGetwd(), "create .env with MONGO_URI, BASE_URL and API_KEY, or export them (the server currently refuses to start without .env)")
+	} else {
+		d.report(doctorOK, ".env", "loaded", "")
+	}
+
+	required := map[string]string{
+		"MONGO_URI": "set MONGO_URI, e.g. mongodb://localhost:27017",
+		"BASE_URL":  "set BASE_URL to the current-weather endpoint, e.g. https://api.openweathermap.org/data/2.5/weather",
+		"API_KEY":   "set API_KEY to your OpenWeather API key",
+	}
+	for _, name := range []string{"MONGO_URI", "BASE_URL", "API_KEY"} {
+		if os.Getenv(name) == "" {
+			d.report(doctorFail, name, "not set", required[name])
+		} else {
+			d.report(doctorOK, name, "set", "")
+		}
+	}
+
+	if os.Getenv("SHARE_SECRET") == "" {
+		d.report(doctorWarn, "SHARE_SECRET", "not set, share links are disabled", "set SHARE_SECRET to a long random string")
+	}
+	if os.Getenv("ADMIN_TOKEN") == "" && os.Getenv("ADMIN_INSECURE") == "1" {
+		d.report(doctorWarn, "ADMIN_TOKEN", "not set and ADMIN_INSECURE=1, the admin API is unauthenticated", "set ADMIN_TOKEN and send it as a Bearer token")
+	} else if os.Getenv("ADMIN_TOKEN") == "" {
+		d.report(doctorWarn, "ADMIN_TOKEN", "not set, the admin API is disabled", "set ADMIN_TOKEN and send it as a Bearer token")
+	}
+	if err := loadSLOConfig(os.Getenv("SLO_CONFIG")); err != nil {
+		d.report(doctorFail, "SLO config", err.Error(), "fix or unset SLO_CONFIG")
+	}
+	if err := loadExportConfig(os.Getenv("EXPORT_CONFIG")); err != nil {
+		d.report(doctorFail, "export config", err.Error(), "fix or unset EXPORT_CONFIG")
+	}
+	if err := loadDiscoveryConfig(); err != nil {
+		d.report(doctorFail, "service discovery", err.Error(), "fix DISCOVERY, DISCOVERY_SRV or ADVERTISE_ADDR, and set ADMIN_TOKEN on every replica when DISCOVERY is set")
+	}
+}
+
+func (d *doctor) checkStore() *mongo.Client {
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		d.report(doctorSkip, "MongoDB", "MONGO_URI is not set", "")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetServerSelectionTimeout(5*time.Second))
+	if err != nil {
+		d.report(doctorFail, "MongoDB", "invalid MONGO_URI: "+err.Error(), "check the connection string format")
+		return nil
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		d.report(doctorFail, "MongoDB", "ping failed: "+err.Error(), "check that MongoDB is running and reachable from this host, and that credentials in MONGO_URI are correct")
+		client.Disconnect(context.Background())
+		return nil
+	}
+	d.report(doctorOK, "MongoDB", "connected", "")
+	return client
+}
+
+func (d *doctor) checkIndexes() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	wanted := map[*mongo.Collection][]mongo.IndexModel{}
+	for _, p := range projections {
+		wanted[p.collection] = append(wanted[p.collection], p.indexes...)
+	}
+	for c, indexes := range storeIndexes {
+		wanted[c] = append(wanted[c], indexes...)
+	}
+
+	var missing []string
+	for c, indexes := range wanted {
+		cursor, err := c.Indexes().List(ctx)
+		if err != nil {
+			d.report(doctorFail, "indexes", "failed to list indexes: "+err.Error(), "")
+			return
+		}
+		var existing []struct {
+			Key bson.D `bson:"key"`
+		}
+		if err := cursor.All(ctx, &existing); err != nil {
+			d.report(doctorFail, "indexes", "failed to list indexes: "+err.Error(), "")
+			return
+		}
+		have := map[string]bool{}
+		for _, index := range existing {
+			have[fmt.Sprint(index.Key)] = true
+		}
+		for _, index := range indexes {
+			if !have[fmt.Sprint(index.Keys)] {
+				missing = append(missing, fmt.Sprintf("%s %v", c.Name(), index.Keys))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		d.report(doctorWarn, "indexes", "missing: "+strings.Join(missing, "; "), "start the server or run `weather rebuild-projections`; both create indexes")
+		return
+	}
+	d.report(doctorOK, "indexes", "all present", "")
+}
+
+func (d *doctor) checkMigrations() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cities, err := unmigratedCities(ctx)
+	if err != nil {
+		d.report(doctorFail, "migrations", err.Error(), "")
+		return
+	}
+	if len(cities) > 0 {
+		d.report(doctorWarn, "migrations", fmt.Sprintf("%d cities have no events yet", len(cities)), "run `weather rebuild-projections` to import them into the event log")
+		return
+	}
+	legacy, err := weatherCollection.Database().ListCollectionNames(ctx, bson.M{"name": "weather_history"})
+	if err == nil && len(legacy) > 0 {
+		d.report(doctorWarn, "migrations", "per-reading weather_history collection is no longer used", "run `weather rebuild-projections` to fill weather_blocks, then drop weather_history")
+		return
+	}
+	d.report(doctorOK, "migrations", "event log covers every stored city", "")
+}
+
+func (d *doctor) checkClockSkew(client *mongo.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var hello struct {
+		LocalTime time.Time `bson:"localTime"`
+	}
+	start := time.Now()
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil || hello.LocalTime.IsZero() {
+		d.report(doctorSkip, "clock skew", "MongoDB did not report its time", "")
+		return
+	}
+	roundTrip := time.Since(start)
+	skew := start.Add(roundTrip / 2).Sub(hello.LocalTime)
+	if skew < 0 {
+		skew = -skew
+	}
+
+	detail := fmt.Sprintf("%v against MongoDB", skew.Round(time.Millisecond))
+	fix := "enable NTP (e.g. systemd-timesyncd or chrony); skew distorts freshness SLOs and share link expiry"
+	switch {
+	case skew > maxClockSkewFail:
+		d.report(doctorFail, "clock skew", detail, fix)
+	case skew > maxClockSkewWarn:
+		d.report(doctorWarn, "clock skew", detail, fix)
+	default:
+		d.report(doctorOK, "clock skew", detail, "")
+	}
+}
+
+func (d *doctor) checkProviders(router *Router) {
+	providers := router.Providers()
+	fmt.Printf("       note: probing %d provider(s) costs one API call each against your quota (use --skip-providers to avoid)\n", len(providers))
+
+	for _, p := range providers {
+		check := "provider " + p.Name()
+		_, err := p.Current(Location{City: doctorProbeCity, Lat: doctorProbeLat, Lon: doctorProbeLon, HasPos: true})
+		var statusErr *providerStatusError
+		switch {
+		case err == nil:
+			d.report(doctorOK, check, "reachable, key accepted", "")
+		case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized:
+			d.report(doctorFail, check, "API key rejected (401)", "check the provider's API key; new OpenWeather keys can take up to 2 hours to activate")
+		case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests:
+			d.report(doctorWarn, check, "quota exhausted (429)", "wait for the quota window to reset or upgrade the plan")
+		case errors.As(err, &statusErr):
+			d.report(doctorFail, check, err.Error(), "check the provider's base URL")
+		default:
+			d.report(doctorFail, check, "unreachable: "+err.Error(), "check the base URL, DNS and outbound network access")
+		}
+	}
+}
+
+func (d *doctor) checkPort() {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		d.report(doctorFail, "port", listenAddr+" is not available: "+err.Error(), "stop the other process using the port (e.g. `lsof -i "+listenAddr+"`)")
+		return
+	}
+	listener.Close()
+	d.report(doctorOK, "port", listenAddr+" is free", "")
+}
+
+func mustGetwd() string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "the working directory"
+	}
+	return wd
+}
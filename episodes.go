@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Episode is a multi-day weather event such as a heatwave.
+type Episode struct {
+	City      string  `bson:"city" json:"city"`
+	Kind      string  `bson:"kind" json:"kind"`
+	Start     string  `bson:"start" json:"start"`
+	End       string  `bson:"end" json:"end"`
+	Days      int     `bson:"days" json:"days"`
+	Threshold float64 `bson:"threshold" json:"threshold"`
+	Intensity float64 `bson:"intensity" json:"intensity"` // accumulated departure from the threshold
+	Peak      float64 `bson:"peak" json:"peak"`
+	Ongoing   bool    `bson:"ongoing" json:"ongoing"`
+}
+
+// episodeRule detects runs of consecutive days where value is beyond a threshold.
+// When Percentile is set and the city has enough history, the threshold is that
+// percentile of the city's own daily values; otherwise Absolute is used.
+type episodeRule struct {
+	Kind       string
+	MinDays    int
+	Absolute   float64
+	Percentile float64
+	Below      bool
+	Value      func(DailyAggregate) float64
+}
+
+var episodeRules = []episodeRule{
+	{Kind: "heatwave", MinDays: 3, Absolute: 30, Percentile: 90, Value: func(d DailyAggregate) float64 { return d.MaxTemp }},
+	{Kind: "cold_spell", MinDays: 3, Absolute: -5, Percentile: 10, Below: true, Value: func(d DailyAggregate) float64 { return d.MinTemp }},
+	{Kind: "dry_spell", MinDays: 10, Absolute: 0.2, Below: true, Value: func(d DailyAggregate) float64 { return d.Precip }},
+}
+
+const (
+	episodeHistoryDays    = 400
+	minDaysForPercentiles = 60
+)
+
+var episodesCollection *mongo.Collection
+
+func (rule episodeRule) threshold(days []DailyAggregate) float64 {
+	if rule.Percentile == 0 || len(days) < minDaysForPercentiles {
+		return rule.Absolute
+	}
+	values := make([]float64, len(days))
+	for i, d := range days {
+		values[i] = rule.Value(d)
+	}
+	return percentile(values, rule.Percentile)
+}
+
+func (rule episodeRule) detect(city string, days []DailyAggregate) []Episode {
+	threshold := rule.threshold(days)
+	var episodes []Episode
+	var run []DailyAggregate
+
+	flush := func() {
+		if len(run) >= rule.MinDays {
+			ep := Episode{
+				City:      city,
+				Kind:      rule.Kind,
+				Start:     run[0].Day,
+				End:       run[len(run)-1].Day,
+				Days:      len(run),
+				Threshold: threshold,
+				Peak:      rule.Value(run[0]),
+			}
+			for _, d := range run {
+				v := rule.Value(d)
+				ep.Intensity += math.Abs(v - threshold)
+				if (rule.Below && v < ep.Peak) || (!rule.Below && v > ep.Peak) {
+					ep.Peak = v
+				}
+			}
+			episodes = append(episodes, ep)
+		}
+		run = nil
+	}
+
+	for i, d := range days {
+		v := rule.Value(d)
+		beyond := v > threshold
+		if rule.Below {
+			beyond = v < threshold
+		}
+		if !beyond || (len(run) > 0 && !consecutiveDays(days[i-1].Day, d.Day)) {
+			flush()
+		}
+		if beyond {
+			run = append(run, d)
+		}
+	}
+	// A run still open after the last day is an episode that has not ended yet
+	open := len(run) >= rule.MinDays
+	flush()
+	if open {
+		episodes[len(episodes)-1].Ongoing = true
+	}
+	return episodes
+}
+
+func consecutiveDays(a, b string) bool {
+	da, errA := time.Parse(dayLayout, a)
+	db, errB := time.Parse(dayLayout, b)
+	return errA == nil && errB == nil && db.Sub(da) == 24*time.Hour
+}
+
+func percentile(values []float64, p float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
+
+// episodeChange is a detected episode to store, with the stored episode it
+// continues, if any, and the stored ones it replaces because their start moved.
+type episodeChange struct {
+	Episode  Episode
+	Previous *Episode
+	Replaces []Episode
+}
+
+// reconcileEpisodes matches the episodes detected over the days from windowStart
+// with the stored ones ending in that window. A stored episode overlapping a
+// detected one is the same episode, even when a moved threshold or a late reading
+// shifted its start; stored episodes starting in the window that detection no
+// longer finds are returned as stale. An episode that started before the window
+// keeps its start: a run detected at the window's edge only extends or ends it.
+func reconcileEpisodes(stored, detected []Episode, windowStart string) ([]episodeChange, []Episode) {
+	matched := make([]bool, len(stored))
+	var changes []episodeChange
+	for _, ep := range detected {
+		var overlapping []int
+		earlier := -1
+		for i, s := range stored {
+			if s.Start <= ep.End && s.End >= ep.Start {
+				overlapping = append(overlapping, i)
+				if s.Start < windowStart {
+					earlier = i
+				}
+			}
+		}
+		if earlier >= 0 {
+			previous := stored[earlier]
+			extended := previous
+			extended.End, extended.Ongoing = ep.End, ep.Ongoing
+			if start, err := time.Parse(dayLayout, extended.Start); err == nil {
+				if end, err := time.Parse(dayLayout, extended.End); err == nil {
+					extended.Days = int(end.Sub(start).Hours()/24) + 1
+				}
+			}
+			for _, i := range overlapping {
+				matched[i] = true
+			}
+			changes = append(changes, episodeChange{Episode: extended, Previous: &previous})
+			continue
+		}
+		change := episodeChange{Episode: ep}
+		for _, i := range overlapping {
+			matched[i] = true
+			if stored[i].Start == ep.Start {
+				previous := stored[i]
+				change.Previous = &previous
+			} else {
+				change.Replaces = append(change.Replaces, stored[i])
+			}
+		}
+		if change.Previous == nil && len(change.Replaces) > 0 {
+			change.Previous = &change.Replaces[0]
+		}
+		changes = append(changes, change)
+	}
+	var stale []Episode
+	for i, s := range stored {
+		switch {
+		case matched[i]:
+		case s.Start >= windowStart:
+			stale = append(stale, s)
+		case s.Ongoing:
+			// Its run no longer reaches into the window's days, so it has ended
+			ended := s
+			ended.Ongoing = false
+			changes = append(changes, episodeChange{Episode: ended, Previous: &stored[i]})
+		}
+	}
+	return changes, stale
+}
+
+// applyEpisodes re-runs detection over the city's recent completed days. The
+// day of the reading is left out until it is over, so a cool morning does not
+// end a heatwave that the afternoon continues.
+func applyEpisodes(ctx context.Context, c *mongo.Collection, ev Event) error {
+	switch ev.Type {
+	case EventFetch, EventImport:
+	default:
+		return nil
+	}
+
+	today := ev.Data.LastUpdated.UTC().Format(dayLayout)
+	opts := options.Find().SetSort(bson.M{"day": -1}).SetLimit(episodeHistoryDays)
+	cursor, err := dailyCollection.Find(ctx, bson.M{"city": ev.City, "day": bson.M{"$lt": today}}, opts)
+	if err != nil {
+		return err
+	}
+	var days []DailyAggregate
+	if err := cursor.All(ctx, &days); err != nil {
+		return err
+	}
+	if len(days) == 0 {
+		return nil
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Day < days[j].Day })
+	windowStart := days[0].Day
+
+	for _, rule := range episodeRules {
+		var stored []Episode
+		cursor, err := c.Find(ctx, bson.M{"city": ev.City, "kind": rule.Kind, "end": bson.M{"$gte": windowStart}}, options.Find().SetSort(bson.M{"start": 1}))
+		if err != nil {
+			return err
+		}
+		if err := cursor.All(ctx, &stored); err != nil {
+			return err
+		}
+		changes, stale := reconcileEpisodes(stored, rule.detect(ev.City, days), windowStart)
+
+		for _, ep := range stale {
+			if _, err := c.DeleteOne(ctx, bson.M{"city": ep.City, "kind": ep.Kind, "start": ep.Start}); err != nil {
+				return err
+			}
+			if ep.Ongoing {
+				ep.Ongoing = false
+				publish(Event{Type: EventEpisodeEnded, City: ep.City, Time: ev.Time, Payload: ep})
+			}
+		}
+		for _, change := range changes {
+			ep, previous := change.Episode, change.Previous
+			for _, old := range change.Replaces {
+				if _, err := c.DeleteOne(ctx, bson.M{"city": old.City, "kind": old.Kind, "start": old.Start}); err != nil {
+					return err
+				}
+			}
+			filter := bson.M{"city": ep.City, "kind": ep.Kind, "start": ep.Start}
+			if _, err := c.ReplaceOne(ctx, filter, ep, options.Replace().SetUpsert(true)); err != nil {
+				return err
+			}
+			switch {
+			case previous == nil:
+				publish(Event{Type: EventEpisodeStarted, City: ep.City, Time: ev.Time, Payload: ep})
+				if !ep.Ongoing {
+					publish(Event{Type: EventEpisodeEnded, City: ep.City, Time: ev.Time, Payload: ep})
+				}
+			case previous.Ongoing && !ep.Ongoing:
+				publish(Event{Type: EventEpisodeEnded, City: ep.City, Time: ev.Time, Payload: ep})
+			case !previous.Ongoing && ep.Ongoing:
+				// A late reading for an earlier day extended a run that had ended
+				publish(Event{Type: EventEpisodeStarted, City: ep.City, Time: ev.Time, Payload: ep})
+			}
+		}
+	}
+	return nil
+}
+
+func episodesHandler(w http.ResponseWriter, r *http.Request) {
+	city := r.URL.Query().Get("city")
+	if city == "" {
+		http.Error(w, "City parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"city": city}
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		filter["kind"] = kind
+	}
+	cursor, err := episodesCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"start": -1}))
+	if err != nil {
+		http.Error(w, "Failed to load episodes", http.StatusInternalServerError)
+		return
+	}
+	episodes := []Episode{}
+	if err := cursor.All(ctx, &episodes); err != nil {
+		http.Error(w, "Failed to load episodes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(episodes)
+}
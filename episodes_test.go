@@ -0,0 +1,178 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// dailySeries builds consecutive days from 2024-07-01 whose temperatures and
+// precipitation are all the given values.
+func dailySeries(values ...float64) []DailyAggregate {
+	start := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	days := make([]DailyAggregate, len(values))
+	for i, v := range values {
+		days[i] = DailyAggregate{City: "Berlin", Day: start.AddDate(0, 0, i).Format(dayLayout), MaxTemp: v, MinTemp: v, Precip: v}
+	}
+	return days
+}
+
+func TestEpisodeDetect(t *testing.T) {
+	heatwave := episodeRules[0]
+	coldSpell := episodeRules[1]
+	tests := []struct {
+		name string
+		rule episodeRule
+		days []DailyAggregate
+		want []Episode
+	}{
+		{
+			name: "too short",
+			rule: heatwave,
+			days: dailySeries(25, 31, 32, 25),
+		},
+		{
+			name: "ended run",
+			rule: heatwave,
+			days: dailySeries(25, 31, 34, 32, 25),
+			want: []Episode{{City: "Berlin", Kind: "heatwave", Start: "2024-07-02", End: "2024-07-04", Days: 3, Threshold: 30, Intensity: 7, Peak: 34}},
+		},
+		{
+			name: "ongoing run",
+			rule: heatwave,
+			days: dailySeries(25, 31, 32, 33),
+			want: []Episode{{City: "Berlin", Kind: "heatwave", Start: "2024-07-02", End: "2024-07-04", Days: 3, Threshold: 30, Intensity: 6, Peak: 33, Ongoing: true}},
+		},
+		{
+			name: "cold spell peaks at the lowest value",
+			rule: coldSpell,
+			days: dailySeries(0, -6, -9, -7, -6, 2),
+			want: []Episode{{City: "Berlin", Kind: "cold_spell", Start: "2024-07-02", End: "2024-07-05", Days: 4, Threshold: -5, Intensity: 8, Peak: -9}},
+		},
+		{
+			name: "two runs",
+			rule: heatwave,
+			days: dailySeries(31, 31, 31, 20, 35, 35, 35),
+			want: []Episode{
+				{City: "Berlin", Kind: "heatwave", Start: "2024-07-01", End: "2024-07-03", Days: 3, Threshold: 30, Intensity: 3, Peak: 31},
+				{City: "Berlin", Kind: "heatwave", Start: "2024-07-05", End: "2024-07-07", Days: 3, Threshold: 30, Intensity: 15, Peak: 35, Ongoing: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.detect("Berlin", tt.days); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEpisodeDetectBreaksOnMissingDays(t *testing.T) {
+	days := dailySeries(31, 32, 33, 34)
+	days = append(days[:2], days[3:]...)
+	if got := episodeRules[0].detect("Berlin", days); len(got) != 0 {
+		t.Errorf("a gap did not break the run: %+v", got)
+	}
+}
+
+func TestEpisodeThresholdUsesPercentiles(t *testing.T) {
+	values := make([]float64, minDaysForPercentiles)
+	for i := range values {
+		values[i] = float64(i)
+	}
+	days := dailySeries(values...)
+	if got := episodeRules[0].threshold(days); got != 53.1 {
+		t.Errorf("90th percentile threshold = %v, want 53.1", got)
+	}
+	if got := episodeRules[0].threshold(days[:minDaysForPercentiles-1]); got != 30 {
+		t.Errorf("threshold without enough history = %v, want the absolute 30", got)
+	}
+	if got := episodeRules[2].threshold(days); got != 0.2 {
+		t.Errorf("dry spell threshold = %v, want the absolute 0.2", got)
+	}
+}
+
+func TestReconcileEpisodes(t *testing.T) {
+	episode := func(start, end string, ongoing bool) Episode {
+		return Episode{City: "Berlin", Kind: "heatwave", Start: start, End: end, Ongoing: ongoing}
+	}
+	tests := []struct {
+		name       string
+		stored     []Episode
+		detected   []Episode
+		wantStarts []string
+		wantPrev   []string
+		wantStale  []string
+	}{
+		{
+			name:       "new episode",
+			detected:   []Episode{episode("2024-07-02", "2024-07-04", true)},
+			wantStarts: []string{"2024-07-02"},
+			wantPrev:   []string{""},
+		},
+		{
+			name:       "same episode",
+			stored:     []Episode{episode("2024-07-02", "2024-07-04", true)},
+			detected:   []Episode{episode("2024-07-02", "2024-07-05", true)},
+			wantStarts: []string{"2024-07-02"},
+			wantPrev:   []string{"2024-07-02"},
+		},
+		{
+			name:       "start moved earlier by a late reading",
+			stored:     []Episode{episode("2024-07-02", "2024-07-04", true)},
+			detected:   []Episode{episode("2024-07-01", "2024-07-04", true)},
+			wantStarts: []string{"2024-07-01"},
+			wantPrev:   []string{"2024-07-02"},
+		},
+		{
+			name:      "threshold moved and the episode is gone",
+			stored:    []Episode{episode("2024-07-02", "2024-07-04", false)},
+			wantStale: []string{"2024-07-02"},
+		},
+		{
+			name:       "episode from before the window is extended",
+			stored:     []Episode{episode("2023-06-01", "2023-06-05", true)},
+			detected:   []Episode{episode("2023-06-03", "2023-06-06", true)},
+			wantStarts: []string{"2023-06-01"},
+			wantPrev:   []string{"2023-06-01"},
+		},
+		{
+			name:       "episode from before the window ends",
+			stored:     []Episode{episode("2023-06-01", "2023-06-05", true)},
+			wantStarts: []string{"2023-06-01"},
+			wantPrev:   []string{"2023-06-01"},
+		},
+	}
+	for _, tt := range tests {
+		changes, stale := reconcileEpisodes(tt.stored, tt.detected, "2023-06-03")
+		var starts, prev, staleStarts []string
+		for _, c := range changes {
+			starts = append(starts, c.Episode.Start)
+			if c.Previous == nil {
+				prev = append(prev, "")
+			} else {
+				prev = append(prev, c.Previous.Start)
+			}
+		}
+		for _, s := range stale {
+			staleStarts = append(staleStarts, s.Start)
+		}
+		if !reflect.DeepEqual(starts, tt.wantStarts) || !reflect.DeepEqual(prev, tt.wantPrev) || !reflect.DeepEqual(staleStarts, tt.wantStale) {
+			t.Errorf("%s: stored %v, previous %v, stale %v", tt.name, starts, prev, staleStarts)
+		}
+	}
+
+	// The shifted episode replaces the stored one, and the extension keeps the
+	// earlier start with the new end
+	changes, _ := reconcileEpisodes([]Episode{episode("2024-07-02", "2024-07-04", true)}, []Episode{episode("2024-07-01", "2024-07-04", true)}, "2023-06-03")
+	if len(changes[0].Replaces) != 1 || changes[0].Replaces[0].Start != "2024-07-02" {
+		t.Errorf("shifted episode replaces %+v", changes[0].Replaces)
+	}
+	changes, _ = reconcileEpisodes([]Episode{episode("2023-06-01", "2023-06-05", true)}, []Episode{episode("2023-06-03", "2023-06-06", false)}, "2023-06-03")
+	if got := changes[0].Episode; got.End != "2023-06-06" || got.Days != 6 || got.Ongoing || !changes[0].Previous.Ongoing {
+		t.Errorf("extended episode %+v", got)
+	}
+	changes, _ = reconcileEpisodes([]Episode{episode("2023-06-01", "2023-06-05", true)}, nil, "2023-06-03")
+	if changes[0].Episode.Ongoing {
+		t.Errorf("episode from before the window still ongoing: %+v", changes[0].Episode)
+	}
+}
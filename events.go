@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Write events. These are the only things appended to the event log; everything
+// else in the store is a projection of them.
+const (
+	EventFetch  = "fetch"
+	EventDelete = "delete"
+	EventImport = "import" // a city stored before the event log existed
+	EventRetag  = "retag"
+)
+
+// Derived events are published to subscribers but never stored in the event log.
+const (
+	EventEpisodeStarted = "episode.started"
+	EventEpisodeEnded   = "episode.ended"
+	EventRecordBroken   = "record.broken"
+	EventSLOFastBurn    = "slo.fast_burn"
+)
+
+type Event struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Type string             `bson:"type" json:"type"`
+	City string             `bson:"city" json:"city"`
+	Data *WeatherData       `bson:"data,omitempty" json:"data,omitempty"`
+	Tags []string           `bson:"tags,omitempty" json:"tags,omitempty"` // the full tag set after a retag
+	Time time.Time          `bson:"time" json:"time"`
+
+	Payload any `bson:"-" json:"payload,omitempty"`
+}
+
+var eventsCollection *mongo.Collection
+
+var (
+	subscribersMu sync.RWMutex
+	subscribers   []func(Event)
+)
+
+// replaying is set while projections are rebuilt so derived events are not re-sent.
+var replaying atomic.Bool
+
+// subscribe registers fn to be called for every recorded or derived event.
+func subscribe(fn func(Event)) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	subscribers = append(subscribers, fn)
+}
+
+func publish(ev Event) {
+	if replaying.Load() {
+		return
+	}
+	subscribersMu.RLock()
+	defer subscribersMu.RUnlock()
+	for _, fn := range subscribers {
+		fn(ev)
+	}
+}
+
+// recordEvent appends ev to the event log, applies it to every projection and
+// then publishes it to subscribers.
+func recordEvent(ctx context.Context, ev Event) (Event, error) {
+	if readOnly.Load() {
+		return ev, errReadOnly
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ev.ID = primitive.NewObjectID()
+	if _, err := eventsCollection.InsertOne(ctx, ev); err != nil {
+		return ev, fmt.Errorf("failed to record event: %w", err)
+	}
+	if err := applyProjections(ctx, ev); err != nil {
+		// The event is already durable; a rebuild will bring the projections back in line.
+		return ev, err
+	}
+	publish(ev)
+	return ev, nil
+}
+
+// rebuildProjections drops every projection and replays the event log into them.
+// Cities stored before the event log existed are imported first, as they would
+// otherwise be lost with the weather collection.
+func rebuildProjections(ctx context.Context) (int, error) {
+	imported, err := importLegacyCities(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if imported > 0 {
+		log.Printf("Imported %d cities into the event log", imported)
+	}
+
+	replaying.Store(true)
+	defer replaying.Store(false)
+
+	for _, p := range projections {
+		if err := p.collection.Drop(ctx); err != nil {
+			return 0, fmt.Errorf("failed to drop %s projection: %w", p.name, err)
+		}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := eventsCollection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read event log: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	count := 0
+	for cursor.Next(ctx) {
+		var ev Event
+		if err := cursor.Decode(&ev); err != nil {
+			return count, fmt.Errorf("failed to decode event: %w", err)
+		}
+		if err := applyProjections(ctx, ev); err != nil {
+			return count, err
+		}
+		count++
+		if count%1000 == 0 {
+			log.Printf("Replayed %d events", count)
+		}
+	}
+	return count, cursor.Err()
+}
+
+// unmigratedCities returns the stored cities that have no events, i.e. data written
+// before the event log existed.
+func unmigratedCities(ctx context.Context) ([]WeatherData, error) {
+	logged, err := eventsCollection.Distinct(ctx, "city", bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read event log: %w", err)
+	}
+	cursor, err := weatherCollection.Find(ctx, bson.M{"city": bson.M{"$nin": logged}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read weather data: %w", err)
+	}
+	var cities []WeatherData
+	if err := cursor.All(ctx, &cities); err != nil {
+		return nil, fmt.Errorf("failed to read weather data: %w", err)
+	}
+	return cities, nil
+}
+
+// importLegacyCities records an import event for every unmigrated city.
+func importLegacyCities(ctx context.Context) (int, error) {
+	cities, err := unmigratedCities(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for i, weather := range cities {
+		weather := weather
+		if _, err := recordEvent(ctx, Event{Type: EventImport, City: weather.City, Data: &weather, Time: weather.LastUpdated}); err != nil {
+			return i, fmt.Errorf("failed to import %s: %w", weather.City, err)
+		}
+	}
+	return len(cities), nil
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportJob is one entry of the EXPORT_CONFIG file. Cities, Tags and Tenant pick
+// the readings; empty means all of them.
+type exportJob struct {
+	Name        string   `json:"name"`
+	Schedule    string   `json:"schedule"`
+	Format      string   `json:"format"`  // csv, ndjson or parquet
+	Dataset     string   `json:"dataset"` // history (default) or current
+	Cities      []string `json:"cities,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Tenant      string   `json:"tenant,omitempty"`
+	Destination string   `json:"destination"` // a directory, file:///dir or s3://bucket/prefix
+
+	schedule *cronSchedule
+}
+
+type ExportFile struct {
+	Path      string `bson:"path" json:"path"`
+	Partition string `bson:"partition" json:"partition"`
+	Rows      int    `bson:"rows" json:"rows"`
+	Bytes     int    `bson:"bytes" json:"bytes"`
+	SHA256    string `bson:"sha256" json:"sha256"`
+}
+
+// ExportRun is the history entry of one run, keyed by job and scheduled minute so
+// only one replica performs each run.
+type ExportRun struct {
+	ID           string       `bson:"_id" json:"id"`
+	Job          string       `bson:"job" json:"job"`
+	ScheduledFor time.Time    `bson:"scheduled_for" json:"scheduled_for"`
+	StartedAt    time.Time    `bson:"started_at" json:"started_at"`
+	FinishedAt   time.Time    `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+	Status       string       `bson:"status" json:"status"`
+	From         time.Time    `bson:"from" json:"from"`
+	To           time.Time    `bson:"to" json:"to"`
+	Rows         int          `bson:"rows" json:"rows"`
+	Files        []ExportFile `bson:"files" json:"files"`
+	Manifest     string       `bson:"manifest,omitempty" json:"manifest,omitempty"`
+	Error        string       `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+const (
+	exportRunning   = "running"
+	exportSucceeded = "succeeded"
+	exportFailed    = "failed"
+
+	exportTimeout = 10 * time.Minute
+	// Replicas not owning a job run it once it is this late
+	exportTakeover = time.Minute
+	// How far back the first run of a history export reaches
+	exportInitialWindow = 24 * time.Hour
+)
+
+var (
+	exportJobs           []*exportJob
+	exportRunsCollection *mongo.Collection
+
+	errExportClaimed = errors.New("run already claimed")
+)
+
+var exportFormats = map[string]struct {
+	ext         string
+	contentType string
+	encode      func([]WeatherData) ([]byte, error)
+}{
+	"csv":     {"csv", "text/csv", encodeExportCSV},
+	"ndjson":  {"ndjson", "application/x-ndjson", encodeExportNDJSON},
+	"parquet": {"parquet", "application/vnd.apache.parquet", encodeExportParquet},
+}
+
+func loadExportConfig(path string) error {
+	if path == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read export config: %w", err)
+	}
+	var jobs []*exportJob
+	if err := json.Unmarshal(raw, &jobs); err != nil {
+		return fmt.Errorf("failed to parse export config: %w", err)
+	}
+	seen := map[string]bool{}
+	for _, job := range jobs {
+		if job.Name == "" || strings.ContainsAny(job.Name, "/@") || seen[job.Name] {
+			return fmt.Errorf("export %q: names must be unique and not contain / or @", job.Name)
+		}
+		seen[job.Name] = true
+		if job.schedule, err = parseCron(job.Schedule); err != nil {
+			return fmt.Errorf("export %q: %w", job.Name, err)
+		}
+		if _, ok := exportFormats[job.Format]; !ok {
+			return fmt.Errorf("export %q: format must be csv, ndjson or parquet", job.Name)
+		}
+		if job.Dataset == "" {
+			job.Dataset = "history"
+		}
+		if job.Dataset != "history" && job.Dataset != "current" {
+			return fmt.Errorf("export %q: dataset must be history or current", job.Name)
+		}
+		if _, err := openExportSink(job.Destination); err != nil {
+			return fmt.Errorf("export %q: %w", job.Name, err)
+		}
+	}
+	exportJobs = jobs
+	return nil
+}
+
+// exportSink stores export files under keys relative to the destination.
+type exportSink interface {
+	Put(ctx context.Context, key string, body []byte, contentType string) error
+}
+
+type dirSink struct{ root string }
+
+// Put writes to a temporary file first so readers never see a partial export.
+func (s dirSink) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	path := filepath.Join(s.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, body, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+type s3Sink struct {
+	client         *s3Client
+	bucket, prefix string
+}
+
+func (s s3Sink) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	return s.client.PutObject(ctx, s.bucket, strings.TrimPrefix(s.prefix+"/"+key, "/"), body, contentType)
+}
+
+func openExportSink(destination string) (exportSink, error) {
+	switch {
+	case destination == "":
+		return nil, fmt.Errorf("destination is required")
+	case strings.HasPrefix(destination, "s3://"):
+		u, err := url.Parse(destination)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("destination %q must look like s3://bucket/prefix", destination)
+		}
+		client, err := newS3ClientFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return s3Sink{client: client, bucket: u.Host, prefix: strings.Trim(u.Path, "/")}, nil
+	case strings.HasPrefix(destination, "file://"):
+		return dirSink{root: strings.TrimPrefix(destination, "file://")}, nil
+	}
+	return dirSink{root: destination}, nil
+}
+
+var exportColumns = []string{"city", "country", "lat", "lon", "description", "temp", "wind", "precip", "tags", "tenant", "provider", "route", "last_updated"}
+
+func encodeExportCSV(readings []WeatherData) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(exportColumns)
+	for _, r := range readings {
+		w.Write([]string{
+			r.City, r.Country,
+			strconv.FormatFloat(r.Lat, 'f', -1, 64), strconv.FormatFloat(r.Lon, 'f', -1, 64),
+			r.Description,
+			strconv.FormatFloat(r.Temp, 'f', -1, 64), strconv.FormatFloat(r.Wind, 'f', -1, 64), strconv.FormatFloat(r.Precip, 'f', -1, 64),
+			strings.Join(r.Tags, ";"), r.Tenant, r.Provider, r.Route,
+			r.LastUpdated.UTC().Format(time.RFC3339),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func encodeExportNDJSON(readings []WeatherData) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range readings {
+		if err := enc.Encode(r); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeExportParquet(readings []WeatherData) ([]byte, error) {
+	w := newParquetWriter(
+		parquetColumn{Name: "city", Type: parquetByteArray},
+		parquetColumn{Name: "country", Type: parquetByteArray},
+		parquetColumn{Name: "lat", Type: parquetDouble},
+		parquetColumn{Name: "lon", Type: parquetDouble},
+		parquetColumn{Name: "description", Type: parquetByteArray},
+		parquetColumn{Name: "temp", Type: parquetDouble},
+		parquetColumn{Name: "wind", Type: parquetDouble},
+		parquetColumn{Name: "precip", Type: parquetDouble},
+		parquetColumn{Name: "tags", Type: parquetByteArray},
+		parquetColumn{Name: "tenant", Type: parquetByteArray},
+		parquetColumn{Name: "provider", Type: parquetByteArray},
+		parquetColumn{Name: "route", Type: parquetByteArray},
+		parquetColumn{Name: "last_updated", Type: parquetInt64},
+	)
+	for _, r := range readings {
+		w.Append(r.City, r.Country, r.Lat, r.Lon, r.Description, r.Temp, r.Wind, r.Precip,
+			strings.Join(r.Tags, ";"), r.Tenant, r.Provider, r.Route, r.LastUpdated)
+	}
+	return w.Bytes(), nil
+}
+
+func (job *exportJob) selects(r WeatherData) bool {
+	if job.Tenant != "" && r.Tenant != job.Tenant {
+		return false
+	}
+	if len(job.Tags) == 0 {
+		return true
+	}
+	for _, tag := range job.Tags {
+		if containsFold(r.Tags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectExport loads the job's readings: history in [from, to), or the current
+// reading of every selected city.
+func collectExport(ctx context.Context, job *exportJob, from, to time.Time) ([]WeatherData, error) {
+	filter := bson.M{}
+	if len(job.Cities) > 0 {
+		filter["city"] = bson.M{"$in": job.Cities}
+	}
+	var readings []WeatherData
+	if job.Dataset == "current" {
+		cursor, err := weatherCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"city": 1}))
+		if err != nil {
+			return nil, err
+		}
+		var current []WeatherData
+		if err := cursor.All(ctx, &current); err != nil {
+			return nil, err
+		}
+		for _, r := range current {
+			if job.selects(r) {
+				readings = append(readings, r)
+			}
+		}
+		return readings, nil
+	}
+	err := scanHistory(ctx, filter, from, to, func(r WeatherData) error {
+		if job.selects(r) {
+			readings = append(readings, r)
+		}
+		return nil
+	})
+	return readings, err
+}
+
+// runExport performs one run: it claims the run, writes one file per UTC day
+// partition (dt=YYYY-MM-DD) and then a manifest listing them. History exports
+// continue from where the last successful run stopped.
+func runExport(ctx context.Context, job *exportJob, scheduled time.Time) (ExportRun, error) {
+	stamp := scheduled.UTC().Format("20060102T1504Z")
+	run := ExportRun{
+		ID:           job.Name + "@" + stamp,
+		Job:          job.Name,
+		ScheduledFor: scheduled,
+		StartedAt:    time.Now(),
+		Status:       exportRunning,
+		From:         scheduled.Add(-exportInitialWindow),
+		To:           scheduled,
+		Files:        []ExportFile{},
+	}
+	var last ExportRun
+	err := exportRunsCollection.FindOne(ctx, bson.M{"job": job.Name, "status": exportSucceeded},
+		options.FindOne().SetSort(bson.M{"to": -1})).Decode(&last)
+	if err == nil && last.To.Before(run.To) {
+		run.From = last.To
+	}
+	if _, err := exportRunsCollection.InsertOne(ctx, run); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return run, errExportClaimed
+		}
+		return run, err
+	}
+
+	err = writeExport(ctx, job, &run, stamp)
+	run.FinishedAt = time.Now()
+	run.Status = exportSucceeded
+	if err != nil {
+		run.Status = exportFailed
+		run.Error = err.Error()
+	}
+	if _, updateErr := exportRunsCollection.ReplaceOne(ctx, bson.M{"_id": run.ID}, run); updateErr != nil && err == nil {
+		err = updateErr
+	}
+	return run, err
+}
+
+func writeExport(ctx context.Context, job *exportJob, run *ExportRun, stamp string) error {
+	sink, err := openExportSink(job.Destination)
+	if err != nil {
+		return err
+	}
+	readings, err := collectExport(ctx, job, run.From, run.To)
+	if err != nil {
+		return err
+	}
+
+	partitions := map[string][]WeatherData{}
+	for _, r := range readings {
+		day := r.LastUpdated.UTC().Format(dayLayout)
+		if job.Dataset == "current" {
+			day = run.ScheduledFor.UTC().Format(dayLayout)
+		}
+		partitions[day] = append(partitions[day], r)
+	}
+	days := make([]string, 0, len(partitions))
+	for day := range partitions {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+
+	format := exportFormats[job.Format]
+	for _, day := range days {
+		body, err := format.encode(partitions[day])
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s/dt=%s/part-%s.%s", job.Name, day, stamp, format.ext)
+		if err := sink.Put(ctx, key, body, format.contentType); err != nil {
+			return err
+		}
+		run.Files = append(run.Files, ExportFile{
+			Path:      key,
+			Partition: "dt=" + day,
+			Rows:      len(partitions[day]),
+			Bytes:     len(body),
+			SHA256:    sha256Hex(body),
+		})
+		run.Rows += len(partitions[day])
+	}
+
+	// The manifest goes last: once it exists, every file it lists is complete
+	manifest, err := json.MarshalIndent(struct {
+		Run     string       `json:"run"`
+		Job     string       `json:"job"`
+		Format  string       `json:"format"`
+		Dataset string       `json:"dataset"`
+		Columns []string     `json:"columns"`
+		From    time.Time    `json:"from"`
+		To      time.Time    `json:"to"`
+		Rows    int          `json:"rows"`
+		Files   []ExportFile `json:"files"`
+	}{run.ID, job.Name, job.Format, job.Dataset, exportColumns, run.From, run.To, run.Rows, run.Files}, "", "  ")
+	if err != nil {
+		return err
+	}
+	run.Manifest = fmt.Sprintf("%s/_manifests/%s.json", job.Name, stamp)
+	return sink.Put(ctx, run.Manifest, manifest, "application/json")
+}
+
+// runExportScheduler starts each job at its cron times. Runs missed while the
+// service was down are skipped rather than replayed.
+func runExportScheduler() {
+	if len(exportJobs) == 0 {
+		return
+	}
+	next := map[*exportJob]time.Time{}
+	for _, job := range exportJobs {
+		next[job] = job.schedule.Next(time.Now())
+	}
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		// Runs due during maintenance wait until writes resume
+		if readOnly.Load() {
+			continue
+		}
+		for _, job := range exportJobs {
+			due := next[job]
+			if due.IsZero() || now.Before(due) {
+				continue
+			}
+			// The replica owning the job runs it; the others only step in when it is late
+			if !ownsKey("export:"+job.Name) && now.Sub(due) < exportTakeover {
+				continue
+			}
+			next[job] = job.schedule.Next(now)
+			ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+			run, err := runExport(ctx, job, due)
+			cancel()
+			switch {
+			case err == errExportClaimed:
+			case err != nil:
+				log.Printf("Export %s failed: %v", run.ID, err)
+			default:
+				log.Printf("Export %s wrote %d rows in %d files", run.ID, run.Rows, len(run.Files))
+			}
+		}
+	}
+}
+
+type exportStatus struct {
+	Name        string      `json:"name"`
+	Schedule    string      `json:"schedule"`
+	Format      string      `json:"format"`
+	Dataset     string      `json:"dataset"`
+	Destination string      `json:"destination"`
+	NextRun     time.Time   `json:"next_run"`
+	Runs        []ExportRun `json:"runs"`
+}
+
+// exportsHandler lists the configured exports with their recent runs (GET,
+// ?job= for one job) or starts a run now (POST ?job=).
+func exportsHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("job")
+	var selected []*exportJob
+	for _, job := range exportJobs {
+		if name == "" || job.Name == name {
+			selected = append(selected, job)
+		}
+	}
+	if name != "" && len(selected) == 0 {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		limit := int64(5)
+		if name != "" {
+			limit = 50
+		}
+		statuses := []exportStatus{}
+		for _, job := range selected {
+			cursor, err := exportRunsCollection.Find(ctx, bson.M{"job": job.Name},
+				options.Find().SetSort(bson.M{"scheduled_for": -1}).SetLimit(limit))
+			if err != nil {
+				http.Error(w, "Failed to load export runs", http.StatusInternalServerError)
+				return
+			}
+			runs := []ExportRun{}
+			if err := cursor.All(ctx, &runs); err != nil {
+				http.Error(w, "Failed to load export runs", http.StatusInternalServerError)
+				return
+			}
+			statuses = append(statuses, exportStatus{
+				Name:        job.Name,
+				Schedule:    job.Schedule,
+				Format:      job.Format,
+				Dataset:     job.Dataset,
+				Destination: job.Destination,
+				NextRun:     job.schedule.Next(time.Now()),
+				Runs:        runs,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statuses)
+	case http.MethodPost:
+		if name == "" {
+			http.Error(w, "job parameter is required", http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		defer cancel()
+		run, err := runExport(ctx, selected[0], time.Now().UTC().Truncate(time.Minute))
+		switch {
+		case err == errExportClaimed:
+			http.Error(w, "A run of this export already started this minute", http.StatusConflict)
+			return
+		case err != nil && run.FinishedAt.IsZero():
+			http.Error(w, "Failed to start export", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if run.Status == exportFailed {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		json.NewEncoder(w).Encode(run)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ForecastValue is one variable at one forecast hour. Deterministic providers only
+// set Value; ensemble providers also give percentiles over their members and, when
+// every member has data for the hour, the member values in member order.
+type ForecastValue struct {
+	Value   float64   `bson:"value" json:"value"`
+	P10     *float64  `bson:"p10,omitempty" json:"p10,omitempty"`
+	P50     *float64  `bson:"p50,omitempty" json:"p50,omitempty"`
+	P90     *float64  `bson:"p90,omitempty" json:"p90,omitempty"`
+	Members []float64 `bson:"members,omitempty" json:"members,omitempty"`
+}
+
+type ForecastHour struct {
+	Time         time.Time     `bson:"time" json:"time"`
+	Temp         ForecastValue `bson:"temp" json:"temp"`
+	Wind         ForecastValue `bson:"wind" json:"wind"`
+	Precip       ForecastValue `bson:"precip" json:"precip"`
+	PrecipChance *float64      `bson:"precip_chance,omitempty" json:"precip_chance,omitempty"` // 0-1, when the provider gives one
+	Description  string        `bson:"description,omitempty" json:"description,omitempty"`
+}
+
+// ForecastMinute is expected precipitation in mm/h for one minute of the next hour.
+type ForecastMinute struct {
+	Time   time.Time `bson:"time" json:"time"`
+	Precip float64   `bson:"precip" json:"precip"`
+}
+
+type ForecastDay struct {
+	Day          string  `bson:"day" json:"day"`
+	MinTemp      float64 `bson:"min_temp" json:"min_temp"`
+	MaxTemp      float64 `bson:"max_temp" json:"max_temp"`
+	Wind         float64 `bson:"wind" json:"wind"`
+	Precip       float64 `bson:"precip" json:"precip"`
+	PrecipChance float64 `bson:"precip_chance" json:"precip_chance"`
+	Description  string  `bson:"description,omitempty" json:"description,omitempty"`
+	Summary      string  `bson:"summary,omitempty" json:"summary,omitempty"`
+}
+
+// Warning is an official weather alert issued for the forecast's location.
+type Warning struct {
+	Sender      string    `bson:"sender" json:"sender"`
+	Event       string    `bson:"event" json:"event"`
+	Start       time.Time `bson:"start" json:"start"`
+	End         time.Time `bson:"end" json:"end"`
+	Description string    `bson:"description,omitempty" json:"description,omitempty"`
+	Tags        []string  `bson:"tags,omitempty" json:"tags,omitempty"`
+}
+
+// Forecast is the latest forecast fetched for a city; each fetch replaces it.
+// Minutes, Days and Warnings are only set by providers that have them.
+type Forecast struct {
+	City      string           `bson:"_id" json:"city"`
+	Provider  string           `bson:"provider" json:"provider"`
+	Route     string           `bson:"route" json:"route"`
+	Lat       float64          `bson:"lat" json:"lat"`
+	Lon       float64          `bson:"lon" json:"lon"`
+	Members   int              `bson:"members,omitempty" json:"members,omitempty"`
+	Issued    time.Time        `bson:"issued" json:"issued"`
+	Requested int              `bson:"requested" json:"-"` // hours asked for, which may be more than the provider has
+	Hours     []ForecastHour   `bson:"hours" json:"hours"`
+	Minutes   []ForecastMinute `bson:"minutes,omitempty" json:"minutes,omitempty"`
+	Days      []ForecastDay    `bson:"days,omitempty" json:"days,omitempty"`
+	Warnings  []Warning        `bson:"warnings,omitempty" json:"warnings,omitempty"`
+}
+
+// ForecastProvider is implemented by providers that can forecast hourly weather.
+type ForecastProvider interface {
+	Forecast(loc Location, hours int) (Forecast, error)
+}
+
+// EventForecastUpdated is published with the new Forecast as payload whenever a
+// city's forecast is fetched.
+const EventForecastUpdated = "forecast.updated"
+
+const (
+	forecastHoursPerDay  = 24
+	forecastDefaultHours = 48
+	forecastMaxHours     = 16 * forecastHoursPerDay
+	forecastMaxAge       = time.Hour
+)
+
+var forecastsCollection *mongo.Collection
+
+var errNoForecastProvider = errors.New("no forecast provider serves this city")
+
+// ensembleValue summarises one hour of member values. Members missing data are
+// left out of the percentiles, and the member list is only kept when complete so
+// member i means the same run at every hour.
+func ensembleValue(values []*float64) ForecastValue {
+	present := make([]float64, 0, len(values))
+	for _, v := range values {
+		if v != nil {
+			present = append(present, *v)
+		}
+	}
+	switch len(present) {
+	case 0:
+		return ForecastValue{}
+	case 1:
+		return ForecastValue{Value: present[0]}
+	}
+	p10, p50, p90 := percentile(present, 10), percentile(present, 50), percentile(present, 90)
+	value := ForecastValue{Value: p50, P10: &p10, P50: &p50, P90: &p90}
+	if len(present) == len(values) {
+		value.Members = present
+	}
+	return value
+}
+
+// FetchForecast asks each routed provider that can forecast until one succeeds.
+func (r *Router) FetchForecast(loc Location, hours int) (Forecast, error) {
+	route, providers := r.Route(loc)
+	var errs []error
+	for _, p := range providers {
+		fp, ok := p.(ForecastProvider)
+		if !ok {
+			continue
+		}
+		upstreamLimiter.start()
+		start := time.Now()
+		forecast, err := fp.Forecast(loc, hours)
+		upstreamLimiter.finish(time.Since(start), err != nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+			continue
+		}
+		forecast.City = loc.City
+		forecast.Provider = p.Name()
+		forecast.Route = route
+		return forecast, nil
+	}
+	if len(errs) == 0 {
+		return Forecast{}, errNoForecastProvider
+	}
+	return Forecast{}, errors.Join(errs...)
+}
+
+// refreshForecast fetches and stores a forecast for a stored city, then publishes
+// it. It does not go through the event log: forecasts are replaced, not replayed.
+func refreshForecast(ctx context.Context, stored WeatherData, hours int) (Forecast, error) {
+	loc := Location{City: stored.City, Country: stored.Country, Tags: stored.Tags, Tenant: stored.Tenant}
+	if stored.Lat != 0 || stored.Lon != 0 {
+		loc.Lat, loc.Lon, loc.HasPos = stored.Lat, stored.Lon, true
+	}
+	forecast, err := router.FetchForecast(loc, hours)
+	if errors.Is(err, errNoForecastProvider) {
+		return Forecast{}, err
+	} else if err != nil {
+		return Forecast{}, fmt.Errorf("%w: %v", errFetchFailed, err)
+	}
+	forecast.Issued = time.Now()
+	forecast.Requested = hours
+	if _, err := forecastsCollection.ReplaceOne(ctx, bson.M{"_id": forecast.City}, forecast, options.Replace().SetUpsert(true)); err != nil {
+		return Forecast{}, err
+	}
+	publish(Event{Type: EventForecastUpdated, City: forecast.City, Time: forecast.Issued, Payload: forecast})
+	return forecast, nil
+}
+
+// loadForecast returns a forecast for city covering at least hours from now,
+// fetching a new one when the stored one is too old or too short. During
+// maintenance the stored forecast is served however old it is.
+func loadForecast(ctx context.Context, city string, hours int) (Forecast, error) {
+	var stored WeatherData
+	if err := weatherCollection.FindOne(ctx, bson.M{"city": city}).Decode(&stored); err != nil {
+		return Forecast{}, err
+	}
+	var forecast Forecast
+	err := forecastsCollection.FindOne(ctx, bson.M{"_id": city}).Decode(&forecast)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return Forecast{}, err
+	}
+	// A forecast shorter than what was asked for is all the provider has, so
+	// asking again for as many hours would not get more
+	upcoming := len(upcomingHours(forecast.Hours, time.Now()))
+	covered := upcoming >= hours || forecast.Requested >= hours && len(forecast.Hours) < forecast.Requested
+	if err == nil && (readOnly.Load() || time.Since(forecast.Issued) < forecastMaxAge && covered) {
+		return forecast, nil
+	}
+	if readOnly.Load() {
+		return Forecast{}, errReadOnly
+	}
+	return refreshForecast(ctx, stored, hours)
+}
+
+// upcomingHours drops the hours that ended before now.
+func upcomingHours(hours []ForecastHour, now time.Time) []ForecastHour {
+	for i, hour := range hours {
+		if hour.Time.Add(time.Hour).After(now) {
+			return hours[i:]
+		}
+	}
+	return nil
+}
+
+func writeForecastError(w http.ResponseWriter, err error) {
+	switch {
+	case err == mongo.ErrNoDocuments:
+		http.Error(w, "Weather data not found", http.StatusNotFound)
+	case errors.Is(err, errReadOnly):
+		refuseWrite(w)
+	case errors.Is(err, errNoForecastProvider):
+		http.Error(w, "No forecast provider is configured for this city", http.StatusNotImplemented)
+	case errors.Is(err, errFetchFailed):
+		log.Println("Failed to fetch forecast:", err)
+		http.Error(w, "Failed to fetch forecast", http.StatusBadGateway)
+	default:
+		log.Println("Failed to load forecast:", err)
+		http.Error(w, "Failed to load forecast", http.StatusInternalServerError)
+	}
+}
+
+// forecastHandler serves the next ?hours= (default 48) of a city's forecast.
+// Member values are left out unless ?members=true.
+func forecastHandler(w http.ResponseWriter, r *http.Request) {
+	city := r.URL.Query().Get("city")
+	if city == "" {
+		http.Error(w, "City parameter is required", http.StatusBadRequest)
+		return
+	}
+	hours := forecastDefaultHours
+	if raw := r.URL.Query().Get("hours"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > forecastMaxHours {
+			http.Error(w, fmt.Sprintf("hours must be between 1 and %d", forecastMaxHours), http.StatusBadRequest)
+			return
+		}
+		hours = parsed
+	}
+	withMembers := r.URL.Query().Get("members") == "true"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	forecast, err := loadForecast(ctx, city, hours)
+	if err != nil {
+		writeForecastError(w, err)
+		return
+	}
+
+	forecast.Hours = upcomingHours(forecast.Hours, time.Now())
+	if len(forecast.Hours) > hours {
+		forecast.Hours = forecast.Hours[:hours]
+	}
+	if !withMembers {
+		for i := range forecast.Hours {
+			forecast.Hours[i].Temp.Members = nil
+			forecast.Hours[i].Wind.Members = nil
+			forecast.Hours[i].Precip.Members = nil
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(forecast)
+}
+
+var forecastVariables = map[string]func(ForecastHour) ForecastValue{
+	"temp":   func(h ForecastHour) ForecastValue { return h.Temp },
+	"wind":   func(h ForecastHour) ForecastValue { return h.Wind },
+	"precip": func(h ForecastHour) ForecastValue { return h.Precip },
+}
+
+var thresholdOps = map[string]func(v, threshold float64) bool{
+	"lt": func(v, t float64) bool { return v < t },
+	"le": func(v, t float64) bool { return v <= t },
+	"gt": func(v, t float64) bool { return v > t },
+	"ge": func(v, t float64) bool { return v >= t },
+}
+
+// forecastWindow turns ?when=today|tomorrow|next24h, or ?from=&to=, into a time
+// range. Days are UTC like the daily aggregates.
+func forecastWindow(q map[string][]string, now time.Time) (time.Time, time.Time, error) {
+	get := func(key string) string {
+		if values := q[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	if from, to := get("from"), get("to"); from != "" || to != "" {
+		start, err := parseQueryTime(from)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		end, err := parseQueryTime(to)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		if !end.After(start) {
+			return time.Time{}, time.Time{}, fmt.Errorf("to must be after from")
+		}
+		return start, end, nil
+	}
+	today := now.UTC().Truncate(24 * time.Hour)
+	switch get("when") {
+	case "", "next24h":
+		return now, now.Add(24 * time.Hour), nil
+	case "today":
+		return today, today.AddDate(0, 0, 1), nil
+	case "tomorrow":
+		return today.AddDate(0, 0, 1), today.AddDate(0, 0, 2), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("when must be today, tomorrow or next24h")
+}
+
+type hourlyProbability struct {
+	Time        time.Time `json:"time"`
+	Probability float64   `json:"probability"`
+}
+
+// forecastProbabilityHandler answers questions like "chance temp < 0 tomorrow":
+// ?city=&variable=temp&op=lt&threshold=0&when=tomorrow. The window probability is
+// the share of ensemble members for which the condition holds in at least one
+// hour of the window; each hour also gets its own probability. Forecasts without
+// members can only answer 0 or 1.
+func forecastProbabilityHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	city := q.Get("city")
+	if city == "" {
+		http.Error(w, "City parameter is required", http.StatusBadRequest)
+		return
+	}
+	variable, ok := forecastVariables[q.Get("variable")]
+	if !ok {
+		http.Error(w, "variable must be temp, wind or precip", http.StatusBadRequest)
+		return
+	}
+	op, ok := thresholdOps[q.Get("op")]
+	if !ok {
+		http.Error(w, "op must be lt, le, gt or ge", http.StatusBadRequest)
+		return
+	}
+	threshold, err := strconv.ParseFloat(q.Get("threshold"), 64)
+	if err != nil {
+		http.Error(w, "threshold must be a number", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	from, to, err := forecastWindow(q, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if to.Before(now) || to.After(now.Add(forecastMaxHours*time.Hour)) {
+		http.Error(w, "window must lie within the forecast range", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	forecast, err := loadForecast(ctx, city, int(to.Sub(now).Hours())+1)
+	if err != nil {
+		writeForecastError(w, err)
+		return
+	}
+
+	method, probability, hourly := windowProbability(forecast, variable, op, threshold, from, to)
+	if len(hourly) == 0 {
+		http.Error(w, "Forecast does not cover the window", http.StatusUnprocessableEntity)
+		return
+	}
+
+	response := struct {
+		City        string              `json:"city"`
+		Variable    string              `json:"variable"`
+		Op          string              `json:"op"`
+		Threshold   float64             `json:"threshold"`
+		From        time.Time           `json:"from"`
+		To          time.Time           `json:"to"`
+		Method      string              `json:"method"`
+		Members     int                 `json:"members,omitempty"`
+		Probability float64             `json:"probability"`
+		Hourly      []hourlyProbability `json:"hourly"`
+		Issued      time.Time           `json:"issued"`
+		Provider    string              `json:"provider"`
+	}{city, q.Get("variable"), q.Get("op"), threshold, from, to, method, forecast.Members, probability, hourly, forecast.Issued, forecast.Provider}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// windowProbability is the chance that op(variable, threshold) holds in at least
+// one hour of [from, to), with the probability of each hour in the window.
+func windowProbability(forecast Forecast, variable func(ForecastHour) ForecastValue, op func(v, threshold float64) bool, threshold float64, from, to time.Time) (string, float64, []hourlyProbability) {
+	hourly := []hourlyProbability{}
+	var members []bool // members[i] is whether member i met the condition in the window
+	complete, medianMet := true, false
+	for _, hour := range forecast.Hours {
+		if hour.Time.Before(from) || !hour.Time.Before(to) {
+			continue
+		}
+		value := variable(hour)
+		medianMet = medianMet || op(value.Value, threshold)
+		if forecast.Members == 0 || len(value.Members) != forecast.Members {
+			complete = false
+			hourly = append(hourly, hourlyProbability{Time: hour.Time, Probability: boolProbability(op(value.Value, threshold))})
+			continue
+		}
+		if members == nil {
+			members = make([]bool, len(value.Members))
+		}
+		met := 0
+		for i, v := range value.Members {
+			if op(v, threshold) {
+				members[i] = true
+				met++
+			}
+		}
+		hourly = append(hourly, hourlyProbability{Time: hour.Time, Probability: float64(met) / float64(len(value.Members))})
+	}
+
+	// Without every member at every hour there is no telling which runs met the
+	// condition somewhere in the window, so the window falls back to the median
+	method, probability := "deterministic", boolProbability(medianMet)
+	if complete {
+		met := 0
+		for _, m := range members {
+			if m {
+				met++
+			}
+		}
+		method, probability = "ensemble", float64(met)/float64(len(members))
+	}
+	return method, probability, hourly
+}
+
+func boolProbability(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
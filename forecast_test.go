@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func floats(values ...float64) []*float64 {
+	ptrs := make([]*float64, len(values))
+	for i := range values {
+		if !math.IsNaN(values[i]) {
+			ptrs[i] = &values[i]
+		}
+	}
+	return ptrs
+}
+
+func TestEnsembleValue(t *testing.T) {
+	missing := math.NaN()
+
+	if v := ensembleValue(floats(missing, missing)); !reflect.DeepEqual(v, ForecastValue{}) {
+		t.Errorf("no members: %+v", v)
+	}
+	if v := ensembleValue(floats(missing, 4, missing)); v.Value != 4 || v.P50 != nil || v.Members != nil {
+		t.Errorf("one member: %+v", v)
+	}
+
+	v := ensembleValue(floats(0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10))
+	if v.Value != 5 || *v.P10 != 1 || *v.P50 != 5 || *v.P90 != 9 || len(v.Members) != 11 {
+		t.Errorf("complete members: %+v", v)
+	}
+
+	// The missing member is left out of the percentiles and drops the member list
+	v = ensembleValue(floats(10, missing, 0, 20))
+	if v.Value != 10 || math.Abs(*v.P10-2) > 1e-9 || *v.P50 != 10 || math.Abs(*v.P90-18) > 1e-9 {
+		t.Errorf("percentiles with a missing member: value %v p10 %v p50 %v p90 %v", v.Value, *v.P10, *v.P50, *v.P90)
+	}
+	if v.Members != nil {
+		t.Errorf("incomplete members kept: %v", v.Members)
+	}
+}
+
+func TestWindowProbability(t *testing.T) {
+	start := time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+	hour := func(i int, median float64, members ...float64) ForecastHour {
+		return ForecastHour{Time: start.Add(time.Duration(i) * time.Hour), Temp: ForecastValue{Value: median, Members: members}}
+	}
+	below := func(v, t float64) bool { return v < t }
+	to := start.Add(3 * time.Hour)
+
+	// Members 0 and 1 go below zero in different hours, member 2 and 3 never do
+	ensemble := Forecast{Members: 4, Hours: []ForecastHour{
+		hour(0, 1, -1, 2, 3, 4),
+		hour(1, 1, 1, -2, 3, 4),
+		hour(2, 2, 1, 2, 3, 4),
+		hour(3, -5, -5, -5, -5, -5), // outside the window
+	}}
+	method, probability, hourly := windowProbability(ensemble, forecastVariables["temp"], below, 0, start, to)
+	if method != "ensemble" || probability != 0.5 {
+		t.Errorf("ensemble window = %s %v, want ensemble 0.5", method, probability)
+	}
+	want := []float64{0.25, 0.25, 0}
+	if len(hourly) != len(want) {
+		t.Fatalf("hourly = %+v", hourly)
+	}
+	for i, h := range hourly {
+		if h.Probability != want[i] || !h.Time.Equal(start.Add(time.Duration(i)*time.Hour)) {
+			t.Errorf("hour %d = %+v, want %v", i, h, want[i])
+		}
+	}
+
+	// One hour lacks members, so the window falls back to the median
+	partial := Forecast{Members: 4, Hours: []ForecastHour{
+		hour(0, 1, -1, 2, 3, 4),
+		hour(1, 1),
+		hour(2, 2, 1, 2, 3, 4),
+	}}
+	method, probability, hourly = windowProbability(partial, forecastVariables["temp"], below, 0, start, to)
+	if method != "deterministic" || probability != 0 {
+		t.Errorf("partial ensemble window = %s %v, want deterministic 0", method, probability)
+	}
+	if hourly[0].Probability != 0.25 || hourly[1].Probability != 0 {
+		t.Errorf("partial ensemble hourly = %+v", hourly)
+	}
+
+	deterministic := Forecast{Hours: []ForecastHour{hour(0, 3), hour(1, -1), hour(2, 2)}}
+	method, probability, hourly = windowProbability(deterministic, forecastVariables["temp"], below, 0, start, to)
+	if method != "deterministic" || probability != 1 || hourly[1].Probability != 1 || hourly[0].Probability != 0 {
+		t.Errorf("deterministic window = %s %v %+v", method, probability, hourly)
+	}
+
+	if _, _, hourly = windowProbability(deterministic, forecastVariables["temp"], below, 0, to, to.Add(time.Hour)); len(hourly) != 0 {
+		t.Errorf("window past the forecast = %+v", hourly)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// historyBlock holds every reading of one city on one UTC day as compressed
+// columns. Numeric series use Gorilla-style encodings and strings are dictionary
+// encoded; Version guards concurrent appends.
+type historyBlock struct {
+	City        string    `bson:"city"`
+	Day         string    `bson:"day"`
+	Count       int       `bson:"count"`
+	Version     int       `bson:"version"`
+	First       time.Time `bson:"first"`
+	Last        time.Time `bson:"last"`
+	Times       []byte    `bson:"times"`
+	Temp        []byte    `bson:"temp"`
+	Wind        []byte    `bson:"wind"`
+	Precip      []byte    `bson:"precip"`
+	Lat         []byte    `bson:"lat"`
+	Lon         []byte    `bson:"lon"`
+	Dict        []string  `bson:"dict"`
+	Country     []byte    `bson:"country"`
+	Description []byte    `bson:"description"`
+	Tags        []byte    `bson:"tags"`
+	Tenant      []byte    `bson:"tenant"`
+	Provider    []byte    `bson:"provider"`
+	Route       []byte    `bson:"route"`
+}
+
+const (
+	maxBlockAppendRetries = 5
+	tagSeparator          = "\x1f"
+)
+
+var blocksCollection *mongo.Collection
+
+func encodeBlock(city, day string, readings []WeatherData) historyBlock {
+	sort.SliceStable(readings, func(i, j int) bool { return readings[i].LastUpdated.Before(readings[j].LastUpdated) })
+
+	n := len(readings)
+	times := make([]int64, n)
+	temp, wind, precip := make([]float64, n), make([]float64, n), make([]float64, n)
+	lat, lon := make([]float64, n), make([]float64, n)
+	country, description, tags := make([]string, n), make([]string, n), make([]string, n)
+	tenant, provider, route := make([]string, n), make([]string, n), make([]string, n)
+	for i, r := range readings {
+		times[i] = r.LastUpdated.UnixMilli()
+		temp[i], wind[i], precip[i] = r.Temp, r.Wind, r.Precip
+		lat[i], lon[i] = r.Lat, r.Lon
+		country[i], description[i] = r.Country, r.Description
+		tags[i] = strings.Join(r.Tags, tagSeparator)
+		tenant[i], provider[i], route[i] = r.Tenant, r.Provider, r.Route
+	}
+
+	block := historyBlock{City: city, Day: day, Count: n}
+	if n > 0 {
+		block.First = readings[0].LastUpdated
+		block.Last = readings[n-1].LastUpdated
+	}
+	block.Times = encodeTimes(times)
+	block.Temp = encodeFloats(temp)
+	block.Wind = encodeFloats(wind)
+	block.Precip = encodeFloats(precip)
+	block.Lat = encodeFloats(lat)
+	block.Lon = encodeFloats(lon)
+	block.Country = encodeDict(country, &block.Dict)
+	block.Description = encodeDict(description, &block.Dict)
+	block.Tags = encodeDict(tags, &block.Dict)
+	block.Tenant = encodeDict(tenant, &block.Dict)
+	block.Provider = encodeDict(provider, &block.Dict)
+	block.Route = encodeDict(route, &block.Dict)
+	return block
+}
+
+func (b historyBlock) decode() ([]WeatherData, error) {
+	n := b.Count
+	times, err := decodeTimes(b.Times, n)
+	if err != nil {
+		return nil, fmt.Errorf("block %s/%s times: %w", b.City, b.Day, err)
+	}
+	floats := map[string][]float64{}
+	for name, column := range map[string][]byte{"temp": b.Temp, "wind": b.Wind, "precip": b.Precip, "lat": b.Lat, "lon": b.Lon} {
+		if floats[name], err = decodeFloats(column, n); err != nil {
+			return nil, fmt.Errorf("block %s/%s %s: %w", b.City, b.Day, name, err)
+		}
+	}
+	strs := map[string][]string{}
+	for name, column := range map[string][]byte{"country": b.Country, "description": b.Description, "tags": b.Tags, "tenant": b.Tenant, "provider": b.Provider, "route": b.Route} {
+		if strs[name], err = decodeDict(column, b.Dict, n); err != nil {
+			return nil, fmt.Errorf("block %s/%s %s: %w", b.City, b.Day, name, err)
+		}
+	}
+
+	readings := make([]WeatherData, n)
+	for i := range readings {
+		readings[i] = WeatherData{
+			City:        b.City,
+			Country:     strs["country"][i],
+			Lat:         floats["lat"][i],
+			Lon:         floats["lon"][i],
+			Description: strs["description"][i],
+			Temp:        floats["temp"][i],
+			Wind:        floats["wind"][i],
+			Precip:      floats["precip"][i],
+			Tenant:      strs["tenant"][i],
+			Provider:    strs["provider"][i],
+			Route:       strs["route"][i],
+			LastUpdated: time.UnixMilli(times[i]).UTC(),
+		}
+		if tags := strs["tags"][i]; tags != "" {
+			readings[i].Tags = strings.Split(tags, tagSeparator)
+		}
+	}
+	return readings, nil
+}
+
+// applyHistoryBlocks appends the reading to its city/day block, re-encoding the
+// block and retrying if another writer changed it in the meantime.
+func applyHistoryBlocks(ctx context.Context, c *mongo.Collection, ev Event) error {
+	switch ev.Type {
+	case EventFetch, EventImport:
+	default:
+		return nil
+	}
+
+	day := ev.Data.LastUpdated.UTC().Format(dayLayout)
+	filter := bson.M{"city": ev.City, "day": day}
+	for attempt := 0; attempt < maxBlockAppendRetries; attempt++ {
+		var block historyBlock
+		var readings []WeatherData
+		err := c.FindOne(ctx, filter).Decode(&block)
+		switch {
+		case err == mongo.ErrNoDocuments:
+		case err != nil:
+			return err
+		default:
+			if readings, err = block.decode(); err != nil {
+				return err
+			}
+		}
+
+		updated := encodeBlock(ev.City, day, append(readings, *ev.Data))
+		updated.Version = block.Version + 1
+		if block.Count == 0 {
+			_, err = c.InsertOne(ctx, updated)
+			if mongo.IsDuplicateKeyError(err) {
+				continue
+			}
+			return err
+		}
+		result, err := c.ReplaceOne(ctx, bson.M{"city": ev.City, "day": day, "version": block.Version}, updated)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 1 {
+			return nil
+		}
+	}
+	return errors.New("history block kept changing during append")
+}
+
+// loadHistory returns a city's readings in [from, to) in time order, decoding
+// only the day blocks that overlap the range.
+func loadHistory(ctx context.Context, city string, from, to time.Time) ([]WeatherData, error) {
+	var history []WeatherData
+	err := scanHistory(ctx, bson.M{"city": city}, from, to, func(r WeatherData) error {
+		history = append(history, r)
+		return nil
+	})
+	return history, err
+}
+
+// scanHistory streams the readings in [from, to) from the blocks matching filter,
+// in city and day order, stopping at the first error fn returns.
+func scanHistory(ctx context.Context, filter bson.M, from, to time.Time, fn func(WeatherData) error) error {
+	query := bson.M{"first": bson.M{"$lt": to}, "last": bson.M{"$gte": from}}
+	for k, v := range filter {
+		query[k] = v
+	}
+	cursor, err := blocksCollection.Find(ctx, query, options.Find().SetSort(bson.D{{Key: "city", Value: 1}, {Key: "day", Value: 1}}))
+	if err != nil {
+		return fmt.Errorf("failed to load history: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var block historyBlock
+		if err := cursor.Decode(&block); err != nil {
+			return fmt.Errorf("failed to load history: %w", err)
+		}
+		readings, err := block.decode()
+		if err != nil {
+			return err
+		}
+		for _, r := range readings {
+			if r.LastUpdated.Before(from) || !r.LastUpdated.Before(to) {
+				continue
+			}
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+	}
+	return cursor.Err()
+}
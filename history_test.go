@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestHistoryBlockRoundTrip(t *testing.T) {
+	readings := syntheticHistory("Test City", 1, 4)
+	readings[3].Tags = nil
+	readings[5].Tags = []string{"a", "b"}
+	readings[7].Precip = math.NaN()
+	readings[9].Temp = -12.5
+
+	raw, err := bson.Marshal(encodeBlock("Test City", "2024-01-01", append([]WeatherData(nil), readings...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block historyBlock
+	if err := bson.Unmarshal(raw, &block); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := block.decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !math.IsNaN(decoded[7].Precip) {
+		t.Errorf("NaN precipitation decoded as %v", decoded[7].Precip)
+	}
+	decoded[7].Precip, readings[7].Precip = 0, 0
+	if !reflect.DeepEqual(decoded, readings) {
+		t.Fatal("block did not round-trip the readings")
+	}
+}
+
+func TestHistoryBlockSingleReading(t *testing.T) {
+	readings := syntheticHistory("Test City", 1, 1)[:1]
+	decoded, err := encodeBlock("Test City", "2024-01-01", append([]WeatherData(nil), readings...)).decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, readings) {
+		t.Fatalf("got %+v, want %+v", decoded, readings)
+	}
+}
+
+// benchmarkHistory is a year of hourly readings, split into days.
+func benchmarkHistory() ([]WeatherData, [][]WeatherData) {
+	readings := syntheticHistory("Benchmark City", 365, 1)
+	var days [][]WeatherData
+	for i := 0; i < len(readings); i += 24 {
+		days = append(days, readings[i:i+24])
+	}
+	return readings, days
+}
+
+// BenchmarkHistoryDocuments scans a year stored one BSON document per reading,
+// as the history collection used to store it.
+func BenchmarkHistoryDocuments(b *testing.B) {
+	readings, _ := benchmarkHistory()
+	rows := make([][]byte, len(readings))
+	size := 0
+	for i, r := range readings {
+		raw, err := bson.Marshal(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rows[i] = raw
+		size += len(raw)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, raw := range rows {
+			var r WeatherData
+			if err := bson.Unmarshal(raw, &r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(size)/float64(len(readings)), "B/reading")
+}
+
+// BenchmarkHistoryBlocks scans the same year stored as compressed day blocks.
+func BenchmarkHistoryBlocks(b *testing.B) {
+	readings, days := benchmarkHistory()
+	blocks := make([][]byte, len(days))
+	size := 0
+	for i, day := range days {
+		raw, err := bson.Marshal(encodeBlock("Benchmark City", day[0].LastUpdated.Format(dayLayout), day))
+		if err != nil {
+			b.Fatal(err)
+		}
+		blocks[i] = raw
+		size += len(raw)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, raw := range blocks {
+			var block historyBlock
+			if err := bson.Unmarshal(raw, &block); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := block.decode(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(size)/float64(len(readings)), "B/reading")
+}
+
+// syntheticHistory produces plausible readings: a daily temperature cycle with
+// noise at OpenWeather's two-decimal Kelvin precision, gusty wind and occasional rain.
+func syntheticHistory(city string, days, perHour int) []WeatherData {
+	rng := rand.New(rand.NewSource(1))
+	descriptions := []string{"clear sky", "few clouds", "scattered clouds", "broken clouds", "light rain"}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	step := time.Hour / time.Duration(perHour)
+
+	var readings []WeatherData
+	for i := 0; i < days*24*perHour; i++ {
+		at := start.Add(time.Duration(i) * step).Add(time.Duration(rng.Intn(2000)) * time.Millisecond)
+		hours := float64(i) / float64(perHour)
+		kelvin := 283.15 + 8*math.Sin(2*math.Pi*(hours/24-0.375)) + 6*math.Sin(2*math.Pi*hours/(24*365)) + rng.NormFloat64()
+		kelvin = math.Round(kelvin*100) / 100
+		precip := 0.0
+		if rng.Float64() < 0.1 {
+			precip = math.Round(rng.ExpFloat64()*100) / 100
+		}
+		readings = append(readings, WeatherData{
+			City:        city,
+			Country:     "GB",
+			Lat:         51.5085,
+			Lon:         -0.1257,
+			Description: descriptions[rng.Intn(len(descriptions))],
+			Temp:        kelvin - 273.15,
+			Wind:        math.Round(rng.Float64()*120) / 10,
+			Precip:      precip,
+			Tags:        []string{"benchmark"},
+			Provider:    "openweather",
+			Route:       defaultRouteName,
+			LastUpdated: time.UnixMilli(at.UnixMilli()).UTC(),
+		})
+	}
+	return readings
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// providerClient is the HTTP client every provider uses. Its transport is a
+// private HTTP cache (RFC 9111), so fetches the provider says are still fresh
+// cost no quota and stale ones are revalidated with ETag/Last-Modified.
+var providerClient = &http.Client{
+	Timeout:   30 * time.Second,
+	Transport: newCachingTransport(http.DefaultTransport, providerCacheEntries, providerCacheMaxBody),
+}
+
+const (
+	providerCacheEntries = 2000
+	providerCacheMaxBody = 8 << 20
+)
+
+// Cache outcomes, also used as the metric label.
+const (
+	cacheHit         = "hit"
+	cacheRevalidated = "revalidated"
+	cacheMiss        = "miss"
+	cacheBypass      = "bypass"
+)
+
+type cacheEntry struct {
+	key          string
+	status       int
+	proto        string
+	header       http.Header
+	body         []byte
+	vary         map[string]string // request header values the response varies on
+	requestTime  time.Time
+	responseTime time.Time
+}
+
+type cachingTransport struct {
+	next       http.RoundTripper
+	maxEntries int
+	maxBody    int64
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+
+	outcomes map[string]*atomic.Uint64
+}
+
+func newCachingTransport(next http.RoundTripper, maxEntries int, maxBody int64) *cachingTransport {
+	t := &cachingTransport{
+		next:       next,
+		maxEntries: maxEntries,
+		maxBody:    maxBody,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+		outcomes:   map[string]*atomic.Uint64{},
+	}
+	for _, outcome := range []string{cacheHit, cacheRevalidated, cacheMiss, cacheBypass} {
+		t.outcomes[outcome] = &atomic.Uint64{}
+	}
+	return t
+}
+
+// cacheControl parses a Cache-Control header into directive -> argument.
+func cacheControl(h http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "" {
+				continue
+			}
+			directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return directives
+}
+
+func cacheKey(req *http.Request) string {
+	return req.Method + " " + req.URL.String()
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		// Unsafe methods invalidate what is stored for the URL (RFC 9111 §4.4)
+		resp, err := t.next.RoundTrip(req)
+		if err == nil && resp.StatusCode < 400 {
+			t.remove(http.MethodGet + " " + req.URL.String())
+			t.remove(http.MethodHead + " " + req.URL.String())
+		}
+		t.count(cacheBypass)
+		return resp, err
+	}
+
+	reqCC := cacheControl(req.Header)
+	if _, noStore := reqCC["no-store"]; noStore {
+		t.count(cacheBypass)
+		return t.next.RoundTrip(req)
+	}
+	key := cacheKey(req)
+	entry := t.lookup(key, req)
+
+	now := time.Now()
+	if entry != nil && entry.servable(reqCC, now) {
+		t.count(cacheHit)
+		return entry.response(req, now), nil
+	}
+
+	outgoing := req
+	if entry != nil {
+		outgoing = entry.conditional(req)
+	}
+	requestTime := time.Now()
+	resp, err := t.next.RoundTrip(outgoing)
+	if err != nil {
+		return nil, err
+	}
+	responseTime := time.Now()
+
+	if entry != nil && resp.StatusCode == http.StatusNotModified && outgoing != req {
+		resp.Body.Close()
+		t.count(cacheRevalidated)
+		updated := entry.freshen(resp.Header, requestTime, responseTime)
+		t.store(updated)
+		return updated.response(req, responseTime), nil
+	}
+
+	t.count(cacheMiss)
+	if !storable(resp) {
+		return resp, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, t.maxBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > t.maxBody {
+		// Too big to keep: hand the caller what was read followed by the rest
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	stored := &cacheEntry{
+		key:          key,
+		status:       resp.StatusCode,
+		proto:        resp.Proto,
+		header:       resp.Header.Clone(),
+		body:         body,
+		vary:         map[string]string{},
+		requestTime:  requestTime,
+		responseTime: responseTime,
+	}
+	for _, field := range varyFields(resp.Header) {
+		stored.vary[field] = req.Header.Get(field)
+	}
+	t.store(stored)
+	return resp, nil
+}
+
+// storable applies RFC 9111 §3: only complete final responses without no-store,
+// with a status we understand, and either explicit freshness or a validator.
+func storable(resp *http.Response) bool {
+	respCC := cacheControl(resp.Header)
+	if _, ok := respCC["no-store"]; ok {
+		return false
+	}
+	for _, field := range varyFields(resp.Header) {
+		if field == "*" {
+			return false
+		}
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusMultipleChoices,
+		http.StatusMovedPermanently, http.StatusPermanentRedirect, http.StatusNotFound, http.StatusGone:
+	default:
+		return false
+	}
+	if _, ok := respCC["max-age"]; ok {
+		return true
+	}
+	if resp.Header.Get("Expires") != "" || resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != "" {
+		return true
+	}
+	_, public := respCC["public"]
+	return public
+}
+
+func varyFields(h http.Header) []string {
+	var fields []string
+	for _, line := range h.Values("Vary") {
+		for _, field := range strings.Split(line, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, http.CanonicalHeaderKey(field))
+			}
+		}
+	}
+	return fields
+}
+
+// freshnessLifetime follows RFC 9111 §4.2.1. As a private cache s-maxage does
+// not apply; without explicit freshness the response must be revalidated.
+func (e *cacheEntry) freshnessLifetime() time.Duration {
+	cc := cacheControl(e.header)
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	if raw, ok := cc["max-age"]; ok {
+		seconds, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if raw := e.header.Get("Expires"); raw != "" {
+		expires, err := http.ParseTime(raw)
+		if err != nil {
+			return 0 // invalid dates mean already expired
+		}
+		return expires.Sub(e.date())
+	}
+	return 0
+}
+
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.header.Get("Date")); err == nil {
+		return date
+	}
+	return e.responseTime
+}
+
+// currentAge follows RFC 9111 §4.2.3.
+func (e *cacheEntry) currentAge(now time.Time) time.Duration {
+	apparentAge := max(0, e.responseTime.Sub(e.date()))
+	var ageValue time.Duration
+	if seconds, err := strconv.ParseInt(e.header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+	correctedAgeValue := ageValue + e.responseTime.Sub(e.requestTime)
+	return max(apparentAge, correctedAgeValue) + now.Sub(e.responseTime)
+}
+
+// servable reports whether the entry may be returned without contacting the
+// origin, taking the request's own max-age, min-fresh and no-cache into account.
+// Stale responses are never served, so must-revalidate needs no special case.
+func (e *cacheEntry) servable(reqCC map[string]string, now time.Time) bool {
+	if _, ok := reqCC["no-cache"]; ok {
+		return false
+	}
+	age := e.currentAge(now)
+	lifetime := e.freshnessLifetime()
+	if raw, ok := reqCC["max-age"]; ok {
+		if seconds, err := strconv.ParseInt(raw, 10, 64); err == nil && age > time.Duration(seconds)*time.Second {
+			return false
+		}
+	}
+	if raw, ok := reqCC["min-fresh"]; ok {
+		if seconds, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			age += time.Duration(seconds) * time.Second
+		}
+	}
+	return age < lifetime
+}
+
+// conditional clones req with validators from the entry (RFC 9111 §4.3.1).
+func (e *cacheEntry) conditional(req *http.Request) *http.Request {
+	etag, lastModified := e.header.Get("ETag"), e.header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return req
+	}
+	out := req.Clone(req.Context())
+	if etag != "" {
+		out.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		out.Header.Set("If-Modified-Since", lastModified)
+	}
+	return out
+}
+
+// freshen returns a copy of the entry with the headers of a 304 applied
+// (RFC 9111 §4.3.4).
+func (e *cacheEntry) freshen(header http.Header, requestTime, responseTime time.Time) *cacheEntry {
+	updated := *e
+	updated.header = e.header.Clone()
+	for name, values := range header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		updated.header[name] = values
+	}
+	updated.requestTime, updated.responseTime = requestTime, responseTime
+	return &updated
+}
+
+func (e *cacheEntry) response(req *http.Request, now time.Time) *http.Response {
+	header := e.header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(e.currentAge(now)/time.Second), 10))
+	body := e.body
+	if req.Method == http.MethodHead {
+		body = nil
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.status, http.StatusText(e.status)),
+		StatusCode:    e.status,
+		Proto:         e.proto,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+func (t *cachingTransport) lookup(key string, req *http.Request) *cacheEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	element, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	for field, value := range entry.vary {
+		if req.Header.Get(field) != value {
+			return nil
+		}
+	}
+	t.lru.MoveToFront(element)
+	return entry
+}
+
+func (t *cachingTransport) store(entry *cacheEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if element, ok := t.entries[entry.key]; ok {
+		element.Value = entry
+		t.lru.MoveToFront(element)
+		return
+	}
+	t.entries[entry.key] = t.lru.PushFront(entry)
+	for t.lru.Len() > t.maxEntries {
+		oldest := t.lru.Back()
+		t.lru.Remove(oldest)
+		delete(t.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (t *cachingTransport) remove(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if element, ok := t.entries[key]; ok {
+		t.lru.Remove(element)
+		delete(t.entries, key)
+	}
+}
+
+func (t *cachingTransport) count(outcome string) {
+	t.outcomes[outcome].Add(1)
+}
+
+func writeProviderCacheMetrics(w io.Writer) {
+	t, ok := providerClient.Transport.(*cachingTransport)
+	if !ok {
+		return
+	}
+	writeMetricHeader(w, "weather_provider_http_cache_requests_total", "counter", "Provider HTTP requests by cache outcome.")
+	for _, outcome := range []string{cacheHit, cacheRevalidated, cacheMiss, cacheBypass} {
+		fmt.Fprintf(w, "weather_provider_http_cache_requests_total{outcome=%q} %d\n", outcome, t.outcomes[outcome].Load())
+	}
+	t.mu.Lock()
+	entries := t.lru.Len()
+	t.mu.Unlock()
+	writeMetricHeader(w, "weather_provider_http_cache_entries", "gauge", "Responses held by the provider HTTP cache.")
+	fmt.Fprintf(w, "weather_provider_http_cache_entries %d\n", entries)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cacheOrigin serves handler behind a caching transport and counts the requests
+// that reach it.
+type cacheOrigin struct {
+	t         *testing.T
+	server    *httptest.Server
+	transport *cachingTransport
+	hits      atomic.Int64
+}
+
+func newCacheOrigin(t *testing.T, maxEntries int, maxBody int64, handler http.HandlerFunc) *cacheOrigin {
+	o := &cacheOrigin{t: t, transport: newCachingTransport(http.DefaultTransport, maxEntries, maxBody)}
+	o.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o.hits.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(o.server.Close)
+	return o
+}
+
+// do sends a request through the cache and returns the response with its body read.
+func (o *cacheOrigin) do(method, path string, header http.Header) (*http.Response, string) {
+	o.t.Helper()
+	req, err := http.NewRequest(method, o.server.URL+path, nil)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := (&http.Client{Transport: o.transport}).Do(req)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func (o *cacheOrigin) get(path string) (*http.Response, string) {
+	return o.do(http.MethodGet, path, nil)
+}
+
+func (o *cacheOrigin) wantHits(n int64) {
+	o.t.Helper()
+	if got := o.hits.Load(); got != n {
+		o.t.Errorf("origin hit %d times, want %d", got, n)
+	}
+}
+
+func TestHTTPCacheMaxAge(t *testing.T) {
+	o := newCacheOrigin(t, 10, 1<<20, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", r.URL.Query().Get("cc"))
+		io.WriteString(w, "forecast")
+	})
+	o.get("/?cc=max-age=60")
+	if _, body := o.get("/?cc=max-age=60"); body != "forecast" {
+		t.Errorf("cached body = %q", body)
+	}
+	o.wantHits(1)
+
+	o.get("/?cc=max-age=0")
+	o.get("/?cc=max-age=0")
+	o.wantHits(3)
+}
+
+func TestHTTPCacheExpires(t *testing.T) {
+	o := newCacheOrigin(t, 10, 1<<20, func(w http.ResponseWriter, r *http.Request) {
+		offset, _ := time.ParseDuration(r.URL.Query().Get("expires"))
+		now := time.Now()
+		w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+		w.Header().Set("Expires", now.Add(offset).UTC().Format(http.TimeFormat))
+	})
+	o.get("/?expires=1h")
+	o.get("/?expires=1h")
+	o.wantHits(1)
+
+	o.get("/?expires=-1h")
+	o.get("/?expires=-1h")
+	o.wantHits(3)
+}
+
+func TestHTTPCacheCurrentAge(t *testing.T) {
+	responseTime := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	entry := &cacheEntry{
+		header:       http.Header{"Date": {responseTime.Add(-10 * time.Second).Format(http.TimeFormat)}, "Age": {"30"}, "Cache-Control": {"max-age=40"}},
+		requestTime:  responseTime.Add(-2 * time.Second),
+		responseTime: responseTime,
+	}
+	now := responseTime.Add(5 * time.Second)
+	// max(apparent 10s, Age 30s + 2s response delay) + 5s resident
+	if got := entry.currentAge(now); got != 37*time.Second {
+		t.Errorf("currentAge = %v, want 37s", got)
+	}
+	if !entry.servable(map[string]string{}, now) {
+		t.Error("37s old entry with max-age=40 not servable")
+	}
+	if entry.servable(map[string]string{"min-fresh": "5"}, now) {
+		t.Error("served although it would not stay fresh for min-fresh")
+	}
+	if entry.servable(map[string]string{"max-age": "30"}, now) {
+		t.Error("served although older than the request's max-age")
+	}
+	if !entry.servable(map[string]string{}, responseTime.Add(4*time.Second)) || entry.servable(map[string]string{}, responseTime.Add(8*time.Second)) {
+		t.Error("entry should go stale once its age passes max-age")
+	}
+
+	// An Age header from the origin counts against the lifetime and is reported on hits
+	o := newCacheOrigin(t, 10, 1<<20, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Age", r.URL.Query().Get("age"))
+	})
+	o.get("/?age=50")
+	resp, _ := o.get("/?age=50")
+	if age, _ := strconv.Atoi(resp.Header.Get("Age")); age < 50 || age > 55 {
+		t.Errorf("Age on a hit = %q, want about 50", resp.Header.Get("Age"))
+	}
+	o.wantHits(1)
+	o.get("/?age=70")
+	o.get("/?age=70")
+	o.wantHits(3)
+}
+
+func TestHTTPCacheRevalidation(t *testing.T) {
+	lastModified := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	var conditional http.Header
+	o := newCacheOrigin(t, 10, 1<<20, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			conditional = r.Header.Clone()
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("X-Version", "2")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Header().Set("X-Version", "1")
+		io.WriteString(w, "forecast")
+	})
+	o.get("/")
+	resp, body := o.get("/")
+	if conditional.Get("If-None-Match") != `"v1"` || conditional.Get("If-Modified-Since") != lastModified {
+		t.Errorf("revalidation sent If-None-Match %q, If-Modified-Since %q", conditional.Get("If-None-Match"), conditional.Get("If-Modified-Since"))
+	}
+	if resp.StatusCode != http.StatusOK || body != "forecast" {
+		t.Errorf("revalidated response = %d %q, want the stored 200", resp.StatusCode, body)
+	}
+	// freshen merges the 304's headers into the stored ones
+	if resp.Header.Get("X-Version") != "2" || resp.Header.Get("ETag") != `"v1"` || resp.Header.Get("Cache-Control") != "max-age=60" {
+		t.Errorf("revalidated headers = %v", resp.Header)
+	}
+	o.wantHits(2)
+
+	// The 304 made the entry fresh
+	if _, body := o.get("/"); body != "forecast" {
+		t.Errorf("body after revalidation = %q", body)
+	}
+	o.wantHits(2)
+}
+
+func TestHTTPCacheFreshenSkipsBodyHeaders(t *testing.T) {
+	entry := &cacheEntry{header: http.Header{"Content-Length": {"8"}, "Content-Encoding": {"gzip"}, "Etag": {`"v1"`}}}
+	updated := entry.freshen(http.Header{"Content-Length": {"0"}, "Content-Encoding": {"br"}, "Etag": {`"v2"`}}, time.Now(), time.Now())
+	if updated.header.Get("Content-Length") != "8" || updated.header.Get("Content-Encoding") != "gzip" || updated.header.Get("ETag") != `"v2"` {
+		t.Errorf("freshened headers = %v", updated.header)
+	}
+	if entry.header.Get("ETag") != `"v1"` {
+		t.Error("freshen modified the stored entry")
+	}
+}
+
+func TestHTTPCacheNoStore(t *testing.T) {
+	o := newCacheOrigin(t, 10, 1<<20, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", r.URL.Query().Get("cc"))
+	})
+	noStore := http.Header{"Cache-Control": {"no-store"}}
+	o.do(http.MethodGet, "/?cc=max-age=60", noStore)
+	o.get("/?cc=max-age=60")
+	o.wantHits(2)
+	// A no-store request neither reads nor replaces what is stored
+	o.do(http.MethodGet, "/?cc=max-age=60", noStore)
+	o.get("/?cc=max-age=60")
+	o.wantHits(3)
+
+	o.get("/?cc=no-store,max-age=60")
+	o.get("/?cc=no-store,max-age=60")
+	o.wantHits(5)
+}
+
+func TestHTTPCacheVary(t *testing.T) {
+	o := newCacheOrigin(t, 10, 1<<20, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		io.WriteString(w, r.Header.Get("Accept-Language"))
+	})
+	en, de := http.Header{"Accept-Language": {"en"}}, http.Header{"Accept-Language": {"de"}}
+	o.do(http.MethodGet, "/", en)
+	if _, body := o.do(http.MethodGet, "/", en); body != "en" {
+		t.Errorf("matching Vary served %q", body)
+	}
+	o.wantHits(1)
+	if _, body := o.do(http.MethodGet, "/", de); body != "de" {
+		t.Errorf("different Vary served %q", body)
+	}
+	o.wantHits(2)
+}
+
+func TestHTTPCacheUnsafeMethodInvalidates(t *testing.T) {
+	o := newCacheOrigin(t, 10, 1<<20, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+	o.get("/city")
+	o.get("/city")
+	o.wantHits(1)
+	o.do(http.MethodPost, "/city", nil)
+	o.wantHits(2)
+	o.get("/city")
+	o.wantHits(3)
+}
+
+func TestHTTPCacheLRUEviction(t *testing.T) {
+	o := newCacheOrigin(t, 2, 1<<20, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+	o.get("/a")
+	o.get("/b")
+	o.get("/a") // hit, so /b is now the least recently used
+	o.wantHits(2)
+	o.get("/c")
+	o.wantHits(3)
+	o.get("/a")
+	o.wantHits(3)
+	o.get("/b")
+	o.wantHits(4)
+}
+
+func TestHTTPCacheLargeBodyPassesThrough(t *testing.T) {
+	large := strings.Repeat("x", 100)
+	o := newCacheOrigin(t, 10, 10, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, large)
+	})
+	if _, body := o.get("/"); body != large {
+		t.Errorf("body over maxBody came back with %d bytes, want %d", len(body), len(large))
+	}
+	o.get("/")
+	o.wantHits(2)
+}
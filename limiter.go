@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Request priorities. Lower priorities may only use part of a limiter's capacity,
+// so they are shed first when a route or dependency gets saturated.
+const (
+	priorityLow = iota
+	priorityNormal
+	priorityHigh
+)
+
+var priorityShare = map[int]float64{
+	priorityLow:    0.5,
+	priorityNormal: 0.8,
+	priorityHigh:   1.0,
+}
+
+var priorityNames = map[int]string{
+	priorityLow:    "low",
+	priorityNormal: "normal",
+	priorityHigh:   "high",
+}
+
+const (
+	limiterMinLimit   = 4
+	limiterMaxLimit   = 1000
+	limiterStartLimit = 50
+	// A window's average latency above tolerance × the best recent window counts as congestion
+	limiterTolerance = 2.0
+	limiterBackoff   = 0.9
+	// How often the latency baseline moves up towards the best window since the
+	// last move, and by which share of the gap, so it follows lasting changes in
+	// latency without taking sustained congestion as the new normal
+	limiterBaselineReset = time.Minute
+	limiterBaselineDecay = 0.05
+)
+
+// adaptiveLimiter is an AIMD concurrency limiter. Every `limit` completions it
+// compares the window's average latency with a baseline, the best average seen
+// slowly decayed upwards: if the window was slower than limiterTolerance times
+// the baseline, or saw failures, the limit shrinks multiplicatively, otherwise it
+// grows by one.
+type adaptiveLimiter struct {
+	name string
+
+	mu            sync.Mutex
+	limit         float64
+	inflight      int
+	windowCount   int
+	windowLatency time.Duration
+	windowFailed  bool
+	baseline      time.Duration
+	baselineSince time.Time
+	recentBest    time.Duration // best window average since baselineSince
+
+	accepted map[int]uint64
+	shed     map[int]uint64
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*adaptiveLimiter{}
+)
+
+// Dependency limiters, fed by the MongoDB command monitor and provider calls.
+var (
+	mongoLimiter    = getLimiter("dependency:mongo")
+	upstreamLimiter = getLimiter("dependency:upstream")
+)
+
+func getLimiter(name string) *adaptiveLimiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	if l, ok := limiters[name]; ok {
+		return l
+	}
+	l := &adaptiveLimiter{
+		name:     name,
+		limit:    limiterStartLimit,
+		accepted: map[int]uint64{},
+		shed:     map[int]uint64{},
+	}
+	limiters[name] = l
+	return l
+}
+
+func (l *adaptiveLimiter) hasRoom(priority int) bool {
+	return float64(l.inflight) < l.limit*priorityShare[priority]
+}
+
+// admit reports whether a request of this priority fits, without taking a slot.
+func (l *adaptiveLimiter) admit(priority int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.hasRoom(priority)
+}
+
+// acquire takes a slot for a request of this priority, or counts it as shed.
+func (l *adaptiveLimiter) acquire(priority int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.hasRoom(priority) {
+		l.shed[priority]++
+		return false
+	}
+	l.inflight++
+	l.accepted[priority]++
+	return true
+}
+
+// start and finish track calls that are not admitted through acquire, such as
+// MongoDB commands observed by the driver.
+func (l *adaptiveLimiter) start() {
+	l.mu.Lock()
+	l.inflight++
+	l.mu.Unlock()
+}
+
+func (l *adaptiveLimiter) countShed(priority int) {
+	l.mu.Lock()
+	l.shed[priority]++
+	l.mu.Unlock()
+}
+
+func (l *adaptiveLimiter) finish(latency time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inflight > 0 {
+		l.inflight--
+	}
+	l.windowCount++
+	l.windowLatency += latency
+	l.windowFailed = l.windowFailed || failed
+	if l.windowCount < int(l.limit) {
+		return
+	}
+
+	now := time.Now()
+	average := l.windowLatency / time.Duration(l.windowCount)
+	if l.recentBest == 0 || average < l.recentBest {
+		l.recentBest = average
+	}
+	switch {
+	case l.baseline == 0 || average < l.baseline:
+		l.baseline = average
+		l.baselineSince = now
+	case now.Sub(l.baselineSince) > limiterBaselineReset:
+		l.baseline += time.Duration(float64(l.recentBest-l.baseline) * limiterBaselineDecay)
+		l.baselineSince, l.recentBest = now, average
+	}
+	if l.windowFailed || float64(average) > float64(l.baseline)*limiterTolerance {
+		l.limit *= limiterBackoff
+		if l.limit < limiterMinLimit {
+			l.limit = limiterMinLimit
+		}
+	} else if l.limit < limiterMaxLimit {
+		l.limit++
+	}
+	l.windowCount, l.windowLatency, l.windowFailed = 0, 0, false
+}
+
+// mongoCommandMonitor feeds every MongoDB command into mongoLimiter so routes that
+// depend on MongoDB are shed when it slows down.
+func mongoCommandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			mongoLimiter.start()
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			mongoLimiter.finish(e.Duration, false)
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			mongoLimiter.finish(e.Duration, true)
+		},
+	}
+}
+
+// statusRecorder remembers the status code a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func shedRequest(w http.ResponseWriter, priority int) {
+	retryAfter := 1
+	if priority == priorityLow {
+		retryAfter = 5
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, "Service overloaded, retry later", http.StatusServiceUnavailable)
+}
+
+// limited wraps a route in its own adaptive limiter. The request is shed with 503
+// when the route, or any dependency it uses, has no room at its priority.
+func limited(route string, priority int, next http.HandlerFunc, dependencies ...*adaptiveLimiter) http.HandlerFunc {
+	limiter := getLimiter("route:" + route)
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, dependency := range dependencies {
+			if !dependency.admit(priority) {
+				dependency.countShed(priority)
+				shedRequest(w, priority)
+				return
+			}
+		}
+		if !limiter.acquire(priority) {
+			shedRequest(w, priority)
+			return
+		}
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			limiter.finish(time.Since(start), recorder.status >= http.StatusInternalServerError)
+		}()
+		next(recorder, r)
+	}
+}
+
+func writeLimiterMetrics(w io.Writer) {
+	type snapshot struct {
+		name     string
+		limit    float64
+		inflight int
+		accepted map[int]uint64
+		shed     map[int]uint64
+	}
+
+	limitersMu.Lock()
+	snapshots := make([]snapshot, 0, len(limiters))
+	for name, l := range limiters {
+		l.mu.Lock()
+		s := snapshot{name: name, limit: l.limit, inflight: l.inflight, accepted: map[int]uint64{}, shed: map[int]uint64{}}
+		for priority, n := range l.accepted {
+			s.accepted[priority] = n
+		}
+		for priority, n := range l.shed {
+			s.shed[priority] = n
+		}
+		l.mu.Unlock()
+		snapshots = append(snapshots, s)
+	}
+	limitersMu.Unlock()
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].name < snapshots[j].name })
+
+	writeMetricHeader(w, "weather_limiter_limit", "gauge", "Current adaptive concurrency limit.")
+	for _, s := range snapshots {
+		fmt.Fprintf(w, "weather_limiter_limit{limiter=%q} %.2f\n", s.name, s.limit)
+	}
+	writeMetricHeader(w, "weather_limiter_inflight", "gauge", "Requests or calls currently in flight.")
+	for _, s := range snapshots {
+		fmt.Fprintf(w, "weather_limiter_inflight{limiter=%q} %d\n", s.name, s.inflight)
+	}
+	writeMetricHeader(w, "weather_limiter_accepted_total", "counter", "Requests admitted, by priority.")
+	for _, s := range snapshots {
+		for _, priority := range []int{priorityLow, priorityNormal, priorityHigh} {
+			fmt.Fprintf(w, "weather_limiter_accepted_total{limiter=%q,priority=%q} %d\n", s.name, priorityNames[priority], s.accepted[priority])
+		}
+	}
+	writeMetricHeader(w, "weather_limiter_shed_total", "counter", "Requests shed with 503, by priority.")
+	for _, s := range snapshots {
+		for _, priority := range []int{priorityLow, priorityNormal, priorityHigh} {
+			fmt.Fprintf(w, "weather_limiter_shed_total{limiter=%q,priority=%q} %d\n", s.name, priorityNames[priority], s.shed[priority])
+		}
+	}
+}
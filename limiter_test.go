@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(limit float64) *adaptiveLimiter {
+	return &adaptiveLimiter{name: "test", limit: limit, accepted: map[int]uint64{}, shed: map[int]uint64{}}
+}
+
+// runWindow completes one full window of calls with the given latency.
+func runWindow(l *adaptiveLimiter, latency time.Duration, failed bool) {
+	for n := int(l.limit); n > 0; n-- {
+		l.start()
+		l.finish(latency, failed && n == 1)
+	}
+}
+
+func TestLimiterAIMD(t *testing.T) {
+	l := newTestLimiter(10)
+	runWindow(l, 10*time.Millisecond, false)
+	runWindow(l, 12*time.Millisecond, false)
+	if l.limit != 12 || l.baseline != 10*time.Millisecond {
+		t.Fatalf("after two healthy windows: limit %v, baseline %s", l.limit, l.baseline)
+	}
+
+	runWindow(l, 30*time.Millisecond, false)
+	if l.limit != 12*limiterBackoff {
+		t.Errorf("slow window: limit %v, want %v", l.limit, 12*limiterBackoff)
+	}
+	limit := l.limit
+	runWindow(l, 10*time.Millisecond, true)
+	if l.limit != limit*limiterBackoff {
+		t.Errorf("failed window: limit %v, want %v", l.limit, limit*limiterBackoff)
+	}
+
+	l = newTestLimiter(limiterMinLimit)
+	runWindow(l, 10*time.Millisecond, true)
+	if l.limit != limiterMinLimit {
+		t.Errorf("limit fell below the minimum: %v", l.limit)
+	}
+}
+
+func TestLimiterBaselineSurvivesSustainedCongestion(t *testing.T) {
+	l := newTestLimiter(20)
+	runWindow(l, 10*time.Millisecond, false)
+
+	// Ten baseline periods of congestion keep shrinking the limit
+	for i := 0; i < 10; i++ {
+		l.baselineSince = l.baselineSince.Add(-2 * limiterBaselineReset)
+		runWindow(l, 50*time.Millisecond, false)
+	}
+	if l.baseline > 30*time.Millisecond {
+		t.Errorf("baseline moved to %s, near the congested latency", l.baseline)
+	}
+	if l.limit >= 20*limiterBackoff*limiterBackoff {
+		t.Errorf("limit recovered to %v during congestion", l.limit)
+	}
+
+	// A lasting change is followed eventually
+	for i := 0; i < 100; i++ {
+		l.baselineSince = l.baselineSince.Add(-2 * limiterBaselineReset)
+		runWindow(l, 50*time.Millisecond, false)
+	}
+	if l.baseline < 26*time.Millisecond {
+		t.Errorf("baseline stuck at %s after a lasting change", l.baseline)
+	}
+}
+
+func TestLimiterShedsByPriority(t *testing.T) {
+	l := newTestLimiter(10)
+	for i := 0; i < 5; i++ {
+		if !l.acquire(priorityHigh) {
+			t.Fatalf("request %d shed below the limit", i)
+		}
+	}
+	if l.acquire(priorityLow) {
+		t.Error("low priority admitted beyond half the limit")
+	}
+	for i := 0; i < 3; i++ {
+		if !l.acquire(priorityNormal) {
+			t.Fatalf("normal request %d shed below 80%% of the limit", i)
+		}
+	}
+	if l.acquire(priorityNormal) {
+		t.Error("normal priority admitted beyond 80% of the limit")
+	}
+	if !l.acquire(priorityHigh) || !l.acquire(priorityHigh) || l.acquire(priorityHigh) {
+		t.Error("high priority not admitted up to exactly the limit")
+	}
+	if l.shed[priorityLow] != 1 || l.shed[priorityNormal] != 1 || l.shed[priorityHigh] != 1 || l.accepted[priorityHigh] != 7 {
+		t.Errorf("accepted %v, shed %v", l.accepted, l.shed)
+	}
+}
+
+func TestLimitedRetryAfter(t *testing.T) {
+	dependency := newTestLimiter(5)
+	dependency.inflight = 4
+	handler := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+
+	for _, tt := range []struct {
+		priority   int
+		status     int
+		retryAfter string
+	}{
+		{priorityLow, http.StatusServiceUnavailable, "5"},
+		{priorityNormal, http.StatusServiceUnavailable, "1"},
+		{priorityHigh, http.StatusNoContent, ""},
+	} {
+		w := httptest.NewRecorder()
+		limited("limiter-test", tt.priority, handler, dependency)(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != tt.status || w.Header().Get("Retry-After") != tt.retryAfter {
+			t.Errorf("%s priority: status %d, Retry-After %q", priorityNames[tt.priority], w.Code, w.Header().Get("Retry-After"))
+		}
+	}
+	if dependency.shed[priorityLow] != 1 || dependency.shed[priorityNormal] != 1 {
+		t.Errorf("dependency shed %v", dependency.shed)
+	}
+}
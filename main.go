@@ -3,11 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -18,8 +20,17 @@ import (
 
 type WeatherData struct {
 	City        string    `bson:"city" json:"city"`
+	Country     string    `bson:"country,omitempty" json:"country,omitempty"`
+	Lat         float64   `bson:"lat" json:"lat"`
+	Lon         float64   `bson:"lon" json:"lon"`
 	Description string    `bson:"description" json:"description"`
 	Temp        float64   `bson:"temp" json:"temp"`
+	Wind        float64   `bson:"wind" json:"wind"`
+	Precip      float64   `bson:"precip" json:"precip"`
+	Tags        []string  `bson:"tags,omitempty" json:"tags,omitempty"`
+	Tenant      string    `bson:"tenant,omitempty" json:"tenant,omitempty"`
+	Provider    string    `bson:"provider,omitempty" json:"provider,omitempty"`
+	Route       string    `bson:"route,omitempty" json:"route,omitempty"`
 	LastUpdated time.Time `bson:"last_updated" json:"last_updated"`
 }
 
@@ -32,27 +43,75 @@ type weatherjson struct {
 		Temp float64 `json:"temp"`
 	} `json:"main"`
 
+	Wind struct {
+		Speed float64 `json:"speed"`
+	} `json:"wind"`
+
+	Rain struct {
+		OneHour float64 `json:"1h"`
+	} `json:"rain"`
+
+	Coord struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	} `json:"coord"`
+
+	Sys struct {
+		Country string `json:"country"`
+	} `json:"sys"`
+
 	Name string `json:"name"`
 }
 
 var weatherCollection *mongo.Collection
+var router *Router
+
+const listenAddr = ":8080"
 
 func main() {
+	// Commands like `weather doctor` run before the setup below, which they may diagnose
+	if len(os.Args) > 1 {
+		if command, ok := offlineCommands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
 	// Load environment variables
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		log.Fatal("Error loading .env file (run `weather doctor` for details)")
 	}
 
 	MONGO_URI := os.Getenv("MONGO_URI")
 	BASE_URL := os.Getenv("BASE_URL")
 	API_KEY := os.Getenv("API_KEY")
+	ROUTING_CONFIG := os.Getenv("ROUTING_CONFIG")
+	shareSecret = []byte(os.Getenv("SHARE_SECRET"))
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	adminInsecure = os.Getenv("ADMIN_INSECURE") == "1"
+
+	router, err = loadRouter(ROUTING_CONFIG, newOpenWeatherProvider("openweather", BASE_URL, API_KEY))
+	if err != nil {
+		log.Fatal("Failed to load routing rules:", err)
+	}
+	if err := loadSLOConfig(os.Getenv("SLO_CONFIG")); err != nil {
+		log.Fatal("Failed to load SLOs:", err)
+	}
+	if err := loadExportConfig(os.Getenv("EXPORT_CONFIG")); err != nil {
+		log.Fatal("Failed to load exports:", err)
+	}
+	if err := loadMaintenanceConfig(os.Getenv("READ_ONLY")); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadDiscoveryConfig(); err != nil {
+		log.Fatal("Failed to configure service discovery:", err)
+	}
 
 	// Connect to MongoDB
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(MONGO_URI))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(MONGO_URI).SetMonitor(mongoCommandMonitor()))
 	if err != nil {
 		log.Fatal("Failed to connect to MongoDB:", err)
 	}
@@ -67,47 +126,149 @@ func main() {
 		}
 	}()
 
-	weatherCollection = client.Database("weatherdb").Collection("weather")
+	initStore(client.Database(databaseName))
+	if err := ensureIndexes(ctx); err != nil {
+		log.Fatal("Failed to create indexes:", err)
+	}
+	if err := syncMaintenance(ctx); err != nil {
+		log.Fatal("Failed to load maintenance mode:", err)
+	}
 
+	// Run a one-off command instead of the server, e.g. `weather rebuild-projections`
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if !readOnly.Load() {
+		if n, err := failInterruptedBulkJobs(ctx); err != nil {
+			log.Println("Failed to clean up interrupted bulk jobs:", err)
+		} else if n > 0 {
+			log.Printf("Marked %d interrupted bulk jobs as failed", n)
+		}
+	}
+
+	getWeather := limited("weather_get", priorityHigh, getWeatherHandler, mongoLimiter)
+	putWeather := limited("weather_put", priorityNormal, putWeatherHandler, mongoLimiter, upstreamLimiter)
+	deleteWeather := limited("weather_delete", priorityNormal, readOnlyGuard(deleteWeatherHandler), mongoLimiter)
 	http.HandleFunc("/weather", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			getWeatherHandler(w, r)
+			getWeather(w, r)
 		case http.MethodPut:
-			putWeatherHandler(w, r, BASE_URL, API_KEY)
+			putWeather(w, r)
+		case http.MethodDelete:
+			deleteWeather(w, r)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	})
+	http.HandleFunc("/weather/bulk", limited("bulk", priorityLow, bulkHandler, mongoLimiter))
+	http.HandleFunc("/weather/bulk/", limited("bulk_job", priorityLow, bulkJobHandler, mongoLimiter))
+	http.HandleFunc("/weather/search", limited("search", priorityNormal, searchWeatherHandler, mongoLimiter))
+	http.HandleFunc("/weather/stats", limited("stats", priorityLow, statsHandler, mongoLimiter))
+	http.HandleFunc("/weather/compare", limited("compare", priorityLow, compareHandler, mongoLimiter))
+	http.HandleFunc("/weather/regions", limited("regions", priorityLow, regionsHandler, mongoLimiter))
+	http.HandleFunc("/weather/episodes", limited("episodes", priorityLow, episodesHandler, mongoLimiter))
+	http.HandleFunc("/weather/records", limited("records", priorityLow, recordsHandler, mongoLimiter))
+	http.HandleFunc("/share", limited("share", priorityNormal, readOnlyGuard(sharesHandler), mongoLimiter))
+	http.HandleFunc("/s/", limited("share_open", priorityLow, openShareHandler, mongoLimiter))
+	http.HandleFunc("/storms", limited("storms", priorityLow, stormsHandler, mongoLimiter))
+	http.HandleFunc("/storms/", limited("storm", priorityLow, stormHandler, mongoLimiter))
+	http.HandleFunc("/analytics/series", limited("series", priorityNormal, readOnlyGuard(seriesHandler), mongoLimiter))
+	http.HandleFunc("/analytics/correlation", limited("correlation", priorityLow, correlationHandler, mongoLimiter))
+	http.HandleFunc("/forecast", limited("forecast", priorityNormal, forecastHandler, mongoLimiter, upstreamLimiter))
+	http.HandleFunc("/forecast/probability", limited("forecast_probability", priorityLow, forecastProbabilityHandler, mongoLimiter, upstreamLimiter))
+	http.HandleFunc("/ui", limited("ui", priorityNormal, uiHandler, mongoLimiter))
+	http.HandleFunc("/widget", limited("widget", priorityNormal, widgetHandler, mongoLimiter))
+	http.HandleFunc("/plan", limited("plan", priorityNormal, readOnlyGuard(planHandler), mongoLimiter, upstreamLimiter))
+	http.HandleFunc("/plan/", limited("plan_get", priorityNormal, readOnlyGuard(planByIDHandler), mongoLimiter))
+	http.HandleFunc("/query", limited("query", priorityLow, queryHandler, mongoLimiter))
+	http.HandleFunc("/admin/slo", adminOnly(sloHandler))
+	http.HandleFunc("/admin/exports", adminOnly(readOnlyGuard(exportsHandler)))
+	http.HandleFunc("/admin/audit", adminOnly(auditHandler))
+	http.HandleFunc("/admin/maintenance", adminOnly(maintenanceHandler))
+	http.HandleFunc("/admin/tenants", adminOnly(tenantsHandler))
+	http.HandleFunc("/admin/tenants/", adminOnly(readOnlyGuard(tenantHandler)))
+	http.HandleFunc("/admin/webhooks", adminOnly(readOnlyGuard(webhooksHandler)))
+	http.HandleFunc("/admin/webhooks/", adminOnly(readOnlyGuard(webhookHandler)))
+	http.HandleFunc("/admin/cluster", adminOnly(clusterHandler))
+	http.HandleFunc("/admin/cluster/invalidate", adminOnly(invalidateHandler))
+	http.HandleFunc("/admin/cluster/maintenance", adminOnly(clusterMaintenanceHandler))
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+
+	subscribe(refreshResponseCache)
+	subscribe(notifyPeers)
+	subscribe(dispatchWebhooks)
+	subscribe(reevaluatePlans)
+	go runSLOEvaluator()
+	go runExportScheduler()
+	go runRefreshScheduler()
+	go runDiscovery()
+	go runWebhooks()
+	go runPlanMonitor()
+	go watchMaintenanceSignal()
+	go runMaintenanceSync()
 
 	fmt.Println("Server is running on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Fatal(http.ListenAndServe(listenAddr, withMaintenanceHeader(http.DefaultServeMux)))
 }
 
 func getWeatherHandler(w http.ResponseWriter, r *http.Request) {
-	city := r.URL.Query().Get("city")
+	query := r.URL.Query()
+	city := query.Get("city")
 	if city == "" {
 		http.Error(w, "City parameter is required", http.StatusBadRequest)
 		return
 	}
+	variant, ok := responseVariant(query.Get("format"), query.Get("units"))
+	if !ok {
+		http.Error(w, "format must be json or csv and units metric, imperial or standard", http.StatusBadRequest)
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	// Hot cities are served from responses encoded when they were written
+	response, ok := cachedResponse(city, variant)
+	if !ok {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
 
-	var weather WeatherData
-	err := weatherCollection.FindOne(ctx, bson.M{"city": city}).Decode(&weather)
-	if err != nil {
-		http.Error(w, "Weather data not found", http.StatusNotFound)
-		return
+		generation := responseGeneration(city)
+		var weather WeatherData
+		err := weatherCollection.FindOne(ctx, bson.M{"city": city}).Decode(&weather)
+		if err != nil {
+			http.Error(w, "Weather data not found", http.StatusNotFound)
+			return
+		}
+		responses, err := storeResponses(weather, generation)
+		if err != nil {
+			http.Error(w, "Failed to encode weather data", http.StatusInternalServerError)
+			return
+		}
+		response = responses[variant]
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(weather)
+	header := w.Header()
+	header["Etag"] = response.etagHeader
+	if match := r.Header.Get("If-None-Match"); match != "" && match == response.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	header["Content-Type"] = response.contentType
+	w.Write(response.body)
 }
 
-func putWeatherHandler(w http.ResponseWriter, r *http.Request, baseURL, apiKey string) {
+func putWeatherHandler(w http.ResponseWriter, r *http.Request) {
 	var requestBody struct {
-		City string `json:"city"`
+		City    string   `json:"city"`
+		Country string   `json:"country"`
+		Lat     *float64 `json:"lat"`
+		Lon     *float64 `json:"lon"`
+		Tags    []string `json:"tags"`
+		Tenant  string   `json:"tenant"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -120,49 +281,138 @@ func putWeatherHandler(w http.ResponseWriter, r *http.Request, baseURL, apiKey s
 		return
 	}
 
-	// Fetch weather data from OpenWeather API
-	searchURL := fmt.Sprintf("%v?appid=%s&q=%s", baseURL, apiKey, city)
-	response, err := http.Get(searchURL)
+	loc := Location{City: city, Country: requestBody.Country, Tags: requestBody.Tags, Tenant: requestBody.Tenant}
+	if loc.Tenant == "" {
+		loc.Tenant = r.Header.Get("X-Tenant")
+	}
+	if requestBody.Lat != nil && requestBody.Lon != nil {
+		loc.Lat, loc.Lon, loc.HasPos = *requestBody.Lat, *requestBody.Lon, true
+	}
+
+	// During maintenance the refresh is queued and runs when writes resume
+	if readOnly.Load() {
+		if !queueRefresh(loc) {
+			refuseWrite(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(struct {
+			City   string `json:"city"`
+			Queued bool   `json:"queued"`
+		}{city, true})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	weatherData, err := refreshLocation(ctx, loc)
+	switch {
+	case errors.Is(err, errFetchFailed):
+		log.Println(err)
+		http.Error(w, "Failed to fetch weather data", http.StatusBadGateway)
+		return
+	case errors.Is(err, errReadOnly):
+		refuseWrite(w)
+		return
+	case err != nil:
+		log.Println("Failed to record fetch:", err)
+		http.Error(w, "Failed to update weather data", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(weatherData)
+}
+
+var errFetchFailed = errors.New("failed to fetch weather data")
+
+// refreshLocation fetches current weather for loc from the routed provider and
+// records it. What is already stored about the city fills in missing location
+// details so routing rules can use them.
+func refreshLocation(ctx context.Context, loc Location) (WeatherData, error) {
+	var stored WeatherData
+	if err := weatherCollection.FindOne(ctx, bson.M{"city": loc.City}).Decode(&stored); err == nil {
+		if loc.Country == "" {
+			loc.Country = stored.Country
+		}
+		if !loc.HasPos && (stored.Lat != 0 || stored.Lon != 0) {
+			loc.Lat, loc.Lon, loc.HasPos = stored.Lat, stored.Lon, true
+		}
+		if len(loc.Tags) == 0 {
+			loc.Tags = stored.Tags
+		}
+		if loc.Tenant == "" {
+			loc.Tenant = stored.Tenant
+		}
+	}
+
+	weatherData, err := router.Fetch(loc)
 	if err != nil {
-		http.Error(w, "Failed to fetch weather data", http.StatusInternalServerError)
+		recordRefreshOutcome(loc.City, false)
+		return WeatherData{}, fmt.Errorf("%w: %v", errFetchFailed, err)
+	}
+	recordRefreshOutcome(weatherData.City, true)
+	weatherData.Tags = loc.Tags
+	weatherData.Tenant = loc.Tenant
+
+	// The weather collection is updated from the event
+	_, err = recordEvent(ctx, Event{Type: EventFetch, City: weatherData.City, Data: &weatherData})
+	return weatherData, err
+}
+
+func deleteWeatherHandler(w http.ResponseWriter, r *http.Request) {
+	city := r.URL.Query().Get("city")
+	if city == "" {
+		http.Error(w, "City parameter is required", http.StatusBadRequest)
 		return
 	}
-	defer response.Body.Close()
 
-	if response.StatusCode != http.StatusOK {
-		http.Error(w, "Failed to fetch weather data from API", http.StatusInternalServerError)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	count, err := weatherCollection.CountDocuments(ctx, bson.M{"city": city})
+	if err != nil {
+		http.Error(w, "Failed to delete weather data", http.StatusInternalServerError)
+		return
+	}
+	if count == 0 {
+		http.Error(w, "Weather data not found", http.StatusNotFound)
 		return
 	}
 
-	weatherBytes, _ := io.ReadAll(response.Body)
-	var weatherAPIResponse weatherjson
-	if err := json.Unmarshal(weatherBytes, &weatherAPIResponse); err != nil {
-		http.Error(w, "Failed to parse weather data", http.StatusInternalServerError)
+	if _, err := recordEvent(ctx, Event{Type: EventDelete, City: city}); err != nil {
+		log.Println("Failed to record delete:", err)
+		http.Error(w, "Failed to delete weather data", http.StatusInternalServerError)
 		return
 	}
 
-	// Prepare the data for MongoDB
-	weatherData := WeatherData{
-		City:        weatherAPIResponse.Name,
-		Description: weatherAPIResponse.Weather[0].Description,
-		Temp:        weatherAPIResponse.Main.Temp - 273.15,
-		LastUpdated: time.Now(),
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func searchWeatherHandler(w http.ResponseWriter, r *http.Request) {
+	q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	if q == "" {
+		http.Error(w, "q parameter is required", http.StatusBadRequest)
+		return
 	}
 
-	// Upsert data into MongoDB
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	filter := bson.M{"city": weatherData.City}
-	update := bson.M{"$set": weatherData}
-	opts := options.Update().SetUpsert(true)
-
-	_, err = weatherCollection.UpdateOne(ctx, filter, update, opts)
+	filter := bson.M{"city_lower": bson.M{"$regex": "^" + regexp.QuoteMeta(q)}}
+	cursor, err := searchCollection.Find(ctx, filter, options.Find().SetLimit(20))
 	if err != nil {
-		http.Error(w, "Failed to update weather data", http.StatusInternalServerError)
+		http.Error(w, "Failed to search weather data", http.StatusInternalServerError)
+		return
+	}
+	results := []searchEntry{}
+	if err := cursor.All(ctx, &results); err != nil {
+		http.Error(w, "Failed to search weather data", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(weatherData)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
 }
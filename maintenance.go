@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// In read-only mode nothing writes to MongoDB: refreshes are queued and replayed
+// when the mode ends, other writes are refused, and reads are served from the
+// response cache or the store with an X-Maintenance header.
+//
+// The mode is on while any source asks for it: the process itself (READ_ONLY,
+// SIGUSR1) or the whole cluster (the admin API, stored in MongoDB and polled by
+// every replica).
+var (
+	readOnly atomic.Bool
+
+	maintenanceMu      sync.Mutex
+	maintenanceSources = map[string]string{} // source -> reason
+	maintenanceSince   time.Time
+	maintenanceQueue   []Location
+
+	maintenanceCollection *mongo.Collection
+)
+
+const (
+	maintenanceLocal   = "local"
+	maintenanceCluster = "cluster"
+)
+
+const (
+	maxMaintenanceQueue     = 1000
+	maintenanceRetryAfter   = 60
+	maintenanceHeader       = "X-Maintenance"
+	maintenanceHeaderActive = "read-only"
+	maintenanceSyncInterval = 10 * time.Second
+	maintenanceDocID        = "mode"
+)
+
+// maintenanceMode is the cluster-wide mode as stored in MongoDB. Writing it is
+// the one write allowed while read-only.
+type maintenanceMode struct {
+	ID        string    `bson:"_id"`
+	ReadOnly  bool      `bson:"read_only"`
+	Reason    string    `bson:"reason,omitempty"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+var errReadOnly = errors.New("service is in read-only maintenance mode")
+
+type MaintenanceStatus struct {
+	ReadOnly bool      `json:"read_only"`
+	Reason   string    `json:"reason,omitempty"`
+	Since    time.Time `json:"since,omitempty"`
+	Queued   int       `json:"queued_refreshes"`
+}
+
+func maintenanceStatus() MaintenanceStatus {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	status := MaintenanceStatus{ReadOnly: readOnly.Load(), Queued: len(maintenanceQueue)}
+	if status.ReadOnly {
+		status.Reason, status.Since = maintenanceReason(), maintenanceSince
+	}
+	return status
+}
+
+// maintenanceReason joins the reasons of every source holding the mode on. The
+// caller holds maintenanceMu.
+func maintenanceReason() string {
+	var reasons []string
+	for _, source := range []string{maintenanceCluster, maintenanceLocal} {
+		if reason, ok := maintenanceSources[source]; ok {
+			reasons = append(reasons, reason)
+		}
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// setReadOnly turns one source's request for the mode on or off. The mode
+// follows the sources; leaving it replays the queued refreshes.
+func setReadOnly(source string, on bool, reason string) {
+	maintenanceMu.Lock()
+	if on {
+		maintenanceSources[source] = reason
+	} else {
+		delete(maintenanceSources, source)
+	}
+	on = len(maintenanceSources) > 0
+	reason = maintenanceReason()
+	was := readOnly.Swap(on)
+	if on && !was {
+		maintenanceSince = time.Now()
+	}
+	var queued []Location
+	if !on && was {
+		queued, maintenanceQueue = maintenanceQueue, nil
+	}
+	maintenanceMu.Unlock()
+
+	if on && !was {
+		log.Printf("Read-only mode on (%s)", reason)
+	} else if !on && was {
+		log.Printf("Read-only mode off, replaying %d queued refreshes", len(queued))
+	}
+	if len(queued) > 0 {
+		go replayQueuedRefreshes(queued)
+	}
+}
+
+// queueRefresh keeps the latest request per city; it reports false when full.
+func queueRefresh(loc Location) bool {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	for i, queued := range maintenanceQueue {
+		if queued.City == loc.City {
+			maintenanceQueue[i] = loc
+			return true
+		}
+	}
+	if len(maintenanceQueue) >= maxMaintenanceQueue {
+		return false
+	}
+	maintenanceQueue = append(maintenanceQueue, loc)
+	return true
+}
+
+func replayQueuedRefreshes(queued []Location) {
+	for _, loc := range queued {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if _, err := refreshLocation(ctx, loc); err != nil {
+			log.Printf("Failed to replay queued refresh of %s: %v", loc.City, err)
+			if errors.Is(err, errReadOnly) {
+				queueRefresh(loc)
+			}
+		}
+		cancel()
+	}
+}
+
+func loadMaintenanceConfig(value string) error {
+	if value == "" {
+		return nil
+	}
+	on, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("READ_ONLY must be true or false")
+	}
+	setReadOnly(maintenanceLocal, on, "READ_ONLY")
+	return nil
+}
+
+// watchMaintenanceSignal toggles this process's read-only mode on SIGUSR1.
+func watchMaintenanceSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		maintenanceMu.Lock()
+		_, on := maintenanceSources[maintenanceLocal]
+		maintenanceMu.Unlock()
+		setReadOnly(maintenanceLocal, !on, "SIGUSR1")
+	}
+}
+
+// syncMaintenance applies the cluster-wide mode stored in MongoDB.
+func syncMaintenance(ctx context.Context) error {
+	var mode maintenanceMode
+	err := maintenanceCollection.FindOne(ctx, bson.M{"_id": maintenanceDocID}).Decode(&mode)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	setReadOnly(maintenanceCluster, mode.ReadOnly, mode.Reason)
+	return nil
+}
+
+// runMaintenanceSync polls the cluster-wide mode, so every replica follows a
+// switch made on any of them. While MongoDB is unreachable the last known mode
+// stays in force.
+func runMaintenanceSync() {
+	for {
+		time.Sleep(maintenanceSyncInterval)
+		ctx, cancel := context.WithTimeout(context.Background(), maintenanceSyncInterval)
+		if err := syncMaintenance(ctx); err != nil {
+			log.Println("Failed to load maintenance mode:", err)
+		}
+		cancel()
+	}
+}
+
+// withMaintenanceHeader marks every response served while read-only.
+func withMaintenanceHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if readOnly.Load() {
+			w.Header().Set(maintenanceHeader, maintenanceHeaderActive)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func refuseWrite(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+	http.Error(w, "Read-only maintenance in progress, retry later", http.StatusServiceUnavailable)
+}
+
+// readOnlyGuard refuses anything but GET and HEAD while read-only.
+func readOnlyGuard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if readOnly.Load() && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			refuseWrite(w)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// maintenanceHandler reports (GET) or switches (PUT {"read_only": true, "reason": ...})
+// read-only mode for the whole cluster. Peers are told to pick up the switch at
+// once instead of at their next poll.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var body struct {
+			ReadOnly *bool  `json:"read_only"`
+			Reason   string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ReadOnly == nil {
+			http.Error(w, "read_only is required", http.StatusBadRequest)
+			return
+		}
+		if body.Reason == "" {
+			body.Reason = "admin API"
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		mode := maintenanceMode{ID: maintenanceDocID, ReadOnly: *body.ReadOnly, Reason: body.Reason, UpdatedAt: time.Now()}
+		if _, err := maintenanceCollection.ReplaceOne(ctx, bson.M{"_id": maintenanceDocID}, mode, options.Replace().SetUpsert(true)); err != nil {
+			http.Error(w, "Failed to store maintenance mode", http.StatusInternalServerError)
+			return
+		}
+		setReadOnly(maintenanceCluster, mode.ReadOnly, mode.Reason)
+		notifyPeersOfMaintenance()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenanceStatus())
+}
+
+// readyzHandler reports whether the instance can serve traffic. In read-only mode
+// it stays ready without MongoDB, since reads can come from the response cache.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		Ready bool   `json:"ready"`
+		Mode  string `json:"mode"`
+		Mongo string `json:"mongo"`
+	}{Ready: true, Mode: "read-write", Mongo: "ok"}
+	if readOnly.Load() {
+		status.Mode = "read-only"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := weatherCollection.Database().Client().Ping(ctx, nil); err != nil {
+		status.Mongo = err.Error()
+		status.Ready = readOnly.Load()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+func writeMaintenanceMetrics(w io.Writer) {
+	status := maintenanceStatus()
+	value := 0
+	if status.ReadOnly {
+		value = 1
+	}
+	writeMetricHeader(w, "weather_read_only", "gauge", "1 while the service is in read-only maintenance mode.")
+	fmt.Fprintf(w, "weather_read_only %d\n", value)
+	writeMetricHeader(w, "weather_maintenance_queued_refreshes", "gauge", "Refreshes queued until read-only mode ends.")
+	fmt.Fprintf(w, "weather_maintenance_queued_refreshes %d\n", status.Queued)
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestSetReadOnlyCombinesSources(t *testing.T) {
+	defer func() {
+		setReadOnly(maintenanceLocal, false, "")
+		setReadOnly(maintenanceCluster, false, "")
+	}()
+
+	setReadOnly(maintenanceCluster, true, "migration")
+	setReadOnly(maintenanceLocal, true, "SIGUSR1")
+	if status := maintenanceStatus(); !status.ReadOnly || status.Reason != "migration; SIGUSR1" {
+		t.Fatalf("both sources on: %+v", status)
+	}
+	setReadOnly(maintenanceLocal, false, "")
+	if status := maintenanceStatus(); !status.ReadOnly || status.Reason != "migration" {
+		t.Errorf("cluster mode dropped with the local one: %+v", status)
+	}
+	setReadOnly(maintenanceCluster, false, "")
+	if readOnly.Load() {
+		t.Error("still read-only with no source on")
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// metricsWriters each write one or more metric families in the Prometheus text format.
+var metricsWriters = []func(w io.Writer){
+	writeLimiterMetrics,
+	writeMaintenanceMetrics,
+	writeProviderCacheMetrics,
+	writeClusterMetrics,
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, write := range metricsWriters {
+		write(w)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const oneCallURL = "https://api.openweathermap.org/data/3.0/onecall"
+
+// oneCallProvider uses OpenWeather's One Call API, which returns current
+// conditions, minutely, hourly and daily forecasts and alerts in one response.
+// It needs coordinates.
+type oneCallProvider struct {
+	name    string
+	baseURL string
+	apiKey  string
+}
+
+func newOneCallProvider(name, baseURL, apiKey string) *oneCallProvider {
+	if baseURL == "" {
+		baseURL = oneCallURL
+	}
+	return &oneCallProvider{name: name, baseURL: baseURL, apiKey: apiKey}
+}
+
+type oneCallConditions []struct {
+	Description string `json:"description"`
+}
+
+func (c oneCallConditions) description() string {
+	if len(c) == 0 {
+		return ""
+	}
+	return c[0].Description
+}
+
+type oneCallVolume struct {
+	OneHour float64 `json:"1h"`
+}
+
+type oneCallResponse struct {
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+	Current struct {
+		Dt        int64             `json:"dt"`
+		Temp      float64           `json:"temp"`
+		WindSpeed float64           `json:"wind_speed"`
+		Rain      oneCallVolume     `json:"rain"`
+		Snow      oneCallVolume     `json:"snow"`
+		Weather   oneCallConditions `json:"weather"`
+	} `json:"current"`
+	Minutely []struct {
+		Dt            int64   `json:"dt"`
+		Precipitation float64 `json:"precipitation"`
+	} `json:"minutely"`
+	Hourly []struct {
+		Dt        int64             `json:"dt"`
+		Temp      float64           `json:"temp"`
+		WindSpeed float64           `json:"wind_speed"`
+		Pop       float64           `json:"pop"`
+		Rain      oneCallVolume     `json:"rain"`
+		Snow      oneCallVolume     `json:"snow"`
+		Weather   oneCallConditions `json:"weather"`
+	} `json:"hourly"`
+	Daily []struct {
+		Dt      int64  `json:"dt"`
+		Summary string `json:"summary"`
+		Temp    struct {
+			Min float64 `json:"min"`
+			Max float64 `json:"max"`
+		} `json:"temp"`
+		WindSpeed float64           `json:"wind_speed"`
+		Pop       float64           `json:"pop"`
+		Rain      float64           `json:"rain"`
+		Snow      float64           `json:"snow"`
+		Weather   oneCallConditions `json:"weather"`
+	} `json:"daily"`
+	Alerts []struct {
+		SenderName  string   `json:"sender_name"`
+		Event       string   `json:"event"`
+		Start       int64    `json:"start"`
+		End         int64    `json:"end"`
+		Description string   `json:"description"`
+		Tags        []string `json:"tags"`
+	} `json:"alerts"`
+}
+
+func (p *oneCallProvider) Name() string {
+	return p.name
+}
+
+func (p *oneCallProvider) fetch(loc Location) (oneCallResponse, error) {
+	if !loc.HasPos {
+		return oneCallResponse{}, fmt.Errorf("%s needs coordinates for %s", p.name, loc.City)
+	}
+	query := url.Values{
+		"lat":   {fmt.Sprint(loc.Lat)},
+		"lon":   {fmt.Sprint(loc.Lon)},
+		"appid": {p.apiKey},
+		"units": {"metric"},
+	}
+	response, err := providerClient.Get(p.baseURL + "?" + query.Encode())
+	if err != nil {
+		return oneCallResponse{}, fmt.Errorf("failed to fetch weather data: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return oneCallResponse{}, &providerStatusError{StatusCode: response.StatusCode}
+	}
+	raw, err := io.ReadAll(response.Body)
+	if err != nil {
+		return oneCallResponse{}, fmt.Errorf("failed to read weather data: %w", err)
+	}
+	var body oneCallResponse
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return oneCallResponse{}, fmt.Errorf("failed to parse weather data: %w", err)
+	}
+	return body, nil
+}
+
+func (p *oneCallProvider) Current(loc Location) (WeatherData, error) {
+	body, err := p.fetch(loc)
+	if err != nil {
+		return WeatherData{}, err
+	}
+	if len(body.Current.Weather) == 0 {
+		return WeatherData{}, fmt.Errorf("weather data has no conditions")
+	}
+	return oneCallWeather(loc, body), nil
+}
+
+func (p *oneCallProvider) Forecast(loc Location, hours int) (Forecast, error) {
+	body, err := p.fetch(loc)
+	if err != nil {
+		return Forecast{}, err
+	}
+	return oneCallForecast(loc, body, hours), nil
+}
+
+func oneCallWeather(loc Location, body oneCallResponse) WeatherData {
+	return WeatherData{
+		City:        loc.City,
+		Country:     loc.Country,
+		Lat:         body.Lat,
+		Lon:         body.Lon,
+		Description: body.Current.Weather.description(),
+		Temp:        body.Current.Temp,
+		Wind:        body.Current.WindSpeed,
+		Precip:      body.Current.Rain.OneHour + body.Current.Snow.OneHour,
+		LastUpdated: time.Now(),
+	}
+}
+
+func oneCallForecast(loc Location, body oneCallResponse, hours int) Forecast {
+	forecast := Forecast{City: loc.City, Lat: body.Lat, Lon: body.Lon}
+	for _, m := range body.Minutely {
+		forecast.Minutes = append(forecast.Minutes, ForecastMinute{Time: time.Unix(m.Dt, 0).UTC(), Precip: m.Precipitation})
+	}
+	for _, h := range body.Hourly {
+		if len(forecast.Hours) == hours {
+			break
+		}
+		chance := h.Pop
+		forecast.Hours = append(forecast.Hours, ForecastHour{
+			Time:         time.Unix(h.Dt, 0).UTC(),
+			Temp:         ForecastValue{Value: h.Temp},
+			Wind:         ForecastValue{Value: h.WindSpeed},
+			Precip:       ForecastValue{Value: h.Rain.OneHour + h.Snow.OneHour},
+			PrecipChance: &chance,
+			Description:  h.Weather.description(),
+		})
+	}
+	for _, d := range body.Daily {
+		forecast.Days = append(forecast.Days, ForecastDay{
+			Day:          time.Unix(d.Dt, 0).UTC().Format(dayLayout),
+			MinTemp:      d.Temp.Min,
+			MaxTemp:      d.Temp.Max,
+			Wind:         d.WindSpeed,
+			Precip:       d.Rain + d.Snow,
+			PrecipChance: d.Pop,
+			Description:  d.Weather.description(),
+			Summary:      d.Summary,
+		})
+	}
+	for _, a := range body.Alerts {
+		forecast.Warnings = append(forecast.Warnings, Warning{
+			Sender:      a.SenderName,
+			Event:       a.Event,
+			Start:       time.Unix(a.Start, 0).UTC(),
+			End:         time.Unix(a.End, 0).UTC(),
+			Description: a.Description,
+			Tags:        a.Tags,
+		})
+	}
+	return forecast
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func loadOneCallFixture(t *testing.T, name string) oneCallResponse {
+	t.Helper()
+	raw, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body oneCallResponse
+	if err := json.Unmarshal(raw, &body); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return body
+}
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestOneCallWeather(t *testing.T) {
+	loc := Location{City: "Berlin", Country: "DE", Lat: 52.5, Lon: 13.4, HasPos: true}
+	weather := oneCallWeather(loc, loadOneCallFixture(t, "onecall_full.json"))
+	if weather.City != "Berlin" || weather.Country != "DE" || weather.Lat != 52.52 || weather.Lon != 13.405 {
+		t.Errorf("unexpected location %+v", weather)
+	}
+	if weather.Description != "rain and snow" || weather.Temp != 0.8 || weather.Wind != 4.6 {
+		t.Errorf("unexpected conditions %+v", weather)
+	}
+	// Rain and snow both count as precipitation
+	if !closeTo(weather.Precip, 0.65) {
+		t.Errorf("precip = %v, want 0.65", weather.Precip)
+	}
+
+	dry := oneCallWeather(Location{City: "Sydney"}, loadOneCallFixture(t, "onecall_dry.json"))
+	if dry.Precip != 0 || dry.Description != "clear sky" || dry.Temp != 27.4 {
+		t.Errorf("unexpected dry conditions %+v", dry)
+	}
+}
+
+func TestOneCallForecast(t *testing.T) {
+	forecast := oneCallForecast(Location{City: "Berlin"}, loadOneCallFixture(t, "onecall_full.json"), 2)
+	if forecast.City != "Berlin" || forecast.Lat != 52.52 {
+		t.Errorf("unexpected forecast %+v", forecast)
+	}
+
+	if len(forecast.Minutes) != 3 || forecast.Minutes[1].Precip != 0.58 || !forecast.Minutes[1].Time.Equal(time.Unix(1706713260, 0)) {
+		t.Errorf("unexpected minutes %+v", forecast.Minutes)
+	}
+
+	if len(forecast.Hours) != 2 {
+		t.Fatalf("got %d hours, want the 2 asked for", len(forecast.Hours))
+	}
+	first, second := forecast.Hours[0], forecast.Hours[1]
+	if !first.Time.Equal(time.Date(2024, 1, 31, 15, 0, 0, 0, time.UTC)) || first.Time.Location() != time.UTC {
+		t.Errorf("first hour at %s", first.Time)
+	}
+	if first.Temp.Value != 0.8 || first.Wind.Value != 4.6 || !closeTo(first.Precip.Value, 0.65) || first.Description != "rain and snow" {
+		t.Errorf("unexpected first hour %+v", first)
+	}
+	if second.PrecipChance == nil || *second.PrecipChance != 0.64 || second.Precip.Value != 0.31 {
+		t.Errorf("unexpected second hour %+v", second)
+	}
+	if first.PrecipChance == second.PrecipChance {
+		t.Error("hours share one precip chance")
+	}
+
+	wantDays := []ForecastDay{
+		{Day: "2024-01-31", MinTemp: -1.4, MaxTemp: 2.3, Wind: 5.2, Precip: 4.8, PrecipChance: 1, Description: "rain and snow", Summary: "Expect a day of partly cloudy with rain and snow"},
+		{Day: "2024-02-01", MinTemp: -0.8, MaxTemp: 4.6, Wind: 3.3, Precip: 0, PrecipChance: 0, Description: "clear sky", Summary: "There will be clear sky today"},
+	}
+	if len(forecast.Days) != len(wantDays) {
+		t.Fatalf("got %d days, want %d", len(forecast.Days), len(wantDays))
+	}
+	for i, want := range wantDays {
+		got := forecast.Days[i]
+		if !closeTo(got.Precip, want.Precip) {
+			t.Errorf("day %d precip = %v, want %v", i, got.Precip, want.Precip)
+		}
+		got.Precip = want.Precip
+		if got != want {
+			t.Errorf("day %d: got %+v, want %+v", i, got, want)
+		}
+	}
+
+	wantWarnings := []Warning{{
+		Sender:      "Deutscher Wetterdienst",
+		Event:       "Glätte",
+		Start:       time.Date(2024, 1, 31, 15, 0, 0, 0, time.UTC),
+		End:         time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC),
+		Description: "Es tritt Glätte durch Schneematsch auf.",
+		Tags:        []string{"Snow/Ice"},
+	}}
+	if !reflect.DeepEqual(forecast.Warnings, wantWarnings) {
+		t.Errorf("got warnings %+v, want %+v", forecast.Warnings, wantWarnings)
+	}
+}
+
+func TestOneCallForecastWithoutAlertsOrRain(t *testing.T) {
+	forecast := oneCallForecast(Location{City: "Sydney"}, loadOneCallFixture(t, "onecall_dry.json"), 48)
+	if forecast.Warnings != nil || forecast.Minutes != nil {
+		t.Errorf("got warnings %v and minutes %v, want none", forecast.Warnings, forecast.Minutes)
+	}
+	if len(forecast.Hours) != 1 || forecast.Hours[0].Precip.Value != 0 || *forecast.Hours[0].PrecipChance != 0 {
+		t.Errorf("unexpected hours %+v", forecast.Hours)
+	}
+	if len(forecast.Days) != 1 || forecast.Days[0].Precip != 0 || forecast.Days[0].Day != "2024-02-01" {
+		t.Errorf("unexpected days %+v", forecast.Days)
+	}
+}
+
+func TestOneCallProvider(t *testing.T) {
+	raw, err := os.ReadFile("testdata/onecall_full.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := http.StatusOK
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("lat") != "52.52" || q.Get("lon") != "13.405" || q.Get("appid") != "key" || q.Get("units") != "metric" {
+			t.Errorf("unexpected query %s", r.URL.RawQuery)
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		w.Write(raw)
+	}))
+	defer stub.Close()
+
+	p := newOneCallProvider("onecall", stub.URL, "key")
+	loc := Location{City: "Berlin", Lat: 52.52, Lon: 13.405, HasPos: true}
+	weather, err := p.Current(loc)
+	if err != nil || weather.Description != "rain and snow" {
+		t.Errorf("Current: %+v, %v", weather, err)
+	}
+	forecast, err := p.Forecast(loc, 48)
+	if err != nil || len(forecast.Hours) != 3 || len(forecast.Warnings) != 1 {
+		t.Errorf("Forecast: %d hours, %d warnings, %v", len(forecast.Hours), len(forecast.Warnings), err)
+	}
+
+	if _, err := p.Current(Location{City: "Nowhere"}); err == nil {
+		t.Error("Current without coordinates succeeded")
+	}
+
+	status = http.StatusUnauthorized
+	var statusErr *providerStatusError
+	if _, err := p.Current(loc); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got %v, want a 401 providerStatusError", err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	openMeteoEnsembleURL  = "https://ensemble-api.open-meteo.com/v1/ensemble"
+	openMeteoDefaultModel = "icon_seamless"
+	openMeteoHourlyFields = "temperature_2m,wind_speed_10m,precipitation,cloud_cover"
+	ensembleMemberInfix   = "_member"
+
+	rainThresholdMM      = 0.1
+	snowThresholdCelsius = 0.5
+	overcastCloudCover   = 85
+	brokenCloudCover     = 50
+	scatteredCloudCover  = 25
+	fewCloudsCloudCover  = 10
+)
+
+// openMeteoEnsembleProvider serves ensemble forecasts from Open-Meteo's ensemble
+// API. Current conditions are the ensemble median of the current hour, so it can
+// also sit in a routing rule's provider list. It needs coordinates.
+type openMeteoEnsembleProvider struct {
+	name    string
+	baseURL string
+	model   string
+}
+
+func newOpenMeteoEnsembleProvider(name, baseURL, model string) *openMeteoEnsembleProvider {
+	if baseURL == "" {
+		baseURL = openMeteoEnsembleURL
+	}
+	if model == "" {
+		model = openMeteoDefaultModel
+	}
+	return &openMeteoEnsembleProvider{name: name, baseURL: baseURL, model: model}
+}
+
+func (p *openMeteoEnsembleProvider) Name() string {
+	return p.name
+}
+
+func (p *openMeteoEnsembleProvider) Current(loc Location) (WeatherData, error) {
+	forecast, err := p.Forecast(loc, forecastHoursPerDay)
+	if err != nil {
+		return WeatherData{}, err
+	}
+	now := time.Now()
+	var hour *ForecastHour
+	for i := range forecast.Hours {
+		if forecast.Hours[i].Time.After(now) {
+			break
+		}
+		hour = &forecast.Hours[i]
+	}
+	if hour == nil {
+		return WeatherData{}, fmt.Errorf("ensemble forecast does not cover the current hour")
+	}
+	return WeatherData{
+		City:        loc.City,
+		Country:     loc.Country,
+		Lat:         forecast.Lat,
+		Lon:         forecast.Lon,
+		Description: hour.Description,
+		Temp:        hour.Temp.Value,
+		Wind:        hour.Wind.Value,
+		Precip:      hour.Precip.Value,
+		LastUpdated: now,
+	}, nil
+}
+
+func (p *openMeteoEnsembleProvider) Forecast(loc Location, hours int) (Forecast, error) {
+	if !loc.HasPos {
+		return Forecast{}, fmt.Errorf("%s needs coordinates for %s", p.name, loc.City)
+	}
+	// Hourly data starts at midnight UTC today, so the hours already gone today
+	// count towards forecast_days too
+	now := time.Now().UTC()
+	days := (now.Hour() + hours + forecastHoursPerDay - 1) / forecastHoursPerDay
+	if days > forecastMaxHours/forecastHoursPerDay {
+		days = forecastMaxHours / forecastHoursPerDay
+	}
+	query := url.Values{
+		"latitude":        {fmt.Sprint(loc.Lat)},
+		"longitude":       {fmt.Sprint(loc.Lon)},
+		"hourly":          {openMeteoHourlyFields},
+		"models":          {p.model},
+		"past_days":       {"0"},
+		"forecast_days":   {fmt.Sprint(days)},
+		"wind_speed_unit": {"ms"},
+		"timeformat":      {"unixtime"},
+	}
+	response, err := providerClient.Get(p.baseURL + "?" + query.Encode())
+	if err != nil {
+		return Forecast{}, fmt.Errorf("failed to fetch ensemble forecast: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return Forecast{}, &providerStatusError{StatusCode: response.StatusCode}
+	}
+	raw, err := io.ReadAll(response.Body)
+	if err != nil {
+		return Forecast{}, fmt.Errorf("failed to read ensemble forecast: %w", err)
+	}
+
+	var body struct {
+		Latitude  float64                    `json:"latitude"`
+		Longitude float64                    `json:"longitude"`
+		Hourly    map[string]json.RawMessage `json:"hourly"`
+	}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return Forecast{}, fmt.Errorf("failed to parse ensemble forecast: %w", err)
+	}
+	var times []int64
+	if err := json.Unmarshal(body.Hourly["time"], &times); err != nil || len(times) == 0 {
+		return Forecast{}, fmt.Errorf("ensemble forecast has no hourly times")
+	}
+
+	// Each variable comes as the control run plus name_member01, name_member02, ...
+	members := map[string][][]*float64{}
+	keys := make([]string, 0, len(body.Hourly))
+	for key := range body.Hourly {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		variable, _, _ := strings.Cut(key, ensembleMemberInfix)
+		if variable == "time" {
+			continue
+		}
+		var series []*float64
+		if err := json.Unmarshal(body.Hourly[key], &series); err != nil {
+			return Forecast{}, fmt.Errorf("failed to parse ensemble forecast %s: %w", key, err)
+		}
+		members[variable] = append(members[variable], series)
+	}
+
+	forecast := Forecast{
+		City:    loc.City,
+		Lat:     body.Latitude,
+		Lon:     body.Longitude,
+		Members: len(members["temperature_2m"]),
+	}
+	for i, t := range times {
+		if len(forecast.Hours) == hours {
+			break
+		}
+		start := time.Unix(t, 0).UTC()
+		if !start.Add(time.Hour).After(now) {
+			continue
+		}
+		hour := ForecastHour{
+			Time:   start,
+			Temp:   ensembleValue(memberValues(members["temperature_2m"], i)),
+			Wind:   ensembleValue(memberValues(members["wind_speed_10m"], i)),
+			Precip: ensembleValue(memberValues(members["precipitation"], i)),
+		}
+		clouds := ensembleValue(memberValues(members["cloud_cover"], i))
+		hour.Description = describeConditions(hour.Temp.Value, hour.Precip.Value, clouds.Value)
+		forecast.Hours = append(forecast.Hours, hour)
+	}
+	return forecast, nil
+}
+
+// memberValues collects hour i from every member, nil where a member has no data.
+func memberValues(series [][]*float64, i int) []*float64 {
+	values := make([]*float64, len(series))
+	for m, s := range series {
+		if i < len(s) {
+			values[m] = s[i]
+		}
+	}
+	return values
+}
+
+// describeConditions names the median conditions in OpenWeather's vocabulary so
+// conditionCategory and everything built on it keep working.
+func describeConditions(temp, precip, cloudCover float64) string {
+	switch {
+	case precip >= rainThresholdMM && temp <= snowThresholdCelsius:
+		return "snow"
+	case precip >= rainThresholdMM:
+		return "rain"
+	case cloudCover >= overcastCloudCover:
+		return "overcast clouds"
+	case cloudCover >= brokenCloudCover:
+		return "broken clouds"
+	case cloudCover >= scatteredCloudCover:
+		return "scattered clouds"
+	case cloudCover >= fewCloudsCloudCover:
+		return "few clouds"
+	}
+	return "clear sky"
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// openMeteoStub answers like the ensemble API: hourly data from midnight UTC
+// today for forecast_days days.
+func openMeteoStub(t *testing.T, queries chan<- url.Values) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		queries <- query
+		days, err := strconv.Atoi(query.Get("forecast_days"))
+		if err != nil {
+			t.Errorf("forecast_days %q", query.Get("forecast_days"))
+		}
+		midnight := time.Now().UTC().Truncate(24 * time.Hour)
+		var times []int64
+		var temps, members []float64
+		for h := 0; h < days*24; h++ {
+			times = append(times, midnight.Add(time.Duration(h)*time.Hour).Unix())
+			temps = append(temps, float64(h))
+			members = append(members, float64(h)+1)
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"latitude":  52.5,
+			"longitude": 13.4,
+			"hourly": map[string]any{
+				"time":                    times,
+				"temperature_2m":          temps,
+				"temperature_2m_member01": members,
+			},
+		})
+	}))
+}
+
+func TestOpenMeteoForecastStartsAtCurrentHour(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	stub := openMeteoStub(t, queries)
+	defer stub.Close()
+
+	p := newOpenMeteoEnsembleProvider("ensemble", stub.URL, "")
+	loc := Location{City: "Berlin", Lat: 52.5, Lon: 13.4, HasPos: true}
+	forecast, err := p.Forecast(loc, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := <-queries
+	now := time.Now().UTC()
+	if query.Get("past_days") != "0" {
+		t.Errorf("past_days = %q, want 0", query.Get("past_days"))
+	}
+	if want := (now.Hour() + 30 + 23) / 24; query.Get("forecast_days") != fmt.Sprint(want) {
+		t.Errorf("forecast_days = %s, want %d", query.Get("forecast_days"), want)
+	}
+
+	if len(forecast.Hours) != 30 {
+		t.Fatalf("got %d hours, want 30", len(forecast.Hours))
+	}
+	if first, want := forecast.Hours[0].Time, now.Truncate(time.Hour); !first.Equal(want) {
+		t.Errorf("first hour %s, want the current hour %s", first, want)
+	}
+	if got := len(upcomingHours(forecast.Hours, now)); got != 30 {
+		t.Errorf("%d of the hours are upcoming, want 30", got)
+	}
+}
+
+func TestOpenMeteoForecastCapsDays(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	stub := openMeteoStub(t, queries)
+	defer stub.Close()
+
+	p := newOpenMeteoEnsembleProvider("ensemble", stub.URL, "")
+	forecast, err := p.Forecast(Location{City: "Berlin", HasPos: true}, forecastMaxHours)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := (<-queries).Get("forecast_days"); got != "16" {
+		t.Errorf("forecast_days = %s, want 16", got)
+	}
+	// The provider runs out before the hours asked for, counting from now
+	if want := forecastMaxHours - time.Now().UTC().Hour(); len(forecast.Hours) != want {
+		t.Errorf("got %d hours, want %d", len(forecast.Hours), want)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// A minimal Parquet writer: one row group, one PLAIN-encoded uncompressed data
+// page per column and only REQUIRED columns, which is all exports need and keeps
+// definition levels out of the picture. Metadata is Thrift compact protocol.
+
+type parquetType int
+
+const (
+	parquetInt64     parquetType = 2
+	parquetDouble    parquetType = 5
+	parquetByteArray parquetType = 6
+)
+
+// Converted types from parquet.thrift
+const (
+	parquetConvertedUTF8            = 0
+	parquetConvertedTimestampMillis = 9
+)
+
+type parquetColumn struct {
+	Name   string
+	Type   parquetType
+	values bytes.Buffer
+}
+
+type parquetWriter struct {
+	columns []*parquetColumn
+	rows    int
+}
+
+func newParquetWriter(columns ...parquetColumn) *parquetWriter {
+	w := &parquetWriter{}
+	for i := range columns {
+		w.columns = append(w.columns, &parquetColumn{Name: columns[i].Name, Type: columns[i].Type})
+	}
+	return w
+}
+
+// Append adds one row; values are string, float64 or time.Time in column order.
+func (w *parquetWriter) Append(values ...any) {
+	for i, v := range values {
+		buf := &w.columns[i].values
+		switch x := v.(type) {
+		case string:
+			binary.Write(buf, binary.LittleEndian, uint32(len(x)))
+			buf.WriteString(x)
+		case float64:
+			binary.Write(buf, binary.LittleEndian, math.Float64bits(x))
+		case time.Time:
+			binary.Write(buf, binary.LittleEndian, x.UnixMilli())
+		}
+	}
+	w.rows++
+}
+
+func (w *parquetWriter) Bytes() []byte {
+	var out bytes.Buffer
+	out.WriteString("PAR1")
+
+	type chunk struct {
+		offset, size int64
+	}
+	chunks := make([]chunk, len(w.columns))
+	for i, c := range w.columns {
+		page := c.values.Bytes()
+		var header thriftWriter
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(page)))
+		header.beginStruct(5)
+		header.i32(1, int32(w.rows))
+		header.i32(2, 0) // PLAIN
+		header.i32(3, 3) // RLE
+		header.i32(4, 3)
+		header.endStruct()
+		header.stop()
+
+		chunks[i].offset = int64(out.Len())
+		out.Write(header.Bytes())
+		out.Write(page)
+		chunks[i].size = int64(out.Len()) - chunks[i].offset
+	}
+
+	var meta thriftWriter
+	meta.i32(1, 1)
+	meta.beginList(2, thriftStruct, len(w.columns)+1)
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(w.columns)))
+	meta.stop()
+	for _, c := range w.columns {
+		meta.i32(1, int32(c.Type))
+		meta.i32(3, 0) // REQUIRED
+		meta.binary(4, c.Name)
+		switch c.Type {
+		case parquetByteArray:
+			meta.i32(6, parquetConvertedUTF8)
+		case parquetInt64:
+			meta.i32(6, parquetConvertedTimestampMillis)
+		}
+		meta.stop()
+	}
+	meta.endList()
+	meta.i64(3, int64(w.rows))
+
+	var total int64
+	for _, c := range chunks {
+		total += c.size
+	}
+	meta.beginList(4, thriftStruct, 1)
+	meta.beginList(1, thriftStruct, len(w.columns))
+	for i, c := range w.columns {
+		meta.i64(2, chunks[i].offset)
+		meta.beginStruct(3)
+		meta.i32(1, int32(c.Type))
+		meta.beginList(2, thriftI32, 1)
+		meta.listI32(0)
+		meta.endList()
+		meta.beginList(3, thriftBinary, 1)
+		meta.listBinary(c.Name)
+		meta.endList()
+		meta.i32(4, 0) // UNCOMPRESSED
+		meta.i64(5, int64(w.rows))
+		meta.i64(6, chunks[i].size)
+		meta.i64(7, chunks[i].size)
+		meta.i64(9, chunks[i].offset)
+		meta.endStruct()
+		meta.stop()
+	}
+	meta.endList()
+	meta.i64(2, total)
+	meta.i64(3, int64(w.rows))
+	meta.stop()
+	meta.endList()
+	meta.binary(6, "weather-app-2")
+	meta.stop()
+
+	footer := meta.Bytes()
+	out.Write(footer)
+	binary.Write(&out, binary.LittleEndian, uint32(len(footer)))
+	out.WriteString("PAR1")
+	return out.Bytes()
+}
+
+// Thrift compact protocol type ids.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes Thrift compact protocol structs. Field ids are written as
+// deltas from the previous field, so each nested struct or list element keeps its
+// own last id on a stack.
+type thriftWriter struct {
+	bytes.Buffer
+	lastID []int16
+	last   int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	t.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (t *thriftWriter) field(id int16, kind byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		t.WriteByte(kind)
+		t.varint(uint64((id << 1) ^ (id >> 15)))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(uint64(uint32((v << 1) ^ (v >> 31))))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.listBinary(s)
+}
+
+func (t *thriftWriter) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.lastID = append(t.lastID, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) endStruct() {
+	t.stop()
+	t.last = t.lastID[len(t.lastID)-1]
+	t.lastID = t.lastID[:len(t.lastID)-1]
+}
+
+// stop ends a struct. Inside a list of structs it also resets the field ids for
+// the next element.
+func (t *thriftWriter) stop() {
+	t.WriteByte(0)
+	t.last = 0
+}
+
+func (t *thriftWriter) beginList(id int16, elem byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.WriteByte(byte(size)<<4 | elem)
+	} else {
+		t.WriteByte(0xf0 | elem)
+		t.varint(uint64(size))
+	}
+	t.lastID = append(t.lastID, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) endList() {
+	t.last = t.lastID[len(t.lastID)-1]
+	t.lastID = t.lastID[:len(t.lastID)-1]
+}
+
+func (t *thriftWriter) listI32(v int32) {
+	t.varint(uint64(uint32((v << 1) ^ (v >> 31))))
+}
+
+func (t *thriftWriter) listBinary(s string) {
+	t.varint(uint64(len(s)))
+	t.WriteString(s)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+// parquetBytes serves an in-memory file to the reader, which opens a new handle
+// per column.
+type parquetBytes struct {
+	*bytes.Reader
+	data []byte
+}
+
+func newParquetBytes(data []byte) *parquetBytes {
+	return &parquetBytes{Reader: bytes.NewReader(data), data: data}
+}
+
+func (f *parquetBytes) Open(string) (source.ParquetFile, error) { return newParquetBytes(f.data), nil }
+func (f *parquetBytes) Create(string) (source.ParquetFile, error) {
+	return nil, errors.New("read only")
+}
+func (f *parquetBytes) Write([]byte) (int, error) { return 0, errors.New("read only") }
+func (f *parquetBytes) Close() error              { return nil }
+
+type parquetExportRow struct {
+	City        string  `parquet:"name=city, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Country     string  `parquet:"name=country, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Lat         float64 `parquet:"name=lat, type=DOUBLE"`
+	Lon         float64 `parquet:"name=lon, type=DOUBLE"`
+	Description string  `parquet:"name=description, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Temp        float64 `parquet:"name=temp, type=DOUBLE"`
+	Wind        float64 `parquet:"name=wind, type=DOUBLE"`
+	Precip      float64 `parquet:"name=precip, type=DOUBLE"`
+	Tags        string  `parquet:"name=tags, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Tenant      string  `parquet:"name=tenant, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Provider    string  `parquet:"name=provider, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Route       string  `parquet:"name=route, type=BYTE_ARRAY, convertedtype=UTF8"`
+	LastUpdated int64   `parquet:"name=last_updated, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+}
+
+func readParquet(t *testing.T, data []byte) []parquetExportRow {
+	t.Helper()
+	pr, err := reader.NewParquetReader(newParquetBytes(data), new(parquetExportRow), 1)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer pr.ReadStop()
+	rows := make([]parquetExportRow, pr.GetNumRows())
+	if err := pr.Read(&rows); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return rows
+}
+
+func TestParquetExportReadsBack(t *testing.T) {
+	updated := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	readings := []WeatherData{
+		{City: "Berlin", Country: "DE", Lat: 52.52, Lon: 13.405, Description: "light rain", Temp: 7.5, Wind: 4.1, Precip: 0.6, Tags: []string{"capital", "eu"}, Provider: "openweather", LastUpdated: updated},
+		{City: "São Paulo", Country: "BR", Lat: -23.55, Lon: -46.63, Description: "", Temp: -0.5, Tenant: "acme", Route: "primary", LastUpdated: updated.Add(time.Hour)},
+	}
+	data, err := encodeExportParquet(readings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := readParquet(t, data)
+	if len(rows) != len(readings) {
+		t.Fatalf("got %d rows, want %d", len(rows), len(readings))
+	}
+	want := []parquetExportRow{
+		{City: "Berlin", Country: "DE", Lat: 52.52, Lon: 13.405, Description: "light rain", Temp: 7.5, Wind: 4.1, Precip: 0.6, Tags: "capital;eu", Provider: "openweather", LastUpdated: updated.UnixMilli()},
+		{City: "São Paulo", Country: "BR", Lat: -23.55, Lon: -46.63, Temp: -0.5, Tenant: "acme", Route: "primary", LastUpdated: updated.Add(time.Hour).UnixMilli()},
+	}
+	for i := range want {
+		if rows[i] != want[i] {
+			t.Errorf("row %d: got %+v, want %+v", i, rows[i], want[i])
+		}
+	}
+}
+
+func TestParquetExportEmpty(t *testing.T) {
+	data, err := encodeExportParquet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := readParquet(t, data); len(rows) != 0 {
+		t.Errorf("got %d rows from an empty export", len(rows))
+	}
+}
+
+func TestParquetManyColumnsAndRows(t *testing.T) {
+	// More than 15 list elements switches the Thrift list header to its long form
+	var columns []parquetColumn
+	for i := 0; i < 20; i++ {
+		columns = append(columns, parquetColumn{Name: string(rune('a' + i)), Type: parquetDouble})
+	}
+	w := newParquetWriter(columns...)
+	for r := 0; r < 1000; r++ {
+		values := make([]any, len(columns))
+		for i := range values {
+			values[i] = float64(r*100 + i)
+		}
+		w.Append(values...)
+	}
+
+	pr, err := reader.NewParquetReader(newParquetBytes(w.Bytes()), nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+	if pr.GetNumRows() != 1000 {
+		t.Fatalf("got %d rows, want 1000", pr.GetNumRows())
+	}
+	if n := len(pr.Footer.Schema); n != 21 {
+		t.Errorf("got %d schema elements, want 21", n)
+	}
+	values, _, _, err := pr.ReadColumnByIndex(19, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1000 || values[999] != float64(99919) {
+		t.Errorf("column t: got %d values ending in %v", len(values), values[len(values)-1])
+	}
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Plan is a set of outdoor tasks scheduled into the slots the forecast suits
+// best. Plans are re-evaluated whenever a forecast for one of their cities
+// arrives; owners hear about slots turning unsuitable, or tasks becoming feasible
+// again, through a webhook subscription to EventPlanUnsuitable or EventPlanFeasible
+// whose filter names them in owners. Only the holder of the token returned on
+// creation can read or cancel a plan.
+type Plan struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Owner       string             `bson:"owner" json:"owner"`
+	Tasks       []PlanTask         `bson:"tasks" json:"tasks"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	EvaluatedAt time.Time          `bson:"evaluated_at" json:"evaluated_at"`
+	TokenHash   string             `bson:"token_hash" json:"-"`
+	Token       string             `bson:"-" json:"token,omitempty"`
+}
+
+type PlanTask struct {
+	ID          string          `bson:"id" json:"id"`
+	Name        string          `bson:"name,omitempty" json:"name,omitempty"`
+	City        string          `bson:"city" json:"city"`
+	Duration    string          `bson:"duration" json:"duration"`
+	From        time.Time       `bson:"from" json:"from"`
+	To          time.Time       `bson:"to" json:"to"`
+	Constraints PlanConstraints `bson:"constraints" json:"constraints"`
+	// MinConfidence is the lowest chance, across the slot's hours, that the
+	// constraints hold for a slot to be feasible (default 0.5)
+	MinConfidence float64 `bson:"min_confidence" json:"min_confidence"`
+
+	Status    string     `bson:"status" json:"status"`
+	Scheduled *PlanSlot  `bson:"scheduled,omitempty" json:"scheduled,omitempty"`
+	Slots     []PlanSlot `bson:"slots" json:"slots"`
+	Provider  string     `bson:"provider,omitempty" json:"provider,omitempty"`
+	Issued    time.Time  `bson:"issued,omitempty" json:"forecast_issued,omitempty"`
+	// FeasibleAt is when a later forecast last turned the task from infeasible
+	// or unsuitable back to scheduled
+	FeasibleAt *time.Time `bson:"feasible_at,omitempty" json:"feasible_at,omitempty"`
+}
+
+// PlanConstraints bound the weather a task can be done in; unset bounds are not
+// checked. AvoidConditions lists condition categories such as rain or snow.
+type PlanConstraints struct {
+	MinTemp         *float64 `bson:"min_temp,omitempty" json:"min_temp,omitempty"`
+	MaxTemp         *float64 `bson:"max_temp,omitempty" json:"max_temp,omitempty"`
+	MaxWind         *float64 `bson:"max_wind,omitempty" json:"max_wind,omitempty"`
+	MaxPrecip       *float64 `bson:"max_precip,omitempty" json:"max_precip,omitempty"`
+	MaxPrecipChance *float64 `bson:"max_precip_chance,omitempty" json:"max_precip_chance,omitempty"`
+	AvoidConditions []string `bson:"avoid_conditions,omitempty" json:"avoid_conditions,omitempty"`
+}
+
+// PlanSlot is a candidate time for a task. Score is the lowest hourly chance that
+// the constraints hold, so it reads as the confidence in the worst hour.
+type PlanSlot struct {
+	Start time.Time `bson:"start" json:"start"`
+	End   time.Time `bson:"end" json:"end"`
+	Score float64   `bson:"score" json:"score"`
+}
+
+const (
+	planScheduled  = "scheduled"
+	planInfeasible = "infeasible"
+	planUnsuitable = "unsuitable"
+	planStarted    = "started"
+
+	maxPlanTasks         = 50
+	maxPlanSlots         = 5
+	defaultMinConfidence = 0.5
+	planMonitorInterval  = 30 * time.Minute
+)
+
+// EventPlanUnsuitable is published for each task whose scheduled slot a new
+// forecast makes unsuitable, and EventPlanFeasible for each infeasible or
+// unsuitable task a new forecast schedules again, with a planNotice as payload.
+const (
+	EventPlanUnsuitable = "plan.slot_unsuitable"
+	EventPlanFeasible   = "plan.slot_feasible"
+)
+
+type planNotice struct {
+	PlanID string     `json:"plan_id"`
+	Owner  string     `json:"owner"`
+	Tasks  []PlanTask `json:"tasks"`
+}
+
+var plansCollection *mongo.Collection
+
+// recheckedPlanStatuses are the task statuses a new forecast can change.
+var recheckedPlanStatuses = bson.A{planScheduled, planUnsuitable, planInfeasible}
+
+func (c PlanConstraints) validate() error {
+	for _, category := range c.AvoidConditions {
+		if !knownConditionCategory(category) {
+			return fmt.Errorf("unknown condition category %q", category)
+		}
+	}
+	if c.MinTemp != nil && c.MaxTemp != nil && *c.MinTemp > *c.MaxTemp {
+		return fmt.Errorf("min_temp is above max_temp")
+	}
+	return nil
+}
+
+// holds reports whether one set of values meets the numeric constraints.
+func (c PlanConstraints) holds(temp, wind, precip float64) bool {
+	return (c.MinTemp == nil || temp >= *c.MinTemp) &&
+		(c.MaxTemp == nil || temp <= *c.MaxTemp) &&
+		(c.MaxWind == nil || wind <= *c.MaxWind) &&
+		(c.MaxPrecip == nil || precip <= *c.MaxPrecip)
+}
+
+// hourChance is the chance the constraints hold in one forecast hour: the share
+// of ensemble members meeting them, or 0/1 from the median without members.
+// Conditions and precipitation chance are single values, so they gate the hour.
+func (c PlanConstraints) hourChance(h ForecastHour, members int) float64 {
+	if len(c.AvoidConditions) > 0 && containsFold(c.AvoidConditions, conditionCategory(h.Description)) {
+		return 0
+	}
+	if c.MaxPrecipChance != nil && h.PrecipChance != nil && *h.PrecipChance > *c.MaxPrecipChance {
+		return 0
+	}
+	if members > 0 && len(h.Temp.Members) == members && len(h.Wind.Members) == members && len(h.Precip.Members) == members {
+		met := 0
+		for i := 0; i < members; i++ {
+			if c.holds(h.Temp.Members[i], h.Wind.Members[i], h.Precip.Members[i]) {
+				met++
+			}
+		}
+		return float64(met) / float64(members)
+	}
+	return boolProbability(c.holds(h.Temp.Value, h.Wind.Value, h.Precip.Value))
+}
+
+// rankSlots scores every whole-hour start in the task's window that the forecast
+// covers and returns the feasible ones, best first.
+func rankSlots(task PlanTask, forecast Forecast, now time.Time) []PlanSlot {
+	duration, _ := time.ParseDuration(task.Duration)
+	hours := int((duration + time.Hour - 1) / time.Hour)
+	earliest := task.From
+	if earliest.Before(now) {
+		earliest = now
+	}
+	from := earliest.Truncate(time.Hour)
+	if from.Before(earliest) {
+		from = from.Add(time.Hour)
+	}
+
+	chances := map[int64]float64{}
+	for _, h := range forecast.Hours {
+		chances[h.Time.Unix()] = task.Constraints.hourChance(h, forecast.Members)
+	}
+	var slots []PlanSlot
+	for start := from; !start.Add(duration).After(task.To); start = start.Add(time.Hour) {
+		score, covered := 1.0, true
+		for i := 0; i < hours; i++ {
+			chance, ok := chances[start.Add(time.Duration(i)*time.Hour).Unix()]
+			if !ok {
+				covered = false
+				break
+			}
+			score = min(score, chance)
+		}
+		if covered && score >= task.MinConfidence {
+			slots = append(slots, PlanSlot{Start: start, End: start.Add(duration), Score: score})
+		}
+	}
+	sort.SliceStable(slots, func(i, j int) bool { return slots[i].Score > slots[j].Score })
+	return slots
+}
+
+// slotScore re-scores an already chosen slot against a new forecast. It reports
+// false when the forecast no longer covers the slot.
+func slotScore(task PlanTask, slot PlanSlot, forecast Forecast) (float64, bool) {
+	for _, s := range rankSlots(PlanTask{Duration: task.Duration, From: slot.Start, To: slot.End, Constraints: task.Constraints}, forecast, slot.Start) {
+		if s.Start.Equal(slot.Start) {
+			return s.Score, true
+		}
+	}
+	// rankSlots drops slots scoring below MinConfidence, which is zero here, so
+	// a missing slot means missing forecast hours
+	return 0, false
+}
+
+// planForecastHours is how many forecast hours from now cover a window ending at
+// to.
+func planForecastHours(to, now time.Time) int {
+	hours := int(to.Sub(now).Hours()) + 1
+	return max(1, min(hours, forecastMaxHours))
+}
+
+// evaluateTask fills in a task's slots from the forecast and schedules the best
+// one.
+func evaluateTask(ctx context.Context, task *PlanTask, now time.Time) error {
+	forecast, err := loadForecast(ctx, task.City, planForecastHours(task.To, now))
+	if err != nil {
+		return err
+	}
+	task.Provider, task.Issued = forecast.Provider, forecast.Issued
+	slots := rankSlots(*task, forecast, now)
+	task.Slots = append([]PlanSlot{}, slots...)
+	if len(task.Slots) > maxPlanSlots {
+		task.Slots = task.Slots[:maxPlanSlots]
+	}
+	if len(slots) == 0 {
+		task.Status, task.Scheduled = planInfeasible, nil
+		return nil
+	}
+	task.Status, task.Scheduled = planScheduled, &slots[0]
+	return nil
+}
+
+func parsePlan(r *http.Request) (Plan, error) {
+	var plan Plan
+	if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+		return Plan{}, fmt.Errorf("Invalid request body")
+	}
+	if plan.Owner == "" {
+		plan.Owner = requestActor(r)
+	}
+	if len(plan.Tasks) == 0 || len(plan.Tasks) > maxPlanTasks {
+		return Plan{}, fmt.Errorf("a plan needs between 1 and %d tasks", maxPlanTasks)
+	}
+	now := time.Now()
+	ids := map[string]bool{}
+	for i := range plan.Tasks {
+		task := &plan.Tasks[i]
+		if task.ID == "" {
+			task.ID = fmt.Sprint(i + 1)
+		}
+		// Re-evaluation updates tasks by ID
+		if ids[task.ID] {
+			return Plan{}, fmt.Errorf("task %s: task IDs must be unique", task.ID)
+		}
+		ids[task.ID] = true
+		if task.City == "" {
+			return Plan{}, fmt.Errorf("task %s: city is required", task.ID)
+		}
+		duration, err := time.ParseDuration(task.Duration)
+		if err != nil || duration <= 0 {
+			return Plan{}, fmt.Errorf("task %s: duration must be like 90m or 3h", task.ID)
+		}
+		if task.From.IsZero() {
+			task.From = now
+		}
+		if task.To.IsZero() || task.To.Sub(task.From) < duration {
+			return Plan{}, fmt.Errorf("task %s: the window from %s to %s is shorter than the task", task.ID, task.From.Format(time.RFC3339), task.To.Format(time.RFC3339))
+		}
+		if !task.To.After(now) || task.To.After(now.Add(forecastMaxHours*time.Hour)) {
+			return Plan{}, fmt.Errorf("task %s: the window must end within the forecast range", task.ID)
+		}
+		if err := task.Constraints.validate(); err != nil {
+			return Plan{}, fmt.Errorf("task %s: %v", task.ID, err)
+		}
+		if task.MinConfidence == 0 {
+			task.MinConfidence = defaultMinConfidence
+		}
+		if task.MinConfidence < 0 || task.MinConfidence > 1 {
+			return Plan{}, fmt.Errorf("task %s: min_confidence must be between 0 and 1", task.ID)
+		}
+		task.Status, task.Scheduled, task.Slots = "", nil, nil
+	}
+	return plan, nil
+}
+
+// planHandler creates a plan: POST /plan ranks slots for each task, schedules the
+// best and stores the plan so later forecasts can re-check it. The response
+// carries the token that GET and DELETE /plan/{id} need in X-Plan-Token.
+func planHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	plan, err := parsePlan(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	now := time.Now()
+	for i := range plan.Tasks {
+		task := &plan.Tasks[i]
+		if err := evaluateTask(ctx, task, now); err != nil {
+			switch {
+			case err == mongo.ErrNoDocuments:
+				http.Error(w, fmt.Sprintf("task %s: weather data for %s not found", task.ID, task.City), http.StatusBadRequest)
+			case errors.Is(err, errNoForecastProvider):
+				http.Error(w, fmt.Sprintf("task %s: no forecast provider is configured for %s", task.ID, task.City), http.StatusUnprocessableEntity)
+			default:
+				writeForecastError(w, err)
+			}
+			return
+		}
+	}
+	tokenBytes := make([]byte, 24)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		http.Error(w, "Failed to save plan", http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(tokenBytes)
+	plan.ID = primitive.NewObjectID()
+	plan.CreatedAt, plan.EvaluatedAt = now, now
+	plan.TokenHash = sha256Hex([]byte(token))
+	if _, err := plansCollection.InsertOne(ctx, plan); err != nil {
+		http.Error(w, "Failed to save plan", http.StatusInternalServerError)
+		return
+	}
+	plan.Token = token
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/plan/"+plan.ID.Hex())
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(plan)
+}
+
+// ownedPlan loads the plan named by the /plan/{id} path if the request carries
+// its token in X-Plan-Token. Plans of other creators are reported as not found.
+func ownedPlan(ctx context.Context, r *http.Request) (Plan, bool) {
+	id, err := primitive.ObjectIDFromHex(strings.TrimPrefix(r.URL.Path, "/plan/"))
+	if err != nil {
+		return Plan{}, false
+	}
+	var plan Plan
+	if err := plansCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&plan); err != nil {
+		return Plan{}, false
+	}
+	token := sha256Hex([]byte(r.Header.Get("X-Plan-Token")))
+	if plan.TokenHash == "" || !hmac.Equal([]byte(token), []byte(plan.TokenHash)) {
+		return Plan{}, false
+	}
+	return plan, true
+}
+
+// planByIDHandler reads (GET) or cancels (DELETE) a stored plan at /plan/{id}.
+func planByIDHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	plan, ok := ownedPlan(ctx, r)
+	if !ok {
+		http.Error(w, "Plan not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(plan)
+	case http.MethodDelete:
+		result, err := plansCollection.DeleteOne(ctx, bson.M{"_id": plan.ID})
+		if err != nil {
+			http.Error(w, "Failed to delete plan", http.StatusInternalServerError)
+			return
+		}
+		if result.DeletedCount == 0 {
+			http.Error(w, "Plan not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// reevaluatePlans is subscribed to forecast updates. It runs in the background
+// because forecasts are published from request handlers.
+func reevaluatePlans(ev Event) {
+	if ev.Type != EventForecastUpdated {
+		return
+	}
+	forecast, ok := ev.Payload.(Forecast)
+	if !ok || readOnly.Load() {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := reevaluateCityPlans(ctx, forecast, time.Now()); err != nil {
+			log.Printf("Failed to re-evaluate plans for %s: %v", forecast.City, err)
+		}
+	}()
+}
+
+// reevaluateTask applies a new forecast for the task's city to a stored task. It
+// returns the task fields to set, nil when there is nothing to re-check, and the
+// event to tell the owner, if any. A scheduled slot falling below the task's
+// confidence becomes unsuitable and gets fresh alternatives; the owner decides
+// whether to move the task, so it is not rescheduled. An unsuitable slot that
+// recovers is scheduled again, and an infeasible task gets the best slot once
+// one qualifies.
+func reevaluateTask(task *PlanTask, forecast Forecast, now time.Time) (bson.M, string) {
+	switch task.Status {
+	case planScheduled:
+		if task.Scheduled == nil {
+			return nil, ""
+		}
+		if !task.Scheduled.Start.After(now) {
+			task.Status = planStarted
+			return bson.M{"status": planStarted}, ""
+		}
+	case planUnsuitable:
+		if task.Scheduled == nil || !task.Scheduled.Start.After(now) {
+			return nil, ""
+		}
+	case planInfeasible:
+		if !task.To.After(now) {
+			return nil, ""
+		}
+	default:
+		return nil, ""
+	}
+
+	task.Provider, task.Issued = forecast.Provider, forecast.Issued
+	set := bson.M{"provider": task.Provider, "issued": task.Issued}
+	status := task.Status
+	if task.Scheduled != nil {
+		score, covered := slotScore(*task, *task.Scheduled, forecast)
+		if !covered {
+			return set, ""
+		}
+		task.Scheduled.Score = score
+		set["scheduled.score"] = score
+		status = planScheduled
+		if score < task.MinConfidence {
+			status = planUnsuitable
+		}
+	}
+	slots := rankSlots(*task, forecast, now)
+	if task.Scheduled == nil && len(slots) > 0 {
+		best := slots[0]
+		task.Scheduled = &best
+		set["scheduled"] = task.Scheduled
+		status = planScheduled
+	}
+	task.Slots = append([]PlanSlot{}, slots[:min(len(slots), maxPlanSlots)]...)
+	set["slots"] = task.Slots
+
+	var event string
+	switch {
+	case status == planUnsuitable && task.Status == planScheduled:
+		event = EventPlanUnsuitable
+	case status == planScheduled && task.Status != planScheduled:
+		event = EventPlanFeasible
+		task.FeasibleAt = &now
+		set["feasible_at"] = now
+	}
+	task.Status = status
+	set["status"] = status
+	return set, event
+}
+
+// reevaluateCityPlans re-checks the upcoming tasks in forecast's city with
+// reevaluateTask. Each task is updated on its own and only while its status is
+// still the one read, so tasks in other cities being re-evaluated at the same
+// time are left alone and no change is reported twice.
+func reevaluateCityPlans(ctx context.Context, forecast Forecast, now time.Time) error {
+	filter := bson.M{"tasks": bson.M{"$elemMatch": bson.M{"city": forecast.City, "status": bson.M{"$in": recheckedPlanStatuses}}}}
+	cursor, err := plansCollection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var plans []Plan
+	if err := cursor.All(ctx, &plans); err != nil {
+		return err
+	}
+
+	for _, plan := range plans {
+		changed := map[string][]PlanTask{}
+		for i := range plan.Tasks {
+			task := &plan.Tasks[i]
+			if task.City != forecast.City {
+				continue
+			}
+			read := task.Status
+			fields, event := reevaluateTask(task, forecast, now)
+			if fields == nil {
+				continue
+			}
+			set := bson.M{"evaluated_at": now}
+			for name, value := range fields {
+				set["tasks.$[t]."+name] = value
+			}
+			opts := options.Update().SetArrayFilters(options.ArrayFilters{Filters: []any{bson.M{"t.id": task.ID, "t.status": read}}})
+			result, err := plansCollection.UpdateOne(ctx, bson.M{"_id": plan.ID, "tasks": bson.M{"$elemMatch": bson.M{"id": task.ID, "status": read}}}, bson.M{"$set": set}, opts)
+			if err != nil {
+				return err
+			}
+			if result.MatchedCount > 0 && event != "" {
+				changed[event] = append(changed[event], *task)
+			}
+		}
+		for _, event := range []string{EventPlanUnsuitable, EventPlanFeasible} {
+			if len(changed[event]) > 0 {
+				notifyPlanOwner(plan, event, changed[event])
+			}
+		}
+	}
+	return nil
+}
+
+// notifyPlanOwner publishes event for webhook subscriptions to pick up.
+func notifyPlanOwner(plan Plan, event string, tasks []PlanTask) {
+	notice := planNotice{PlanID: plan.ID.Hex(), Owner: plan.Owner, Tasks: tasks}
+	for _, task := range tasks {
+		publish(Event{Type: event, City: task.City, Time: time.Now(), Payload: notice})
+	}
+}
+
+// plannedCities maps each city with tasks still to be re-checked to the end of
+// its latest such task's window.
+func plannedCities(ctx context.Context, now time.Time) (map[string]time.Time, error) {
+	cursor, err := plansCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$unwind", Value: "$tasks"}},
+		{{Key: "$match", Value: bson.M{"tasks.status": bson.M{"$in": recheckedPlanStatuses}, "tasks.to": bson.M{"$gt": now}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$tasks.city", "to": bson.M{"$max": "$tasks.to"}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		City string    `bson:"_id"`
+		To   time.Time `bson:"to"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	cities := map[string]time.Time{}
+	for _, row := range rows {
+		cities[row.City] = row.To
+	}
+	return cities, nil
+}
+
+// runPlanMonitor keeps forecasts for cities with upcoming tasks fresh, so plans
+// are re-checked even when nobody asks for those forecasts. Cities are split
+// between replicas with ownsKey.
+func runPlanMonitor() {
+	ticker := time.NewTicker(planMonitorInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if readOnly.Load() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), planMonitorInterval)
+		now := time.Now()
+		cities, err := plannedCities(ctx, now)
+		if err != nil {
+			log.Println("Failed to list planned cities:", err)
+		}
+		for city, to := range cities {
+			if !ownsKey("plan:" + city) {
+				continue
+			}
+			// loadForecast only fetches when the stored forecast is stale or
+			// too short for the latest task, and a fetch publishes
+			// EventForecastUpdated
+			if _, err := loadForecast(ctx, city, planForecastHours(to, now)); err != nil {
+				log.Printf("Failed to refresh forecast for planned tasks in %s: %v", city, err)
+			}
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanForecastHours(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	for to, want := range map[time.Time]int{
+		now.Add(90 * time.Minute):                           2,
+		now.Add(100 * time.Hour):                            101,
+		now.Add(-time.Hour):                                 1,
+		now.Add((forecastMaxHours + 24) * time.Hour):        forecastMaxHours,
+		now.Add(forecastDefaultHours*time.Hour + time.Hour): forecastDefaultHours + 2,
+	} {
+		if got := planForecastHours(to, now); got != want {
+			t.Errorf("window ending %s: got %d hours, want %d", to.Sub(now), got, want)
+		}
+	}
+}
+
+func TestParsePlanRejectsDuplicateTaskIDs(t *testing.T) {
+	to := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	body := `{"tasks": [
+		{"id": "walk", "city": "Berlin", "duration": "1h", "to": "` + to + `"},
+		{"id": "walk", "city": "Paris", "duration": "2h", "to": "` + to + `"}
+	]}`
+	_, err := parsePlan(httptest.NewRequest("POST", "/plan", strings.NewReader(body)))
+	if err == nil || !strings.Contains(err.Error(), "unique") {
+		t.Errorf("got %v, want a duplicate ID error", err)
+	}
+
+	body = strings.Replace(body, `"id": "walk", "city": "Paris"`, `"city": "Paris"`, 1)
+	plan, err := parsePlan(httptest.NewRequest("POST", "/plan", strings.NewReader(body)))
+	if err != nil || plan.Tasks[1].ID != "2" {
+		t.Errorf("got %+v, %v", plan.Tasks, err)
+	}
+}
+
+// hourlyForecast gives one deterministic hour per temp, starting at start.
+func hourlyForecast(start time.Time, temps ...float64) Forecast {
+	forecast := Forecast{Provider: "test", Issued: start}
+	for i, temp := range temps {
+		forecast.Hours = append(forecast.Hours, ForecastHour{Time: start.Add(time.Duration(i) * time.Hour), Temp: ForecastValue{Value: temp}})
+	}
+	return forecast
+}
+
+func TestReevaluateTask(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	minTemp := 10.0
+	newTask := func(status string, scheduledAt int) *PlanTask {
+		task := &PlanTask{ID: "walk", City: "Berlin", Duration: "1h", From: now, To: now.Add(4 * time.Hour),
+			Constraints: PlanConstraints{MinTemp: &minTemp}, MinConfidence: 0.5, Status: status}
+		if scheduledAt >= 0 {
+			start := now.Add(time.Duration(scheduledAt) * time.Hour)
+			task.Scheduled = &PlanSlot{Start: start, End: start.Add(time.Hour), Score: 1}
+		}
+		return task
+	}
+	warm := hourlyForecast(now, 5, 12, 15, 5)
+	cold := hourlyForecast(now, 5, 5, 5, 5)
+
+	tests := []struct {
+		name      string
+		task      *PlanTask
+		forecast  Forecast
+		want      string
+		event     string
+		scheduled int // hours from now, -1 for none
+		slots     int
+	}{
+		{"scheduled slot stays suitable", newTask(planScheduled, 1), warm, planScheduled, "", 1, 2},
+		{"scheduled slot turns unsuitable", newTask(planScheduled, 1), cold, planUnsuitable, EventPlanUnsuitable, 1, 0},
+		{"unsuitable slot stays unsuitable", newTask(planUnsuitable, 1), cold, planUnsuitable, "", 1, 0},
+		{"unsuitable slot recovers", newTask(planUnsuitable, 2), warm, planScheduled, EventPlanFeasible, 2, 2},
+		{"unsuitable task is not moved", newTask(planUnsuitable, 3), warm, planUnsuitable, "", 3, 2},
+		{"infeasible task gets the best slot", newTask(planInfeasible, -1), warm, planScheduled, EventPlanFeasible, 1, 2},
+		{"infeasible task stays infeasible", newTask(planInfeasible, -1), cold, planInfeasible, "", -1, 0},
+	}
+	for _, tt := range tests {
+		set, event := reevaluateTask(tt.task, tt.forecast, now)
+		if set == nil || tt.task.Status != tt.want || set["status"] != tt.want || event != tt.event {
+			t.Errorf("%s: status %s, event %q, set %v; want %s, %q", tt.name, tt.task.Status, event, set, tt.want, tt.event)
+			continue
+		}
+		switch {
+		case tt.scheduled < 0 && tt.task.Scheduled != nil:
+			t.Errorf("%s: scheduled %v", tt.name, tt.task.Scheduled)
+		case tt.scheduled >= 0 && (tt.task.Scheduled == nil || !tt.task.Scheduled.Start.Equal(now.Add(time.Duration(tt.scheduled)*time.Hour))):
+			t.Errorf("%s: scheduled %v, want %d hours from now", tt.name, tt.task.Scheduled, tt.scheduled)
+		}
+		if feasible := tt.task.FeasibleAt != nil && tt.task.FeasibleAt.Equal(now); feasible != (tt.event == EventPlanFeasible) {
+			t.Errorf("%s: feasible_at = %v", tt.name, tt.task.FeasibleAt)
+		}
+		if len(tt.task.Slots) != tt.slots {
+			t.Errorf("%s: %d alternative slots, want %d", tt.name, len(tt.task.Slots), tt.slots)
+		}
+	}
+
+	if set, _ := reevaluateTask(newTask(planScheduled, 0), warm, now); set["status"] != planStarted {
+		t.Errorf("slot starting now: set %v, want started", set)
+	}
+	ended := newTask(planInfeasible, -1)
+	if set, _ := reevaluateTask(ended, warm, ended.To); set != nil {
+		t.Errorf("infeasible task after its window: set %v", set)
+	}
+	if set, _ := reevaluateTask(newTask(planStarted, 0), warm, now); set != nil {
+		t.Errorf("started task re-checked: set %v", set)
+	}
+
+	// A forecast that no longer covers the slot only records where it came from
+	set, event := reevaluateTask(newTask(planScheduled, 3), hourlyForecast(now, 15, 15), now)
+	if _, ok := set["status"]; ok || set["provider"] != "test" || event != "" {
+		t.Errorf("uncovered slot: set %v, event %q", set, event)
+	}
+}
+
+func TestHourChance(t *testing.T) {
+	minTemp, maxWind, maxChance := 10.0, 8.0, 0.3
+	c := PlanConstraints{MinTemp: &minTemp, MaxWind: &maxWind}
+	members := func(values ...float64) ForecastValue {
+		return ForecastValue{Value: values[len(values)/2], Members: values}
+	}
+	chance := func(p float64) *float64 { return &p }
+	tests := []struct {
+		name        string
+		constraints PlanConstraints
+		hour        ForecastHour
+		members     int
+		want        float64
+	}{
+		{"median meets", c, ForecastHour{Temp: ForecastValue{Value: 12}, Wind: ForecastValue{Value: 5}}, 0, 1},
+		{"median fails", c, ForecastHour{Temp: ForecastValue{Value: 12}, Wind: ForecastValue{Value: 9}}, 0, 0},
+		{"share of members", c, ForecastHour{Temp: members(9, 11, 12, 13), Wind: members(1, 9, 2, 3), Precip: members(0, 0, 0, 0)}, 4, 0.5},
+		{"members checked together", c, ForecastHour{Temp: members(9, 12), Wind: members(1, 9), Precip: members(0, 0)}, 2, 0},
+		{"incomplete members use the median", c, ForecastHour{Temp: ForecastValue{Value: 12, Members: []float64{9, 12, 13}}, Wind: members(1, 2, 3), Precip: members(0, 0, 0)}, 4, 1},
+		{"avoided condition", PlanConstraints{AvoidConditions: []string{"rain"}}, ForecastHour{Description: "Light drizzle"}, 0, 0},
+		{"other condition", PlanConstraints{AvoidConditions: []string{"rain"}}, ForecastHour{Description: "clear sky"}, 0, 1},
+		{"precipitation chance too high", PlanConstraints{MaxPrecipChance: &maxChance}, ForecastHour{PrecipChance: chance(0.4)}, 0, 0},
+		{"precipitation chance low enough", PlanConstraints{MaxPrecipChance: &maxChance}, ForecastHour{PrecipChance: chance(0.3)}, 0, 1},
+		{"no precipitation chance given", PlanConstraints{MaxPrecipChance: &maxChance}, ForecastHour{}, 0, 1},
+	}
+	for _, tt := range tests {
+		if got := tt.constraints.hourChance(tt.hour, tt.members); got != tt.want {
+			t.Errorf("%s: hourChance = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// memberForecast gives one hour per share, starting at start, with four members
+// of which that share is warm.
+func memberForecast(start time.Time, shares ...float64) Forecast {
+	forecast := Forecast{Members: 4}
+	for i, share := range shares {
+		temps := []float64{0, 0, 0, 0}
+		for m := 0; m < int(share*4); m++ {
+			temps[m] = 20
+		}
+		zeros := []float64{0, 0, 0, 0}
+		forecast.Hours = append(forecast.Hours, ForecastHour{
+			Time: start.Add(time.Duration(i) * time.Hour),
+			Temp: ForecastValue{Members: temps}, Wind: ForecastValue{Members: zeros}, Precip: ForecastValue{Members: zeros},
+		})
+	}
+	return forecast
+}
+
+func TestRankSlots(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	minTemp := 10.0
+	at := func(hours float64) time.Time { return now.Add(time.Duration(hours * float64(time.Hour))) }
+	gap := memberForecast(now, 1, 1, 1, 1, 1, 1)
+	gap.Hours = append(gap.Hours[:3], gap.Hours[4:]...) // no 13:00
+
+	tests := []struct {
+		name          string
+		duration      string
+		from, to      time.Time
+		now           time.Time
+		forecast      Forecast
+		minConfidence float64
+		want          []float64 // slot starts, hours from 10:00, best first
+		scores        []float64
+	}{
+		{"best first, ties in time order", "1h", at(0), at(4), now, memberForecast(now, 0.5, 1, 0.75, 1), 0.5, []float64{1, 3, 2, 0}, []float64{1, 1, 0.75, 0.5}},
+		{"below min confidence", "1h", at(0), at(4), now, memberForecast(now, 0.5, 1, 0.25, 0.75), 0.6, []float64{1, 3}, []float64{1, 0.75}},
+		{"score is the worst hour", "2h", at(0), at(4), now, memberForecast(now, 1, 0.5, 1, 1), 0.25, []float64{2, 0, 1}, []float64{1, 0.5, 0.5}},
+		{"partial-hour window starts on the next hour", "90m", at(0.5), at(4), now, memberForecast(now, 1, 1, 1, 1, 1), 0.5, []float64{1, 2}, []float64{1, 1}},
+		{"partial-hour duration ends inside the window", "90m", at(0), at(3.5), now, memberForecast(now, 1, 1, 1, 1), 0.5, []float64{0, 1, 2}, []float64{1, 1, 1}},
+		{"no slot before now", "1h", at(-2), at(3), at(0.25), memberForecast(at(-2), 1, 1, 1, 1, 1), 0.5, []float64{1, 2}, []float64{1, 1}},
+		{"hours missing from the forecast", "2h", at(0), at(6), now, gap, 0.5, []float64{0, 1, 4}, []float64{1, 1, 1}},
+		{"window past the forecast", "1h", at(4), at(8), now, memberForecast(now, 1, 1, 1, 1, 1, 1), 0.5, []float64{4, 5}, []float64{1, 1}},
+	}
+	for _, tt := range tests {
+		task := PlanTask{Duration: tt.duration, From: tt.from, To: tt.to, Constraints: PlanConstraints{MinTemp: &minTemp}, MinConfidence: tt.minConfidence}
+		slots := rankSlots(task, tt.forecast, tt.now)
+		if len(slots) != len(tt.want) {
+			t.Errorf("%s: got %d slots %+v, want starts %v", tt.name, len(slots), slots, tt.want)
+			continue
+		}
+		duration, _ := time.ParseDuration(tt.duration)
+		for i, slot := range slots {
+			if !slot.Start.Equal(at(tt.want[i])) || !slot.End.Equal(slot.Start.Add(duration)) || slot.Score != tt.scores[i] {
+				t.Errorf("%s: slot %d = %s-%s %v, want start %v score %v", tt.name, i, slot.Start.Format("15:04"), slot.End.Format("15:04"), slot.Score, tt.want[i], tt.scores[i])
+			}
+		}
+	}
+}
+
+func TestSlotScore(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	minTemp := 10.0
+	task := PlanTask{Duration: "2h", Constraints: PlanConstraints{MinTemp: &minTemp}, MinConfidence: 0.9}
+	slot := PlanSlot{Start: now.Add(time.Hour), End: now.Add(3 * time.Hour)}
+
+	// Scores below the task's confidence are still reported
+	if score, covered := slotScore(task, slot, memberForecast(now, 1, 1, 0.25, 1)); !covered || score != 0.25 {
+		t.Errorf("slotScore = %v, %v; want 0.25, true", score, covered)
+	}
+	if score, covered := slotScore(task, slot, memberForecast(now, 1, 1, 0, 1)); !covered || score != 0 {
+		t.Errorf("slotScore of a failing slot = %v, %v; want 0, true", score, covered)
+	}
+	if _, covered := slotScore(task, slot, memberForecast(now, 1, 1)); covered {
+		t.Error("slot past the end of the forecast reported as covered")
+	}
+}
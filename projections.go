@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DailyAggregate summarises the readings for one city on one UTC day.
+type DailyAggregate struct {
+	City    string  `bson:"city" json:"city"`
+	Day     string  `bson:"day" json:"day"`
+	MinTemp float64 `bson:"min_temp" json:"min_temp"`
+	MaxTemp float64 `bson:"max_temp" json:"max_temp"`
+	SumTemp float64 `bson:"sum_temp" json:"-"`
+	MaxWind float64 `bson:"max_wind" json:"max_wind"`
+	Precip  float64 `bson:"precip" json:"precip"` // see dailyPrecip
+	Count   int     `bson:"count" json:"count"`
+
+	// PrecipHourly holds the reported last-hour precipitation per UTC hour ("00"
+	// to "23"), so the daily total does not depend on how often the city is read.
+	PrecipHourly map[string]float64 `bson:"precip_hourly,omitempty" json:"-"`
+}
+
+func (d DailyAggregate) AvgTemp() float64 {
+	if d.Count == 0 {
+		return 0
+	}
+	return d.SumTemp / float64(d.Count)
+}
+
+type searchEntry struct {
+	City      string   `bson:"city" json:"city"`
+	CityLower string   `bson:"city_lower" json:"-"`
+	Country   string   `bson:"country,omitempty" json:"country,omitempty"`
+	Tags      []string `bson:"tags,omitempty" json:"tags,omitempty"`
+}
+
+type projection struct {
+	name       string
+	collection *mongo.Collection
+	indexes    []mongo.IndexModel
+	apply      func(ctx context.Context, c *mongo.Collection, ev Event) error
+}
+
+const dayLayout = "2006-01-02"
+
+var (
+	dailyCollection  *mongo.Collection
+	searchCollection *mongo.Collection
+)
+
+var projections []projection
+
+func initProjections(db *mongo.Database) {
+	weatherCollection = db.Collection("weather")
+	blocksCollection = db.Collection("weather_blocks")
+	dailyCollection = db.Collection("weather_daily")
+	searchCollection = db.Collection("weather_search")
+	episodesCollection = db.Collection("weather_episodes")
+	recordsCollection = db.Collection("weather_records")
+	aggCacheCollection = db.Collection("aggregation_cache")
+	eventsCollection = db.Collection("weather_events")
+
+	projections = []projection{
+		{
+			name:       "current",
+			collection: weatherCollection,
+			indexes:    []mongo.IndexModel{{Keys: bson.D{{Key: "city", Value: 1}}, Options: options.Index().SetUnique(true)}},
+			apply:      applyCurrent,
+		},
+		{
+			name:       "history",
+			collection: blocksCollection,
+			indexes:    []mongo.IndexModel{{Keys: bson.D{{Key: "city", Value: 1}, {Key: "day", Value: 1}}, Options: options.Index().SetUnique(true)}},
+			apply:      applyHistoryBlocks,
+		},
+		{
+			name:       "daily",
+			collection: dailyCollection,
+			indexes:    []mongo.IndexModel{{Keys: bson.D{{Key: "city", Value: 1}, {Key: "day", Value: 1}}, Options: options.Index().SetUnique(true)}},
+			apply:      applyDaily,
+		},
+		{
+			name:       "search",
+			collection: searchCollection,
+			indexes:    []mongo.IndexModel{{Keys: bson.D{{Key: "city_lower", Value: 1}}}},
+			apply:      applySearch,
+		},
+		{
+			name:       "episodes",
+			collection: episodesCollection,
+			indexes:    []mongo.IndexModel{{Keys: bson.D{{Key: "city", Value: 1}, {Key: "kind", Value: 1}, {Key: "start", Value: 1}}, Options: options.Index().SetUnique(true)}},
+			apply:      applyEpisodes,
+		},
+		{
+			name:       "records",
+			collection: recordsCollection,
+			indexes:    []mongo.IndexModel{{Keys: bson.D{{Key: "city", Value: 1}, {Key: "scope", Value: 1}, {Key: "metric", Value: 1}}, Options: options.Index().SetUnique(true)}},
+			apply:      applyRecords,
+		},
+		{
+			name:       "aggregation cache",
+			collection: aggCacheCollection,
+			indexes: []mongo.IndexModel{
+				{Keys: bson.D{{Key: "cities", Value: 1}, {Key: "from", Value: 1}}},
+				{Keys: bson.D{{Key: "countries", Value: 1}}},
+				{Keys: bson.D{{Key: "computed_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(aggCacheTTL / time.Second))},
+			},
+			apply: applyAggCache,
+		},
+	}
+}
+
+// storeIndexes holds the indexes of collections that are not projections.
+var storeIndexes = map[*mongo.Collection][]mongo.IndexModel{}
+
+func registerIndexes(c *mongo.Collection, indexes ...mongo.IndexModel) {
+	storeIndexes[c] = append(storeIndexes[c], indexes...)
+}
+
+func ensureIndexes(ctx context.Context) error {
+	for _, p := range projections {
+		if len(p.indexes) == 0 {
+			continue
+		}
+		if _, err := p.collection.Indexes().CreateMany(ctx, p.indexes); err != nil {
+			return fmt.Errorf("failed to create indexes for %s projection: %w", p.name, err)
+		}
+	}
+	for c, indexes := range storeIndexes {
+		if _, err := c.Indexes().CreateMany(ctx, indexes); err != nil {
+			return fmt.Errorf("failed to create indexes for %s: %w", c.Name(), err)
+		}
+	}
+	return nil
+}
+
+func applyProjections(ctx context.Context, ev Event) error {
+	for _, p := range projections {
+		if err := p.apply(ctx, p.collection, ev); err != nil {
+			return fmt.Errorf("failed to apply %s event to %s projection: %w", ev.Type, p.name, err)
+		}
+	}
+	return nil
+}
+
+func applyCurrent(ctx context.Context, c *mongo.Collection, ev Event) error {
+	switch ev.Type {
+	case EventFetch, EventImport:
+		filter := bson.M{"city": ev.City}
+		update := bson.M{"$set": ev.Data}
+		_, err := c.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+		return err
+	case EventRetag:
+		_, err := c.UpdateOne(ctx, bson.M{"city": ev.City}, retagUpdate(ev.Tags))
+		return err
+	case EventDelete:
+		_, err := c.DeleteOne(ctx, bson.M{"city": ev.City})
+		return err
+	}
+	return nil
+}
+
+// retagUpdate replaces a document's tags, dropping the field when there are none
+// as omitempty would.
+func retagUpdate(tags []string) bson.M {
+	if len(tags) == 0 {
+		return bson.M{"$unset": bson.M{"tags": ""}}
+	}
+	return bson.M{"$set": bson.M{"tags": tags}}
+}
+
+func applyDaily(ctx context.Context, c *mongo.Collection, ev Event) error {
+	switch ev.Type {
+	case EventFetch, EventImport:
+		filter := bson.M{"city": ev.City, "day": ev.Data.LastUpdated.UTC().Format(dayLayout)}
+		// Readings within one hour overlap, so the hour keeps the largest
+		update := bson.M{
+			"$min": bson.M{"min_temp": ev.Data.Temp},
+			"$max": bson.M{"max_temp": ev.Data.Temp, "max_wind": ev.Data.Wind, "precip_hourly." + ev.Data.LastUpdated.UTC().Format("15"): ev.Data.Precip},
+			"$inc": bson.M{"sum_temp": ev.Data.Temp, "count": 1},
+		}
+		var daily DailyAggregate
+		opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+		if err := c.FindOneAndUpdate(ctx, filter, update, opts).Decode(&daily); err != nil {
+			return err
+		}
+		// Only the latest reading of the day sets the total; an older one racing
+		// with it no longer matches the count
+		filter["count"] = daily.Count
+		_, err := c.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"precip": dailyPrecip(daily.PrecipHourly)}})
+		return err
+	}
+	return nil
+}
+
+// maxPrecipGap caps how many hours one hourly reading stands in for.
+const maxPrecipGap = 3
+
+// dailyPrecip totals the hourly values of a day, weighting each by the hours
+// since the previous reported hour (or midnight), up to maxPrecipGap. A city
+// read every ten minutes and one read every hour get the same total, and one
+// read every three hours is not undercounted threefold.
+func dailyPrecip(hourly map[string]float64) float64 {
+	hours := make([]string, 0, len(hourly))
+	for h := range hourly {
+		hours = append(hours, h)
+	}
+	sort.Strings(hours)
+	total, previous := 0.0, -1
+	for _, h := range hours {
+		hour, err := strconv.Atoi(h)
+		if err != nil {
+			continue
+		}
+		total += hourly[h] * float64(min(hour-previous, maxPrecipGap))
+		previous = hour
+	}
+	return total
+}
+
+func applySearch(ctx context.Context, c *mongo.Collection, ev Event) error {
+	switch ev.Type {
+	case EventFetch, EventImport:
+		entry := searchEntry{
+			City:      ev.City,
+			CityLower: strings.ToLower(ev.City),
+			Country:   ev.Data.Country,
+			Tags:      ev.Data.Tags,
+		}
+		_, err := c.ReplaceOne(ctx, bson.M{"city": ev.City}, entry, options.Replace().SetUpsert(true))
+		return err
+	case EventRetag:
+		_, err := c.UpdateOne(ctx, bson.M{"city": ev.City}, retagUpdate(ev.Tags))
+		return err
+	case EventDelete:
+		_, err := c.DeleteOne(ctx, bson.M{"city": ev.City})
+		return err
+	}
+	return nil
+}
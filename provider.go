@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Provider is a weather data source that can serve current conditions for a location.
+type Provider interface {
+	Name() string
+	Current(loc Location) (WeatherData, error)
+}
+
+// providerStatusError is returned when a provider answers with a non-200 status.
+type providerStatusError struct {
+	StatusCode int
+}
+
+func (e *providerStatusError) Error() string {
+	return fmt.Sprintf("failed to fetch weather data from API: status %d", e.StatusCode)
+}
+
+type openWeatherProvider struct {
+	name    string
+	baseURL string
+	apiKey  string
+}
+
+func newOpenWeatherProvider(name, baseURL, apiKey string) *openWeatherProvider {
+	return &openWeatherProvider{name: name, baseURL: baseURL, apiKey: apiKey}
+}
+
+func (p *openWeatherProvider) Name() string {
+	return p.name
+}
+
+func (p *openWeatherProvider) Current(loc Location) (WeatherData, error) {
+	searchURL := fmt.Sprintf("%v?appid=%s&q=%s", p.baseURL, p.apiKey, url.QueryEscape(loc.City))
+	response, err := providerClient.Get(searchURL)
+	if err != nil {
+		return WeatherData{}, fmt.Errorf("failed to fetch weather data: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return WeatherData{}, &providerStatusError{StatusCode: response.StatusCode}
+	}
+
+	weatherBytes, err := io.ReadAll(response.Body)
+	if err != nil {
+		return WeatherData{}, fmt.Errorf("failed to read weather data: %w", err)
+	}
+	var weatherAPIResponse weatherjson
+	if err := json.Unmarshal(weatherBytes, &weatherAPIResponse); err != nil {
+		return WeatherData{}, fmt.Errorf("failed to parse weather data: %w", err)
+	}
+	if len(weatherAPIResponse.Weather) == 0 {
+		return WeatherData{}, fmt.Errorf("weather data has no conditions")
+	}
+
+	return WeatherData{
+		City:        weatherAPIResponse.Name,
+		Country:     weatherAPIResponse.Sys.Country,
+		Lat:         weatherAPIResponse.Coord.Lat,
+		Lon:         weatherAPIResponse.Coord.Lon,
+		Description: weatherAPIResponse.Weather[0].Description,
+		Temp:        weatherAPIResponse.Main.Temp - 273.15,
+		Wind:        weatherAPIResponse.Wind.Speed,
+		Precip:      weatherAPIResponse.Rain.OneHour,
+		LastUpdated: time.Now(),
+	}, nil
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A small read-only SQL dialect:
+//
+//	SELECT <expr [AS alias]>, ... | *
+//	FROM current | history | daily
+//	[WHERE <condition>]
+//	[GROUP BY <expr>, ...]
+//	[ORDER BY <expr> [ASC|DESC], ...]
+//	[LIMIT n]
+//
+// Conditions support = != <> < <= > >=, AND, OR, NOT, IN (...), BETWEEN,
+// LIKE and parentheses. Aggregates are count(*), count, sum, avg, min and max.
+// Comparisons with a missing value are unknown, as with SQL NULL: NOT keeps
+// them unknown and WHERE drops them.
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenKeyword
+	tokenNumber
+	tokenString
+	tokenSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var queryKeywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "GROUP": true, "BY": true, "ORDER": true,
+	"ASC": true, "DESC": true, "LIMIT": true, "AND": true, "OR": true, "NOT": true,
+	"IN": true, "BETWEEN": true, "LIKE": true, "AS": true, "TRUE": true, "FALSE": true,
+}
+
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(input) {
+		c := rune(input[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'':
+			start := i
+			i++
+			var b strings.Builder
+			for {
+				if i >= len(input) {
+					return nil, fmt.Errorf("unterminated string at %d", start)
+				}
+				if input[i] == '\'' {
+					if i+1 < len(input) && input[i+1] == '\'' {
+						b.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteByte(input[i])
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenString, text: b.String(), pos: start})
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(input) && unicode.IsDigit(rune(input[i+1])) && lastIsOperator(tokens)):
+			start := i
+			i++
+			for i < len(input) && (unicode.IsDigit(rune(input[i])) || input[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: input[start:i], pos: start})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(input) && (unicode.IsLetter(rune(input[i])) || unicode.IsDigit(rune(input[i])) || input[i] == '_') {
+				i++
+			}
+			word := input[start:i]
+			if queryKeywords[strings.ToUpper(word)] {
+				tokens = append(tokens, token{kind: tokenKeyword, text: strings.ToUpper(word), pos: start})
+			} else {
+				tokens = append(tokens, token{kind: tokenIdent, text: strings.ToLower(word), pos: start})
+			}
+		default:
+			start := i
+			two := ""
+			if i+1 < len(input) {
+				two = input[i : i+2]
+			}
+			switch two {
+			case "<=", ">=", "!=", "<>":
+				tokens = append(tokens, token{kind: tokenSymbol, text: two, pos: start})
+				i += 2
+				continue
+			}
+			if !strings.ContainsRune("=<>(),*", c) {
+				return nil, fmt.Errorf("unexpected %q at %d", c, start)
+			}
+			tokens = append(tokens, token{kind: tokenSymbol, text: string(c), pos: start})
+			i++
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(input)}), nil
+}
+
+// lastIsOperator tells a negative number from a minus sign; the dialect has no
+// arithmetic, so a '-' is only valid where a value may start.
+func lastIsOperator(tokens []token) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+	last := tokens[len(tokens)-1]
+	return last.kind == tokenSymbol && last.text != ")" || last.kind == tokenKeyword
+}
+
+type queryExpr interface{}
+
+type columnRef struct{ Name string }
+
+type literalExpr struct{ Value any }
+
+type binaryExpr struct {
+	Op          string
+	Left, Right queryExpr
+}
+
+type notExpr struct{ Expr queryExpr }
+
+type inExpr struct {
+	Expr queryExpr
+	List []queryExpr
+}
+
+type callExpr struct {
+	Func string
+	Arg  queryExpr // nil for count(*)
+}
+
+type selectItem struct {
+	Expr  queryExpr
+	Alias string
+}
+
+type orderItem struct {
+	Expr queryExpr
+	Desc bool
+}
+
+type parsedQuery struct {
+	Star    bool
+	Items   []selectItem
+	From    string
+	Where   queryExpr
+	GroupBy []queryExpr
+	OrderBy []orderItem
+	Limit   int // -1 without a LIMIT clause
+}
+
+var comparisonOps = map[string]bool{"=": true, "!=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true}
+
+var aggregateFuncs = map[string]bool{"count": true, "sum": true, "avg": true, "min": true, "max": true}
+
+type queryParser struct {
+	tokens []token
+	pos    int
+}
+
+func parseQuery(input string) (*parsedQuery, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	q, err := p.parseSelect()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	return q, nil
+}
+
+// parseCondition parses a bare WHERE expression, e.g. for bulk operation filters.
+func parseCondition(input string) (queryExpr, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	if hasAggregate(expr) {
+		return nil, fmt.Errorf("aggregates are not allowed in filters")
+	}
+	return expr, nil
+}
+
+func (p *queryParser) peek() token { return p.tokens[p.pos] }
+
+func (p *queryParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *queryParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("at %d: %s", p.peek().pos, fmt.Sprintf(format, args...))
+}
+
+func (p *queryParser) accept(kind tokenKind, text string) bool {
+	t := p.peek()
+	if t.kind == kind && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expect(kind tokenKind, text string) error {
+	if !p.accept(kind, text) {
+		return p.errorf("expected %s", text)
+	}
+	return nil
+}
+
+func (p *queryParser) parseSelect() (*parsedQuery, error) {
+	q := &parsedQuery{Limit: -1}
+	if err := p.expect(tokenKeyword, "SELECT"); err != nil {
+		return nil, err
+	}
+	if p.accept(tokenSymbol, "*") {
+		q.Star = true
+	} else {
+		for {
+			expr, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			item := selectItem{Expr: expr}
+			if p.accept(tokenKeyword, "AS") {
+				alias := p.next()
+				if alias.kind != tokenIdent {
+					return nil, p.errorf("expected alias")
+				}
+				item.Alias = alias.text
+			}
+			q.Items = append(q.Items, item)
+			if !p.accept(tokenSymbol, ",") {
+				break
+			}
+		}
+	}
+
+	if err := p.expect(tokenKeyword, "FROM"); err != nil {
+		return nil, err
+	}
+	from := p.next()
+	if from.kind != tokenIdent {
+		return nil, p.errorf("expected dataset name")
+	}
+	q.From = from.text
+
+	if p.accept(tokenKeyword, "WHERE") {
+		where, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		q.Where = where
+	}
+	if p.accept(tokenKeyword, "GROUP") {
+		if err := p.expect(tokenKeyword, "BY"); err != nil {
+			return nil, err
+		}
+		for {
+			expr, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			q.GroupBy = append(q.GroupBy, expr)
+			if !p.accept(tokenSymbol, ",") {
+				break
+			}
+		}
+	}
+	if p.accept(tokenKeyword, "ORDER") {
+		if err := p.expect(tokenKeyword, "BY"); err != nil {
+			return nil, err
+		}
+		for {
+			expr, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			item := orderItem{Expr: expr}
+			if p.accept(tokenKeyword, "DESC") {
+				item.Desc = true
+			} else {
+				p.accept(tokenKeyword, "ASC")
+			}
+			q.OrderBy = append(q.OrderBy, item)
+			if !p.accept(tokenSymbol, ",") {
+				break
+			}
+		}
+	}
+	if p.accept(tokenKeyword, "LIMIT") {
+		t := p.next()
+		limit, err := strconv.Atoi(t.text)
+		if t.kind != tokenNumber || err != nil || limit < 0 {
+			return nil, p.errorf("LIMIT needs a non-negative integer")
+		}
+		q.Limit = limit
+	}
+	return q, nil
+}
+
+func (p *queryParser) parseOr() (queryExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokenKeyword, "OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{Op: "OR", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokenKeyword, "AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{Op: "AND", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseNot() (queryExpr, error) {
+	if p.accept(tokenKeyword, "NOT") {
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{Expr: expr}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *queryParser) parseComparison() (queryExpr, error) {
+	if p.peek().kind == tokenSymbol && p.peek().text == "(" {
+		// Either a parenthesised condition or a parenthesised value; conditions are
+		// the only thing that can be grouped in this dialect.
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenSymbol, ")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+
+	left, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokenSymbol && comparisonOps[t.text]:
+		p.next()
+		right, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		op := t.text
+		if op == "<>" {
+			op = "!="
+		}
+		return binaryExpr{Op: op, Left: left, Right: right}, nil
+	case t.kind == tokenKeyword && t.text == "LIKE":
+		p.next()
+		right, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return binaryExpr{Op: "LIKE", Left: left, Right: right}, nil
+	case t.kind == tokenKeyword && (t.text == "IN" || t.text == "BETWEEN" || t.text == "NOT"):
+		negate := p.accept(tokenKeyword, "NOT")
+		var expr queryExpr
+		var err error
+		if p.accept(tokenKeyword, "BETWEEN") {
+			expr, err = p.parseBetween(left)
+		} else if err = p.expect(tokenKeyword, "IN"); err == nil {
+			expr, err = p.parseIn(left)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if negate {
+			return notExpr{Expr: expr}, nil
+		}
+		return expr, nil
+	}
+	return left, nil
+}
+
+// parseIn parses the list after IN. Items are columns or literals only, so a
+// filter cannot hide an aggregate or anything else the checks do not expect.
+func (p *queryParser) parseIn(left queryExpr) (queryExpr, error) {
+	if err := p.expect(tokenSymbol, "("); err != nil {
+		return nil, err
+	}
+	in := inExpr{Expr: left}
+	for {
+		start := p.peek().pos
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		switch value.(type) {
+		case columnRef, literalExpr:
+		default:
+			return nil, fmt.Errorf("at %d: IN list items must be columns or literals", start)
+		}
+		in.List = append(in.List, value)
+		if !p.accept(tokenSymbol, ",") {
+			break
+		}
+	}
+	if err := p.expect(tokenSymbol, ")"); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// parseBetween parses `low AND high` into `left >= low AND left <= high`, which
+// pushdownFilter and timeBounds already understand.
+func (p *queryParser) parseBetween(left queryExpr) (queryExpr, error) {
+	low, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokenKeyword, "AND"); err != nil {
+		return nil, err
+	}
+	high, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return binaryExpr{
+		Op:    "AND",
+		Left:  binaryExpr{Op: ">=", Left: left, Right: low},
+		Right: binaryExpr{Op: "<=", Left: left, Right: high},
+	}, nil
+}
+
+func (p *queryParser) parseValue() (queryExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		value, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("at %d: bad number %q", t.pos, t.text)
+		}
+		return literalExpr{Value: value}, nil
+	case tokenString:
+		return literalExpr{Value: t.text}, nil
+	case tokenKeyword:
+		switch t.text {
+		case "TRUE":
+			return literalExpr{Value: true}, nil
+		case "FALSE":
+			return literalExpr{Value: false}, nil
+		}
+	case tokenIdent:
+		if !p.accept(tokenSymbol, "(") {
+			return columnRef{Name: t.text}, nil
+		}
+		if !aggregateFuncs[t.text] {
+			return nil, fmt.Errorf("at %d: unknown function %q", t.pos, t.text)
+		}
+		call := callExpr{Func: t.text}
+		if !p.accept(tokenSymbol, "*") {
+			arg, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			call.Arg = arg
+		} else if t.text != "count" {
+			return nil, fmt.Errorf("at %d: only count accepts *", t.pos)
+		}
+		if err := p.expect(tokenSymbol, ")"); err != nil {
+			return nil, err
+		}
+		return call, nil
+	}
+	return nil, fmt.Errorf("at %d: unexpected %q", t.pos, t.text)
+}
+
+// exprString renders an expression the way it names a result column.
+func exprString(expr queryExpr) string {
+	switch e := expr.(type) {
+	case columnRef:
+		return e.Name
+	case literalExpr:
+		if s, ok := e.Value.(string); ok {
+			return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+		}
+		return fmt.Sprint(e.Value)
+	case callExpr:
+		if e.Arg == nil {
+			return e.Func + "(*)"
+		}
+		return e.Func + "(" + exprString(e.Arg) + ")"
+	case binaryExpr:
+		return exprString(e.Left) + " " + e.Op + " " + exprString(e.Right)
+	case notExpr:
+		return "NOT " + exprString(e.Expr)
+	case inExpr:
+		items := make([]string, len(e.List))
+		for i, item := range e.List {
+			items[i] = exprString(item)
+		}
+		return exprString(e.Expr) + " IN (" + strings.Join(items, ", ") + ")"
+	}
+	return "?"
+}
+
+func hasAggregate(expr queryExpr) bool {
+	switch e := expr.(type) {
+	case callExpr:
+		return true
+	case binaryExpr:
+		return hasAggregate(e.Left) || hasAggregate(e.Right)
+	case notExpr:
+		return hasAggregate(e.Expr)
+	case inExpr:
+		for _, item := range e.List {
+			if hasAggregate(item) {
+				return true
+			}
+		}
+		return hasAggregate(e.Expr)
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestConditionPrecedence(t *testing.T) {
+	tests := []struct {
+		condition string
+		want      string
+	}{
+		{"a = 1 OR b = 2 AND c = 3", "a = 1 OR b = 2 AND c = 3"},
+		{"(a = 1 OR b = 2) AND c = 3", "a = 1 OR b = 2 AND c = 3"},
+		{"NOT a = 1 AND b = 2", "NOT a = 1 AND b = 2"},
+		{"a NOT IN (1, 2)", "NOT a IN (1, 2)"},
+		{"a BETWEEN 1 AND 5 AND b = 2", "a >= 1 AND a <= 5 AND b = 2"},
+	}
+	for _, tt := range tests {
+		expr, err := parseCondition(tt.condition)
+		if err != nil {
+			t.Errorf("parseCondition(%q): %v", tt.condition, err)
+			continue
+		}
+		if got := exprString(expr); got != tt.want {
+			t.Errorf("parseCondition(%q) = %s, want %s", tt.condition, got, tt.want)
+		}
+	}
+
+	// exprString does not show grouping, so check the tree shape directly
+	expr, _ := parseCondition("a = 1 OR b = 2 AND c = 3")
+	if or, ok := expr.(binaryExpr); !ok || or.Op != "OR" {
+		t.Errorf("AND should bind tighter than OR, got %#v", expr)
+	}
+	expr, _ = parseCondition("(a = 1 OR b = 2) AND c = 3")
+	if and, ok := expr.(binaryExpr); !ok || and.Op != "AND" {
+		t.Errorf("parentheses should group the OR, got %#v", expr)
+	}
+	expr, _ = parseCondition("NOT a = 1 AND b = 2")
+	if and, ok := expr.(binaryExpr); !ok || and.Op != "AND" {
+		t.Errorf("NOT should bind tighter than AND, got %#v", expr)
+	}
+}
+
+func TestConditionEval(t *testing.T) {
+	row := queryRow{"city": "Berlin", "country": "DE", "temp": 21.5, "wind": 3.0, "tags": "coastal,capital", "missing": nil}
+	tests := []struct {
+		condition string
+		want      any
+	}{
+		{"city = 'Berlin'", true},
+		{"city <> 'Berlin'", false},
+		{"temp > 20 AND wind < 5", true},
+		{"temp > 30 OR country = 'DE'", true},
+		{"temp > 30 OR country = 'FR' AND wind < 5", false},
+		{"(temp > 30 OR country = 'DE') AND wind > 5", false},
+		{"NOT temp > 30", true},
+		{"city LIKE 'Ber%'", true},
+		{"city LIKE 'B_rlin'", true},
+		{"tags LIKE '%capital%'", true},
+		{"city IN ('Paris', 'Berlin')", true},
+		{"city IN ('Paris', country)", false},
+		{"city NOT IN ('Paris', 'Rome')", true},
+		{"temp BETWEEN 20 AND 22", true},
+		{"temp BETWEEN 21.5 AND 21.5", true},
+		{"temp BETWEEN 22 AND 30", false},
+		{"temp NOT BETWEEN 22 AND 30", true},
+
+		// A missing value is unknown: neither it nor its negation matches
+		{"missing = 1", nil},
+		{"NOT missing = 1", nil},
+		{"missing IN (1, 2)", nil},
+		{"missing NOT IN (1, 2)", nil},
+		{"city IN ('Paris', missing)", nil},
+		{"city IN ('Berlin', missing)", true},
+		{"missing BETWEEN 1 AND 2", nil},
+		{"missing = 1 AND temp > 30", false},
+		{"missing = 1 AND temp > 20", nil},
+		{"missing = 1 OR temp > 20", true},
+		{"missing = 1 OR temp > 30", nil},
+		{"NOT (missing = 1 OR temp > 30)", nil},
+	}
+	for _, tt := range tests {
+		expr, err := parseCondition(tt.condition)
+		if err != nil {
+			t.Errorf("parseCondition(%q): %v", tt.condition, err)
+			continue
+		}
+		got, err := evalExpr(expr, row, nil)
+		if err != nil {
+			t.Errorf("evalExpr(%q): %v", tt.condition, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("evalExpr(%q) = %v, want %v", tt.condition, got, tt.want)
+		}
+	}
+}
+
+func TestConditionRejected(t *testing.T) {
+	tests := []struct {
+		condition string
+		err       string
+	}{
+		{"count(*) > 1", "aggregates are not allowed"},
+		{"NOT max(temp) > 30", "aggregates are not allowed"},
+		{"temp IN (max(temp))", "IN list items must be columns or literals"},
+		{"temp BETWEEN 1 OR 2", "expected AND"},
+		{"city IN ()", "unexpected"},
+		{"city = 'Berlin", "unterminated string"},
+		{"upper(city) = 'BERLIN'", "unknown function"},
+		{"city = 'Berlin' city", "unexpected"},
+	}
+	for _, tt := range tests {
+		_, err := parseCondition(tt.condition)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseCondition(%q): got error %v, want %q", tt.condition, err, tt.err)
+		}
+	}
+}
+
+func TestCheckColumnsInList(t *testing.T) {
+	expr, err := parseCondition("city IN ('Berlin', nope)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkColumns(expr, weatherColumns); err == nil || !strings.Contains(err.Error(), `"nope"`) {
+		t.Errorf("got %v, want an unknown column error", err)
+	}
+}
+
+func TestParseQueryAggregates(t *testing.T) {
+	q, err := parseQuery("SELECT city, max(temp) AS hottest FROM daily WHERE day BETWEEN '2024-01-01' AND '2024-01-31' GROUP BY city ORDER BY hottest DESC LIMIT 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Items) != 2 || q.Items[1].Alias != "hottest" || q.From != "daily" || q.Limit != 3 {
+		t.Errorf("unexpected query %+v", q)
+	}
+	if len(q.OrderBy) != 1 || !q.OrderBy[0].Desc {
+		t.Errorf("unexpected ORDER BY %+v", q.OrderBy)
+	}
+	if got := len(conjuncts(q.Where)); got != 2 {
+		t.Errorf("BETWEEN gave %d conjuncts, want 2 for pushdown", got)
+	}
+
+	if _, err := parseQuery("SELECT sum(*) FROM current"); err == nil {
+		t.Error("sum(*) was accepted")
+	}
+}
+
+func TestRunQueryRejectsAggregates(t *testing.T) {
+	// These fail validation before anything is read from MongoDB
+	for _, query := range []string{
+		"SELECT city FROM current WHERE count(*) > 1",
+		"SELECT city FROM current GROUP BY max(temp)",
+		"SELECT city, max(temp) FROM current",
+		"SELECT temp, max(temp) FROM current GROUP BY city",
+	} {
+		q, err := parseQuery(query)
+		if err != nil {
+			t.Errorf("parseQuery(%q): %v", query, err)
+			continue
+		}
+		if _, err := runQuery(context.Background(), q); err == nil {
+			t.Errorf("runQuery(%q) was accepted", query)
+		}
+	}
+}
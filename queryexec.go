@@ -0,0 +1,847 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	queryTimeout       = 10 * time.Second
+	maxQueryLength     = 4096
+	maxQueryScanRows   = 200000
+	maxQueryResultRows = 10000
+)
+
+var (
+	errQueryTooExpensive = fmt.Errorf("query scans more than %d rows; narrow it with WHERE on city or last_updated/day", maxQueryScanRows)
+	errStopScan          = errors.New("stop scan")
+)
+
+type queryRow map[string]any
+
+// queryError is a problem with the query itself rather than with storage.
+type queryError struct{ error }
+
+func badQuery(format string, args ...any) error {
+	return queryError{fmt.Errorf(format, args...)}
+}
+
+// queryDataset is a table the query API reads. Scans receive the WHERE clause so
+// they can push simple predicates down to MongoDB; every row they return is still
+// checked against the full clause in memory.
+type queryDataset struct {
+	columns []string
+	scan    func(ctx context.Context, where queryExpr, fn func(queryRow) error) error
+}
+
+var weatherColumns = []string{"city", "country", "lat", "lon", "description", "condition", "temp", "wind", "precip", "tags", "tenant", "provider", "route", "last_updated"}
+
+var queryDatasets = map[string]queryDataset{
+	"current": {columns: weatherColumns, scan: scanCurrent},
+	"history": {columns: weatherColumns, scan: scanHistoryRows},
+	"daily":   {columns: []string{"city", "day", "min_temp", "max_temp", "avg_temp", "max_wind", "precip", "readings"}, scan: scanDaily},
+}
+
+type QueryResult struct {
+	Columns   []string `json:"columns"`
+	Rows      [][]any  `json:"rows"`
+	Scanned   int      `json:"scanned"`
+	Truncated bool     `json:"truncated,omitempty"`
+	ElapsedMS int64    `json:"elapsed_ms"`
+}
+
+func weatherRow(w WeatherData) queryRow {
+	return queryRow{
+		"city":         w.City,
+		"country":      w.Country,
+		"lat":          w.Lat,
+		"lon":          w.Lon,
+		"description":  w.Description,
+		"condition":    conditionCategory(w.Description),
+		"temp":         w.Temp,
+		"wind":         w.Wind,
+		"precip":       w.Precip,
+		"tags":         strings.Join(w.Tags, ","),
+		"tenant":       w.Tenant,
+		"provider":     w.Provider,
+		"route":        w.Route,
+		"last_updated": w.LastUpdated.UTC(),
+	}
+}
+
+func scanCurrent(ctx context.Context, where queryExpr, fn func(queryRow) error) error {
+	filter := pushdownFilter(where, map[string]string{
+		"city": "city", "country": "country", "tenant": "tenant", "provider": "provider", "route": "route", "last_updated": "last_updated",
+	})
+	cursor, err := weatherCollection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var weather WeatherData
+		if err := cursor.Decode(&weather); err != nil {
+			return err
+		}
+		if err := fn(weatherRow(weather)); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func scanHistoryRows(ctx context.Context, where queryExpr, fn func(queryRow) error) error {
+	filter := pushdownFilter(where, map[string]string{"city": "city"})
+	from, to := timeBounds(where, "last_updated")
+	return scanHistory(ctx, filter, from, to, func(w WeatherData) error {
+		return fn(weatherRow(w))
+	})
+}
+
+func scanDaily(ctx context.Context, where queryExpr, fn func(queryRow) error) error {
+	filter := pushdownFilter(where, map[string]string{"city": "city", "day": "day"})
+	cursor, err := dailyCollection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var d DailyAggregate
+		if err := cursor.Decode(&d); err != nil {
+			return err
+		}
+		row := queryRow{
+			"city":     d.City,
+			"day":      d.Day,
+			"min_temp": d.MinTemp,
+			"max_temp": d.MaxTemp,
+			"avg_temp": d.AvgTemp(),
+			"max_wind": d.MaxWind,
+			"precip":   d.Precip,
+			"readings": float64(d.Count),
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// conjuncts splits a condition on its top-level ANDs.
+func conjuncts(expr queryExpr) []queryExpr {
+	if b, ok := expr.(binaryExpr); ok && b.Op == "AND" {
+		return append(conjuncts(b.Left), conjuncts(b.Right)...)
+	}
+	if expr == nil {
+		return nil
+	}
+	return []queryExpr{expr}
+}
+
+// pushdownFilter builds a MongoDB filter from the `column op literal` and
+// `column IN (...)` conjuncts on the given columns. It only has to select a
+// superset of the matching rows, so anything it does not understand is skipped.
+func pushdownFilter(where queryExpr, fields map[string]string) bson.M {
+	operators := map[string]string{"=": "$eq", "<": "$lt", "<=": "$lte", ">": "$gt", ">=": "$gte"}
+	filter := bson.M{}
+	add := func(field, op string, value any) {
+		conditions, ok := filter[field].(bson.M)
+		if !ok {
+			conditions = bson.M{}
+			filter[field] = conditions
+		}
+		conditions[op] = value
+	}
+
+	for _, c := range conjuncts(where) {
+		switch e := c.(type) {
+		case binaryExpr:
+			column, ok := e.Left.(columnRef)
+			literal, isLiteral := e.Right.(literalExpr)
+			field, pushable := fields[column.Name]
+			op := operators[e.Op]
+			if !ok || !isLiteral || !pushable || op == "" {
+				continue
+			}
+			if value, ok := pushdownValue(column.Name, literal.Value); ok {
+				add(field, op, value)
+			}
+		case inExpr:
+			column, ok := e.Expr.(columnRef)
+			field, pushable := fields[column.Name]
+			if !ok || !pushable {
+				continue
+			}
+			values := make([]any, 0, len(e.List))
+			for _, item := range e.List {
+				literal, isLiteral := item.(literalExpr)
+				value, ok := pushdownValue(column.Name, literal.Value)
+				if !isLiteral || !ok {
+					values = nil
+					break
+				}
+				values = append(values, value)
+			}
+			if values != nil {
+				add(field, "$in", values)
+			}
+		}
+	}
+	return filter
+}
+
+// pushdownValue converts a literal to the type stored in MongoDB. Empty strings
+// are not pushed down because omitempty fields are missing rather than "".
+func pushdownValue(column string, value any) (any, bool) {
+	s, ok := value.(string)
+	if !ok || s == "" {
+		return nil, false
+	}
+	if column == "last_updated" {
+		t, err := parseQueryTime(s)
+		return t, err == nil
+	}
+	return s, true
+}
+
+// timeBounds derives a [from, to) range from the conjuncts on a time column,
+// defaulting to all time.
+func timeBounds(where queryExpr, column string) (time.Time, time.Time) {
+	from, to := time.Time{}, time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range conjuncts(where) {
+		b, ok := c.(binaryExpr)
+		if !ok {
+			continue
+		}
+		ref, ok := b.Left.(columnRef)
+		literal, isLiteral := b.Right.(literalExpr)
+		if !ok || !isLiteral || ref.Name != column {
+			continue
+		}
+		s, _ := literal.Value.(string)
+		t, err := parseQueryTime(s)
+		if err != nil {
+			continue
+		}
+		switch b.Op {
+		case ">", ">=":
+			if t.After(from) {
+				from = t
+			}
+		case "<":
+			if t.Before(to) {
+				to = t
+			}
+		case "<=":
+			if t.Add(time.Millisecond).Before(to) {
+				to = t.Add(time.Millisecond)
+			}
+		case "=":
+			from, to = t, t.Add(time.Millisecond)
+		}
+	}
+	return from, to
+}
+
+func parseQueryTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", dayLayout} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a time; use RFC 3339 or YYYY-MM-DD", s)
+}
+
+// compareValues orders two values of the same kind. Strings compared with times
+// are parsed as times so `last_updated >= '2024-01-01'` works.
+func compareValues(a, b any) (int, error) {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			switch {
+			case x < y:
+				return -1, nil
+			case x > y:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case string:
+		switch y := b.(type) {
+		case string:
+			return strings.Compare(x, y), nil
+		case time.Time:
+			c, err := compareValues(b, a)
+			return -c, err
+		}
+	case time.Time:
+		switch y := b.(type) {
+		case time.Time:
+			return x.Compare(y), nil
+		case string:
+			t, err := parseQueryTime(y)
+			if err != nil {
+				return 0, err
+			}
+			return x.Compare(t), nil
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			if x == y {
+				return 0, nil
+			}
+			if !x {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %v with %v", a, b)
+}
+
+// likeMatch implements SQL LIKE, where % matches any run and _ any one character.
+func likeMatch(s, pattern string) bool {
+	text, pat := []rune(s), []rune(pattern)
+	ti, pi := 0, 0
+	star, mark := -1, 0
+	for ti < len(text) {
+		switch {
+		case pi < len(pat) && (pat[pi] == '_' || pat[pi] == text[ti]):
+			ti++
+			pi++
+		case pi < len(pat) && pat[pi] == '%':
+			star, mark = pi, ti
+			pi++
+		case star >= 0:
+			pi = star + 1
+			mark++
+			ti = mark
+		default:
+			return false
+		}
+	}
+	for pi < len(pat) && pat[pi] == '%' {
+		pi++
+	}
+	return pi == len(pat)
+}
+
+func truthy(v any) bool {
+	b, ok := v.(bool)
+	return ok && b
+}
+
+// evalExpr evaluates an expression on a row. Aggregate calls are looked up in
+// aggregates, which is nil outside grouped queries.
+func evalExpr(expr queryExpr, row queryRow, aggregates map[string]any) (any, error) {
+	switch e := expr.(type) {
+	case columnRef:
+		return row[e.Name], nil
+	case literalExpr:
+		return e.Value, nil
+	case callExpr:
+		if aggregates == nil {
+			return nil, fmt.Errorf("%s is not allowed here", exprString(e))
+		}
+		return aggregates[exprString(e)], nil
+	case notExpr:
+		v, err := evalExpr(e.Expr, row, aggregates)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		return !truthy(v), nil
+	case inExpr:
+		v, err := evalExpr(e.Expr, row, aggregates)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		unknown := false
+		for _, item := range e.List {
+			candidate, err := evalExpr(item, row, aggregates)
+			if err != nil {
+				return nil, err
+			}
+			if candidate == nil {
+				unknown = true
+			} else if c, err := compareValues(v, candidate); err == nil && c == 0 {
+				return true, nil
+			}
+		}
+		if unknown {
+			return nil, nil
+		}
+		return false, nil
+	case binaryExpr:
+		left, err := evalExpr(e.Left, row, aggregates)
+		if err != nil {
+			return nil, err
+		}
+		switch e.Op {
+		case "AND", "OR":
+			// A decided left side short-circuits; otherwise unknown wins over the
+			// value that would not decide the result
+			decides := e.Op == "OR"
+			if left != nil && truthy(left) == decides {
+				return decides, nil
+			}
+			right, err := evalExpr(e.Right, row, aggregates)
+			if err != nil {
+				return nil, err
+			}
+			if right != nil && truthy(right) == decides {
+				return decides, nil
+			}
+			if left == nil || right == nil {
+				return nil, nil
+			}
+			return !decides, nil
+		}
+		right, err := evalExpr(e.Right, row, aggregates)
+		if err != nil {
+			return nil, err
+		}
+		if left == nil || right == nil {
+			return nil, nil
+		}
+		if e.Op == "LIKE" {
+			s, ok1 := left.(string)
+			pattern, ok2 := right.(string)
+			if !ok1 || !ok2 {
+				return nil, fmt.Errorf("LIKE needs strings")
+			}
+			return likeMatch(s, pattern), nil
+		}
+		c, err := compareValues(left, right)
+		if err != nil {
+			return nil, err
+		}
+		switch e.Op {
+		case "=":
+			return c == 0, nil
+		case "!=":
+			return c != 0, nil
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		case ">=":
+			return c >= 0, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot evaluate %s", exprString(expr))
+}
+
+// checkColumns rejects references to columns the dataset does not have.
+func checkColumns(expr queryExpr, columns []string) error {
+	switch e := expr.(type) {
+	case columnRef:
+		for _, c := range columns {
+			if c == e.Name {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown column %q; columns are %s", e.Name, strings.Join(columns, ", "))
+	case callExpr:
+		if e.Arg == nil {
+			return nil
+		}
+		if hasAggregate(e.Arg) {
+			return fmt.Errorf("aggregates cannot be nested in %s", exprString(e))
+		}
+		return checkColumns(e.Arg, columns)
+	case binaryExpr:
+		if err := checkColumns(e.Left, columns); err != nil {
+			return err
+		}
+		return checkColumns(e.Right, columns)
+	case notExpr:
+		return checkColumns(e.Expr, columns)
+	case inExpr:
+		for _, item := range e.List {
+			if err := checkColumns(item, columns); err != nil {
+				return err
+			}
+		}
+		return checkColumns(e.Expr, columns)
+	}
+	return nil
+}
+
+// checkGrouped requires columns outside aggregates to be grouped on.
+func checkGrouped(expr queryExpr, grouped map[string]bool) error {
+	if grouped[exprString(expr)] {
+		return nil
+	}
+	switch e := expr.(type) {
+	case columnRef:
+		return fmt.Errorf("column %q must appear in GROUP BY or inside an aggregate", e.Name)
+	case binaryExpr:
+		if err := checkGrouped(e.Left, grouped); err != nil {
+			return err
+		}
+		return checkGrouped(e.Right, grouped)
+	case notExpr:
+		return checkGrouped(e.Expr, grouped)
+	case inExpr:
+		for _, item := range e.List {
+			if err := checkGrouped(item, grouped); err != nil {
+				return err
+			}
+		}
+		return checkGrouped(e.Expr, grouped)
+	}
+	return nil
+}
+
+func collectCalls(expr queryExpr, calls map[string]callExpr) {
+	switch e := expr.(type) {
+	case callExpr:
+		calls[exprString(e)] = e
+	case binaryExpr:
+		collectCalls(e.Left, calls)
+		collectCalls(e.Right, calls)
+	case notExpr:
+		collectCalls(e.Expr, calls)
+	case inExpr:
+		collectCalls(e.Expr, calls)
+	}
+}
+
+type aggregateState struct {
+	call  callExpr
+	count int
+	sum   float64
+	best  any
+}
+
+func (s *aggregateState) add(row queryRow) error {
+	if s.call.Arg == nil {
+		s.count++
+		return nil
+	}
+	v, err := evalExpr(s.call.Arg, row, nil)
+	if err != nil || v == nil {
+		return err
+	}
+	s.count++
+	switch s.call.Func {
+	case "sum", "avg":
+		f, ok := v.(float64)
+		if !ok {
+			return fmt.Errorf("%s needs a numeric argument", s.call.Func)
+		}
+		s.sum += f
+	case "min", "max":
+		if s.best == nil {
+			s.best = v
+			return nil
+		}
+		c, err := compareValues(v, s.best)
+		if err != nil {
+			return err
+		}
+		if (s.call.Func == "min" && c < 0) || (s.call.Func == "max" && c > 0) {
+			s.best = v
+		}
+	}
+	return nil
+}
+
+func (s *aggregateState) result() any {
+	switch s.call.Func {
+	case "count":
+		return float64(s.count)
+	case "sum":
+		return s.sum
+	case "avg":
+		if s.count == 0 {
+			return nil
+		}
+		return s.sum / float64(s.count)
+	}
+	return s.best
+}
+
+type queryGroup struct {
+	first  queryRow
+	states []*aggregateState
+}
+
+// compareForOrder sorts nulls first and treats incomparable values as equal.
+func compareForOrder(a, b any) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	c, _ := compareValues(a, b)
+	return c
+}
+
+// runQuery plans and evaluates a parsed query: validate it against the dataset,
+// scan with pushed-down filters, then filter, group, order and limit in memory.
+func runQuery(ctx context.Context, q *parsedQuery) (*QueryResult, error) {
+	dataset, ok := queryDatasets[q.From]
+	if !ok {
+		return nil, badQuery("unknown dataset %q; use current, history or daily", q.From)
+	}
+
+	grouping := len(q.GroupBy) > 0
+	for _, item := range q.Items {
+		grouping = grouping || hasAggregate(item.Expr)
+	}
+	items := q.Items
+	if q.Star {
+		if grouping {
+			return nil, badQuery("SELECT * cannot be combined with GROUP BY")
+		}
+		for _, c := range dataset.columns {
+			items = append(items, selectItem{Expr: columnRef{Name: c}})
+		}
+	}
+
+	if q.Where != nil {
+		if hasAggregate(q.Where) {
+			return nil, badQuery("aggregates are not allowed in WHERE")
+		}
+		if err := checkColumns(q.Where, dataset.columns); err != nil {
+			return nil, queryError{err}
+		}
+	}
+	grouped := map[string]bool{}
+	for _, g := range q.GroupBy {
+		if hasAggregate(g) {
+			return nil, badQuery("aggregates are not allowed in GROUP BY")
+		}
+		if err := checkColumns(g, dataset.columns); err != nil {
+			return nil, queryError{err}
+		}
+		grouped[exprString(g)] = true
+	}
+
+	result := &QueryResult{Rows: [][]any{}}
+	names := map[string]int{}
+	for i, item := range items {
+		name := item.Alias
+		if name == "" {
+			name = exprString(item.Expr)
+		}
+		result.Columns = append(result.Columns, name)
+		names[name] = i
+	}
+
+	// ORDER BY may name an output column or alias; anything else is evaluated as a
+	// hidden column that is dropped after sorting
+	var orderIndex []int
+	for _, o := range q.OrderBy {
+		if i, ok := names[exprString(o.Expr)]; ok {
+			orderIndex = append(orderIndex, i)
+			continue
+		}
+		orderIndex = append(orderIndex, len(items))
+		items = append(items, selectItem{Expr: o.Expr})
+	}
+
+	for _, item := range items {
+		if err := checkColumns(item.Expr, dataset.columns); err != nil {
+			return nil, queryError{err}
+		}
+		if grouping {
+			if err := checkGrouped(item.Expr, grouped); err != nil {
+				return nil, queryError{err}
+			}
+		} else if hasAggregate(item.Expr) {
+			return nil, badQuery("%s needs GROUP BY or other aggregates", exprString(item.Expr))
+		}
+	}
+
+	calls := map[string]callExpr{}
+	for _, item := range items {
+		collectCalls(item.Expr, calls)
+	}
+
+	var rows [][]any
+	var groups []*queryGroup
+	groupIndex := map[string]*queryGroup{}
+	stopAt := -1
+	if !grouping && len(q.OrderBy) == 0 && q.Limit >= 0 {
+		stopAt = q.Limit
+	}
+
+	err := dataset.scan(ctx, q.Where, func(row queryRow) error {
+		result.Scanned++
+		if result.Scanned > maxQueryScanRows {
+			return errQueryTooExpensive
+		}
+		if q.Where != nil {
+			match, err := evalExpr(q.Where, row, nil)
+			if err != nil {
+				return queryError{err}
+			}
+			if !truthy(match) {
+				return nil
+			}
+		}
+
+		if !grouping {
+			if stopAt >= 0 && len(rows) >= stopAt {
+				return errStopScan
+			}
+			out := make([]any, len(items))
+			for i, item := range items {
+				v, err := evalExpr(item.Expr, row, nil)
+				if err != nil {
+					return queryError{err}
+				}
+				out[i] = v
+			}
+			rows = append(rows, out)
+			return nil
+		}
+
+		var key strings.Builder
+		for _, g := range q.GroupBy {
+			v, err := evalExpr(g, row, nil)
+			if err != nil {
+				return queryError{err}
+			}
+			fmt.Fprintf(&key, "%v\x00", v)
+		}
+		group, ok := groupIndex[key.String()]
+		if !ok {
+			group = &queryGroup{first: row}
+			for _, call := range calls {
+				group.states = append(group.states, &aggregateState{call: call})
+			}
+			groupIndex[key.String()] = group
+			groups = append(groups, group)
+		}
+		for _, s := range group.states {
+			if err := s.add(row); err != nil {
+				return queryError{err}
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errStopScan {
+		return nil, err
+	}
+
+	if grouping {
+		// Aggregates without GROUP BY summarise an empty scan as one row
+		if len(groups) == 0 && len(q.GroupBy) == 0 {
+			group := &queryGroup{first: queryRow{}}
+			for _, call := range calls {
+				group.states = append(group.states, &aggregateState{call: call})
+			}
+			groups = append(groups, group)
+		}
+		for _, group := range groups {
+			aggregates := map[string]any{}
+			for _, s := range group.states {
+				aggregates[exprString(s.call)] = s.result()
+			}
+			out := make([]any, len(items))
+			for i, item := range items {
+				v, err := evalExpr(item.Expr, group.first, aggregates)
+				if err != nil {
+					return nil, queryError{err}
+				}
+				out[i] = v
+			}
+			rows = append(rows, out)
+		}
+	}
+
+	if len(q.OrderBy) > 0 {
+		sort.SliceStable(rows, func(i, j int) bool {
+			for k, o := range q.OrderBy {
+				c := compareForOrder(rows[i][orderIndex[k]], rows[j][orderIndex[k]])
+				if c == 0 {
+					continue
+				}
+				if o.Desc {
+					return c > 0
+				}
+				return c < 0
+			}
+			return false
+		})
+	}
+
+	limit := q.Limit
+	if limit < 0 || limit > maxQueryResultRows {
+		if len(rows) > maxQueryResultRows {
+			result.Truncated = true
+		}
+		limit = maxQueryResultRows
+	}
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	for _, row := range rows {
+		result.Rows = append(result.Rows, row[:len(result.Columns)])
+	}
+	return result, nil
+}
+
+// queryHandler runs a read-only query sent as {"query": "SELECT ..."}.
+func queryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Query string `json:"query"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&body); err != nil || body.Query == "" {
+		http.Error(w, "query is required", http.StatusBadRequest)
+		return
+	}
+	if len(body.Query) > maxQueryLength {
+		http.Error(w, fmt.Sprintf("query is longer than %d characters", maxQueryLength), http.StatusBadRequest)
+		return
+	}
+	q, err := parseQuery(body.Query)
+	if err != nil {
+		http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+	start := time.Now()
+	result, err := runQuery(ctx, q)
+	switch {
+	case errors.Is(err, errQueryTooExpensive):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case ctx.Err() == context.DeadlineExceeded:
+		http.Error(w, "Query timed out", http.StatusGatewayTimeout)
+		return
+	case errors.As(err, &queryError{}):
+		http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	result.ElapsedMS = time.Since(start).Milliseconds()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Record is the extreme value of one metric for a city, either over all time
+// (Scope "all") or for one calendar day across years (Scope "MM-DD").
+type Record struct {
+	City   string    `bson:"city" json:"city"`
+	Scope  string    `bson:"scope" json:"scope"`
+	Metric string    `bson:"metric" json:"metric"`
+	Value  float64   `bson:"value" json:"value"`
+	Day    string    `bson:"day" json:"day"`
+	At     time.Time `bson:"at" json:"at"`
+}
+
+type RecordBroken struct {
+	Record   Record `json:"record"`
+	Previous Record `json:"previous"`
+}
+
+const (
+	allTimeScope      = "all"
+	calendarDayLayout = "01-02"
+)
+
+type recordMetric struct {
+	Name  string
+	Lower bool
+}
+
+var recordMetrics = []recordMetric{
+	{Name: "max_temp"},
+	{Name: "min_temp", Lower: true},
+	{Name: "max_wind"},
+	{Name: "max_daily_precip"},
+}
+
+var recordsCollection *mongo.Collection
+
+// applyRecords checks the reading (and its day's precipitation total) against the
+// all-time and calendar-day records and publishes EventRecordBroken for those beaten.
+func applyRecords(ctx context.Context, c *mongo.Collection, ev Event) error {
+	switch ev.Type {
+	case EventFetch, EventImport:
+	default:
+		return nil
+	}
+
+	day := ev.Data.LastUpdated.UTC().Format(dayLayout)
+	var daily DailyAggregate
+	if err := dailyCollection.FindOne(ctx, bson.M{"city": ev.City, "day": day}).Decode(&daily); err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	values := map[string]float64{
+		"max_temp":         ev.Data.Temp,
+		"min_temp":         ev.Data.Temp,
+		"max_wind":         ev.Data.Wind,
+		"max_daily_precip": daily.Precip,
+	}
+	scopes := []string{allTimeScope, ev.Data.LastUpdated.UTC().Format(calendarDayLayout)}
+
+	for _, scope := range scopes {
+		for _, metric := range recordMetrics {
+			candidate := Record{
+				City:   ev.City,
+				Scope:  scope,
+				Metric: metric.Name,
+				Value:  values[metric.Name],
+				Day:    day,
+				At:     ev.Data.LastUpdated,
+			}
+			previous, found, beaten, err := setRecord(ctx, c, candidate, metric.Lower)
+			if err != nil {
+				return err
+			}
+			// The first reading for a city sets every record, and a record that keeps
+			// climbing through the day is only reported when it first falls
+			if beaten && found && previous.Day != candidate.Day {
+				publish(Event{Type: EventRecordBroken, City: ev.City, Time: ev.Time, Payload: RecordBroken{Record: candidate, Previous: previous}})
+			}
+		}
+	}
+	return nil
+}
+
+func recordsHandler(w http.ResponseWriter, r *http.Request) {
+	city := r.URL.Query().Get("city")
+	if city == "" {
+		http.Error(w, "City parameter is required", http.StatusBadRequest)
+		return
+	}
+	day := r.URL.Query().Get("day")
+	if day == "" {
+		day = time.Now().UTC().Format(calendarDayLayout)
+	} else if _, err := time.Parse(calendarDayLayout, day); err != nil {
+		http.Error(w, "day must be MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"city": city, "scope": bson.M{"$in": bson.A{allTimeScope, day}}}
+	cursor, err := recordsCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"metric": 1}))
+	if err != nil {
+		http.Error(w, "Failed to load records", http.StatusInternalServerError)
+		return
+	}
+	var records []Record
+	if err := cursor.All(ctx, &records); err != nil {
+		http.Error(w, "Failed to load records", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		City        string   `json:"city"`
+		Day         string   `json:"day"`
+		AllTime     []Record `json:"all_time"`
+		CalendarDay []Record `json:"calendar_day"`
+	}{City: city, Day: day, AllTime: []Record{}, CalendarDay: []Record{}}
+	for _, record := range records {
+		if record.Scope == allTimeScope {
+			response.AllTime = append(response.AllTime, record)
+		} else {
+			response.CalendarDay = append(response.CalendarDay, record)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// setRecord stores candidate if it beats the current record, in one conditional
+// write so a concurrent lower (or higher) value cannot overwrite it. It returns
+// the record it replaced, if any.
+func setRecord(ctx context.Context, c *mongo.Collection, candidate Record, lower bool) (previous Record, found, beaten bool, err error) {
+	beats := bson.M{"$lt": candidate.Value}
+	if lower {
+		beats = bson.M{"$gt": candidate.Value}
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		conditional := bson.M{"city": candidate.City, "scope": candidate.Scope, "metric": candidate.Metric, "value": beats}
+		err = c.FindOneAndReplace(ctx, conditional, candidate).Decode(&previous)
+		if err == nil {
+			return previous, true, true, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return Record{}, false, false, err
+		}
+		// Either there is no record yet or it is not beaten; the unique index
+		// tells the two apart
+		_, err = c.InsertOne(ctx, candidate)
+		if err == nil {
+			return Record{}, false, true, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return Record{}, false, false, err
+		}
+		// The record exists: either it was not beaten, or another reading just
+		// inserted it and it is worth one more comparison
+	}
+	return Record{}, false, false, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RefreshSchedule makes the refresh scheduler fetch a city every Interval.
+type RefreshSchedule struct {
+	City            string    `bson:"_id" json:"city"`
+	IntervalSeconds int64     `bson:"interval_seconds" json:"interval_seconds"`
+	NextRefresh     time.Time `bson:"next_refresh" json:"next_refresh"`
+}
+
+const (
+	refreshTick        = 15 * time.Second
+	refreshBatch       = 50
+	minRefreshInterval = time.Minute
+	// Cities owned by another replica are taken over once this overdue
+	refreshTakeover = 2 * refreshTick
+)
+
+var refreshSchedulesCollection *mongo.Collection
+
+// setRefreshInterval schedules a city every interval, or stops scheduling it
+// when interval is zero.
+func setRefreshInterval(ctx context.Context, city string, interval time.Duration) error {
+	if interval == 0 {
+		_, err := refreshSchedulesCollection.DeleteOne(ctx, bson.M{"_id": city})
+		return err
+	}
+	schedule := RefreshSchedule{City: city, IntervalSeconds: int64(interval / time.Second), NextRefresh: time.Now().Add(interval)}
+	_, err := refreshSchedulesCollection.ReplaceOne(ctx, bson.M{"_id": city}, schedule, options.Replace().SetUpsert(true))
+	return err
+}
+
+// runRefreshScheduler refreshes cities whose next refresh is due. Cities are
+// partitioned between replicas with ownsKey; each replica still claims a city by
+// moving its next_refresh forward, so only one fetches it while peers disagree.
+func runRefreshScheduler() {
+	ticker := time.NewTicker(refreshTick)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		// Refreshes would only be queued during maintenance
+		if readOnly.Load() {
+			continue
+		}
+		if err := refreshDueCities(now); err != nil {
+			log.Println("Failed to run scheduled refreshes:", err)
+		}
+	}
+}
+
+func refreshDueCities(now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), refreshTick)
+	defer cancel()
+
+	cursor, err := refreshSchedulesCollection.Find(ctx, bson.M{"next_refresh": bson.M{"$lte": now}},
+		options.Find().SetSort(bson.M{"next_refresh": 1}).SetLimit(refreshBatch))
+	if err != nil {
+		return err
+	}
+	var due []RefreshSchedule
+	if err := cursor.All(ctx, &due); err != nil {
+		return err
+	}
+
+	for _, schedule := range due {
+		if !ownsKey(schedule.City) && now.Sub(schedule.NextRefresh) < refreshTakeover {
+			continue
+		}
+		interval := time.Duration(schedule.IntervalSeconds) * time.Second
+		claim := bson.M{"_id": schedule.City, "next_refresh": schedule.NextRefresh}
+		result, err := refreshSchedulesCollection.UpdateOne(ctx, claim, bson.M{"$set": bson.M{"next_refresh": now.Add(interval)}})
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			continue
+		}
+
+		// A schedule outliving its city must not bring the city back
+		if n, err := weatherCollection.CountDocuments(ctx, bson.M{"city": schedule.City}); err == nil && n == 0 {
+			refreshSchedulesCollection.DeleteOne(ctx, bson.M{"_id": schedule.City})
+			continue
+		}
+		refreshCtx, cancelRefresh := context.WithTimeout(context.Background(), 10*time.Second)
+		if _, err := refreshLocation(refreshCtx, Location{City: schedule.City}); err != nil {
+			log.Printf("Scheduled refresh of %s failed: %v", schedule.City, err)
+		}
+		cancelRefresh()
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// GET /weather variants. Every combination is encoded once when a city is written
+// and served straight from memory afterwards.
+var (
+	responseFormats = []string{"json", "csv"}
+	responseUnits   = []string{"metric", "imperial", "standard"}
+)
+
+var responseContentTypes = map[string][]string{
+	"json": {"application/json"},
+	"csv":  {"text/csv; charset=utf-8"},
+}
+
+type encodedResponse struct {
+	body        []byte
+	etag        string
+	etagHeader  []string
+	contentType []string
+}
+
+type cityResponses []encodedResponse
+
+// responseCacheTTL bounds how long a city's responses are served without a
+// write refreshing them, as a backstop for a missed invalidation.
+const responseCacheTTL = 5 * time.Minute
+
+type cachedCity struct {
+	responses cityResponses
+	expires   time.Time
+}
+
+// generation counts the writes seen per city. A read that missed the cache
+// notes it before loading the city and only stores what it loaded if no write
+// came in between, so an older document never replaces a newer one.
+var responseCache = struct {
+	sync.RWMutex
+	byCity     map[string]cachedCity
+	generation map[string]uint64
+}{byCity: map[string]cachedCity{}, generation: map[string]uint64{}}
+
+func responseVariant(format, units string) (int, bool) {
+	if format == "" {
+		format = "json"
+	}
+	if units == "" {
+		units = "metric"
+	}
+	for f, name := range responseFormats {
+		if name != format {
+			continue
+		}
+		for u, unit := range responseUnits {
+			if unit == units {
+				return f*len(responseUnits) + u, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// convertUnits returns the reading in OpenWeather's unit systems: metric is °C and
+// m/s, imperial is °F and mph, standard is K and m/s.
+func convertUnits(weather WeatherData, units string) WeatherData {
+	switch units {
+	case "imperial":
+		weather.Temp = weather.Temp*9/5 + 32
+		weather.Wind = weather.Wind * 2.236936
+	case "standard":
+		weather.Temp = weather.Temp + 273.15
+	}
+	return weather
+}
+
+func encodeWeather(weather WeatherData, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(&buf)
+		writer.Write([]string{"city", "country", "lat", "lon", "description", "temp", "wind", "precip", "provider", "last_updated"})
+		writer.Write([]string{
+			weather.City,
+			weather.Country,
+			strconv.FormatFloat(weather.Lat, 'f', -1, 64),
+			strconv.FormatFloat(weather.Lon, 'f', -1, 64),
+			weather.Description,
+			strconv.FormatFloat(weather.Temp, 'f', 2, 64),
+			strconv.FormatFloat(weather.Wind, 'f', 2, 64),
+			strconv.FormatFloat(weather.Precip, 'f', 2, 64),
+			weather.Provider,
+			weather.LastUpdated.UTC().Format(time.RFC3339),
+		})
+		writer.Flush()
+		return buf.Bytes(), writer.Error()
+	default:
+		err := json.NewEncoder(&buf).Encode(weather)
+		return buf.Bytes(), err
+	}
+}
+
+func precomputeResponses(weather WeatherData) (cityResponses, error) {
+	responses := make(cityResponses, len(responseFormats)*len(responseUnits))
+	for f, format := range responseFormats {
+		for u, units := range responseUnits {
+			body, err := encodeWeather(convertUnits(weather, units), format)
+			if err != nil {
+				return nil, err
+			}
+			sum := sha256.Sum256(body)
+			etag := `"` + hex.EncodeToString(sum[:12]) + `"`
+			responses[f*len(responseUnits)+u] = encodedResponse{
+				body:        body,
+				etag:        etag,
+				etagHeader:  []string{etag},
+				contentType: responseContentTypes[format],
+			}
+		}
+	}
+	return responses, nil
+}
+
+func cachedResponse(city string, variant int) (encodedResponse, bool) {
+	responseCache.RLock()
+	defer responseCache.RUnlock()
+	cached, ok := responseCache.byCity[city]
+	if !ok || time.Now().After(cached.expires) {
+		return encodedResponse{}, false
+	}
+	return cached.responses[variant], true
+}
+
+func responseGeneration(city string) uint64 {
+	responseCache.RLock()
+	defer responseCache.RUnlock()
+	return responseCache.generation[city]
+}
+
+// storeResponses encodes weather and caches it, unless the city has been written
+// since generation was read. The responses are returned either way.
+func storeResponses(weather WeatherData, generation uint64) (cityResponses, error) {
+	responses, err := precomputeResponses(weather)
+	if err != nil {
+		return nil, err
+	}
+	responseCache.Lock()
+	if responseCache.generation[weather.City] == generation {
+		responseCache.byCity[weather.City] = cachedCity{responses: responses, expires: time.Now().Add(responseCacheTTL)}
+	}
+	responseCache.Unlock()
+	return responses, nil
+}
+
+// evictResponses drops a city's responses and starts a new generation for it.
+func evictResponses(city string) uint64 {
+	responseCache.Lock()
+	defer responseCache.Unlock()
+	delete(responseCache.byCity, city)
+	responseCache.generation[city]++
+	return responseCache.generation[city]
+}
+
+// refreshResponseCache re-encodes a city's responses after a write, from the stored
+// document so the cache matches what the store would return.
+func refreshResponseCache(ev Event) {
+	switch ev.Type {
+	case EventFetch, EventImport, EventRetag:
+	case EventDelete:
+		evictResponses(ev.City)
+		return
+	default:
+		return
+	}
+
+	generation := evictResponses(ev.City)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var weather WeatherData
+	if err := weatherCollection.FindOne(ctx, bson.M{"city": ev.City}).Decode(&weather); err != nil {
+		return
+	}
+	if _, err := storeResponses(weather, generation); err != nil {
+		log.Println("Failed to precompute responses:", err)
+	}
+}
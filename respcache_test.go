@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestStaleReadDoesNotReplaceWrite(t *testing.T) {
+	older := WeatherData{City: "Race City", Temp: 10, LastUpdated: time.Now().Add(-time.Hour)}
+	newer := older
+	newer.Temp, newer.LastUpdated = 20, time.Now()
+
+	// A GET misses and reads the older document; a write lands before it stores
+	generation := responseGeneration(older.City)
+	written := evictResponses(older.City)
+	if _, err := storeResponses(newer, written); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storeResponses(older, generation); err != nil {
+		t.Fatal(err)
+	}
+
+	variant, _ := responseVariant("json", "metric")
+	response, ok := cachedResponse(older.City, variant)
+	if !ok {
+		t.Fatal("the write's responses were not cached")
+	}
+	var served WeatherData
+	if err := json.Unmarshal(response.body, &served); err != nil {
+		t.Fatal(err)
+	}
+	if served.Temp != 20 {
+		t.Fatalf("served temp %v, want the written 20", served.Temp)
+	}
+}
+
+func TestCachedResponsesExpire(t *testing.T) {
+	weather := WeatherData{City: "Expiring City", LastUpdated: time.Now()}
+	if _, err := storeResponses(weather, responseGeneration(weather.City)); err != nil {
+		t.Fatal(err)
+	}
+	variant, _ := responseVariant("csv", "imperial")
+	if _, ok := cachedResponse(weather.City, variant); !ok {
+		t.Fatal("fresh responses not served")
+	}
+
+	responseCache.Lock()
+	cached := responseCache.byCity[weather.City]
+	cached.expires = time.Now().Add(-time.Second)
+	responseCache.byCity[weather.City] = cached
+	responseCache.Unlock()
+	if _, ok := cachedResponse(weather.City, variant); ok {
+		t.Fatal("expired responses still served")
+	}
+}
+
+// discardResponseWriter is a ResponseWriter that keeps nothing, so benchmarks
+// measure the handler rather than the recorder.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+
+// BenchmarkGetDecodeEncode is the GET /weather work before precomputed responses:
+// decode the stored BSON document and encode JSON. It skips the round trip to
+// MongoDB, which only favours it.
+func BenchmarkGetDecodeEncode(b *testing.B) {
+	stored, err := bson.Marshal(syntheticHistory("Benchmark City", 1, 1)[0])
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := &discardResponseWriter{header: http.Header{}}
+		var weather WeatherData
+		if err := bson.Unmarshal(stored, &weather); err != nil {
+			b.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(weather)
+	}
+}
+
+// BenchmarkGetPrecomputed serves the same city through getWeatherHandler from
+// its precomputed responses.
+func BenchmarkGetPrecomputed(b *testing.B) {
+	weather := syntheticHistory("Benchmark City", 1, 1)[0]
+	if _, err := storeResponses(weather, responseGeneration(weather.City)); err != nil {
+		b.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodGet, "/weather?city=Benchmark+City", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		getWeatherHandler(&discardResponseWriter{header: http.Header{}}, request)
+	}
+}
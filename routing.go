@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Location describes what we know about a place before asking a provider for it.
+type Location struct {
+	City    string
+	Country string
+	Lat     float64
+	Lon     float64
+	HasPos  bool
+	Tags    []string
+	Tenant  string
+}
+
+// RoutingRule picks the providers that serve matching locations. Empty criteria
+// match everything; Providers lists the primary provider followed by fallbacks.
+type RoutingRule struct {
+	Name      string    `json:"name"`
+	Countries []string  `json:"countries"`
+	BBox      []float64 `json:"bbox"` // min lon, min lat, max lon, max lat; min lon > max lon crosses the antimeridian
+	Tags      []string  `json:"tags"`
+	Tenants   []string  `json:"tenants"`
+	Providers []string  `json:"providers"`
+}
+
+type providerConfig struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	BaseURL string `json:"base_url"`
+	APIKey  string `json:"api_key"`
+	Model   string `json:"model"`
+}
+
+type routingConfig struct {
+	Providers []providerConfig `json:"providers"`
+	Rules     []RoutingRule    `json:"rules"`
+	Default   []string         `json:"default"`
+}
+
+type Router struct {
+	providers map[string]Provider
+	rules     []RoutingRule
+	fallback  []string
+}
+
+const defaultRouteName = "default"
+
+// loadRouter builds a router from the JSON file at path. The provider built from
+// BASE_URL/API_KEY is always registered as "openweather" and used when no rule matches.
+func loadRouter(path string, defaultProvider Provider) (*Router, error) {
+	router := &Router{
+		providers: map[string]Provider{defaultProvider.Name(): defaultProvider},
+		fallback:  []string{defaultProvider.Name()},
+	}
+	if path == "" {
+		return router, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing config: %w", err)
+	}
+	var config routingConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse routing config: %w", err)
+	}
+
+	for _, pc := range config.Providers {
+		switch pc.Type {
+		case "", "openweather":
+			router.providers[pc.Name] = newOpenWeatherProvider(pc.Name, pc.BaseURL, pc.APIKey)
+		case "openweather-onecall":
+			router.providers[pc.Name] = newOneCallProvider(pc.Name, pc.BaseURL, pc.APIKey)
+		case "open-meteo-ensemble":
+			router.providers[pc.Name] = newOpenMeteoEnsembleProvider(pc.Name, pc.BaseURL, pc.Model)
+		default:
+			return nil, fmt.Errorf("provider %q has unknown type %q", pc.Name, pc.Type)
+		}
+	}
+	if len(config.Default) > 0 {
+		router.fallback = config.Default
+	}
+	for _, rule := range config.Rules {
+		if len(rule.BBox) != 0 && len(rule.BBox) != 4 {
+			return nil, fmt.Errorf("rule %q: bbox must have 4 values", rule.Name)
+		}
+		if len(rule.BBox) == 4 {
+			minLon, minLat, maxLon, maxLat := rule.BBox[0], rule.BBox[1], rule.BBox[2], rule.BBox[3]
+			if minLon < -180 || minLon > 180 || maxLon < -180 || maxLon > 180 || minLat < -90 || maxLat > 90 || minLat > maxLat {
+				return nil, fmt.Errorf("rule %q: bbox must be min lon, min lat, max lon, max lat within -180..180 and -90..90", rule.Name)
+			}
+		}
+		if len(rule.Providers) == 0 {
+			return nil, fmt.Errorf("rule %q has no providers", rule.Name)
+		}
+		router.rules = append(router.rules, rule)
+	}
+	for _, names := range append([][]string{router.fallback}, ruleProviders(router.rules)...) {
+		for _, name := range names {
+			if _, ok := router.providers[name]; !ok {
+				return nil, fmt.Errorf("unknown provider %q in routing config", name)
+			}
+		}
+	}
+	return router, nil
+}
+
+func ruleProviders(rules []RoutingRule) [][]string {
+	var names [][]string
+	for _, rule := range rules {
+		names = append(names, rule.Providers)
+	}
+	return names
+}
+
+func (rule RoutingRule) matches(loc Location) bool {
+	if len(rule.Countries) > 0 && !containsFold(rule.Countries, loc.Country) {
+		return false
+	}
+	if len(rule.BBox) == 4 {
+		if !loc.HasPos {
+			return false
+		}
+		if loc.Lat < rule.BBox[1] || loc.Lat > rule.BBox[3] {
+			return false
+		}
+		if rule.BBox[0] <= rule.BBox[2] {
+			if loc.Lon < rule.BBox[0] || loc.Lon > rule.BBox[2] {
+				return false
+			}
+		} else if loc.Lon < rule.BBox[0] && loc.Lon > rule.BBox[2] {
+			return false
+		}
+	}
+	if len(rule.Tags) > 0 {
+		found := false
+		for _, tag := range loc.Tags {
+			if containsFold(rule.Tags, tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.Tenants) > 0 && !containsFold(rule.Tenants, loc.Tenant) {
+		return false
+	}
+	return true
+}
+
+// Route returns the name of the first matching rule and its providers in the order to try.
+func (r *Router) Route(loc Location) (string, []Provider) {
+	name, names := defaultRouteName, r.fallback
+	for _, rule := range r.rules {
+		if rule.matches(loc) {
+			name, names = rule.Name, rule.Providers
+			break
+		}
+	}
+	providers := make([]Provider, 0, len(names))
+	for _, n := range names {
+		providers = append(providers, r.providers[n])
+	}
+	return name, providers
+}
+
+// Providers returns every configured provider ordered by name.
+func (r *Router) Providers() []Provider {
+	providers := make([]Provider, 0, len(r.providers))
+	for _, p := range r.providers {
+		providers = append(providers, p)
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].Name() < providers[j].Name() })
+	return providers
+}
+
+// Fetch asks each routed provider in turn until one succeeds.
+func (r *Router) Fetch(loc Location) (WeatherData, error) {
+	route, providers := r.Route(loc)
+	var errs []error
+	for _, p := range providers {
+		upstreamLimiter.start()
+		start := time.Now()
+		data, err := p.Current(loc)
+		upstreamLimiter.finish(time.Since(start), err != nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+			continue
+		}
+		data.Provider = p.Name()
+		data.Route = route
+		return data, nil
+	}
+	return WeatherData{}, errors.Join(errs...)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
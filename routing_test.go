@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type fakeProvider struct {
+	name  string
+	err   error
+	calls int
+}
+
+func (p *fakeProvider) Name() string { return p.name }
+
+func (p *fakeProvider) Current(loc Location) (WeatherData, error) {
+	p.calls++
+	if p.err != nil {
+		return WeatherData{}, p.err
+	}
+	return WeatherData{City: loc.City, Description: p.name}, nil
+}
+
+func TestRoutingRuleMatches(t *testing.T) {
+	tests := []struct {
+		name string
+		rule RoutingRule
+		loc  Location
+		want bool
+	}{
+		{"empty rule", RoutingRule{}, Location{City: "Berlin"}, true},
+		{"country", RoutingRule{Countries: []string{"de"}}, Location{Country: "DE"}, true},
+		{"other country", RoutingRule{Countries: []string{"FR"}}, Location{Country: "DE"}, false},
+		{"inside bbox", RoutingRule{BBox: []float64{5, 47, 15, 55}}, Location{Lat: 52.5, Lon: 13.4, HasPos: true}, true},
+		{"outside bbox", RoutingRule{BBox: []float64{5, 47, 15, 55}}, Location{Lat: 48.9, Lon: 2.35, HasPos: true}, false},
+		{"bbox without position", RoutingRule{BBox: []float64{5, 47, 15, 55}}, Location{City: "Berlin"}, false},
+		{"antimeridian east side", RoutingRule{BBox: []float64{170, -50, -170, -30}}, Location{Lat: -41.3, Lon: 174.8, HasPos: true}, true},
+		{"antimeridian west side", RoutingRule{BBox: []float64{170, -50, -170, -30}}, Location{Lat: -44, Lon: -176.5, HasPos: true}, true},
+		{"antimeridian outside", RoutingRule{BBox: []float64{170, -50, -170, -30}}, Location{Lat: -41, Lon: 0, HasPos: true}, false},
+		{"antimeridian wrong latitude", RoutingRule{BBox: []float64{170, -50, -170, -30}}, Location{Lat: 10, Lon: 175, HasPos: true}, false},
+		{"tag", RoutingRule{Tags: []string{"coastal"}}, Location{Tags: []string{"Coastal", "capital"}}, true},
+		{"missing tag", RoutingRule{Tags: []string{"coastal"}}, Location{Tags: []string{"capital"}}, false},
+		{"tenant", RoutingRule{Tenants: []string{"acme"}}, Location{Tenant: "other"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.matches(tt.loc); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func writeRoutingConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "routing.json")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRouterRejectsInvalidRules(t *testing.T) {
+	for config, want := range map[string]string{
+		`{"rules": [{"name": "r", "bbox": [1, 2, 3], "providers": ["openweather"]}]}`:       "4 values",
+		`{"rules": [{"name": "r", "bbox": [1, 60, 3, 50], "providers": ["openweather"]}]}`:  "bbox must be",
+		`{"rules": [{"name": "r", "bbox": [-190, 0, 3, 5], "providers": ["openweather"]}]}`: "bbox must be",
+		`{"rules": [{"name": "r"}]}`:                               "no providers",
+		`{"rules": [{"name": "r", "providers": ["missing"]}]}`:     "unknown provider",
+		`{"providers": [{"name": "x", "type": "carrier-pigeon"}]}`: "unknown type",
+	} {
+		_, err := loadRouter(writeRoutingConfig(t, config), &fakeProvider{name: "openweather"})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want an error containing %q", config, err, want)
+		}
+	}
+
+	router, err := loadRouter(writeRoutingConfig(t, `{"rules": [{"name": "pacific", "bbox": [170, -50, -170, -30], "providers": ["openweather"]}]}`), &fakeProvider{name: "openweather"})
+	if err != nil {
+		t.Fatalf("antimeridian bbox rejected: %v", err)
+	}
+	if name, _ := router.Route(Location{Lat: -41.3, Lon: 174.8, HasPos: true}); name != "pacific" {
+		t.Errorf("routed to %q, want pacific", name)
+	}
+}
+
+func TestRouterFetchFallsBack(t *testing.T) {
+	primary := &fakeProvider{name: "primary", err: errors.New("down")}
+	backup := &fakeProvider{name: "backup"}
+	router := &Router{
+		providers: map[string]Provider{"primary": primary, "backup": backup},
+		rules:     []RoutingRule{{Name: "de", Countries: []string{"DE"}, Providers: []string{"primary", "backup"}}},
+		fallback:  []string{"backup"},
+	}
+
+	data, err := router.Fetch(Location{City: "Berlin", Country: "DE"})
+	if err != nil || data.Provider != "backup" || data.Route != "de" || primary.calls != 1 {
+		t.Errorf("got %+v, %v after %d primary calls", data, err, primary.calls)
+	}
+	if data, err := router.Fetch(Location{City: "Paris", Country: "FR"}); err != nil || data.Route != defaultRouteName || primary.calls != 1 {
+		t.Errorf("unmatched location: %+v, %v", data, err)
+	}
+
+	backup.err = errors.New("also down")
+	if _, err := router.Fetch(Location{City: "Berlin", Country: "DE"}); err == nil || !strings.Contains(err.Error(), "primary: down") || !strings.Contains(err.Error(), "backup: also down") {
+		t.Errorf("got %v, want both providers' errors", err)
+	}
+}
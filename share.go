@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ShareLink grants read-only access to one view without an account. The link
+// carries its expiry and an HMAC signature; the stored record allows revocation.
+// Only the holder of the token returned on creation can read or revoke the record.
+type ShareLink struct {
+	ID           string            `bson:"_id" json:"id"`
+	Kind         string            `bson:"kind" json:"kind"`
+	Params       map[string]string `bson:"params" json:"params"`
+	CreatedAt    time.Time         `bson:"created_at" json:"created_at"`
+	ExpiresAt    time.Time         `bson:"expires_at" json:"expires_at"`
+	RevokedAt    *time.Time        `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	Accesses     int               `bson:"accesses" json:"accesses"`
+	LastAccessAt *time.Time        `bson:"last_access_at,omitempty" json:"last_access_at,omitempty"`
+	TokenHash    string            `bson:"token_hash" json:"-"`
+	Token        string            `bson:"-" json:"token,omitempty"`
+	URL          string            `bson:"-" json:"url,omitempty"`
+}
+
+const (
+	defaultShareTTL = 7 * 24 * time.Hour
+	maxShareTTL     = 90 * 24 * time.Hour
+)
+
+// shareKinds maps a shareable view to the read-only handler that renders it.
+var shareKinds = map[string]http.HandlerFunc{
+	"view":     getWeatherHandler,
+	"compare":  compareHandler,
+	"stats":    statsHandler,
+	"regions":  regionsHandler,
+	"records":  recordsHandler,
+	"episodes": episodesHandler,
+	"chart":    shareChartHandler,
+	"export":   shareExportHandler,
+}
+
+var (
+	sharesCollection *mongo.Collection
+	shareSecret      []byte
+	shareLimiter     = newRateLimiter(60, 20)
+)
+
+func signShare(id string, expires int64) string {
+	mac := hmac.New(sha256.New, shareSecret)
+	fmt.Fprintf(mac, "%s.%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func shareURL(link ShareLink) string {
+	expires := link.ExpiresAt.Unix()
+	return fmt.Sprintf("/s/%s?exp=%d&sig=%s", link.ID, expires, signShare(link.ID, expires))
+}
+
+func sharesHandler(w http.ResponseWriter, r *http.Request) {
+	if len(shareSecret) == 0 {
+		http.Error(w, "Share links are not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		createShareHandler(w, r)
+	case http.MethodGet:
+		getShareHandler(w, r)
+	case http.MethodDelete:
+		revokeShareHandler(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createShareHandler(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		Kind   string            `json:"kind"`
+		Params map[string]string `json:"params"`
+		TTL    string            `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if _, ok := shareKinds[requestBody.Kind]; !ok {
+		http.Error(w, "Unknown share kind", http.StatusBadRequest)
+		return
+	}
+	ttl := defaultShareTTL
+	if requestBody.TTL != "" {
+		parsed, err := time.ParseDuration(requestBody.TTL)
+		if err != nil || parsed <= 0 || parsed > maxShareTTL {
+			http.Error(w, "ttl must be a positive duration of at most 90 days", http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+
+	idBytes := make([]byte, 12)
+	tokenBytes := make([]byte, 24)
+	if _, err := rand.Read(idBytes); err != nil {
+		http.Error(w, "Failed to create share link", http.StatusInternalServerError)
+		return
+	}
+	if _, err := rand.Read(tokenBytes); err != nil {
+		http.Error(w, "Failed to create share link", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	token := hex.EncodeToString(tokenBytes)
+	link := ShareLink{
+		ID:        hex.EncodeToString(idBytes),
+		Kind:      requestBody.Kind,
+		Params:    requestBody.Params,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl).Truncate(time.Second),
+		TokenHash: sha256Hex([]byte(token)),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := sharesCollection.InsertOne(ctx, link); err != nil {
+		http.Error(w, "Failed to create share link", http.StatusInternalServerError)
+		return
+	}
+
+	link.URL = shareURL(link)
+	link.Token = token
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(link)
+}
+
+// ownedShare loads the link named by ?id= if the request carries its token in
+// X-Share-Token. Links of other creators are reported as not found.
+func ownedShare(ctx context.Context, r *http.Request) (ShareLink, bool) {
+	var link ShareLink
+	if err := sharesCollection.FindOne(ctx, bson.M{"_id": r.URL.Query().Get("id")}).Decode(&link); err != nil {
+		return ShareLink{}, false
+	}
+	token := sha256Hex([]byte(r.Header.Get("X-Share-Token")))
+	if link.TokenHash == "" || !hmac.Equal([]byte(token), []byte(link.TokenHash)) {
+		return ShareLink{}, false
+	}
+	return link, true
+}
+
+func getShareHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	link, ok := ownedShare(ctx, r)
+	if !ok {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+
+	link.URL = shareURL(link)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(link)
+}
+
+func revokeShareHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	link, ok := ownedShare(ctx, r)
+	if !ok {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if _, err := sharesCollection.UpdateOne(ctx, bson.M{"_id": link.ID}, bson.M{"$set": bson.M{"revoked_at": time.Now()}}); err != nil {
+		http.Error(w, "Failed to revoke share link", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// openShareHandler serves /s/{id}?exp=&sig= by replaying the shared view's query
+// against its read-only handler.
+func openShareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(shareSecret) == 0 {
+		http.Error(w, "Share links are not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/s/")
+	expires, err := strconv.ParseInt(r.URL.Query().Get("exp"), 10, 64)
+	sig := r.URL.Query().Get("sig")
+	if err != nil || !hmac.Equal([]byte(sig), []byte(signShare(id, expires))) {
+		http.Error(w, "Invalid share link", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "Share link has expired", http.StatusGone)
+		return
+	}
+
+	if ok, wait := shareLimiter.Allow(id); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var link ShareLink
+	if err := sharesCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&link); err != nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if link.RevokedAt != nil {
+		http.Error(w, "Share link has been revoked", http.StatusGone)
+		return
+	}
+
+	// Access counts are not kept while read-only
+	if !readOnly.Load() {
+		update := bson.M{"$inc": bson.M{"accesses": 1}, "$set": bson.M{"last_access_at": time.Now()}}
+		if _, err := sharesCollection.UpdateOne(ctx, bson.M{"_id": id}, update); err != nil {
+			log.Println("Failed to record share access:", err)
+		}
+	}
+
+	query := url.Values{}
+	for k, v := range link.Params {
+		query.Set(k, v)
+	}
+	shared := r.Clone(r.Context())
+	shared.Method = http.MethodGet
+	shared.URL.RawQuery = query.Encode()
+	shared.Body = http.NoBody
+
+	w.Header().Set("Cache-Control", "private, max-age=60")
+	shareKinds[link.Kind](w, shared)
+}
+
+// shareChartHandler renders the "chart" kind: the temperature (default) or
+// precipitation chart of a publish-static city page (params city and variable).
+// The forecast is drawn when one is stored.
+func shareChartHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("city")
+	if name == "" {
+		http.Error(w, "City parameter is required", http.StatusBadRequest)
+		return
+	}
+	variable := r.URL.Query().Get("variable")
+	if variable != "" && variable != "temp" && variable != "precip" {
+		http.Error(w, "variable must be temp or precip", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	city := staticCity{}
+	if err := weatherCollection.FindOne(ctx, bson.M{"city": name}).Decode(&city.Weather); err != nil {
+		http.Error(w, "Weather data not found", http.StatusNotFound)
+		return
+	}
+	err := scanHistory(ctx, bson.M{"city": name}, time.Now().Add(-staticHistoryWindow), time.Now(), func(reading WeatherData) error {
+		city.History = append(city.History, reading)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to load history", http.StatusInternalServerError)
+		return
+	}
+	if city.Forecast, err = storedForecast(ctx, name); err != nil {
+		http.Error(w, "Failed to load forecast", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	if variable == "precip" {
+		w.Write(staticChart(&city, "Precipitation (mm)", true))
+		return
+	}
+	w.Write(staticChart(&city, "Temperature (°C)", false))
+}
+
+const maxShareExportDays = 31
+
+// shareExportHandler renders the "export" kind: one city's history between the
+// from and to days (default the last 7) as a single csv, ndjson or parquet file
+// (params city and format).
+func shareExportHandler(w http.ResponseWriter, r *http.Request) {
+	city := r.URL.Query().Get("city")
+	if city == "" {
+		http.Error(w, "City parameter is required", http.StatusBadRequest)
+		return
+	}
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = "csv"
+	}
+	format, ok := exportFormats[name]
+	if !ok {
+		http.Error(w, "format must be csv, ndjson or parquet", http.StatusBadRequest)
+		return
+	}
+	fromDay, toDay, ok := parseDayRange(r)
+	if !ok {
+		http.Error(w, "from and to must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	to := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	if toDay != "" {
+		day, _ := time.Parse(dayLayout, toDay)
+		to = day.Add(24 * time.Hour)
+	}
+	from := to.Add(-7 * 24 * time.Hour)
+	if fromDay != "" {
+		from, _ = time.Parse(dayLayout, fromDay)
+	}
+	if !from.Before(to) || to.Sub(from) > maxShareExportDays*24*time.Hour {
+		http.Error(w, fmt.Sprintf("from must be before to and at most %d days earlier", maxShareExportDays), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	readings, err := collectExport(ctx, &exportJob{Cities: []string{city}}, from, to)
+	if err != nil {
+		http.Error(w, "Failed to load history", http.StatusInternalServerError)
+		return
+	}
+	body, err := format.encode(readings)
+	if err != nil {
+		http.Error(w, "Failed to encode history", http.StatusInternalServerError)
+		return
+	}
+	filename := fmt.Sprintf("%s_%s_%s.%s", staticSlug(city), from.Format(dayLayout), to.Add(-24*time.Hour).Format(dayLayout), format.ext)
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Write(body)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// sloObjective says that LastUpdated should be younger than MaxAge for Target of
+// the time, measured over Window.
+type sloObjective struct {
+	MaxAge time.Duration
+	Target float64
+	Window time.Duration
+}
+
+type sloConfigEntry struct {
+	City   string  `json:"city"` // "*" sets the default for every tracked city
+	MaxAge string  `json:"max_age"`
+	Target float64 `json:"target"`
+	Window string  `json:"window"`
+}
+
+// sloBucket counts freshness samples and refresh outcomes for one city and hour.
+type sloBucket struct {
+	City          string    `bson:"city"`
+	Hour          time.Time `bson:"hour"`
+	Good          int       `bson:"good"`
+	Total         int       `bson:"total"`
+	RefreshOK     int       `bson:"refresh_ok"`
+	RefreshFailed int       `bson:"refresh_failed"`
+}
+
+type sloSample struct {
+	At   time.Time
+	Good bool
+}
+
+type sloState struct {
+	samples  []sloSample
+	alerting bool
+}
+
+type SLOStatus struct {
+	City            string             `json:"city"`
+	MaxAge          string             `json:"max_age"`
+	Target          float64            `json:"target"`
+	Window          string             `json:"window"`
+	Age             string             `json:"age"`
+	Fresh           bool               `json:"fresh"`
+	Compliance      float64            `json:"compliance"`
+	BudgetRemaining float64            `json:"error_budget_remaining"`
+	BurnRates       map[string]float64 `json:"burn_rates"`
+	RefreshOK       int                `json:"refresh_ok"`
+	RefreshFailed   int                `json:"refresh_failed"`
+	FastBurn        bool               `json:"fast_burn"`
+}
+
+type SLOAlert struct {
+	City      string  `json:"city"`
+	Burn5m    float64 `json:"burn_5m"`
+	Burn1h    float64 `json:"burn_1h"`
+	Target    float64 `json:"target"`
+	MaxAgeSec float64 `json:"max_age_seconds"`
+}
+
+const (
+	sloSampleInterval = time.Minute
+	sloMemoryWindow   = 6 * time.Hour
+	// Burning 2% of a 30 day budget in an hour; see the Google SRE workbook.
+	sloFastBurnRate = 14.4
+	// sloMaxWindow is the longest window an objective may use; hourly buckets
+	// expire after it.
+	sloMaxWindow = 90 * 24 * time.Hour
+)
+
+var (
+	sloBucketsCollection *mongo.Collection
+
+	sloDefault   = sloObjective{MaxAge: 30 * time.Minute, Target: 0.95, Window: 30 * 24 * time.Hour}
+	sloOverrides = map[string]sloObjective{}
+
+	sloMu     sync.Mutex
+	sloStates = map[string]*sloState{}
+)
+
+func loadSLOConfig(path string) error {
+	if path == "" {
+		return nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read SLO config: %w", err)
+	}
+	var entries []sloConfigEntry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return fmt.Errorf("failed to parse SLO config: %w", err)
+	}
+	for _, entry := range entries {
+		objective := sloDefault
+		if entry.MaxAge != "" {
+			if objective.MaxAge, err = time.ParseDuration(entry.MaxAge); err != nil {
+				return fmt.Errorf("SLO for %q: bad max_age: %w", entry.City, err)
+			}
+		}
+		if entry.Window != "" {
+			if objective.Window, err = time.ParseDuration(entry.Window); err != nil {
+				return fmt.Errorf("SLO for %q: bad window: %w", entry.City, err)
+			}
+			if objective.Window <= 0 || objective.Window > sloMaxWindow {
+				return fmt.Errorf("SLO for %q: window must be positive and at most %s", entry.City, sloMaxWindow)
+			}
+		}
+		if entry.Target != 0 {
+			if entry.Target <= 0 || entry.Target >= 1 {
+				return fmt.Errorf("SLO for %q: target must be between 0 and 1", entry.City)
+			}
+			objective.Target = entry.Target
+		}
+		if entry.City == "*" {
+			sloDefault = objective
+		} else {
+			sloOverrides[entry.City] = objective
+		}
+	}
+	return nil
+}
+
+func objectiveFor(city string) sloObjective {
+	if objective, ok := sloOverrides[city]; ok {
+		return objective
+	}
+	return sloDefault
+}
+
+func burnRate(good, total int, target float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return (float64(total-good) / float64(total)) / (1 - target)
+}
+
+func (s *sloState) burn(window time.Duration, target float64, now time.Time) float64 {
+	good, total := 0, 0
+	for _, sample := range s.samples {
+		if now.Sub(sample.At) <= window {
+			total++
+			if sample.Good {
+				good++
+			}
+		}
+	}
+	return burnRate(good, total, target)
+}
+
+func incSLOBucket(ctx context.Context, city string, at time.Time, inc bson.M) error {
+	filter := bson.M{"city": city, "hour": at.UTC().Truncate(time.Hour)}
+	_, err := sloBucketsCollection.UpdateOne(ctx, filter, bson.M{"$inc": inc}, options.Update().SetUpsert(true))
+	return err
+}
+
+// recordRefreshOutcome counts a refresh attempt for the city's SLO report.
+func recordRefreshOutcome(city string, ok bool) {
+	if readOnly.Load() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	field := "refresh_ok"
+	if !ok {
+		field = "refresh_failed"
+	}
+	if err := incSLOBucket(ctx, city, time.Now(), bson.M{field: 1}); err != nil {
+		log.Println("Failed to record refresh outcome:", err)
+	}
+}
+
+func runSLOEvaluator() {
+	ticker := time.NewTicker(sloSampleInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// Planned maintenance does not count against freshness objectives
+		if readOnly.Load() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), sloSampleInterval)
+		if err := evaluateSLOs(ctx, time.Now()); err != nil {
+			log.Println("Failed to evaluate SLOs:", err)
+		}
+		cancel()
+	}
+}
+
+// evaluateSLOs samples the freshness of every tracked city and raises a fast-burn
+// alert when both the 5 minute and 1 hour burn rates exceed sloFastBurnRate.
+// Cities are split between replicas with ownsKey, so each sample is counted and
+// each alert raised once; a replica forgets the burn state of cities it no
+// longer owns.
+func evaluateSLOs(ctx context.Context, now time.Time) error {
+	cursor, err := weatherCollection.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"city": 1, "last_updated": 1}))
+	if err != nil {
+		return err
+	}
+	var tracked []WeatherData
+	if err := cursor.All(ctx, &tracked); err != nil {
+		return err
+	}
+
+	for _, weather := range tracked {
+		if !ownsKey("slo:" + weather.City) {
+			sloMu.Lock()
+			delete(sloStates, weather.City)
+			sloMu.Unlock()
+			continue
+		}
+		objective := objectiveFor(weather.City)
+		good := now.Sub(weather.LastUpdated) <= objective.MaxAge
+
+		inc := bson.M{"total": 1}
+		if good {
+			inc["good"] = 1
+		}
+		if err := incSLOBucket(ctx, weather.City, now, inc); err != nil {
+			return err
+		}
+
+		sloMu.Lock()
+		state, ok := sloStates[weather.City]
+		if !ok {
+			state = &sloState{}
+			sloStates[weather.City] = state
+		}
+		state.samples = append(state.samples, sloSample{At: now, Good: good})
+		for len(state.samples) > 0 && now.Sub(state.samples[0].At) > sloMemoryWindow {
+			state.samples = state.samples[1:]
+		}
+		burn5m := state.burn(5*time.Minute, objective.Target, now)
+		burn1h := state.burn(time.Hour, objective.Target, now)
+		fastBurn := burn5m >= sloFastBurnRate && burn1h >= sloFastBurnRate
+		started := fastBurn && !state.alerting
+		state.alerting = fastBurn
+		sloMu.Unlock()
+
+		if started {
+			alert := SLOAlert{City: weather.City, Burn5m: burn5m, Burn1h: burn1h, Target: objective.Target, MaxAgeSec: objective.MaxAge.Seconds()}
+			log.Printf("SLO fast burn for %s: 5m burn %.1f, 1h burn %.1f", weather.City, burn5m, burn1h)
+			publish(Event{Type: EventSLOFastBurn, City: weather.City, Time: now, Payload: alert})
+		}
+	}
+	return nil
+}
+
+// sloHandler reports compliance and error budgets from the stored buckets. The
+// short burn rates are only known to the replica that owns the city.
+func sloHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{}
+	if city := r.URL.Query().Get("city"); city != "" {
+		filter["city"] = city
+	}
+	cursor, err := weatherCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{"city": 1, "last_updated": 1}))
+	if err != nil {
+		http.Error(w, "Failed to load SLOs", http.StatusInternalServerError)
+		return
+	}
+	var tracked []WeatherData
+	if err := cursor.All(ctx, &tracked); err != nil {
+		http.Error(w, "Failed to load SLOs", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	longest := sloDefault.Window
+	for _, objective := range sloOverrides {
+		if objective.Window > longest {
+			longest = objective.Window
+		}
+	}
+	bucketFilter := bson.M{"hour": bson.M{"$gte": now.Add(-longest).Truncate(time.Hour)}}
+	if city, ok := filter["city"]; ok {
+		bucketFilter["city"] = city
+	}
+	cursor, err = sloBucketsCollection.Find(ctx, bucketFilter)
+	if err != nil {
+		http.Error(w, "Failed to load SLOs", http.StatusInternalServerError)
+		return
+	}
+	var buckets []sloBucket
+	if err := cursor.All(ctx, &buckets); err != nil {
+		http.Error(w, "Failed to load SLOs", http.StatusInternalServerError)
+		return
+	}
+	bucketsByCity := map[string][]sloBucket{}
+	for _, b := range buckets {
+		bucketsByCity[b.City] = append(bucketsByCity[b.City], b)
+	}
+
+	statuses := []SLOStatus{}
+	for _, weather := range tracked {
+		objective := objectiveFor(weather.City)
+		age := now.Sub(weather.LastUpdated)
+		status := SLOStatus{
+			City:      weather.City,
+			MaxAge:    objective.MaxAge.String(),
+			Target:    objective.Target,
+			Window:    objective.Window.String(),
+			Age:       age.Truncate(time.Second).String(),
+			Fresh:     age <= objective.MaxAge,
+			BurnRates: map[string]float64{},
+		}
+
+		good, total := 0, 0
+		for _, b := range bucketsByCity[weather.City] {
+			if now.Sub(b.Hour) > objective.Window {
+				continue
+			}
+			good += b.Good
+			total += b.Total
+			status.RefreshOK += b.RefreshOK
+			status.RefreshFailed += b.RefreshFailed
+		}
+		status.Compliance = 1
+		if total > 0 {
+			status.Compliance = float64(good) / float64(total)
+		}
+		windowBurn := burnRate(good, total, objective.Target)
+		status.BudgetRemaining = 1 - windowBurn
+		status.BurnRates["window"] = windowBurn
+
+		sloMu.Lock()
+		if state, ok := sloStates[weather.City]; ok {
+			status.BurnRates["5m"] = state.burn(5*time.Minute, objective.Target, now)
+			status.BurnRates["1h"] = state.burn(time.Hour, objective.Target, now)
+			status.BurnRates["6h"] = state.burn(6*time.Hour, objective.Target, now)
+			status.FastBurn = state.alerting
+		}
+		sloMu.Unlock()
+
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].BudgetRemaining < statuses[j].BudgetRemaining })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadSLOConfig(t *testing.T) {
+	savedDefault, savedOverrides := sloDefault, sloOverrides
+	defer func() { sloDefault, sloOverrides = savedDefault, savedOverrides }()
+
+	write := func(config string) string {
+		path := filepath.Join(t.TempDir(), "slo.json")
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	for config, want := range map[string]string{
+		`[{"city": "Berlin", "window": "2160h1m"}]`: "at most",
+		`[{"city": "Berlin", "window": "-1h"}]`:     "positive",
+		`[{"city": "Berlin", "target": 1.5}]`:       "between 0 and 1",
+		`[{"city": "Berlin", "max_age": "soon"}]`:   "bad max_age",
+	} {
+		sloOverrides = map[string]sloObjective{}
+		if err := loadSLOConfig(write(config)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want an error containing %q", config, err, want)
+		}
+	}
+
+	sloOverrides = map[string]sloObjective{}
+	if err := loadSLOConfig(write(`[{"city": "*", "max_age": "1h"}, {"city": "Berlin", "window": "2160h", "target": 0.99}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := objectiveFor("Paris"); got.MaxAge != time.Hour || got.Target != 0.95 {
+		t.Errorf("default objective %+v", got)
+	}
+	if got := objectiveFor("Berlin"); got.Window != sloMaxWindow || got.Target != 0.99 || got.MaxAge != time.Hour {
+		t.Errorf("Berlin objective %+v", got)
+	}
+}
+
+func TestBurnRate(t *testing.T) {
+	if got := burnRate(0, 0, 0.95); got != 0 {
+		t.Errorf("burn without samples = %v", got)
+	}
+	if got := burnRate(95, 100, 0.95); got < 0.999 || got > 1.001 {
+		t.Errorf("burn at the target = %v, want 1", got)
+	}
+	now := time.Now()
+	state := &sloState{samples: []sloSample{{At: now.Add(-2 * time.Hour), Good: false}, {At: now.Add(-time.Minute), Good: true}}}
+	if got := state.burn(5*time.Minute, 0.95, now); got != 0 {
+		t.Errorf("5m burn = %v, want 0", got)
+	}
+	if got := state.burn(6*time.Hour, 0.95, now); got < 9.99 || got > 10.01 {
+		t.Errorf("6h burn = %v, want 10", got)
+	}
+}
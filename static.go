@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Bump staticLayoutVersion whenever the rendered output changes so every city
+// is regenerated on the next publish.
+const (
+	staticLayoutVersion = 1
+	staticStateFile     = ".publish-state.json"
+	staticHistoryWindow = 48 * time.Hour
+	staticForecastHours = 48
+	staticChartWidth    = 640
+	staticChartHeight   = 240
+	staticChartPadding  = 36
+)
+
+// staticState remembers what the last publish wrote, so unchanged cities are not
+// rendered again and unchanged files are not rewritten (keeping their mtimes and
+// the static host's caches valid).
+type staticState struct {
+	Cities map[string]string   `json:"cities"` // city -> fingerprint of its data
+	Files  map[string]string   `json:"files"`  // key -> sha256 of its content
+	Owned  map[string][]string `json:"owned"`  // city -> keys of its files
+	Slugs  map[string]string   `json:"slugs"`  // city -> directory of its pages
+}
+
+type staticCity struct {
+	Weather  WeatherData
+	Slug     string
+	Forecast *Forecast
+	History  []WeatherData
+}
+
+type staticPublisher struct {
+	sink    dirSink
+	title   string
+	state   staticState
+	written int
+	skipped int
+}
+
+// runPublishStatic implements `weather publish-static`: it renders current
+// conditions, forecasts and charts for the selected cities into -out. With
+// -watch it keeps running and regenerates whatever changed every interval.
+func runPublishStatic(args []string) error {
+	flags := flag.NewFlagSet("publish-static", flag.ContinueOnError)
+	out := flags.String("out", "public", "output directory")
+	cities := flags.String("cities", "", "comma-separated cities to publish (default all)")
+	tag := flags.String("tag", "", "publish only cities with this tag")
+	title := flags.String("title", "Weather status", "site title")
+	watch := flags.Duration("watch", 0, "regenerate every interval instead of exiting")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	p := &staticPublisher{sink: dirSink{root: *out}, title: *title}
+	if err := p.loadState(); err != nil {
+		return err
+	}
+	filter := bson.M{}
+	if *cities != "" {
+		filter["city"] = bson.M{"$in": strings.Split(*cities, ",")}
+	}
+	if *tag != "" {
+		filter["tags"] = *tag
+	}
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		err := p.publish(ctx, filter)
+		cancel()
+		if err != nil && *watch == 0 {
+			return err
+		}
+		if err != nil {
+			log.Println("Failed to publish static site:", err)
+		} else {
+			log.Printf("Published static site to %s: %d file(s) written, %d city(ies) unchanged", *out, p.written, p.skipped)
+		}
+		if *watch == 0 {
+			return nil
+		}
+		time.Sleep(*watch)
+	}
+}
+
+func (p *staticPublisher) loadState() error {
+	p.state = staticState{Cities: map[string]string{}, Files: map[string]string{}, Owned: map[string][]string{}, Slugs: map[string]string{}}
+	raw, err := os.ReadFile(filepath.Join(p.sink.root, staticStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, &p.state); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", staticStateFile, err)
+	}
+	return nil
+}
+
+func (p *staticPublisher) saveState(ctx context.Context) error {
+	raw, err := json.MarshalIndent(p.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return p.sink.Put(ctx, staticStateFile, raw, "application/json")
+}
+
+// put writes key unless it already holds body.
+func (p *staticPublisher) put(ctx context.Context, key string, body []byte, contentType string) error {
+	sum := sha256Hex(body)
+	if p.state.Files[key] == sum {
+		if _, err := os.Stat(filepath.Join(p.sink.root, filepath.FromSlash(key))); err == nil {
+			return nil
+		}
+	}
+	if err := p.sink.Put(ctx, key, body, contentType); err != nil {
+		return err
+	}
+	p.state.Files[key] = sum
+	p.written++
+	return nil
+}
+
+// remove deletes one of city's files unless another city's pages use it too.
+func (p *staticPublisher) remove(key, city string) {
+	for other, keys := range p.state.Owned {
+		if other == city {
+			continue
+		}
+		for _, k := range keys {
+			if k == key {
+				return
+			}
+		}
+	}
+	os.Remove(filepath.Join(p.sink.root, filepath.FromSlash(key)))
+	delete(p.state.Files, key)
+}
+
+// assignSlugs gives every city a slug no other city has. Cities keep the slug
+// they were published under; a new city whose name slugs the same as another's
+// ("New York" and "New-York") gets a hash suffix.
+func (p *staticPublisher) assignSlugs(cities []string) {
+	taken := map[string]string{}
+	for _, city := range cities {
+		if slug, ok := p.state.Slugs[city]; ok && taken[slug] == "" {
+			taken[slug] = city
+		}
+	}
+	for _, city := range cities {
+		if slug, ok := p.state.Slugs[city]; ok && taken[slug] == city {
+			continue
+		}
+		slug := staticSlug(city)
+		if _, ok := taken[slug]; ok {
+			slug += "-" + sha256Hex([]byte(city))[:8]
+		}
+		p.state.Slugs[city] = slug
+		taken[slug] = city
+	}
+}
+
+// storedForecast returns the stored forecast for city from now on, or nil if
+// there is none. It never fetches, so static pages only read what is stored.
+func storedForecast(ctx context.Context, city string) (*Forecast, error) {
+	var forecast Forecast
+	err := forecastsCollection.FindOne(ctx, bson.M{"_id": city}).Decode(&forecast)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	forecast.Hours = upcomingHours(forecast.Hours, time.Now())
+	return &forecast, nil
+}
+
+func (p *staticPublisher) publish(ctx context.Context, filter bson.M) error {
+	p.written, p.skipped = 0, 0
+	var weathers []WeatherData
+	cursor, err := weatherCollection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &weathers); err != nil {
+		return err
+	}
+	sort.Slice(weathers, func(i, j int) bool { return weathers[i].City < weathers[j].City })
+
+	published := map[string]bool{}
+	names := make([]string, 0, len(weathers))
+	for _, weather := range weathers {
+		published[weather.City] = true
+		names = append(names, weather.City)
+	}
+	// Cities no longer published lose their pages first, so their slugs are free
+	for city, keys := range p.state.Owned {
+		if published[city] {
+			continue
+		}
+		for _, key := range keys {
+			p.remove(key, city)
+		}
+		delete(p.state.Owned, city)
+		delete(p.state.Cities, city)
+	}
+	for city := range p.state.Slugs {
+		if !published[city] {
+			delete(p.state.Slugs, city)
+		}
+	}
+	p.assignSlugs(names)
+
+	var cities []staticCity
+	for _, weather := range weathers {
+		city := staticCity{Weather: weather, Slug: p.state.Slugs[weather.City]}
+		forecast, err := storedForecast(ctx, weather.City)
+		if err != nil {
+			return fmt.Errorf("failed to load the forecast for %s: %w", weather.City, err)
+		}
+		if forecast != nil {
+			for i := range forecast.Hours {
+				forecast.Hours[i].Temp.Members = nil
+				forecast.Hours[i].Wind.Members = nil
+				forecast.Hours[i].Precip.Members = nil
+			}
+			city.Forecast = forecast
+		}
+		cities = append(cities, city)
+
+		fingerprint := fmt.Sprintf("v%d|%s|%s", staticLayoutVersion, city.Slug, weather.LastUpdated.UTC().Format(time.RFC3339Nano))
+		if city.Forecast != nil {
+			fingerprint += "|" + city.Forecast.Issued.UTC().Format(time.RFC3339Nano)
+		}
+		if p.state.Cities[weather.City] == fingerprint {
+			p.skipped++
+			continue
+		}
+		if err := p.publishCity(ctx, &city); err != nil {
+			return fmt.Errorf("failed to publish %s: %w", weather.City, err)
+		}
+		p.state.Cities[weather.City] = fingerprint
+	}
+
+	if err := p.publishIndex(ctx, cities); err != nil {
+		return err
+	}
+	return p.saveState(ctx)
+}
+
+func (p *staticPublisher) publishCity(ctx context.Context, city *staticCity) error {
+	err := scanHistory(ctx, bson.M{"city": city.Weather.City}, time.Now().Add(-staticHistoryWindow), time.Now(), func(reading WeatherData) error {
+		city.History = append(city.History, reading)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	prefix := "cities/" + city.Slug + "/"
+	data := struct {
+		Current  WeatherData   `json:"current"`
+		Forecast *Forecast     `json:"forecast,omitempty"`
+		History  []WeatherData `json:"history"`
+	}{city.Weather, city.Forecast, city.History}
+	if data.History == nil {
+		data.History = []WeatherData{}
+	}
+	raw, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	var page bytes.Buffer
+	if err := staticCityTemplate.Execute(&page, struct {
+		Title string
+		City  *staticCity
+	}{p.title, city}); err != nil {
+		return err
+	}
+
+	files := []struct {
+		key, contentType string
+		body             []byte
+	}{
+		{prefix + "index.html", "text/html; charset=utf-8", page.Bytes()},
+		{prefix + "data.json", "application/json", raw},
+		{prefix + "temp.svg", "image/svg+xml", staticChart(city, "Temperature (°C)", false)},
+		{prefix + "precip.svg", "image/svg+xml", staticChart(city, "Precipitation (mm)", true)},
+	}
+	var keys []string
+	written := map[string]bool{}
+	for _, f := range files {
+		if err := p.put(ctx, f.key, f.body, f.contentType); err != nil {
+			return err
+		}
+		keys = append(keys, f.key)
+		written[f.key] = true
+	}
+	// Files left over from an earlier slug
+	for _, key := range p.state.Owned[city.Weather.City] {
+		if !written[key] {
+			p.remove(key, city.Weather.City)
+		}
+	}
+	p.state.Owned[city.Weather.City] = keys
+	return nil
+}
+
+func (p *staticPublisher) publishIndex(ctx context.Context, cities []staticCity) error {
+	current := make([]WeatherData, 0, len(cities))
+	var updated time.Time
+	for _, city := range cities {
+		current = append(current, city.Weather)
+		if city.Weather.LastUpdated.After(updated) {
+			updated = city.Weather.LastUpdated
+		}
+	}
+	raw, err := json.MarshalIndent(current, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := p.put(ctx, "index.json", raw, "application/json"); err != nil {
+		return err
+	}
+	var page bytes.Buffer
+	if err := staticIndexTemplate.Execute(&page, struct {
+		Title   string
+		Cities  []staticCity
+		Updated time.Time
+	}{p.title, cities, updated}); err != nil {
+		return err
+	}
+	return p.put(ctx, "index.html", page.Bytes(), "text/html; charset=utf-8")
+}
+
+// staticSlug makes a city name safe as a path segment.
+func staticSlug(city string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(city) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r > 127 {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	if slug := strings.TrimSuffix(b.String(), "-"); slug != "" {
+		return slug
+	}
+	return "city-" + sha256Hex([]byte(city))[:8]
+}
+
+// staticChart draws the observed values as a solid line and the forecast median
+// as a dashed one, with the p10-p90 range shaded when the forecast has it.
+// Precipitation is drawn from zero as bars would be, so the axis starts at 0.
+func staticChart(city *staticCity, label string, precip bool) []byte {
+	observed := func(w WeatherData) float64 { return w.Temp }
+	predicted := func(h ForecastHour) ForecastValue { return h.Temp }
+	if precip {
+		observed = func(w WeatherData) float64 { return w.Precip }
+		predicted = func(h ForecastHour) ForecastValue { return h.Precip }
+	}
+
+	now := time.Now()
+	start, end := now.Add(-staticHistoryWindow), now
+	lo, hi := math.Inf(1), math.Inf(-1)
+	extend := func(v float64) {
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	for _, r := range city.History {
+		extend(observed(r))
+	}
+	var hours []ForecastHour
+	if city.Forecast != nil {
+		hours = city.Forecast.Hours
+		if len(hours) > staticForecastHours {
+			hours = hours[:staticForecastHours]
+		}
+	}
+	for _, h := range hours {
+		v := predicted(h)
+		extend(v.Value)
+		if v.P10 != nil && v.P90 != nil {
+			extend(*v.P10)
+			extend(*v.P90)
+		}
+		if h.Time.After(end) {
+			end = h.Time
+		}
+	}
+	if precip || math.IsInf(lo, 1) {
+		lo = math.Min(lo, 0)
+	}
+	if math.IsInf(hi, -1) {
+		hi = 1
+	}
+	if hi-lo < 1 {
+		hi = lo + 1
+	}
+
+	x := func(t time.Time) float64 {
+		return staticChartPadding + float64(t.Sub(start))/float64(end.Sub(start))*(staticChartWidth-2*staticChartPadding)
+	}
+	y := func(v float64) float64 {
+		return staticChartHeight - staticChartPadding - (v-lo)/(hi-lo)*(staticChartHeight-2*staticChartPadding)
+	}
+	points := func(n int, at func(i int) (time.Time, float64)) string {
+		var b strings.Builder
+		for i := 0; i < n; i++ {
+			t, v := at(i)
+			fmt.Fprintf(&b, "%.1f,%.1f ", x(t), y(v))
+		}
+		return strings.TrimSpace(b.String())
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`+"\n",
+		staticChartWidth, staticChartHeight, staticChartWidth, staticChartHeight)
+	fmt.Fprintf(&b, `<text x="%d" y="16">%s</text>`+"\n", staticChartPadding, html.EscapeString(label))
+	fmt.Fprintf(&b, `<text x="4" y="%.1f">%.1f</text><text x="4" y="%.1f">%.1f</text>`+"\n", y(hi)+4, hi, y(lo)+4, lo)
+	fmt.Fprintf(&b, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%d" stroke="#999" stroke-dasharray="2,2"/>`+"\n",
+		x(now), staticChartPadding, x(now), staticChartHeight-staticChartPadding)
+
+	var band []ForecastHour
+	for _, h := range hours {
+		if v := predicted(h); v.P10 != nil && v.P90 != nil {
+			band = append(band, h)
+		}
+	}
+	if len(band) > 1 {
+		upper := points(len(band), func(i int) (time.Time, float64) { return band[i].Time, *predicted(band[i]).P90 })
+		lower := points(len(band), func(i int) (time.Time, float64) {
+			h := band[len(band)-1-i]
+			return h.Time, *predicted(h).P10
+		})
+		fmt.Fprintf(&b, `<polygon points="%s %s" fill="#4a90d9" fill-opacity="0.2"/>`+"\n", upper, lower)
+	}
+	if len(city.History) > 0 {
+		fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="#333" stroke-width="1.5"/>`+"\n",
+			points(len(city.History), func(i int) (time.Time, float64) { return city.History[i].LastUpdated, observed(city.History[i]) }))
+	}
+	if len(hours) > 0 {
+		fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="#4a90d9" stroke-width="1.5" stroke-dasharray="5,3"/>`+"\n",
+			points(len(hours), func(i int) (time.Time, float64) { return hours[i].Time, predicted(hours[i]).Value }))
+	}
+	b.WriteString("</svg>\n")
+	return []byte(b.String())
+}
+
+var staticFuncs = template.FuncMap{
+	"temp":  func(v float64) string { return fmt.Sprintf("%.1f °C", v) },
+	"time":  func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04 UTC") },
+	"hour":  func(t time.Time) string { return t.UTC().Format("Mon 15:04") },
+	"deref": func(v *float64) float64 { return *v },
+}
+
+var staticIndexTemplate = template.Must(template.New("index").Funcs(staticFuncs).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<table>
+<tr><th>City</th><th>Conditions</th><th>Temperature</th><th>Wind</th><th>Updated</th></tr>
+{{range .Cities}}<tr><td><a href="cities/{{.Slug}}/">{{.Weather.City}}</a></td><td>{{.Weather.Description}}</td><td>{{temp .Weather.Temp}}</td><td>{{printf "%.1f" .Weather.Wind}} m/s</td><td>{{time .Weather.LastUpdated}}</td></tr>
+{{end}}</table>
+{{if not .Updated.IsZero}}<p>Latest reading {{time .Updated}}. <a href="index.json">JSON</a></p>{{end}}
+</body>
+</html>
+`))
+
+var staticCityTemplate = template.Must(template.New("city").Funcs(staticFuncs).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>{{.City.Weather.City}} · {{.Title}}</title></head>
+<body>
+<p><a href="../../">{{.Title}}</a></p>
+<h1>{{.City.Weather.City}}{{with .City.Weather.Country}}, {{.}}{{end}}</h1>
+<p>{{.City.Weather.Description}}, {{temp .City.Weather.Temp}}, wind {{printf "%.1f" .City.Weather.Wind}} m/s, precipitation {{printf "%.1f" .City.Weather.Precip}} mm. Updated {{time .City.Weather.LastUpdated}}.</p>
+<img src="temp.svg" alt="Temperature, last 48 hours and forecast">
+<img src="precip.svg" alt="Precipitation, last 48 hours and forecast">
+{{with .City.Forecast}}
+{{range .Warnings}}<p><strong>{{.Event}}</strong> ({{.Sender}}) {{time .Start}} – {{time .End}}</p>
+{{end}}<h2>Forecast</h2>
+<table>
+<tr><th>Time</th><th>Conditions</th><th>Temperature</th><th>Range</th><th>Precipitation</th></tr>
+{{range .Hours}}<tr><td>{{hour .Time}}</td><td>{{.Description}}</td><td>{{temp .Temp.Value}}</td><td>{{if .Temp.P10}}{{temp (deref .Temp.P10)}} – {{temp (deref .Temp.P90)}}{{end}}</td><td>{{printf "%.1f" .Precip.Value}} mm</td></tr>
+{{end}}</table>
+<p>Forecast by {{.Provider}}, issued {{time .Issued}}.</p>
+{{end}}
+<p><a href="data.json">JSON</a></p>
+</body>
+</html>
+`))
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestPublisher(t *testing.T) *staticPublisher {
+	p := &staticPublisher{sink: dirSink{root: t.TempDir()}}
+	if err := p.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestStaticSlug(t *testing.T) {
+	for city, want := range map[string]string{
+		"New York":         "new-york",
+		"New-York":         "new-york",
+		"  St. John's  ":   "st-john-s",
+		"São Paulo":        "são-paulo",
+		"../../etc":        "etc",
+		"東京":               "東京",
+		"???":              "city-" + sha256Hex([]byte("???"))[:8],
+		"Frankfurt (Oder)": "frankfurt-oder",
+	} {
+		if got := staticSlug(city); got != want {
+			t.Errorf("staticSlug(%q) = %q, want %q", city, got, want)
+		}
+	}
+}
+
+func TestAssignSlugsAvoidsCollisions(t *testing.T) {
+	p := newTestPublisher(t)
+	p.assignSlugs([]string{"New York", "New-York", "Paris"})
+	if p.state.Slugs["New York"] != "new-york" || p.state.Slugs["Paris"] != "paris" {
+		t.Errorf("unexpected slugs %v", p.state.Slugs)
+	}
+	if got, want := p.state.Slugs["New-York"], "new-york-"+sha256Hex([]byte("New-York"))[:8]; got != want {
+		t.Errorf("colliding city got slug %q, want %q", got, want)
+	}
+
+	// A city keeps its slug even when a city sorting before it appears later
+	p = newTestPublisher(t)
+	p.assignSlugs([]string{"New-York"})
+	p.assignSlugs([]string{"New York", "New-York"})
+	if p.state.Slugs["New-York"] != "new-york" {
+		t.Errorf("existing city moved to %q", p.state.Slugs["New-York"])
+	}
+	if p.state.Slugs["New York"] == "new-york" {
+		t.Error("new city took an existing city's slug")
+	}
+}
+
+func TestRemoveKeepsOtherCitiesFiles(t *testing.T) {
+	p := newTestPublisher(t)
+	ctx := context.Background()
+	for _, key := range []string{"cities/a/index.html", "cities/shared/index.html"} {
+		if err := p.put(ctx, key, []byte(key), "text/html"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.state.Owned["A"] = []string{"cities/a/index.html", "cities/shared/index.html"}
+	p.state.Owned["B"] = []string{"cities/shared/index.html"}
+
+	for _, key := range p.state.Owned["A"] {
+		p.remove(key, "A")
+	}
+	if _, err := os.Stat(filepath.Join(p.sink.root, "cities", "a", "index.html")); !os.IsNotExist(err) {
+		t.Errorf("A's own file was not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(p.sink.root, "cities", "shared", "index.html")); err != nil {
+		t.Errorf("B's file was removed: %v", err)
+	}
+}
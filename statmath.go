@@ -0,0 +1,126 @@
+package main
+
+import "math"
+
+// pearson returns the correlation coefficient of xs and ys, which must be the
+// same length. It returns NaN when either series is constant.
+func pearson(xs, ys []float64) float64 {
+	n := float64(len(xs))
+	if n < 2 {
+		return math.NaN()
+	}
+	var sumX, sumY float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+	}
+	meanX, meanY := sumX/n, sumY/n
+	var cov, varX, varY float64
+	for i := range xs {
+		dx, dy := xs[i]-meanX, ys[i]-meanY
+		cov += dx * dy
+		varX += dx * dx
+		varY += dy * dy
+	}
+	if varX == 0 || varY == 0 {
+		return math.NaN()
+	}
+	return cov / math.Sqrt(varX*varY)
+}
+
+// correlationPValue is the two-sided p-value of r under the null hypothesis of no
+// correlation, using the t statistic with n-2 degrees of freedom.
+func correlationPValue(r float64, n int) float64 {
+	if n < 3 || math.IsNaN(r) {
+		return math.NaN()
+	}
+	if math.Abs(r) >= 1 {
+		return 0
+	}
+	df := float64(n - 2)
+	t := r * math.Sqrt(df/(1-r*r))
+	return regularizedIncompleteBeta(df/2, 0.5, df/(df+t*t))
+}
+
+// fisherInterval is the 95% confidence interval for r from the Fisher z transform.
+func fisherInterval(r float64, n int) (float64, float64) {
+	if math.Abs(r) >= 1 {
+		return r, r
+	}
+	if n < 4 || math.IsNaN(r) {
+		return math.NaN(), math.NaN()
+	}
+	z := math.Atanh(r)
+	se := 1 / math.Sqrt(float64(n-3))
+	return math.Tanh(z - 1.959964*se), math.Tanh(z + 1.959964*se)
+}
+
+// bonferroni adjusts the p-value of one of tests simultaneous tests.
+func bonferroni(p float64, tests int) float64 {
+	return math.Min(1, p*float64(tests))
+}
+
+// regularizedIncompleteBeta computes I_x(a, b) with the continued fraction from
+// Numerical Recipes (betacf).
+func regularizedIncompleteBeta(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	lgab, _ := math.Lgamma(a + b)
+	lga, _ := math.Lgamma(a)
+	lgb, _ := math.Lgamma(b)
+	front := math.Exp(lgab - lga - lgb + a*math.Log(x) + b*math.Log(1-x))
+	if x < (a+1)/(a+b+2) {
+		return front * betaContinuedFraction(a, b, x) / a
+	}
+	return 1 - front*betaContinuedFraction(b, a, 1-x)/b
+}
+
+func betaContinuedFraction(a, b, x float64) float64 {
+	const (
+		maxIterations = 200
+		epsilon       = 3e-14
+		tiny          = 1e-300
+	)
+	qab, qap, qam := a+b, a+1, a-1
+	c, d := 1.0, 1-qab*x/qap
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= maxIterations; m++ {
+		m2 := float64(2 * m)
+		fm := float64(m)
+		aa := fm * (b - fm) * x / ((qam + m2) * (a + m2))
+		d = 1 + aa*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+		aa = -(a + fm) * (qab + fm) * x / ((a + m2) * (qap + m2))
+		d = 1 + aa*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		del := d * c
+		h *= del
+		if math.Abs(del-1) < epsilon {
+			break
+		}
+	}
+	return h
+}
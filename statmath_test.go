@@ -0,0 +1,111 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func near(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+func TestPearson(t *testing.T) {
+	tests := []struct {
+		xs, ys []float64
+		want   float64
+	}{
+		{[]float64{1, 2, 3, 4, 5}, []float64{2, 4, 5, 4, 5}, 6 / math.Sqrt(60)},
+		{[]float64{1, 2, 3}, []float64{3, 2, 1}, -1},
+		{[]float64{1, 2, 3, 4}, []float64{10, 20, 30, 40}, 1},
+	}
+	for _, tt := range tests {
+		if got := pearson(tt.xs, tt.ys); !near(got, tt.want, 1e-12) {
+			t.Errorf("pearson(%v, %v) = %v, want %v", tt.xs, tt.ys, got, tt.want)
+		}
+	}
+	if !math.IsNaN(pearson([]float64{1, 2, 3}, []float64{5, 5, 5})) {
+		t.Error("constant series did not give NaN")
+	}
+	if !math.IsNaN(pearson([]float64{1}, []float64{2})) {
+		t.Error("single point did not give NaN")
+	}
+}
+
+func TestRegularizedIncompleteBeta(t *testing.T) {
+	tests := []struct {
+		a, b, x, want float64
+	}{
+		{1, 1, 0.3, 0.3},
+		{3, 1, 0.5, 0.125},                             // x^a
+		{1, 4, 0.2, 1 - math.Pow(0.8, 4)},              // 1-(1-x)^b
+		{2.5, 2.5, 0.5, 0.5},                           // symmetric
+		{0.5, 0.5, 0.25, 2 / math.Pi * math.Asin(0.5)}, // arcsine distribution
+		{2, 3, 0, 0},
+		{2, 3, 1, 1},
+	}
+	for _, tt := range tests {
+		if got := regularizedIncompleteBeta(tt.a, tt.b, tt.x); !near(got, tt.want, 1e-10) {
+			t.Errorf("I_%v(%v, %v) = %v, want %v", tt.x, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCorrelationPValue(t *testing.T) {
+	tests := []struct {
+		r    float64
+		n    int
+		want float64
+	}{
+		// With 1 degree of freedom t is Cauchy: p = 1 - 2/π·atan(|t|), t = 1/√3
+		{0.5, 3, 2.0 / 3},
+		// With 2: p = 1 - |t|/√(t²+2), which is exactly 0.5 here
+		{0.5, 4, 0.5},
+		{-0.5, 4, 0.5},
+		// The textbook example r = 0.7746 with n = 5 (t = 2.1213, df = 3)
+		{6 / math.Sqrt(60), 5, 0.124027},
+		{0, 30, 1},
+		{1, 10, 0},
+	}
+	for _, tt := range tests {
+		if got := correlationPValue(tt.r, tt.n); !near(got, tt.want, 1e-6) {
+			t.Errorf("correlationPValue(%v, %d) = %v, want %v", tt.r, tt.n, got, tt.want)
+		}
+	}
+	if !math.IsNaN(correlationPValue(0.5, 2)) {
+		t.Error("two points gave a p-value")
+	}
+}
+
+func TestFisherInterval(t *testing.T) {
+	// z = atanh(0.5) = 0.5493, se = 1/√25 = 0.2
+	low, high := fisherInterval(0.5, 28)
+	if !near(low, 0.156028, 1e-6) || !near(high, 0.735818, 1e-6) {
+		t.Errorf("fisherInterval(0.5, 28) = [%v, %v], want [0.156028, 0.735818]", low, high)
+	}
+	low, high = fisherInterval(-0.5, 28)
+	if !near(low, -0.735818, 1e-6) || !near(high, -0.156028, 1e-6) {
+		t.Errorf("interval for a negative r is not mirrored: [%v, %v]", low, high)
+	}
+	if low, high := fisherInterval(1, 10); low != 1 || high != 1 {
+		t.Errorf("perfect correlation interval [%v, %v]", low, high)
+	}
+	if low, _ := fisherInterval(0.5, 3); !math.IsNaN(low) {
+		t.Error("three points gave an interval")
+	}
+}
+
+func TestBonferroni(t *testing.T) {
+	for _, tt := range []struct {
+		p     float64
+		tests int
+		want  float64
+	}{
+		{0.01, 1, 0.01},
+		{0.01, 4, 0.04},
+		{0.3, 5, 1},
+	} {
+		if got := bonferroni(tt.p, tt.tests); !near(got, tt.want, 1e-15) {
+			t.Errorf("bonferroni(%v, %d) = %v, want %v", tt.p, tt.tests, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type CityStats struct {
+	City    string  `json:"city"`
+	From    string  `json:"from,omitempty"`
+	To      string  `json:"to,omitempty"`
+	Days    int     `json:"days"`
+	Count   int     `json:"count"`
+	MinTemp float64 `json:"min_temp"`
+	MaxTemp float64 `json:"max_temp"`
+	AvgTemp float64 `json:"avg_temp"`
+}
+
+type RegionSummary struct {
+	Country string  `bson:"_id" json:"country"`
+	Cities  int     `bson:"cities" json:"cities"`
+	MinTemp float64 `bson:"min_temp" json:"min_temp"`
+	MaxTemp float64 `bson:"max_temp" json:"max_temp"`
+	AvgTemp float64 `bson:"avg_temp" json:"avg_temp"`
+}
+
+// parseDayRange reads the optional from/to query parameters (YYYY-MM-DD).
+func parseDayRange(r *http.Request) (string, string, bool) {
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	for _, day := range []string{from, to} {
+		if day == "" {
+			continue
+		}
+		if _, err := time.Parse(dayLayout, day); err != nil {
+			return "", "", false
+		}
+	}
+	return from, to, true
+}
+
+func computeCityStats(ctx context.Context, city, from, to string) (CityStats, error) {
+	match := bson.M{"city": city}
+	dayFilter := bson.M{}
+	if from != "" {
+		dayFilter["$gte"] = from
+	}
+	if to != "" {
+		dayFilter["$lte"] = to
+	}
+	if len(dayFilter) > 0 {
+		match["day"] = dayFilter
+	}
+
+	pipeline := bson.A{
+		bson.M{"$match": match},
+		bson.M{"$group": bson.M{
+			"_id":      nil,
+			"days":     bson.M{"$sum": 1},
+			"count":    bson.M{"$sum": "$count"},
+			"min_temp": bson.M{"$min": "$min_temp"},
+			"max_temp": bson.M{"$max": "$max_temp"},
+			"sum_temp": bson.M{"$sum": "$sum_temp"},
+		}},
+	}
+	cursor, err := dailyCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return CityStats{}, err
+	}
+	var rows []struct {
+		Days    int     `bson:"days"`
+		Count   int     `bson:"count"`
+		MinTemp float64 `bson:"min_temp"`
+		MaxTemp float64 `bson:"max_temp"`
+		SumTemp float64 `bson:"sum_temp"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return CityStats{}, err
+	}
+
+	stats := CityStats{City: city, From: from, To: to}
+	if len(rows) == 1 {
+		row := rows[0]
+		stats.Days, stats.Count = row.Days, row.Count
+		stats.MinTemp, stats.MaxTemp = row.MinTemp, row.MaxTemp
+		if row.Count > 0 {
+			stats.AvgTemp = row.SumTemp / float64(row.Count)
+		}
+	}
+	return stats, nil
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	city := r.URL.Query().Get("city")
+	if city == "" {
+		http.Error(w, "City parameter is required", http.StatusBadRequest)
+		return
+	}
+	from, to, ok := parseDayRange(r)
+	if !ok {
+		http.Error(w, "from and to must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	deps := aggDeps{Cities: []string{city}, From: from, To: to}
+	serveCachedAggregation(w, ctx, "stats", deps, func(ctx context.Context) (any, error) {
+		return computeCityStats(ctx, city, from, to)
+	})
+}
+
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	var cities []string
+	for _, city := range strings.Split(r.URL.Query().Get("cities"), ",") {
+		if city = strings.TrimSpace(city); city != "" {
+			cities = append(cities, city)
+		}
+	}
+	if len(cities) < 2 {
+		http.Error(w, "cities parameter needs at least two cities", http.StatusBadRequest)
+		return
+	}
+	from, to, ok := parseDayRange(r)
+	if !ok {
+		http.Error(w, "from and to must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	deps := aggDeps{Cities: cities, From: from, To: to}
+	serveCachedAggregation(w, ctx, "compare", deps, func(ctx context.Context) (any, error) {
+		results := make([]CityStats, 0, len(cities))
+		for _, city := range cities {
+			stats, err := computeCityStats(ctx, city, from, to)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, stats)
+		}
+		return results, nil
+	})
+}
+
+func regionsHandler(w http.ResponseWriter, r *http.Request) {
+	country := r.URL.Query().Get("country")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	deps := aggDeps{AllRegions: true}
+	match := bson.M{}
+	if country != "" {
+		deps = aggDeps{Countries: []string{country}}
+		match["country"] = country
+	}
+	serveCachedAggregation(w, ctx, "regions", deps, func(ctx context.Context) (any, error) {
+		pipeline := bson.A{
+			bson.M{"$match": match},
+			bson.M{"$group": bson.M{
+				"_id":      "$country",
+				"cities":   bson.M{"$sum": 1},
+				"min_temp": bson.M{"$min": "$temp"},
+				"max_temp": bson.M{"$max": "$temp"},
+				"avg_temp": bson.M{"$avg": "$temp"},
+			}},
+			bson.M{"$sort": bson.M{"_id": 1}},
+		}
+		cursor, err := weatherCollection.Aggregate(ctx, pipeline)
+		if err != nil {
+			return nil, err
+		}
+		summaries := []RegionSummary{}
+		if err := cursor.All(ctx, &summaries); err != nil {
+			return nil, err
+		}
+		return summaries, nil
+	})
+}
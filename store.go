@@ -0,0 +1,55 @@
+package main
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const databaseName = "weatherdb"
+
+// initStore binds every collection the service uses and registers the indexes of
+// those that are not projections.
+func initStore(db *mongo.Database) {
+	initProjections(db)
+
+	sharesCollection = db.Collection("share_links")
+	maintenanceCollection = db.Collection("maintenance")
+	sloBucketsCollection = db.Collection("slo_buckets")
+	registerIndexes(sloBucketsCollection,
+		mongo.IndexModel{Keys: bson.D{{Key: "city", Value: 1}, {Key: "hour", Value: 1}}, Options: options.Index().SetUnique(true)},
+		mongo.IndexModel{Keys: bson.D{{Key: "hour", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(sloMaxWindow / time.Second))},
+	)
+
+	seriesCollection = db.Collection("business_series")
+
+	stormsCollection = db.Collection("storms")
+	stormPositionsCollection = db.Collection("storm_positions")
+	registerIndexes(stormsCollection, mongo.IndexModel{Keys: bson.D{{Key: "last_fix", Value: -1}}})
+	registerIndexes(stormPositionsCollection, mongo.IndexModel{
+		Keys:    bson.D{{Key: "storm_id", Value: 1}, {Key: "kind", Value: 1}, {Key: "issued", Value: 1}, {Key: "tau", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+
+	forecastsCollection = db.Collection("forecasts")
+	tenantsCollection = db.Collection("tenants")
+	webhooksCollection = db.Collection("webhooks")
+	plansCollection = db.Collection("plans")
+	registerIndexes(plansCollection, mongo.IndexModel{Keys: bson.D{{Key: "tasks.city", Value: 1}, {Key: "tasks.status", Value: 1}}})
+
+	exportRunsCollection = db.Collection("export_runs")
+	registerIndexes(exportRunsCollection, mongo.IndexModel{Keys: bson.D{{Key: "job", Value: 1}, {Key: "scheduled_for", Value: -1}}})
+
+	refreshSchedulesCollection = db.Collection("refresh_schedules")
+	registerIndexes(refreshSchedulesCollection, mongo.IndexModel{Keys: bson.D{{Key: "next_refresh", Value: 1}}})
+	bulkJobsCollection = db.Collection("bulk_jobs")
+	registerIndexes(bulkJobsCollection, mongo.IndexModel{Keys: bson.D{{Key: "created_at", Value: -1}}})
+	auditCollection = db.Collection("audit_log")
+	registerIndexes(auditCollection,
+		mongo.IndexModel{Keys: bson.D{{Key: "time", Value: -1}}},
+		mongo.IndexModel{Keys: bson.D{{Key: "job", Value: 1}, {Key: "time", Value: -1}}},
+		mongo.IndexModel{Keys: bson.D{{Key: "city", Value: 1}, {Key: "time", Value: -1}}},
+	)
+}
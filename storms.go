@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Storm is a tropical cyclone identified the ATCF way, e.g. "AL092011".
+type Storm struct {
+	ID        string    `bson:"_id" json:"id"`
+	Basin     string    `bson:"basin" json:"basin"`
+	Number    int       `bson:"number" json:"number"`
+	Year      int       `bson:"year" json:"year"`
+	Name      string    `bson:"name,omitempty" json:"name,omitempty"`
+	Source    string    `bson:"source" json:"source"`
+	MaxWindKt int       `bson:"max_wind_kt" json:"max_wind_kt"`
+	MinPresMb int       `bson:"min_pressure_mb,omitempty" json:"min_pressure_mb,omitempty"`
+	LastFix   time.Time `bson:"last_fix" json:"last_fix"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// StormPosition is a best-track fix (Kind "best") or an official forecast point
+// (Kind "forecast") issued at Issued for Tau hours ahead.
+type StormPosition struct {
+	StormID    string    `bson:"storm_id" json:"storm_id"`
+	Kind       string    `bson:"kind" json:"kind"`
+	Issued     time.Time `bson:"issued" json:"issued"`
+	Tau        int       `bson:"tau" json:"tau"`
+	Time       time.Time `bson:"time" json:"time"`
+	Lat        float64   `bson:"lat" json:"lat"`
+	Lon        float64   `bson:"lon" json:"lon"`
+	WindKt     int       `bson:"wind_kt" json:"wind_kt"`
+	PressureMb int       `bson:"pressure_mb,omitempty" json:"pressure_mb,omitempty"`
+	Status     string    `bson:"status,omitempty" json:"status,omitempty"`
+}
+
+type StormProximity struct {
+	City       string  `json:"city"`
+	StormID    string  `json:"storm_id"`
+	StormName  string  `json:"storm_name,omitempty"`
+	Tau        int     `json:"tau"`
+	DistanceKm float64 `json:"distance_km"`
+	ConeKm     float64 `json:"cone_radius_km"`
+}
+
+const (
+	positionBest     = "best"
+	positionForecast = "forecast"
+	nauticalMileKm   = 1.852
+	earthRadiusKm    = 6371.0
+)
+
+// coneRadiiNM are NHC Atlantic track-error cone radii by forecast hour.
+var coneRadiiNM = []struct {
+	Tau    int
+	Radius float64
+}{
+	{0, 0}, {12, 26}, {24, 41}, {36, 55}, {48, 70}, {60, 88}, {72, 102}, {96, 151}, {120, 220},
+}
+
+var (
+	stormsCollection         *mongo.Collection
+	stormPositionsCollection *mongo.Collection
+)
+
+// parseHURDAT2 reads best-track data in the NHC HURDAT2 format: a header line per
+// storm ("AL092011, IRENE, 39,") followed by that many fix lines.
+func parseHURDAT2(r io.Reader) ([]Storm, []StormPosition, error) {
+	var storms []Storm
+	var positions []StormPosition
+	scanner := bufio.NewScanner(r)
+	line := 0
+	var current *Storm
+
+	for scanner.Scan() {
+		line++
+		fields := splitFields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) <= 4 && len(fields[0]) == 8 {
+			storm, err := stormFromID(fields[0])
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			if len(fields) > 1 && fields[1] != "UNNAMED" {
+				storm.Name = fields[1]
+			}
+			storm.Source = "hurdat2"
+			storms = append(storms, storm)
+			current = &storms[len(storms)-1]
+			continue
+		}
+		if current == nil || len(fields) < 8 {
+			return nil, nil, fmt.Errorf("line %d: fix without a storm header", line)
+		}
+
+		at, err := time.Parse("20060102 1504", fields[0]+" "+fields[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: bad time: %w", line, err)
+		}
+		lat, errLat := parseCoord(fields[4], 1)
+		lon, errLon := parseCoord(fields[5], 1)
+		if errLat != nil || errLon != nil {
+			return nil, nil, fmt.Errorf("line %d: bad position", line)
+		}
+		wind, _ := strconv.Atoi(fields[6])
+		pressure, _ := strconv.Atoi(fields[7])
+		if pressure < 0 {
+			pressure = 0
+		}
+		positions = append(positions, StormPosition{
+			StormID:    current.ID,
+			Kind:       positionBest,
+			Issued:     at,
+			Time:       at,
+			Lat:        lat,
+			Lon:        lon,
+			WindKt:     wind,
+			PressureMb: pressure,
+			Status:     fields[3],
+		})
+	}
+	return storms, positions, scanner.Err()
+}
+
+// parseATCF reads ATCF a-deck/b-deck lines. BEST lines become best-track fixes and
+// OFCL lines become official forecast points; other aids are ignored.
+func parseATCF(r io.Reader) ([]Storm, []StormPosition, error) {
+	type atcfLine struct {
+		line   int
+		fields []string
+		number int
+		issued time.Time
+	}
+	var lines []atcfLine
+	// A storm keeps the year it formed in as its ID, so fixes in January belong
+	// to the previous year's storm of the same number if that one had December fixes
+	december := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := splitFields(scanner.Text())
+		if len(fields) < 10 || (fields[4] != "BEST" && fields[4] != "OFCL") {
+			continue
+		}
+		number, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: bad cyclone number", line)
+		}
+		issued, err := time.Parse("2006010215", fields[2])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: bad time: %w", line, err)
+		}
+		if issued.Month() == time.December {
+			december[fmt.Sprintf("%s%02d%d", strings.ToUpper(fields[0]), number, issued.Year())] = true
+		}
+		lines = append(lines, atcfLine{line, fields, number, issued})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	stormsByID := map[string]*Storm{}
+	var positions []StormPosition
+	seen := map[string]bool{}
+	for _, l := range lines {
+		fields, tech := l.fields, l.fields[4]
+		basin := strings.ToUpper(fields[0])
+		year := l.issued.Year()
+		if l.issued.Month() <= time.February && december[fmt.Sprintf("%s%02d%d", basin, l.number, year-1)] {
+			year--
+		}
+		id := fmt.Sprintf("%s%02d%d", basin, l.number, year)
+		storm, ok := stormsByID[id]
+		if !ok {
+			s, err := stormFromID(id)
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %w", l.line, err)
+			}
+			s.Source = "atcf"
+			storm = &s
+			stormsByID[id] = storm
+		}
+		if len(fields) > 27 && fields[27] != "" && !strings.HasPrefix(fields[27], "INVEST") {
+			storm.Name = fields[27]
+		}
+
+		tau, _ := strconv.Atoi(fields[5])
+		lat, errLat := parseCoord(fields[6], 10)
+		lon, errLon := parseCoord(fields[7], 10)
+		if errLat != nil || errLon != nil {
+			return nil, nil, fmt.Errorf("line %d: bad position", l.line)
+		}
+		// Wind radii repeat each fix once per threshold (34/50/64 kt); keep the first
+		key := fmt.Sprintf("%s|%s|%s|%d", id, tech, fields[2], tau)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		wind, _ := strconv.Atoi(fields[8])
+		pressure, _ := strconv.Atoi(fields[9])
+		position := StormPosition{
+			StormID:    id,
+			Kind:       positionBest,
+			Issued:     l.issued,
+			Tau:        tau,
+			Time:       l.issued.Add(time.Duration(tau) * time.Hour),
+			Lat:        lat,
+			Lon:        lon,
+			WindKt:     wind,
+			PressureMb: pressure,
+		}
+		if len(fields) > 10 {
+			position.Status = fields[10]
+		}
+		if tech == "OFCL" {
+			position.Kind = positionForecast
+		}
+		positions = append(positions, position)
+	}
+
+	storms := make([]Storm, 0, len(stormsByID))
+	for _, storm := range stormsByID {
+		storms = append(storms, *storm)
+	}
+	sort.Slice(storms, func(i, j int) bool { return storms[i].ID < storms[j].ID })
+	return storms, positions, nil
+}
+
+func splitFields(line string) []string {
+	parts := strings.Split(strings.TrimSpace(line), ",")
+	fields := make([]string, 0, len(parts))
+	for _, part := range parts {
+		fields = append(fields, strings.TrimSpace(part))
+	}
+	for len(fields) > 0 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	return fields
+}
+
+func stormFromID(id string) (Storm, error) {
+	if len(id) != 8 {
+		return Storm{}, fmt.Errorf("bad storm id %q", id)
+	}
+	number, errNum := strconv.Atoi(id[2:4])
+	year, errYear := strconv.Atoi(id[4:])
+	if errNum != nil || errYear != nil {
+		return Storm{}, fmt.Errorf("bad storm id %q", id)
+	}
+	return Storm{ID: strings.ToUpper(id), Basin: strings.ToUpper(id[:2]), Number: number, Year: year}, nil
+}
+
+// parseCoord parses "15.0N" (scale 1) or "150N" (scale 10, tenths of a degree).
+func parseCoord(s string, scale float64) (float64, error) {
+	if len(s) < 2 {
+		return 0, fmt.Errorf("bad coordinate %q", s)
+	}
+	value, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	if err != nil {
+		return 0, err
+	}
+	value /= scale
+	switch s[len(s)-1] {
+	case 'N', 'S':
+		if value > 90 {
+			return 0, fmt.Errorf("bad latitude %q", s)
+		}
+		if s[len(s)-1] == 'S' {
+			value = -value
+		}
+		return value, nil
+	case 'E':
+		return normalizeLon(value), nil
+	case 'W':
+		return normalizeLon(-value), nil
+	}
+	return 0, fmt.Errorf("bad hemisphere in %q", s)
+}
+
+// normalizeLon maps a longitude into [-180, 180), so "185.0W" becomes 175 E.
+func normalizeLon(lon float64) float64 {
+	lon = math.Mod(lon+180, 360)
+	if lon < 0 {
+		lon += 360
+	}
+	return lon - 180
+}
+
+// readStormSource reads a local file or, for http(s) sources, downloads it.
+func readStormSource(source string) ([]byte, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		response, err := providerClient.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("download failed: status %d", response.StatusCode)
+		}
+		return io.ReadAll(response.Body)
+	}
+	return os.ReadFile(source)
+}
+
+// ingestStorms parses source as HURDAT2 or ATCF, detected from its first line,
+// and upserts the storms and their positions.
+func ingestStorms(ctx context.Context, source string) (int, int, error) {
+	raw, err := readStormSource(source)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read %s: %w", source, err)
+	}
+
+	firstLine := strings.SplitN(strings.TrimSpace(string(raw)), "\n", 2)[0]
+	var storms []Storm
+	var positions []StormPosition
+	if len(splitFields(firstLine)) <= 4 {
+		storms, positions, err = parseHURDAT2(strings.NewReader(string(raw)))
+	} else {
+		storms, positions, err = parseATCF(strings.NewReader(string(raw)))
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse %s: %w", source, err)
+	}
+
+	for _, p := range positions {
+		filter := bson.M{"storm_id": p.StormID, "kind": p.Kind, "issued": p.Issued, "tau": p.Tau}
+		if _, err := stormPositionsCollection.ReplaceOne(ctx, filter, p, options.Replace().SetUpsert(true)); err != nil {
+			return 0, 0, fmt.Errorf("failed to store position: %w", err)
+		}
+	}
+
+	now := time.Now()
+	for _, storm := range storms {
+		if err := refreshStormSummary(ctx, &storm, now); err != nil {
+			return 0, 0, err
+		}
+	}
+	return len(storms), len(positions), nil
+}
+
+// refreshStormSummary recomputes the storm's peak intensity and last fix from all
+// stored best-track positions, keeping a previously ingested name.
+func refreshStormSummary(ctx context.Context, storm *Storm, now time.Time) error {
+	var existing Storm
+	if err := stormsCollection.FindOne(ctx, bson.M{"_id": storm.ID}).Decode(&existing); err == nil && storm.Name == "" {
+		storm.Name = existing.Name
+	}
+
+	cursor, err := stormPositionsCollection.Find(ctx, bson.M{"storm_id": storm.ID, "kind": positionBest})
+	if err != nil {
+		return fmt.Errorf("failed to load positions: %w", err)
+	}
+	var fixes []StormPosition
+	if err := cursor.All(ctx, &fixes); err != nil {
+		return fmt.Errorf("failed to load positions: %w", err)
+	}
+	for _, fix := range fixes {
+		if fix.WindKt > storm.MaxWindKt {
+			storm.MaxWindKt = fix.WindKt
+		}
+		if fix.PressureMb > 0 && (storm.MinPresMb == 0 || fix.PressureMb < storm.MinPresMb) {
+			storm.MinPresMb = fix.PressureMb
+		}
+		if fix.Time.After(storm.LastFix) {
+			storm.LastFix = fix.Time
+		}
+	}
+	storm.UpdatedAt = now
+
+	_, err = stormsCollection.ReplaceOne(ctx, bson.M{"_id": storm.ID}, storm, options.Replace().SetUpsert(true))
+	return err
+}
+
+// latestForecast returns the most recently issued official forecast for a storm.
+func latestForecast(ctx context.Context, stormID string) ([]StormPosition, error) {
+	var newest StormPosition
+	opts := options.FindOne().SetSort(bson.M{"issued": -1})
+	err := stormPositionsCollection.FindOne(ctx, bson.M{"storm_id": stormID, "kind": positionForecast}, opts).Decode(&newest)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := stormPositionsCollection.Find(ctx, bson.M{"storm_id": stormID, "kind": positionForecast, "issued": newest.Issued}, options.Find().SetSort(bson.M{"tau": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var forecast []StormPosition
+	err = cursor.All(ctx, &forecast)
+	return forecast, err
+}
+
+func coneRadiusKm(tau float64) float64 {
+	radii := coneRadiiNM
+	if tau >= float64(radii[len(radii)-1].Tau) {
+		return radii[len(radii)-1].Radius * nauticalMileKm
+	}
+	for i := 1; i < len(radii); i++ {
+		if tau <= float64(radii[i].Tau) {
+			lo, hi := radii[i-1], radii[i]
+			f := (tau - float64(lo.Tau)) / float64(hi.Tau-lo.Tau)
+			return (lo.Radius + f*(hi.Radius-lo.Radius)) * nauticalMileKm
+		}
+	}
+	return 0
+}
+
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// inCone reports whether the point lies within the forecast cone: the union of
+// circles along the forecast track, interpolated hourly between forecast points.
+// Tracks crossing the antimeridian are interpolated the short way round.
+func inCone(forecast []StormPosition, lat, lon float64) (bool, int, float64, float64) {
+	for i := 1; i < len(forecast); i++ {
+		a, b := forecast[i-1], forecast[i]
+		for tau := a.Tau; tau <= b.Tau; tau++ {
+			f := 0.0
+			if b.Tau > a.Tau {
+				f = float64(tau-a.Tau) / float64(b.Tau-a.Tau)
+			}
+			dLon := b.Lon - a.Lon
+			if dLon > 180 {
+				dLon -= 360
+			} else if dLon < -180 {
+				dLon += 360
+			}
+			pLat := a.Lat + f*(b.Lat-a.Lat)
+			pLon := normalizeLon(a.Lon + f*dLon)
+			distance := haversineKm(pLat, pLon, lat, lon)
+			radius := coneRadiusKm(float64(tau))
+			if distance <= radius {
+				return true, tau, distance, radius
+			}
+		}
+	}
+	return false, 0, 0, 0
+}
+
+func stormsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{}
+	if year, err := strconv.Atoi(r.URL.Query().Get("year")); err == nil {
+		filter["year"] = year
+	}
+	if basin := r.URL.Query().Get("basin"); basin != "" {
+		filter["basin"] = strings.ToUpper(basin)
+	}
+	cursor, err := stormsCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"last_fix": -1}).SetLimit(500))
+	if err != nil {
+		http.Error(w, "Failed to load storms", http.StatusInternalServerError)
+		return
+	}
+	storms := []Storm{}
+	if err := cursor.All(ctx, &storms); err != nil {
+		http.Error(w, "Failed to load storms", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(storms)
+}
+
+func stormHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/storms/"))
+	if id == "PROXIMITY" {
+		stormProximityHandler(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var storm Storm
+	if err := stormsCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&storm); err != nil {
+		http.Error(w, "Storm not found", http.StatusNotFound)
+		return
+	}
+	cursor, err := stormPositionsCollection.Find(ctx, bson.M{"storm_id": id, "kind": positionBest}, options.Find().SetSort(bson.M{"time": 1}))
+	if err != nil {
+		http.Error(w, "Failed to load storm track", http.StatusInternalServerError)
+		return
+	}
+	track := []StormPosition{}
+	if err := cursor.All(ctx, &track); err != nil {
+		http.Error(w, "Failed to load storm track", http.StatusInternalServerError)
+		return
+	}
+	forecast, err := latestForecast(ctx, id)
+	if err != nil {
+		http.Error(w, "Failed to load storm forecast", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Storm
+		Track    []StormPosition `json:"track"`
+		Forecast []StormPosition `json:"forecast"`
+	}{Storm: storm, Track: track, Forecast: forecast}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// stormProximityHandler lists tracked locations inside the latest forecast cone of
+// recently active storms (or of ?storm=ID).
+func stormProximityHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"last_fix": bson.M{"$gte": time.Now().Add(-72 * time.Hour)}}
+	if id := r.URL.Query().Get("storm"); id != "" {
+		filter = bson.M{"_id": strings.ToUpper(id)}
+	}
+	cursor, err := stormsCollection.Find(ctx, filter)
+	if err != nil {
+		http.Error(w, "Failed to load storms", http.StatusInternalServerError)
+		return
+	}
+	var storms []Storm
+	if err := cursor.All(ctx, &storms); err != nil {
+		http.Error(w, "Failed to load storms", http.StatusInternalServerError)
+		return
+	}
+
+	cursor, err = weatherCollection.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"city": 1, "lat": 1, "lon": 1}))
+	if err != nil {
+		http.Error(w, "Failed to load locations", http.StatusInternalServerError)
+		return
+	}
+	var locations []WeatherData
+	if err := cursor.All(ctx, &locations); err != nil {
+		http.Error(w, "Failed to load locations", http.StatusInternalServerError)
+		return
+	}
+
+	flagged := []StormProximity{}
+	for _, storm := range storms {
+		forecast, err := latestForecast(ctx, storm.ID)
+		if err != nil {
+			http.Error(w, "Failed to load storm forecast", http.StatusInternalServerError)
+			return
+		}
+		for _, loc := range locations {
+			if loc.Lat == 0 && loc.Lon == 0 {
+				continue
+			}
+			if ok, tau, distance, radius := inCone(forecast, loc.Lat, loc.Lon); ok {
+				flagged = append(flagged, StormProximity{
+					City:       loc.City,
+					StormID:    storm.ID,
+					StormName:  storm.Name,
+					Tau:        tau,
+					DistanceKm: math.Round(distance),
+					ConeKm:     math.Round(radius),
+				})
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flagged)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+const hurdat2Sample = `AL092011,              IRENE,      3,
+20110821, 0000,  , TS, 15.0N,  59.0W,  45, 1006,
+20110821, 0600,  , TS, 16.0N,  60.6W,  45, 1006,
+20110828, 1200, L, TS, 40.6N,  73.8W,  55,  965,
+EP012015,            UNNAMED,      1,
+20150528, 1200,  , TD, 10.5N, 109.0W,  30, -999,
+`
+
+func TestParseHURDAT2(t *testing.T) {
+	storms, positions, err := parseHURDAT2(strings.NewReader(hurdat2Sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(storms) != 2 || len(positions) != 4 {
+		t.Fatalf("got %d storms and %d positions, want 2 and 4", len(storms), len(positions))
+	}
+	irene := storms[0]
+	if irene.ID != "AL092011" || irene.Basin != "AL" || irene.Number != 9 || irene.Year != 2011 || irene.Name != "IRENE" {
+		t.Errorf("unexpected storm %+v", irene)
+	}
+	if storms[1].Name != "" {
+		t.Errorf("UNNAMED storm got name %q", storms[1].Name)
+	}
+
+	landfall := positions[2]
+	want := StormPosition{StormID: "AL092011", Kind: positionBest, Lat: 40.6, Lon: -73.8, WindKt: 55, PressureMb: 965, Status: "TS"}
+	want.Time = time.Date(2011, 8, 28, 12, 0, 0, 0, time.UTC)
+	want.Issued = want.Time
+	if landfall != want {
+		t.Errorf("got %+v, want %+v", landfall, want)
+	}
+	if positions[3].PressureMb != 0 {
+		t.Errorf("missing pressure -999 stored as %d", positions[3].PressureMb)
+	}
+}
+
+func TestParseHURDAT2FixWithoutHeader(t *testing.T) {
+	if _, _, err := parseHURDAT2(strings.NewReader("20110821, 0000,  , TS, 15.0N,  59.0W,  45, 1006,\n")); err == nil {
+		t.Fatal("expected an error for a fix before any storm header")
+	}
+}
+
+// Zeta formed on 30 December 2005 and lasted into January 2006; ATCF keeps
+// calling it AL302005.
+const atcfYearCrossing = `AL, 30, 2005123018,   , BEST,   0, 235N,  384W,  45,  997, TS,  34, NEQ,  100,    0,    0,    0, 1010,  200,  30,   0,   0,   L,   0,    ,   0,   0,       ZETA,
+AL, 30, 2005123018,   , BEST,   0, 235N,  384W,  45,  997, TS,  50, NEQ,    0,    0,    0,    0, 1010,  200,  30,   0,   0,   L,   0,    ,   0,   0,       ZETA,
+AL, 30, 2006010500,   , BEST,   0, 228N,  530W,  30, 1008, TD,   0,    ,    0,    0,    0,    0, 1012,  150,  40,   0,   0,   L,   0,    ,   0,   0,       ZETA,
+AL, 30, 2006010500, 03, OFCL,  12, 230N,  545W,  25,    0, LO,   0,    ,    0,    0,    0,    0,     ,     ,    ,    ,    ,    ,    ,    ,    ,    ,       ZETA,
+AL, 01, 2006061018,   , BEST,   0, 200N,  860W,  30, 1005, TD,   0,    ,    0,    0,    0,    0, 1010,  150,  40,   0,   0,   L,   0,    ,   0,   0,    INVEST,
+`
+
+func TestParseATCF(t *testing.T) {
+	storms, positions, err := parseATCF(strings.NewReader(atcfYearCrossing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(storms) != 2 {
+		t.Fatalf("got storms %+v, want AL012006 and AL302005", storms)
+	}
+	if storms[0].ID != "AL012006" || storms[0].Name != "" {
+		t.Errorf("unexpected storm %+v", storms[0])
+	}
+	if storms[1].ID != "AL302005" || storms[1].Year != 2005 || storms[1].Name != "ZETA" {
+		t.Errorf("unexpected storm %+v", storms[1])
+	}
+
+	// The 50 kt wind radii line repeats the first fix
+	if len(positions) != 4 {
+		t.Fatalf("got %d positions, want 4", len(positions))
+	}
+	for _, p := range positions[:3] {
+		if p.StormID != "AL302005" {
+			t.Errorf("position at %s filed under %s", p.Time, p.StormID)
+		}
+	}
+	forecast := positions[2]
+	if forecast.Kind != positionForecast || forecast.Tau != 12 || !forecast.Time.Equal(time.Date(2006, 1, 5, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected forecast point %+v", forecast)
+	}
+	if forecast.Lat != 23.0 || forecast.Lon != -54.5 {
+		t.Errorf("got position %v,%v, want 23.0,-54.5", forecast.Lat, forecast.Lon)
+	}
+}
+
+func TestParseCoord(t *testing.T) {
+	tests := []struct {
+		in    string
+		scale float64
+		want  float64
+		err   bool
+	}{
+		{"15.0N", 1, 15, false},
+		{"59.0W", 1, -59, false},
+		{"235S", 10, -23.5, false},
+		{"1795E", 10, 179.5, false},
+		{"1795W", 10, -179.5, false},
+		{"1850W", 10, 175, false},
+		{"950N", 10, 0, true},
+		{"15.0X", 1, 0, true},
+		{"N", 1, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCoord(tt.in, tt.scale)
+		if (err != nil) != tt.err {
+			t.Errorf("parseCoord(%q): err = %v", tt.in, err)
+			continue
+		}
+		if !tt.err && math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("parseCoord(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestInConeAcrossAntimeridian(t *testing.T) {
+	forecast := []StormPosition{
+		{Tau: 0, Lat: 20, Lon: 179},
+		{Tau: 12, Lat: 20, Lon: -179},
+	}
+	// The track passes over 180°, not back across the Atlantic
+	if ok, tau, _, _ := inCone(forecast, 20, 180); !ok || tau > 6 {
+		t.Errorf("point on the track: got in=%v tau=%d", ok, tau)
+	}
+	if ok, _, _, _ := inCone(forecast, 20, 0); ok {
+		t.Error("point on the prime meridian reported inside the cone")
+	}
+}
+
+func TestNormalizeLon(t *testing.T) {
+	for in, want := range map[float64]float64{0: 0, 179.5: 179.5, 180: -180, 185: -175, -185: 175, 360: 0, -540: -180} {
+		if got := normalizeLon(in); got != want {
+			t.Errorf("normalizeLon(%v) = %v, want %v", in, got, want)
+		}
+	}
+}
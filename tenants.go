@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Tenant holds a team's branding and defaults for the HTML UI and widget.
+type Tenant struct {
+	ID        string       `bson:"_id" json:"id"`
+	Name      string       `bson:"name" json:"name"`
+	LogoURL   string       `bson:"logo_url,omitempty" json:"logo_url,omitempty"`
+	Colors    TenantColors `bson:"colors" json:"colors"`
+	Units     string       `bson:"units,omitempty" json:"units,omitempty"`
+	Language  string       `bson:"language,omitempty" json:"language,omitempty"`
+	Cities    []string     `bson:"cities,omitempty" json:"cities,omitempty"`
+	Footer    string       `bson:"footer,omitempty" json:"footer,omitempty"`
+	UpdatedAt time.Time    `bson:"updated_at" json:"updated_at"`
+}
+
+type TenantColors struct {
+	Primary    string `bson:"primary,omitempty" json:"primary,omitempty"`
+	Background string `bson:"background,omitempty" json:"background,omitempty"`
+	Text       string `bson:"text,omitempty" json:"text,omitempty"`
+}
+
+const maxTenantCities = 50
+
+var tenantsCollection *mongo.Collection
+
+// defaultTenant is used when a request names no tenant, and fills in whatever a
+// tenant leaves unset.
+var defaultTenant = Tenant{
+	Name:     "Weather",
+	Colors:   TenantColors{Primary: "#2b6cb0", Background: "#ffffff", Text: "#1a202c"},
+	Units:    "metric",
+	Language: "en",
+}
+
+var (
+	tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+	// Colors are interpolated into CSS, so only hex colors are accepted
+	hexColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+)
+
+func (t Tenant) validate() error {
+	if !tenantIDPattern.MatchString(t.ID) {
+		return fmt.Errorf("id must be lowercase letters, digits, - or _")
+	}
+	for name, color := range map[string]string{"primary": t.Colors.Primary, "background": t.Colors.Background, "text": t.Colors.Text} {
+		if color != "" && !hexColorPattern.MatchString(color) {
+			return fmt.Errorf("colors.%s must be a hex color like #1a2b3c", name)
+		}
+	}
+	if t.Units != "" {
+		if _, ok := responseVariant("json", t.Units); !ok {
+			return fmt.Errorf("units must be metric, imperial or standard")
+		}
+	}
+	if t.Language != "" {
+		if _, ok := uiLabels[t.Language]; !ok {
+			return fmt.Errorf("language %q is not supported", t.Language)
+		}
+	}
+	if t.LogoURL != "" {
+		u, err := url.Parse(t.LogoURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("logo_url must be an http(s) URL")
+		}
+	}
+	if len(t.Cities) > maxTenantCities {
+		return fmt.Errorf("at most %d default cities", maxTenantCities)
+	}
+	return nil
+}
+
+// withDefaults fills unset branding from defaultTenant.
+func (t Tenant) withDefaults() Tenant {
+	if t.Name == "" {
+		t.Name = defaultTenant.Name
+	}
+	if t.Colors.Primary == "" {
+		t.Colors.Primary = defaultTenant.Colors.Primary
+	}
+	if t.Colors.Background == "" {
+		t.Colors.Background = defaultTenant.Colors.Background
+	}
+	if t.Colors.Text == "" {
+		t.Colors.Text = defaultTenant.Colors.Text
+	}
+	if t.Units == "" {
+		t.Units = defaultTenant.Units
+	}
+	if t.Language == "" {
+		t.Language = defaultTenant.Language
+	}
+	return t
+}
+
+// requestTenant loads the tenant named by ?tenant= or X-Tenant, with defaults
+// applied. Requests naming no tenant get defaultTenant.
+func requestTenant(ctx context.Context, r *http.Request) (Tenant, error) {
+	id := r.URL.Query().Get("tenant")
+	if id == "" {
+		id = r.Header.Get("X-Tenant")
+	}
+	if id == "" {
+		return defaultTenant, nil
+	}
+	var tenant Tenant
+	if err := tenantsCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&tenant); err != nil {
+		return Tenant{}, err
+	}
+	return tenant.withDefaults(), nil
+}
+
+// tenantsHandler lists tenants (GET /admin/tenants).
+func tenantsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cursor, err := tenantsCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		http.Error(w, "Failed to load tenants", http.StatusInternalServerError)
+		return
+	}
+	tenants := []Tenant{}
+	if err := cursor.All(ctx, &tenants); err != nil {
+		http.Error(w, "Failed to load tenants", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tenants)
+}
+
+// tenantHandler reads, replaces or deletes one tenant at /admin/tenants/{id}.
+func tenantHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/admin/tenants/")
+	if id == "" || strings.Contains(id, "/") {
+		http.Error(w, "Tenant not found", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		var tenant Tenant
+		err := tenantsCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&tenant)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Tenant not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to load tenant", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tenant)
+	case http.MethodPut:
+		var tenant Tenant
+		if err := json.NewDecoder(r.Body).Decode(&tenant); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		tenant.ID = id
+		if err := tenant.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tenant.UpdatedAt = time.Now()
+		if _, err := tenantsCollection.ReplaceOne(ctx, bson.M{"_id": id}, tenant, options.Replace().SetUpsert(true)); err != nil {
+			http.Error(w, "Failed to save tenant", http.StatusInternalServerError)
+			return
+		}
+		writeAudit(ctx, AuditEntry{Actor: requestActor(r), Note: requestNote(r), Action: "tenant.update", Detail: id})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tenant)
+	case http.MethodDelete:
+		result, err := tenantsCollection.DeleteOne(ctx, bson.M{"_id": id})
+		if err != nil {
+			http.Error(w, "Failed to delete tenant", http.StatusInternalServerError)
+			return
+		}
+		if result.DeletedCount == 0 {
+			http.Error(w, "Tenant not found", http.StatusNotFound)
+			return
+		}
+		writeAudit(ctx, AuditEntry{Actor: requestActor(r), Note: requestNote(r), Action: "tenant.delete", Detail: id})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTenantValidate(t *testing.T) {
+	valid := Tenant{ID: "team-a", Colors: TenantColors{Primary: "#1a2b3c", Background: "#FFF"}, Units: "imperial", Language: "de", LogoURL: "https://example.com/logo.png"}
+	if err := valid.validate(); err != nil {
+		t.Fatalf("valid tenant rejected: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Tenant)
+		want   string
+	}{
+		{"uppercase id", func(t *Tenant) { t.ID = "Team" }, "id"},
+		{"empty id", func(t *Tenant) { t.ID = "" }, "id"},
+		{"named color", func(t *Tenant) { t.Colors.Primary = "red" }, "colors.primary"},
+		{"css injection", func(t *Tenant) { t.Colors.Background = "#fff; } body { display: none" }, "colors.background"},
+		{"css expression", func(t *Tenant) { t.Colors.Text = "url(https://evil.example/x)" }, "colors.text"},
+		{"four hex digits", func(t *Tenant) { t.Colors.Text = "#abcd" }, "colors.text"},
+		{"hex without hash", func(t *Tenant) { t.Colors.Primary = "1a2b3c" }, "colors.primary"},
+		{"units", func(t *Tenant) { t.Units = "furlongs" }, "units"},
+		{"language", func(t *Tenant) { t.Language = "xx" }, "language"},
+		{"logo scheme", func(t *Tenant) { t.LogoURL = "javascript:alert(1)" }, "logo_url"},
+		{"logo without host", func(t *Tenant) { t.LogoURL = "https:///logo.png" }, "logo_url"},
+		{"too many cities", func(t *Tenant) { t.Cities = make([]string, maxTenantCities+1) }, "cities"},
+	}
+	for _, tt := range tests {
+		tenant := valid
+		tt.change(&tenant)
+		err := tenant.validate()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want one about %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestTenantWithDefaults(t *testing.T) {
+	got := Tenant{ID: "team-a", Colors: TenantColors{Primary: "#000"}, Language: "fr"}.withDefaults()
+	want := Tenant{ID: "team-a", Name: defaultTenant.Name, Units: defaultTenant.Units, Language: "fr",
+		Colors: TenantColors{Primary: "#000", Background: defaultTenant.Colors.Background, Text: defaultTenant.Colors.Text}}
+	if got.ID != want.ID || got.Name != want.Name || got.Units != want.Units || got.Language != want.Language || got.Colors != want.Colors {
+		t.Errorf("withDefaults = %+v, want %+v", got, want)
+	}
+
+	if got := defaultTenant.withDefaults(); got.Name != defaultTenant.Name || got.Colors != defaultTenant.Colors {
+		t.Errorf("defaultTenant.withDefaults changed it: %+v", got)
+	}
+}
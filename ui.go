@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// uiLabels translates the fixed text of the HTML UI and widget. Condition
+// descriptions come from the providers and are shown as they are.
+var uiLabels = map[string]map[string]string{
+	"en": {"temperature": "Temperature", "wind": "Wind", "precipitation": "Precipitation", "updated": "Updated", "conditions": "Conditions", "city": "City", "empty": "No cities to show."},
+	"de": {"temperature": "Temperatur", "wind": "Wind", "precipitation": "Niederschlag", "updated": "Aktualisiert", "conditions": "Wetterlage", "city": "Ort", "empty": "Keine Orte vorhanden."},
+	"fr": {"temperature": "Température", "wind": "Vent", "precipitation": "Précipitations", "updated": "Mis à jour", "conditions": "Conditions", "city": "Ville", "empty": "Aucune ville à afficher."},
+	"es": {"temperature": "Temperatura", "wind": "Viento", "precipitation": "Precipitación", "updated": "Actualizado", "conditions": "Condiciones", "city": "Ciudad", "empty": "No hay ciudades para mostrar."},
+}
+
+var unitSymbols = map[string]struct{ Temp, Wind string }{
+	"metric":   {"°C", "m/s"},
+	"imperial": {"°F", "mph"},
+	"standard": {"K", "m/s"},
+}
+
+type uiPage struct {
+	Tenant Tenant
+	Labels map[string]string
+	Temp   string
+	Wind   string
+	Cities []WeatherData
+	Widget bool
+}
+
+// uiCities returns the ?city= cities if given, else the tenant's default set, else
+// the tenant's own cities, converted to the tenant's units.
+func uiCities(ctx context.Context, r *http.Request, tenant Tenant, widget bool) ([]WeatherData, error) {
+	filter := uiCityFilter(r.URL.Query(), tenant, widget)
+	opts := options.Find().SetSort(bson.M{"city": 1}).SetLimit(maxTenantCities)
+	cursor, err := weatherCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var cities []WeatherData
+	if err := cursor.All(ctx, &cities); err != nil {
+		return nil, err
+	}
+	for i := range cities {
+		cities[i] = convertUnits(cities[i], tenant.Units)
+	}
+	return cities, nil
+}
+
+// uiCityFilter selects the cities uiCities shows. The widget shows one city: the
+// first one asked for, else the tenant's first default city.
+func uiCityFilter(query url.Values, tenant Tenant, widget bool) bson.M {
+	filter := bson.M{}
+	requested := query["city"]
+	switch {
+	case widget && len(requested) > 0:
+		filter["city"] = requested[0]
+	case len(requested) > 0:
+		filter["city"] = bson.M{"$in": requested}
+	case widget && len(tenant.Cities) > 0:
+		filter["city"] = tenant.Cities[0]
+	case len(tenant.Cities) > 0:
+		filter["city"] = bson.M{"$in": tenant.Cities}
+	case tenant.ID != "":
+		filter["tenant"] = tenant.ID
+	}
+	return filter
+}
+
+func renderUI(w http.ResponseWriter, r *http.Request, widget bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The tenant may come from a header, so caches must not share pages across it
+	w.Header().Set("Vary", "X-Tenant")
+	tenant, err := requestTenant(ctx, r)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Tenant not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to load tenant", http.StatusInternalServerError)
+		return
+	}
+	cities, err := uiCities(ctx, r, tenant, widget)
+	if err != nil {
+		http.Error(w, "Failed to retrieve weather data", http.StatusInternalServerError)
+		return
+	}
+	if widget && len(cities) > 1 {
+		cities = cities[:1]
+	}
+
+	units := unitSymbols[tenant.Units]
+	page := uiPage{Tenant: tenant, Labels: uiLabels[tenant.Language], Temp: units.Temp, Wind: units.Wind, Cities: cities, Widget: widget}
+
+	var buf bytes.Buffer
+	if err := uiTemplate.Execute(&buf, page); err != nil {
+		log.Println("Failed to render UI:", err)
+		http.Error(w, "Failed to render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", tenant.Language)
+	if widget {
+		// The widget is meant to be embedded in other teams' pages
+		w.Header().Set("Content-Security-Policy", "frame-ancestors *")
+		w.Header().Set("Cache-Control", "max-age=60")
+	}
+	w.Write(buf.Bytes())
+}
+
+// uiHandler serves the HTML overview of current conditions (GET /ui).
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+	renderUI(w, r, false)
+}
+
+// widgetHandler serves a compact card for one city to embed in an iframe
+// (GET /widget?city=). Without ?city= it shows the tenant's first default city.
+func widgetHandler(w http.ResponseWriter, r *http.Request) {
+	renderUI(w, r, true)
+}
+
+var uiTemplate = template.Must(template.New("ui").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04 UTC") },
+}).Parse(`<!DOCTYPE html>
+<html lang="{{.Tenant.Language}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Tenant.Name}}</title>
+<style>
+body { margin: 0; padding: 1em; font-family: sans-serif; background: {{.Tenant.Colors.Background}}; color: {{.Tenant.Colors.Text}}; }
+header { display: flex; align-items: center; gap: 0.75em; border-bottom: 3px solid {{.Tenant.Colors.Primary}}; margin-bottom: 1em; }
+header img { max-height: 2.5em; }
+h1 { color: {{.Tenant.Colors.Primary}}; font-size: 1.4em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 0.8em; text-align: left; }
+th { color: {{.Tenant.Colors.Primary}}; }
+.card { border: 2px solid {{.Tenant.Colors.Primary}}; border-radius: 8px; padding: 0.8em; display: inline-block; }
+.card .temp { font-size: 2em; color: {{.Tenant.Colors.Primary}}; }
+footer { margin-top: 1em; font-size: 0.8em; }
+</style>
+</head>
+<body>
+{{- $page := .}}
+{{if .Widget}}
+{{range .Cities}}<div class="card">
+{{with $page.Tenant.LogoURL}}<img src="{{.}}" alt="" style="max-height:1.5em"> {{end}}<strong>{{.City}}</strong>
+<div class="temp">{{printf "%.1f" .Temp}} {{$page.Temp}}</div>
+<div>{{.Description}}</div>
+<div>{{index $page.Labels "wind"}}: {{printf "%.1f" .Wind}} {{$page.Wind}} · {{index $page.Labels "precipitation"}}: {{printf "%.1f" .Precip}} mm</div>
+</div>{{else}}<p>{{index .Labels "empty"}}</p>{{end}}
+{{else}}
+<header>{{with .Tenant.LogoURL}}<img src="{{.}}" alt="">{{end}}<h1>{{.Tenant.Name}}</h1></header>
+{{if .Cities}}<table>
+<tr><th>{{index .Labels "city"}}</th><th>{{index .Labels "conditions"}}</th><th>{{index .Labels "temperature"}}</th><th>{{index .Labels "wind"}}</th><th>{{index .Labels "precipitation"}}</th><th>{{index .Labels "updated"}}</th></tr>
+{{range .Cities}}<tr><td>{{.City}}</td><td>{{.Description}}</td><td>{{printf "%.1f" .Temp}} {{$page.Temp}}</td><td>{{printf "%.1f" .Wind}} {{$page.Wind}}</td><td>{{printf "%.1f" .Precip}} mm</td><td>{{time .LastUpdated}}</td></tr>
+{{end}}</table>{{else}}<p>{{index .Labels "empty"}}</p>{{end}}
+{{end}}
+{{with .Tenant.Footer}}<footer>{{.}}</footer>{{end}}
+</body>
+</html>
+`))
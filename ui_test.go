@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestUICityFilter(t *testing.T) {
+	requested := url.Values{"city": {"Paris", "Berlin"}}
+	tenant := Tenant{ID: "team-a", Cities: []string{"Oslo", "Bergen"}}
+	tests := []struct {
+		name   string
+		query  url.Values
+		tenant Tenant
+		widget bool
+		want   bson.M
+	}{
+		{"requested cities win", requested, tenant, false, bson.M{"city": bson.M{"$in": []string{"Paris", "Berlin"}}}},
+		{"widget shows the first requested", requested, tenant, true, bson.M{"city": "Paris"}},
+		{"tenant defaults", url.Values{}, tenant, false, bson.M{"city": bson.M{"$in": []string{"Oslo", "Bergen"}}}},
+		{"widget shows the first default", url.Values{}, tenant, true, bson.M{"city": "Oslo"}},
+		{"tenant's own cities", url.Values{}, Tenant{ID: "team-b"}, false, bson.M{"tenant": "team-b"}},
+		{"no tenant", url.Values{}, defaultTenant, false, bson.M{}},
+	}
+	for _, tt := range tests {
+		if got := uiCityFilter(tt.query, tt.tenant, tt.widget); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: filter = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// WebhookSubscription delivers matching events to URL. Filter narrows which
+// events are sent; Template, if set, is a text/template rendering the body from
+// a webhookPayload instead of the default JSON.
+type WebhookSubscription struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	URL         string             `bson:"url" json:"url"`
+	Secret      string             `bson:"secret,omitempty" json:"secret,omitempty"`
+	Events      []string           `bson:"events,omitempty" json:"events,omitempty"`
+	Filter      WebhookFilter      `bson:"filter" json:"filter"`
+	Template    string             `bson:"template,omitempty" json:"template,omitempty"`
+	ContentType string             `bson:"content_type,omitempty" json:"content_type,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+
+	LastDelivery time.Time `bson:"last_delivery,omitempty" json:"last_delivery,omitempty"`
+	LastStatus   int       `bson:"last_status,omitempty" json:"last_status,omitempty"`
+	LastError    string    `bson:"last_error,omitempty" json:"last_error,omitempty"`
+
+	tmpl *template.Template
+}
+
+// WebhookFilter matches events whose city is in Cities, has one of Tags and whose
+// condition category is one of Conditions; empty lists match everything. Owners
+// limits plan notices to the plans of those owners, and matches nothing else. The
+// Min* thresholds require a reading to differ from the city's previous one by at
+// least that much in any of the given variables, or ConditionChange to change
+// category.
+type WebhookFilter struct {
+	Cities          []string `bson:"cities,omitempty" json:"cities,omitempty"`
+	Tags            []string `bson:"tags,omitempty" json:"tags,omitempty"`
+	Conditions      []string `bson:"conditions,omitempty" json:"conditions,omitempty"`
+	Owners          []string `bson:"owners,omitempty" json:"owners,omitempty"`
+	MinTempChange   float64  `bson:"min_temp_change,omitempty" json:"min_temp_change,omitempty"`
+	MinWindChange   float64  `bson:"min_wind_change,omitempty" json:"min_wind_change,omitempty"`
+	MinPrecipChange float64  `bson:"min_precip_change,omitempty" json:"min_precip_change,omitempty"`
+	ConditionChange bool     `bson:"condition_change,omitempty" json:"condition_change,omitempty"`
+}
+
+// webhookPayload is what templates render and what is sent as JSON without one.
+type webhookPayload struct {
+	Event     string       `json:"event"`
+	City      string       `json:"city"`
+	Time      time.Time    `json:"time"`
+	Condition string       `json:"condition,omitempty"`
+	Owner     string       `json:"owner,omitempty"`
+	Current   *WeatherData `json:"current,omitempty"`
+	Previous  *WeatherData `json:"previous,omitempty"`
+	Change    *webhookDiff `json:"change,omitempty"`
+	Tags      []string     `json:"tags,omitempty"`
+	Payload   any          `json:"payload,omitempty"`
+}
+
+type webhookDiff struct {
+	Temp          float64 `json:"temp"`
+	Wind          float64 `json:"wind"`
+	Precip        float64 `json:"precip"`
+	ConditionFrom string  `json:"condition_from"`
+	ConditionTo   string  `json:"condition_to"`
+}
+
+// webhookDelivery is one body to post to sub, or, when pending is set, an event
+// still to be compared with the city's previous reading and matched against the
+// magnitude filters of subs.
+type webhookDelivery struct {
+	sub  *WebhookSubscription
+	body []byte
+
+	pending *webhookPayload
+	subs    []*WebhookSubscription
+}
+
+const (
+	webhookWorkers       = 4
+	webhookQueueSize     = 1000
+	webhookTimeout       = 10 * time.Second
+	webhookAttempts      = 3
+	webhookReload        = 30 * time.Second
+	webhookMaxBody       = 1 << 20
+	webhookSignature     = "X-Webhook-Signature"
+	webhookPreviousRange = 7 * 24 * time.Hour
+)
+
+// Write events are delivered unless a subscription names the events it wants.
+var defaultWebhookEvents = []string{EventFetch, EventImport, EventDelete}
+
+var webhooksCollection *mongo.Collection
+
+var webhooks = struct {
+	sync.RWMutex
+	subs []*WebhookSubscription
+}{}
+
+var webhookQueue = make(chan webhookDelivery, webhookQueueSize)
+
+// webhookClient only connects to public addresses, whatever the host resolves
+// to at delivery time, and does not follow redirects.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return fmt.Errorf("refusing to connect to non-public address %s", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// publicIP reports whether ip is a routable address, not loopback, private,
+// link-local or unspecified.
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsUnspecified()
+}
+
+// checkPublicURL resolves the host of an http(s) URL and rejects it if any of
+// its addresses is not public.
+func checkPublicURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("url must be an http(s) URL")
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("cannot resolve %s", u.Hostname())
+	}
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return fmt.Errorf("url must not point at a loopback, private or link-local address")
+		}
+	}
+	return nil
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		raw, err := json.Marshal(v)
+		return string(raw), err
+	},
+	"round": func(v float64, places int) float64 {
+		scale := math.Pow(10, float64(places))
+		return math.Round(v*scale) / scale
+	},
+	"rfc3339": func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+	"unix":    func(t time.Time) int64 { return t.Unix() },
+	"upper":   strings.ToUpper,
+	"lower":   strings.ToLower,
+}
+
+func (s *WebhookSubscription) validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("url must be an http(s) URL")
+	}
+	for _, category := range s.Filter.Conditions {
+		if !knownConditionCategory(category) {
+			return fmt.Errorf("unknown condition category %q", category)
+		}
+	}
+	if s.Filter.MinTempChange < 0 || s.Filter.MinWindChange < 0 || s.Filter.MinPrecipChange < 0 {
+		return fmt.Errorf("change thresholds must not be negative")
+	}
+	if s.Template != "" {
+		tmpl, err := template.New("webhook").Funcs(webhookFuncs).Option("missingkey=error").Parse(s.Template)
+		if err != nil {
+			return fmt.Errorf("invalid template: %w", err)
+		}
+		s.tmpl = tmpl
+	}
+	return nil
+}
+
+func knownConditionCategory(category string) bool {
+	if category == "other" {
+		return true
+	}
+	for _, c := range conditionCategories {
+		if c.Category == category {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *WebhookSubscription) wants(eventType string) bool {
+	events := s.Events
+	if len(events) == 0 {
+		events = defaultWebhookEvents
+	}
+	for _, e := range events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *WebhookSubscription) hasMagnitudeFilter() bool {
+	f := s.Filter
+	return f.MinTempChange > 0 || f.MinWindChange > 0 || f.MinPrecipChange > 0 || f.ConditionChange
+}
+
+// matches applies the filter to an event. Magnitude thresholds only pass readings
+// with a previous one to compare against.
+func (s *WebhookSubscription) matches(p webhookPayload) bool {
+	f := s.Filter
+	if len(f.Cities) > 0 && !containsFold(f.Cities, p.City) {
+		return false
+	}
+	if len(f.Tags) > 0 {
+		found := false
+		for _, tag := range p.Tags {
+			if containsFold(f.Tags, tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Conditions) > 0 && !containsFold(f.Conditions, p.Condition) {
+		return false
+	}
+	if len(f.Owners) > 0 && (p.Owner == "" || !containsFold(f.Owners, p.Owner)) {
+		return false
+	}
+	if !s.hasMagnitudeFilter() {
+		return true
+	}
+	if p.Change == nil {
+		return false
+	}
+	return f.MinTempChange > 0 && math.Abs(p.Change.Temp) >= f.MinTempChange ||
+		f.MinWindChange > 0 && math.Abs(p.Change.Wind) >= f.MinWindChange ||
+		f.MinPrecipChange > 0 && math.Abs(p.Change.Precip) >= f.MinPrecipChange ||
+		f.ConditionChange && p.Change.ConditionFrom != p.Change.ConditionTo
+}
+
+func (s *WebhookSubscription) render(p webhookPayload) ([]byte, error) {
+	if s.tmpl == nil {
+		return json.Marshal(p)
+	}
+	// Templates can loop, so stop them as soon as the body is too big rather
+	// than after they have filled memory
+	buf := &cappedBuffer{max: webhookMaxBody}
+	if err := s.tmpl.Execute(buf, p); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var errWebhookBodyTooLarge = fmt.Errorf("rendered payload exceeds %d bytes", webhookMaxBody)
+
+// cappedBuffer collects writes and fails the one that would take it past max
+// bytes. It is only an io.Writer, so nothing can write around the check.
+type cappedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > b.max {
+		return 0, errWebhookBodyTooLarge
+	}
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// loadWebhooks refreshes the in-memory subscriptions from the store.
+func loadWebhooks(ctx context.Context) error {
+	cursor, err := webhooksCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var loaded []*WebhookSubscription
+	if err := cursor.All(ctx, &loaded); err != nil {
+		return err
+	}
+	subs := loaded[:0]
+	for _, sub := range loaded {
+		if err := sub.validate(); err != nil {
+			log.Printf("Skipping webhook %s: %v", sub.ID.Hex(), err)
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	webhooks.Lock()
+	webhooks.subs = subs
+	webhooks.Unlock()
+	return nil
+}
+
+// runWebhooks starts the delivery workers and keeps subscriptions made on other
+// replicas in sync.
+func runWebhooks() {
+	for i := 0; i < webhookWorkers; i++ {
+		go deliverWebhooks()
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), webhookReload)
+		if err := loadWebhooks(ctx); err != nil {
+			log.Println("Failed to load webhooks:", err)
+		}
+		cancel()
+		time.Sleep(webhookReload)
+	}
+}
+
+// previousReading finds the city's last reading before t in history. It is
+// looked up on the delivery workers, never while an event is being published.
+func previousReading(ctx context.Context, city string, t time.Time) *WeatherData {
+	var previous *WeatherData
+	scanHistory(ctx, bson.M{"city": city}, t.Add(-webhookPreviousRange), t, func(reading WeatherData) error {
+		if reading.LastUpdated.Before(t) {
+			r := reading
+			previous = &r
+		}
+		return nil
+	})
+	return previous
+}
+
+// dispatchWebhooks is subscribed to every event and queues a delivery for each
+// matching subscription. Deliveries, and the previous-reading lookup magnitude
+// filters need, happen on the workers so recording an event never waits on a
+// subscriber or the history.
+func dispatchWebhooks(ev Event) {
+	webhooks.RLock()
+	var subs, magnitude []*WebhookSubscription
+	for _, sub := range webhooks.subs {
+		if !sub.wants(ev.Type) {
+			continue
+		}
+		if sub.hasMagnitudeFilter() {
+			magnitude = append(magnitude, sub)
+		} else {
+			subs = append(subs, sub)
+		}
+	}
+	webhooks.RUnlock()
+	if len(subs) == 0 && len(magnitude) == 0 {
+		return
+	}
+
+	payload := webhookPayload{Event: ev.Type, City: ev.City, Time: ev.Time, Current: ev.Data, Tags: ev.Tags, Payload: ev.Payload}
+	if notice, ok := ev.Payload.(planNotice); ok {
+		payload.Owner = notice.Owner
+	}
+	if ev.Data != nil {
+		payload.Condition = conditionCategory(ev.Data.Description)
+		if len(payload.Tags) == 0 {
+			payload.Tags = ev.Data.Tags
+		}
+	}
+	queueWebhooks(payload, subs)
+	// Without a reading there is nothing to compare, so magnitude filters cannot pass
+	if len(magnitude) > 0 && ev.Data != nil {
+		enqueueWebhook(webhookDelivery{pending: &payload, subs: magnitude}, ev.Type, "magnitude filters")
+	}
+}
+
+// queueWebhooks renders the payload for each subscription it matches.
+func queueWebhooks(payload webhookPayload, subs []*WebhookSubscription) {
+	for _, sub := range subs {
+		if !sub.matches(payload) {
+			continue
+		}
+		body, err := sub.render(payload)
+		if err != nil {
+			recordWebhookResult(sub, 0, fmt.Errorf("template: %w", err))
+			continue
+		}
+		enqueueWebhook(webhookDelivery{sub: sub, body: body}, payload.Event, sub.URL)
+	}
+}
+
+func enqueueWebhook(d webhookDelivery, eventType, target string) {
+	select {
+	case webhookQueue <- d:
+	default:
+		log.Printf("Webhook queue full, dropping %s delivery to %s", eventType, target)
+	}
+}
+
+// withPrevious adds the city's previous reading and the change from it.
+func withPrevious(payload webhookPayload) webhookPayload {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	payload.Previous = previousReading(ctx, payload.City, payload.Current.LastUpdated)
+	if payload.Previous != nil {
+		payload.Change = &webhookDiff{
+			Temp:          payload.Current.Temp - payload.Previous.Temp,
+			Wind:          payload.Current.Wind - payload.Previous.Wind,
+			Precip:        payload.Current.Precip - payload.Previous.Precip,
+			ConditionFrom: conditionCategory(payload.Previous.Description),
+			ConditionTo:   payload.Condition,
+		}
+	}
+	return payload
+}
+
+func deliverWebhooks() {
+	for d := range webhookQueue {
+		if d.pending != nil {
+			queueWebhooks(withPrevious(*d.pending), d.subs)
+			continue
+		}
+		var status int
+		var err error
+		for attempt := 0; attempt < webhookAttempts; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(1<<(2*attempt)) * time.Second)
+			}
+			status, err = postWebhook(d)
+			// Client errors will not go away by retrying
+			if err == nil || status >= 400 && status < 500 {
+				break
+			}
+		}
+		recordWebhookResult(d.sub, status, err)
+	}
+}
+
+func postWebhook(d webhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, d.sub.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return 0, err
+	}
+	contentType := d.sub.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	if d.sub.Secret != "" {
+		req.Header.Set(webhookSignature, "sha256="+hex.EncodeToString(hmacSHA256([]byte(d.sub.Secret), string(d.body))))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func recordWebhookResult(sub *WebhookSubscription, status int, err error) {
+	update := bson.M{"last_delivery": time.Now(), "last_status": status, "last_error": ""}
+	if err != nil {
+		log.Printf("Webhook delivery to %s failed: %v", sub.URL, err)
+		update["last_error"] = err.Error()
+	}
+	if readOnly.Load() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	webhooksCollection.UpdateOne(ctx, bson.M{"_id": sub.ID}, bson.M{"$set": update})
+}
+
+// webhooksHandler lists (GET) or creates (POST) subscriptions at /admin/webhooks.
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		cursor, err := webhooksCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"created_at": 1}))
+		if err != nil {
+			http.Error(w, "Failed to load webhooks", http.StatusInternalServerError)
+			return
+		}
+		subs := []WebhookSubscription{}
+		if err := cursor.All(ctx, &subs); err != nil {
+			http.Error(w, "Failed to load webhooks", http.StatusInternalServerError)
+			return
+		}
+		for i := range subs {
+			subs[i].Secret = ""
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subs)
+	case http.MethodPost:
+		var sub WebhookSubscription
+		if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := sub.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkPublicURL(ctx, sub.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sub.ID = primitive.NewObjectID()
+		sub.CreatedAt = time.Now()
+		sub.LastDelivery, sub.LastStatus, sub.LastError = time.Time{}, 0, ""
+		if _, err := webhooksCollection.InsertOne(ctx, sub); err != nil {
+			http.Error(w, "Failed to save webhook", http.StatusInternalServerError)
+			return
+		}
+		if err := loadWebhooks(ctx); err != nil {
+			log.Println("Failed to reload webhooks:", err)
+		}
+		writeAudit(ctx, AuditEntry{Actor: requestActor(r), Note: requestNote(r), Action: "webhook.create", Detail: sub.ID.Hex()})
+		sub.Secret = ""
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/admin/webhooks/"+sub.ID.Hex())
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(sub)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookHandler reads or deletes one subscription at /admin/webhooks/{id}.
+// POST /admin/webhooks/{id}/preview renders the payload for a sample event
+// without sending it, to check a template.
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/admin/webhooks/")
+	idText, action, _ := strings.Cut(rest, "/")
+	id, err := primitive.ObjectIDFromHex(idText)
+	if err != nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var sub WebhookSubscription
+	if err := webhooksCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&sub); err == mongo.ErrNoDocuments {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to load webhook", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		sub.Secret = ""
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sub)
+	case action == "" && r.Method == http.MethodDelete:
+		if _, err := webhooksCollection.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+			http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+			return
+		}
+		if err := loadWebhooks(ctx); err != nil {
+			log.Println("Failed to reload webhooks:", err)
+		}
+		writeAudit(ctx, AuditEntry{Actor: requestActor(r), Note: requestNote(r), Action: "webhook.delete", Detail: id.Hex()})
+		w.WriteHeader(http.StatusNoContent)
+	case action == "preview" && r.Method == http.MethodPost:
+		if err := sub.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		var payload webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		body, err := sub.render(payload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		contentType := sub.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Webhook-Matches", fmt.Sprint(sub.matches(payload)))
+		w.Write(body)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
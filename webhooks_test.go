@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublicIP(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"fd00::8":          false,
+		"fe80::1":          false,
+		"::ffff:127.0.0.1": false,
+	} {
+		if got := publicIP(net.ParseIP(addr)); got != want {
+			t.Errorf("publicIP(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestCheckPublicURL(t *testing.T) {
+	ctx := context.Background()
+	if err := checkPublicURL(ctx, "https://93.184.216.34/hook"); err != nil {
+		t.Errorf("public address rejected: %v", err)
+	}
+	for _, rawURL := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]/hook",
+		"http://10.0.0.5/hook",
+		"ftp://93.184.216.34/hook",
+		"/hook",
+	} {
+		if err := checkPublicURL(ctx, rawURL); err == nil {
+			t.Errorf("%s accepted", rawURL)
+		}
+	}
+}
+
+func TestWebhookClientRefusesLoopback(t *testing.T) {
+	hit := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit = true
+	}))
+	defer server.Close()
+
+	_, err := postWebhook(webhookDelivery{sub: &WebhookSubscription{URL: server.URL}, body: []byte("{}")})
+	if err == nil || !strings.Contains(err.Error(), "non-public") || hit {
+		t.Errorf("delivery to %s: %v, reached server %v", server.URL, err, hit)
+	}
+}
+
+func TestWebhookClientDoesNotFollowRedirects(t *testing.T) {
+	if err := webhookClient.CheckRedirect(httptest.NewRequest("GET", "http://10.0.0.1/", nil), nil); err != http.ErrUseLastResponse {
+		t.Errorf("CheckRedirect = %v, want http.ErrUseLastResponse", err)
+	}
+}
+
+func TestDispatchWebhooksDefersPreviousLookup(t *testing.T) {
+	webhooks.Lock()
+	saved := webhooks.subs
+	plain := &WebhookSubscription{URL: "https://example.com/all"}
+	magnitude := &WebhookSubscription{URL: "https://example.com/big", Filter: WebhookFilter{MinTempChange: 5}}
+	webhooks.subs = []*WebhookSubscription{plain, magnitude}
+	webhooks.Unlock()
+	defer func() {
+		webhooks.Lock()
+		webhooks.subs = saved
+		webhooks.Unlock()
+	}()
+
+	// The history store is not connected, so a lookup here would panic
+	dispatchWebhooks(Event{Type: EventFetch, City: "Berlin", Time: time.Now(), Data: &WeatherData{City: "Berlin", Temp: 21, LastUpdated: time.Now()}})
+
+	var queued []webhookDelivery
+	for len(webhookQueue) > 0 {
+		queued = append(queued, <-webhookQueue)
+	}
+	if len(queued) != 2 {
+		t.Fatalf("queued %d deliveries, want 2", len(queued))
+	}
+	if queued[0].sub != plain || len(queued[0].body) == 0 {
+		t.Errorf("unfiltered subscription not queued directly: %+v", queued[0])
+	}
+	if p := queued[1].pending; p == nil || p.Previous != nil || p.Current.Temp != 21 || len(queued[1].subs) != 1 || queued[1].subs[0] != magnitude {
+		t.Errorf("magnitude filter not left to the workers: %+v", queued[1])
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	change := &webhookDiff{Temp: -6, Wind: 1, Precip: 0.5, ConditionFrom: "clear", ConditionTo: "clear"}
+	payload := webhookPayload{City: "Berlin", Condition: "rain", Tags: []string{"Capital", "eu"}, Change: change}
+	tests := []struct {
+		name    string
+		filter  WebhookFilter
+		payload webhookPayload
+		want    bool
+	}{
+		{"empty filter", WebhookFilter{}, payload, true},
+		{"city, any case", WebhookFilter{Cities: []string{"berlin"}}, payload, true},
+		{"other city", WebhookFilter{Cities: []string{"Paris"}}, payload, false},
+		{"one of the tags", WebhookFilter{Tags: []string{"coast", "capital"}}, payload, true},
+		{"no tag in common", WebhookFilter{Tags: []string{"coast"}}, payload, false},
+		{"untagged city", WebhookFilter{Tags: []string{"coast"}}, webhookPayload{City: "Berlin"}, false},
+		{"condition", WebhookFilter{Conditions: []string{"snow", "rain"}}, payload, true},
+		{"other condition", WebhookFilter{Conditions: []string{"snow"}}, payload, false},
+		{"temp drop past the threshold", WebhookFilter{MinTempChange: 5}, payload, true},
+		{"temp change below the threshold", WebhookFilter{MinTempChange: 7}, payload, false},
+		{"any threshold is enough", WebhookFilter{MinTempChange: 7, MinPrecipChange: 0.5}, payload, true},
+		{"wind below the threshold", WebhookFilter{MinWindChange: 2}, payload, false},
+		{"condition unchanged", WebhookFilter{ConditionChange: true}, payload, false},
+		{"condition changed", WebhookFilter{ConditionChange: true}, webhookPayload{Change: &webhookDiff{ConditionFrom: "clear", ConditionTo: "rain"}}, true},
+		{"threshold without a previous reading", WebhookFilter{MinTempChange: 1}, webhookPayload{City: "Berlin"}, false},
+		{"filters combine", WebhookFilter{Cities: []string{"Paris"}, MinTempChange: 5}, payload, false},
+		{"owner's plan notice", WebhookFilter{Owners: []string{"Team-A"}}, webhookPayload{Event: EventPlanUnsuitable, Owner: "team-a"}, true},
+		{"another owner's plan notice", WebhookFilter{Owners: []string{"team-a"}}, webhookPayload{Event: EventPlanUnsuitable, Owner: "team-b"}, false},
+		{"owner filter on an event without owner", WebhookFilter{Owners: []string{"team-a"}}, payload, false},
+	}
+	for _, tt := range tests {
+		sub := &WebhookSubscription{Filter: tt.filter}
+		if got := sub.matches(tt.payload); got != tt.want {
+			t.Errorf("%s: matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func newTemplateSubscription(t *testing.T, tmpl string) *WebhookSubscription {
+	sub := &WebhookSubscription{URL: "https://example.com/hook", Template: tmpl}
+	if err := sub.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return sub
+}
+
+func TestWebhookRender(t *testing.T) {
+	payload := webhookPayload{Event: EventFetch, City: "Berlin", Current: &WeatherData{Temp: 21.456}, Payload: map[string]any{"plan": "p1"}}
+
+	if body, err := (&WebhookSubscription{}).render(payload); err != nil || !strings.Contains(string(body), `"city":"Berlin"`) {
+		t.Errorf("default JSON body = %s, %v", body, err)
+	}
+
+	body, err := newTemplateSubscription(t, `{{.City | upper}} {{round .Current.Temp 1}} {{.Payload.plan}}`).render(payload)
+	if err != nil || string(body) != "BERLIN 21.5 p1" {
+		t.Errorf("template body = %q, %v", body, err)
+	}
+
+	// missingkey=error: a misspelt key fails instead of sending "<no value>"
+	if body, err := newTemplateSubscription(t, `{{.Payload.plna}}`).render(payload); err == nil {
+		t.Errorf("missing key rendered %q", body)
+	}
+}
+
+func TestWebhookRenderSizeCap(t *testing.T) {
+	chunk := strings.Repeat("x", 100<<10)
+	payload := webhookPayload{City: chunk, Tags: make([]string, 20)}
+
+	sub := newTemplateSubscription(t, `{{range .Tags}}{{$.City}}{{end}}`)
+	if body, err := sub.render(payload); !errors.Is(err, errWebhookBodyTooLarge) || body != nil {
+		t.Errorf("2MB body: %d bytes, err %v", len(body), err)
+	}
+
+	payload.Tags = payload.Tags[:10]
+	if body, err := sub.render(payload); err != nil || len(body) != 10*len(chunk) {
+		t.Errorf("1000KB body: %d bytes, err %v", len(body), err)
+	}
+}
+
+func TestDispatchWebhooksFiltersPlanNoticesByOwner(t *testing.T) {
+	webhooks.Lock()
+	saved := webhooks.subs
+	mine := &WebhookSubscription{URL: "https://example.com/a", Events: []string{EventPlanUnsuitable}, Filter: WebhookFilter{Owners: []string{"team-a"}}}
+	theirs := &WebhookSubscription{URL: "https://example.com/b", Events: []string{EventPlanUnsuitable}, Filter: WebhookFilter{Owners: []string{"team-b"}}}
+	webhooks.subs = []*WebhookSubscription{mine, theirs}
+	webhooks.Unlock()
+	defer func() {
+		webhooks.Lock()
+		webhooks.subs = saved
+		webhooks.Unlock()
+	}()
+
+	notice := planNotice{PlanID: "p1", Owner: "team-a", Tasks: []PlanTask{{ID: "walk", City: "Berlin"}}}
+	dispatchWebhooks(Event{Type: EventPlanUnsuitable, City: "Berlin", Time: time.Now(), Payload: notice})
+
+	var queued []webhookDelivery
+	for len(webhookQueue) > 0 {
+		queued = append(queued, <-webhookQueue)
+	}
+	if len(queued) != 1 || queued[0].sub != mine || !strings.Contains(string(queued[0].body), `"owner":"team-a"`) {
+		t.Errorf("queued %+v, want one delivery to team-a's subscription", queued)
+	}
+}